@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/aliases"
+	"github.com/Queueue0/jums/internal/config"
+)
+
+func aliasCmd(args []string) error {
+	if len(args) < 1 {
+		return errors.New("alias: missing subcommand, expected add, del or list")
+	}
+
+	conf := config.GetConfig()
+	t, err := aliases.Load(conf.AliasesFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			return errors.New("alias add: expected a source and at least one target")
+		}
+		if err = t.Add(args[1], args[2:]...); err != nil {
+			return err
+		}
+	case "del":
+		if len(args) < 2 {
+			return errors.New("alias del: expected a source")
+		}
+		if err = t.Delete(args[1], args[2:]...); err != nil {
+			return err
+		}
+	case "list":
+		for _, source := range t.Sources() {
+			targets, _ := t.Lookup(source)
+			fmt.Printf("%s: %s\n", source, strings.Join(targets, ", "))
+		}
+		return nil
+	default:
+		return fmt.Errorf("alias: unknown subcommand %q", args[0])
+	}
+
+	return t.Save()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: jumsctl <command> [arguments]
+
+commands:
+	alias add <source> <target>...            send mail for source on to the targets, "@domain" is a catch-all
+	alias del <source> [target]...            remove targets from an alias, or the whole alias
+	alias list                                list aliases
+	quota set [flags] <name>                  set a user's own storage and message limits
+	quota reset <name>                        go back to the domain's limits for a user
+	quota show <name>                         show a user's quotas and usage
+	spam train (--ham|--spam) <maildir>...    train the spam filter on existing mail
+	user add <name>                           add a user, reading the password from stdin
+	user passwd <name>                        change a user's password
+	user del <name>                           remove a user
+	user list                                 list users
+	vacation set [flags] <name>               turn on a user's auto reply, reading the text from stdin
+	vacation off <name>                       turn off a user's auto reply
+	vacation show <name>                      show a user's auto reply
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "alias":
+		err = aliasCmd(os.Args[2:])
+	case "quota":
+		err = quotaCmd(os.Args[2:])
+	case "spam":
+		err = spamCmd(os.Args[2:])
+	case "user":
+		err = userCmd(os.Args[2:])
+	case "vacation":
+		err = vacationCmd(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "jumsctl: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jumsctl: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
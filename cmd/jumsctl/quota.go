@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/quota"
+)
+
+func quotaCmd(args []string) error {
+	if len(args) < 1 {
+		return errors.New("quota: missing subcommand, expected set, reset or show")
+	}
+
+	switch args[0] {
+	case "set":
+		return quotaSet(args[1:])
+	case "reset", "show":
+		if len(args) != 2 {
+			return fmt.Errorf("quota %s: expected a username", args[0])
+		}
+		dir, err := userMaildir(args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "reset" {
+			return maildir.SetUserQuota(dir, nil)
+		}
+		return printQuota(args[1])
+	default:
+		return fmt.Errorf("quota: unknown subcommand %q", args[0])
+	}
+}
+
+func quotaSet(args []string) error {
+	fset := flag.NewFlagSet("quota set", flag.ContinueOnError)
+	storage := fset.String("storage", "", "storage limit, e.g. 500M or 2G, 0 for none")
+	messages := fset.Int64("messages", -1, "message count limit, 0 for none")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("quota set: expected a username")
+	}
+	name := fset.Arg(0)
+
+	dir, err := userMaildir(name)
+	if err != nil {
+		return err
+	}
+	// anything not given stays as it is now
+	q, err := quota.Limit(name)
+	if err != nil {
+		return err
+	}
+	if *storage != "" {
+		if q.Storage, err = config.ParseSize(*storage); err != nil {
+			return fmt.Errorf("quota set: %w", err)
+		}
+	}
+	if *messages >= 0 {
+		q.Messages = *messages
+	}
+	return maildir.SetUserQuota(dir, &q)
+}
+
+func printQuota(name string) error {
+	roots, err := quota.Roots(name)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		label := "user"
+		if r.Name != "" {
+			label = "domain " + r.Name
+		}
+		fmt.Printf("%s:\n", label)
+		fmt.Printf("  storage:  %s of %s\n", formatSize(r.Usage.Bytes), formatLimit(r.Limit.Storage, formatSize))
+		fmt.Printf("  messages: %d of %s\n", r.Usage.Messages, formatLimit(r.Limit.Messages, func(n int64) string { return fmt.Sprint(n) }))
+	}
+	return nil
+}
+
+func formatLimit(n int64, format func(int64) string) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return format(n)
+}
+
+func formatSize(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/spam"
+)
+
+func spamCmd(args []string) error {
+	if len(args) < 1 {
+		return errors.New("spam: missing subcommand, expected train")
+	}
+
+	switch args[0] {
+	case "train":
+		return spamTrain(args[1:])
+	default:
+		return fmt.Errorf("spam: unknown subcommand %q", args[0])
+	}
+}
+
+func spamTrain(args []string) error {
+	fset := flag.NewFlagSet("spam train", flag.ContinueOnError)
+	ham := fset.Bool("ham", false, "train the given maildirs as ham")
+	isSpam := fset.Bool("spam", false, "train the given maildirs as spam")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if *ham == *isSpam {
+		return errors.New("spam train: exactly one of --ham or --spam is required")
+	}
+	if fset.NArg() == 0 {
+		return errors.New("spam train: no maildirs given")
+	}
+
+	conf := config.GetConfig()
+	path := spam.DefaultPath(conf.BoxesDir)
+	c, err := spam.Load(path)
+	if err != nil {
+		return err
+	}
+
+	trained := 0
+	for _, dir := range fset.Args() {
+		err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// messages live in cur and new, tmp is for deliveries in progress
+			parent := filepath.Base(filepath.Dir(p))
+			if d.IsDir() || (parent != "cur" && parent != "new") {
+				return nil
+			}
+
+			msg, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			c.Train(msg, *isSpam)
+			trained++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("spam train: %w", err)
+		}
+	}
+
+	if err = c.Save(path); err != nil {
+		return err
+	}
+
+	kind := "ham"
+	if *isSpam {
+		kind = "spam"
+	}
+	fmt.Printf("Trained %d messages as %s (%d spam, %d ham total)\n", trained, kind, c.NSpam, c.NHam)
+	return nil
+}
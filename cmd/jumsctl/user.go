@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+func userCmd(args []string) error {
+	if len(args) < 1 {
+		return errors.New("user: missing subcommand, expected add, passwd, del or list")
+	}
+
+	conf := config.GetConfig()
+	s, err := users.Load(conf.UsersFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add", "passwd":
+		if len(args) != 2 {
+			return fmt.Errorf("user %s: expected a username", args[0])
+		}
+		exists := s.Exists(args[1])
+		if args[0] == "add" && exists {
+			return fmt.Errorf("user add: %s already exists", args[1])
+		}
+		if args[0] == "passwd" && !exists {
+			return fmt.Errorf("user passwd: %w", users.ErrNoSuchUser)
+		}
+
+		pass, err := readPassword()
+		if err != nil {
+			return fmt.Errorf("user %s: %w", args[0], err)
+		}
+		if err = s.SetPassword(args[1], pass); err != nil {
+			return err
+		}
+	case "del":
+		if len(args) != 2 {
+			return errors.New("user del: expected a username")
+		}
+		if err = s.Delete(args[1]); err != nil {
+			return err
+		}
+	case "list":
+		for _, n := range s.Names() {
+			fmt.Println(n)
+		}
+		return nil
+	default:
+		return fmt.Errorf("user: unknown subcommand %q", args[0])
+	}
+
+	return s.Save()
+}
+
+// readPassword reads the new password from stdin so it doesn't end up in the
+// shell history. It isn't hidden, pipe it in if that matters.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	pass := strings.TrimRight(line, "\r\n")
+	if pass == "" {
+		return "", errors.New("empty password")
+	}
+	return pass, nil
+}
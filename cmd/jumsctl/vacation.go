@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+const dateLayout = "2006-01-02"
+
+func vacationCmd(args []string) error {
+	if len(args) < 1 {
+		return errors.New("vacation: missing subcommand, expected set, off or show")
+	}
+
+	switch args[0] {
+	case "set":
+		return vacationSet(args[1:])
+	case "off", "show":
+		if len(args) != 2 {
+			return fmt.Errorf("vacation %s: expected a username", args[0])
+		}
+		dir, err := userMaildir(args[1])
+		if err != nil {
+			return err
+		}
+		ar, err := mail.LoadAutoReply(dir)
+		if err != nil {
+			return err
+		}
+		if ar == nil {
+			fmt.Println("no auto reply set")
+			return nil
+		}
+		if args[0] == "show" {
+			printAutoReply(ar)
+			return nil
+		}
+		ar.Enabled = false
+		return ar.Save(dir)
+	default:
+		return fmt.Errorf("vacation: unknown subcommand %q", args[0])
+	}
+}
+
+// userMaildir is the maildir of an existing user
+func userMaildir(name string) (string, error) {
+	conf := config.GetConfig()
+	s, err := users.Load(conf.UsersFile)
+	if err != nil {
+		return "", err
+	}
+	if !s.Exists(name) {
+		return "", users.ErrNoSuchUser
+	}
+	dir, err := maildir.UserDir(conf.Mailbox(name))
+	if err != nil {
+		return "", err
+	}
+	return dir, maildir.Create(dir)
+}
+
+func vacationSet(args []string) error {
+	fset := flag.NewFlagSet("vacation set", flag.ContinueOnError)
+	start := fset.String("start", "", "first day away, YYYY-MM-DD")
+	end := fset.String("end", "", "last day away, YYYY-MM-DD")
+	days := fset.Int("days", 7, "only reply to each sender once in this many days")
+	subject := fset.String("subject", "", "subject of the reply, \"Auto: \" and the original subject if empty")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("vacation set: expected a username")
+	}
+
+	ar := &mail.AutoReply{Enabled: true, Days: *days, Subject: *subject}
+	var err error
+	if *start != "" {
+		if ar.Start, err = time.ParseInLocation(dateLayout, *start, time.Local); err != nil {
+			return fmt.Errorf("vacation set: bad start date: %w", err)
+		}
+	}
+	if *end != "" {
+		if ar.End, err = time.ParseInLocation(dateLayout, *end, time.Local); err != nil {
+			return fmt.Errorf("vacation set: bad end date: %w", err)
+		}
+		// replies carry on through the last day
+		ar.End = ar.End.AddDate(0, 0, 1)
+	}
+	if ar.Days < 1 {
+		return errors.New("vacation set: --days must be at least 1")
+	}
+
+	dir, err := userMaildir(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Reply text, end with EOF:")
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("vacation set: %w", err)
+	}
+	if len(body) == 0 {
+		return errors.New("vacation set: empty reply")
+	}
+	ar.Body = string(body)
+	return ar.Save(dir)
+}
+
+func printAutoReply(ar *mail.AutoReply) {
+	now := time.Now()
+	state := "off"
+	switch {
+	case ar.Active(now):
+		state = "on"
+	case ar.Enabled && !ar.End.IsZero() && !now.Before(ar.End):
+		state = "ended"
+	case ar.Enabled:
+		state = "scheduled"
+	}
+	fmt.Printf("state:   %s\n", state)
+	if !ar.Start.IsZero() {
+		fmt.Printf("start:   %s\n", ar.Start.Format(dateLayout))
+	}
+	if !ar.End.IsZero() {
+		fmt.Printf("end:     %s\n", ar.End.AddDate(0, 0, -1).Format(dateLayout))
+	}
+	fmt.Printf("days:    %d\n", ar.Days)
+	if ar.Subject != "" {
+		fmt.Printf("subject: %s\n", ar.Subject)
+	}
+	fmt.Printf("\n%s", ar.Body)
+}
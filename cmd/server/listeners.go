@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/imap"
+	"github.com/Queueue0/jums/internal/jmap"
+	"github.com/Queueue0/jums/internal/lists"
+	"github.com/Queueue0/jums/internal/managesieve"
+	"github.com/Queueue0/jums/internal/pop3"
+	"github.com/Queueue0/jums/internal/smtp"
+)
+
+// listeners are what startListeners opened, kept so they can be closed
+type listeners struct {
+	lns []net.Listener
+	// JMAP's HTTP servers, which close their own listeners
+	servers []*http.Server
+}
+
+// startListeners opens everything in the config's [[Listener]]s and serves
+// each on its own goroutine. It only returns an error if one couldn't be
+// opened.
+func startListeners() (*listeners, error) {
+	conf := config.GetConfig()
+	ls := &listeners{}
+	for _, l := range conf.Listener {
+		ln, err := listen(l.Listen())
+		if err != nil {
+			ls.close(context.Background())
+			return nil, fmt.Errorf("%s: %w", l.String(), err)
+		}
+		if l.MaxConnections > 0 {
+			ln = &limitListener{Listener: ln, name: l.String(), max: l.MaxConnections}
+		}
+		if l.ImplicitTLS {
+			ln = tls.NewListener(ln, config.ServerTLSConfig())
+		}
+		slog.Info("Listening", "listener", l.String())
+
+		opts := smtp.Options{
+			Submission:     l.Role == "submission",
+			RequireAuth:    l.RequireAuth,
+			Timeout:        l.Timeout,
+			MaxMessageSize: int64(l.MaxMessageSize),
+		}
+		var handle func(net.Conn)
+		switch l.Role {
+		case "mx", "submission":
+			handle = func(c net.Conn) { smtp.Handle(c, opts) }
+		case "lmtp":
+			handle = func(c net.Conn) { smtp.HandleLMTP(c, opts) }
+		case "imap":
+			handle = imap.Handle
+		case "pop3":
+			handle = pop3.Handle
+		case "managesieve":
+			handle = managesieve.Handle
+		case "jmap":
+			srv := jmapServer()
+			ls.servers = append(ls.servers, srv)
+			go serveJMAP(srv, ln, l.String())
+			continue
+		}
+		ls.lns = append(ls.lns, ln)
+		go accept(ln, l.String(), handle)
+	}
+	return ls, nil
+}
+
+// close stops taking new connections. JMAP requests already being served
+// get until ctx is done to finish.
+func (ls *listeners) close(ctx context.Context) {
+	for _, ln := range ls.lns {
+		ln.Close()
+	}
+	for _, srv := range ls.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+}
+
+func listen(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		// a socket left behind by the last run would stop us binding
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// accept hands each connection on ln to handle on its own goroutine until
+// ln is closed
+func accept(ln net.Listener, name string, handle func(net.Conn)) {
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("Error accepting connection", "listener", name, "err", err.Error())
+			// don't spin if we're out of file descriptors or the like
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		slog.Info("Received connection", "listener", name, "addr", c.RemoteAddr().String())
+
+		go handle(c)
+	}
+}
+
+// jmapServer serves JMAP, with one-click unsubscribe links for lists
+// alongside it
+func jmapServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", jmap.Handler())
+	mux.Handle(lists.UnsubscribePath, lists.Handler())
+	return &http.Server{Handler: mux}
+}
+
+func serveJMAP(srv *http.Server, ln net.Listener, name string) {
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error serving JMAP", "listener", name, "err", err.Error())
+	}
+}
+
+// limitListener turns away connections beyond max at once
+type limitListener struct {
+	net.Listener
+	name string
+	max  int
+
+	mu     sync.Mutex
+	active int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		full := l.active >= l.max
+		if !full {
+			l.active++
+		}
+		l.mu.Unlock()
+		if !full {
+			return &limitConn{Conn: c, l: l}, nil
+		}
+		slog.Warn("Too many connections, turning one away", "listener", l.name, "addr", c.RemoteAddr().String())
+		c.Close()
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	l    *limitListener
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		c.l.active--
+		c.l.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"log/slog"
-	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/imap"
+	"github.com/Queueue0/jums/internal/managesieve"
+	"github.com/Queueue0/jums/internal/pop3"
 	"github.com/Queueue0/jums/internal/smtp"
+	"github.com/Queueue0/jums/internal/smtp/mail"
 )
 
 func main() {
@@ -33,72 +39,52 @@ func main() {
 	slog.SetDefault(slog.New(handler))
 	slog.Info("Josh's Unremarkable Mail Server started, listening for connections")
 
-	go func() {
-		srv25, err := net.Listen("tcp", ":25")
-		if err != nil {
-			slog.Error("Fatal error on port 25", "msg", err.Error())
-			panic(err)
-		}
-		defer srv25.Close()
-		for {
-			c, err := srv25.Accept()
-			if err != nil {
-				c.Close()
-				slog.Error("Error on port 25", "err", err.Error())
-				continue
-			}
-			slog.Info("Received connection", "addr", c.RemoteAddr().String())
-
-			go smtp.Handle(c)
-		}
-	}()
-
-	go func() {
-		srv587, err := net.Listen("tcp", ":587")
-		if err != nil {
-			slog.Error("Fatal error on port 587", "msg", err.Error())
-			panic(err)
-		}
-		defer srv587.Close()
-		for {
-			c, err := srv587.Accept()
-			if err != nil {
-				c.Close()
-				slog.Error("Error on port 587", "err", err.Error())
-				continue
-			}
-			slog.Info("Received connection", "addr", c.RemoteAddr().String())
-
-			go smtp.Handle(c)
-		}
-	}()
+	ls, err := startListeners()
+	if err != nil {
+		slog.Error("Fatal error opening listener", "msg", err.Error())
+		panic(err)
+	}
 
-	srvTLS, err := tls.Listen("tcp", ":465", &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
-		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			conf := config.GetConfig()
-			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-			return &cert, nil
-		},
-	})
+	q, err := mail.SharedQueue()
 	if err != nil {
-		slog.Error("Fatal error on port 465", "msg", err.Error())
+		slog.Error("Fatal error opening the queue", "msg", err.Error())
 		panic(err)
 	}
-	defer srvTLS.Close()
+	go q.Run()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	slog.Info("Shutting down", "signal", sig.String(), "timeout", conf.ShutdownTimeout.String())
+	// a second signal means don't wait
+	signal.Reset(syscall.SIGTERM, syscall.SIGINT)
 
-	for {
-		c, err := srvTLS.Accept()
-		if err != nil {
-			c.Close()
-			slog.Error("Error on port 465", "err", err.Error())
-			continue
-		}
-		slog.Info("Received connection", "addr", c.RemoteAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
 
-		go smtp.Handle(c)
+	// everything gets the same ShutdownTimeout, at the same time
+	var wg sync.WaitGroup
+	drain := func(name string, shutdown func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				slog.Warn("Didn't finish in time and was cut off", "what", name, "err", err.Error())
+			}
+		}()
 	}
+	drain("listeners", func(ctx context.Context) error {
+		ls.close(ctx)
+		return nil
+	})
+	drain("SMTP", smtp.Shutdown)
+	drain("IMAP", imap.Shutdown)
+	drain("POP3", pop3.Shutdown)
+	drain("ManageSieve", managesieve.Shutdown)
+	// the queue finishes the delivery it's on, anything still in it is on
+	// disk for next time
+	drain("queue", q.Shutdown)
+	wg.Wait()
+
+	slog.Info("Josh's Unremarkable Mail Server stopped")
 }
@@ -0,0 +1,182 @@
+// Package aliases is the table of addresses that don't belong to an account
+// of their own. Each line of the file is "source: target, target", where the
+// source is an address or "@domain" for a domain's catch-all, and targets are
+// local accounts or addresses anywhere.
+package aliases
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/filecache"
+)
+
+var (
+	ErrNoSuchAlias   = errors.New("no such alias")
+	ErrInvalidSource = errors.New("invalid alias source")
+	ErrInvalidTarget = errors.New("invalid alias target")
+)
+
+type Table struct {
+	mu      sync.RWMutex
+	path    string
+	entries map[string][]string
+}
+
+// Load reads the alias file at path. A missing file is an empty table.
+func Load(path string) (*Table, error) {
+	t := &Table{path: path, entries: map[string][]string{}}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("aliases.Load: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source, targets, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		source = Normalize(source)
+		for _, target := range strings.Split(targets, ",") {
+			if target = Normalize(target); target != "" {
+				t.entries[source] = append(t.entries[source], target)
+			}
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("aliases.Load: %w", err)
+	}
+	return t, nil
+}
+
+func (t *Table) Save() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var b strings.Builder
+	for _, source := range t.sources() {
+		fmt.Fprintf(&b, "%s: %s\n", source, strings.Join(t.entries[source], ", "))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return fmt.Errorf("aliases.Save: %w", err)
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("aliases.Save: %w", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("aliases.Save: %w", err)
+	}
+	return nil
+}
+
+// Normalize case folds an alias source or target
+func Normalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// validSource is user@domain or @domain
+func validSource(s string) bool {
+	user, domain, ok := strings.Cut(s, "@")
+	return ok && domain != "" && !strings.ContainsAny(user+domain, "@ \t,:")
+}
+
+// validTarget is an account name or an address
+func validTarget(s string) bool {
+	user, domain, _ := strings.Cut(s, "@")
+	return user != "" && !strings.ContainsAny(user+domain, "@ \t,:")
+}
+
+// Lookup returns where mail for source goes, source being an address or
+// "@domain" for the catch-all
+func (t *Table) Lookup(source string) ([]string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	targets, ok := t.entries[Normalize(source)]
+	return slices.Clone(targets), ok
+}
+
+// Add adds targets to an alias, creating it if needed
+func (t *Table) Add(source string, targets ...string) error {
+	source = Normalize(source)
+	if !validSource(source) {
+		return fmt.Errorf("aliases.Add: %w", ErrInvalidSource)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.entries[source]
+	for _, target := range targets {
+		target = Normalize(target)
+		if !validTarget(target) {
+			return fmt.Errorf("aliases.Add: %s: %w", target, ErrInvalidTarget)
+		}
+		if !slices.Contains(list, target) {
+			list = append(list, target)
+		}
+	}
+	t.entries[source] = list
+	return nil
+}
+
+// Delete removes targets from an alias, or the whole alias if none are given
+func (t *Table) Delete(source string, targets ...string) error {
+	source = Normalize(source)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list, ok := t.entries[source]
+	if !ok {
+		return fmt.Errorf("aliases.Delete: %w", ErrNoSuchAlias)
+	}
+
+	for _, target := range targets {
+		list = slices.DeleteFunc(list, func(s string) bool { return s == Normalize(target) })
+	}
+	if len(targets) == 0 || len(list) == 0 {
+		delete(t.entries, source)
+	} else {
+		t.entries[source] = list
+	}
+	return nil
+}
+
+// Sources returns every alias in order
+func (t *Table) Sources() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.sources()
+}
+
+func (t *Table) sources() []string {
+	sources := make([]string, 0, len(t.entries))
+	for s := range t.entries {
+		sources = append(sources, s)
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+var shared = filecache.New(Load)
+
+// Shared returns a table for path that's kept in memory and reloaded when
+// the file changes, so edits made with jumsctl are picked up without a
+// restart
+func Shared(path string) (*Table, error) {
+	return shared.Get(path)
+}
@@ -1,11 +1,15 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -19,6 +23,121 @@ type config struct {
 	CertFile string
 	KeyFile  string
 	LogLevel string
+	// accounts for SMTP AUTH, IMAP etc, manage with jumsctl
+	UsersFile string
+	// aliases, forwards and catch-alls, manage with jumsctl
+	AliasesFile string
+	// who else may send as an address, "address: login, login" per line.
+	// Authenticated users can always send as their own address.
+	SenderLoginFile string
+
+	// CIDRs that are allowed to skip anti-spam checks, e.g. your own LAN
+	TrustedNetworks []string
+
+	Greylist   greylistConfig
+	HeloPolicy heloPolicyConfig
+
+	// External content filters, run in order
+	Milters []milterConfig
+	// Where quarantined messages are kept
+	QuarantineDir string
+	// the outbound spool, mail waiting to be delivered
+	QueueDir string
+
+	Antivirus antivirusConfig
+	Spam      spamConfig
+
+	// where connections are taken, [[Listener]] in the file, see
+	// listeners.go
+	Listener []listenerConfig
+	// on SIGTERM or SIGINT, how long clients partway through sending a
+	// message and the queue's delivery attempts get to finish
+	ShutdownTimeout time.Duration
+	// sender rewriting for forwarded mail
+	SRS srsConfig
+	// user+detail addresses
+	Subaddress subaddressConfig
+
+	// other domains we receive mail for, see domains.go
+	Domains []domainConfig
+
+	// mailing lists, see lists.go
+	Lists []listConfig
+	// where list members, held posts and the like are kept
+	ListsDir string
+	// where one-click unsubscribe links point, the JMAP listener's URL e.g.
+	// "https://mail.example.com". Lists only offer unsubscribing by mail
+	// without it.
+	ListsURL string
+}
+
+type greylistConfig struct {
+	Enabled bool
+	// how long a sender has to wait before a retry is accepted, 5m if unset
+	Delay time.Duration
+	// how long an unretried triplet is remembered, 4h if unset
+	Expiry time.Duration
+	// how long a whitelisted triplet stays whitelisted without being seen,
+	// 36 days if unset
+	Lifetime      time.Duration
+	WhitelistFile string
+}
+
+type milterConfig struct {
+	// "unix:/path/to/socket" or "inet:host:port"
+	Address string
+	// for each reply, 30s if unset
+	Timeout time.Duration
+	// what to do when the milter can't be reached, "accept" or "tempfail"
+	OnError string
+}
+
+type antivirusConfig struct {
+	Enabled bool
+	// clamd socket, "unix:/path/to/clamd.ctl" or "tcp:host:port"
+	Address string
+	// for the whole scan, 1m if unset
+	Timeout time.Duration
+	// what to do with infected mail, "reject" or "quarantine"
+	OnVirus string
+	// what to do when clamd can't be reached, "accept" or "tempfail"
+	OnError string
+}
+
+type spamConfig struct {
+	Enabled bool
+	// messages scoring at least this (0 to 1) go to Junk
+	Threshold float64
+}
+
+type srsConfig struct {
+	Enabled bool
+	// the domain rewritten senders are at, defaults to Domain
+	Domain string
+	// the key rewritten addresses are signed with, made on first use
+	SecretFile string
+	// how many days bounces to a rewritten address are accepted for
+	MaxAge int
+}
+
+type subaddressConfig struct {
+	// characters that split the user from the detail, e.g. "+", empty
+	// turns subaddressing off
+	Delimiter string
+	// file mail for user+detail into the folder called detail if the user
+	// has one
+	FileIntoFolder bool
+}
+
+// Each of these is one of "reject", "tempfail", "tag" or "none"
+type heloPolicyConfig struct {
+	Enabled bool
+	// HELO argument isn't an FQDN or address literal
+	BadSyntax string
+	// client IP has no forward-confirmed reverse DNS
+	NoFCrDNS string
+	// client claims to be our Domain or Mxdomain
+	ForgedIdentity string
 }
 
 var confInstance *config
@@ -36,6 +155,23 @@ func GetConfig() *config {
 	return confInstance
 }
 
+// IsTrusted reports whether ip belongs to one of the TrustedNetworks
+func (c *config) IsTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedNetworks {
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func initializeConfig() {
 	configFname := "config.toml"
 	configDir := os.Getenv("XDG_CONFIG_HOME")
@@ -58,6 +194,101 @@ func initializeConfig() {
 		// appropriate situation to panic since we flatly cannot proceed without the config
 		panic(err)
 	}
+
+	confInstance.BoxesDir = expandHome(confInstance.BoxesDir)
+	confInstance.CertFile = expandHome(confInstance.CertFile)
+	confInstance.KeyFile = expandHome(confInstance.KeyFile)
+	confInstance.UsersFile = expandHome(confInstance.UsersFile)
+	if confInstance.AliasesFile == "" {
+		// config files from before there were aliases
+		confInstance.AliasesFile = "~/.jums/aliases"
+	}
+	confInstance.AliasesFile = expandHome(confInstance.AliasesFile)
+	if confInstance.SenderLoginFile == "" {
+		confInstance.SenderLoginFile = "~/.jums/sender_logins"
+	}
+	confInstance.SenderLoginFile = expandHome(confInstance.SenderLoginFile)
+	confInstance.Greylist.WhitelistFile = expandHome(confInstance.Greylist.WhitelistFile)
+	// a zero Delay would let every first attempt straight through
+	if confInstance.Greylist.Delay <= 0 {
+		confInstance.Greylist.Delay = 5 * time.Minute
+	}
+	if confInstance.Greylist.Expiry <= 0 {
+		confInstance.Greylist.Expiry = 4 * time.Hour
+	}
+	if confInstance.Greylist.Lifetime <= 0 {
+		confInstance.Greylist.Lifetime = 36 * 24 * time.Hour
+	}
+	confInstance.QuarantineDir = expandHome(confInstance.QuarantineDir)
+	if confInstance.QueueDir == "" {
+		// config files from before there was a queue
+		confInstance.QueueDir = "~/.jums/queue"
+	}
+	confInstance.QueueDir = expandHome(confInstance.QueueDir)
+	if confInstance.SRS.Domain == "" {
+		confInstance.SRS.Domain = confInstance.Domain
+	}
+	confInstance.SRS.Domain = strings.ToLower(confInstance.SRS.Domain)
+	if confInstance.SRS.SecretFile == "" {
+		confInstance.SRS.SecretFile = "~/.jums/srs.key"
+	}
+	confInstance.SRS.SecretFile = expandHome(confInstance.SRS.SecretFile)
+	if confInstance.SRS.MaxAge <= 0 {
+		confInstance.SRS.MaxAge = 21
+	}
+	if confInstance.ListsDir == "" {
+		// config files from before there were lists
+		confInstance.ListsDir = "~/.jums/lists"
+	}
+	confInstance.ListsDir = expandHome(confInstance.ListsDir)
+	confInstance.ListsURL = strings.TrimSuffix(confInstance.ListsURL, "/")
+	for i := range confInstance.Lists {
+		l := &confInstance.Lists[i]
+		l.Address = strings.ToLower(l.Address)
+		for j := range l.Members {
+			l.Members[j] = strings.ToLower(l.Members[j])
+		}
+		for j := range l.Owners {
+			l.Owners[j] = strings.ToLower(l.Owners[j])
+		}
+	}
+	if confInstance.Antivirus.Timeout <= 0 {
+		confInstance.Antivirus.Timeout = time.Minute
+	}
+	for i := range confInstance.Milters {
+		if confInstance.Milters[i].Timeout <= 0 {
+			confInstance.Milters[i].Timeout = 30 * time.Second
+		}
+	}
+	if confInstance.ShutdownTimeout <= 0 {
+		confInstance.ShutdownTimeout = 30 * time.Second
+	}
+	if len(confInstance.Listener) == 0 {
+		// config files from before listeners could be set
+		confInstance.Listener = confInstance.defaultListeners()
+	}
+	if err = confInstance.checkListeners(); err != nil {
+		panic(err)
+	}
+	for i := range confInstance.Listener {
+		if confInstance.Listener[i].Network == "unix" {
+			confInstance.Listener[i].Address = expandHome(confInstance.Listener[i].Address)
+		}
+	}
+	for i := range confInstance.Domains {
+		d := &confInstance.Domains[i]
+		d.Name = strings.ToLower(d.Name)
+		d.BoxesDir = expandHome(d.BoxesDir)
+		d.DKIM.KeyFile = expandHome(d.DKIM.KeyFile)
+	}
+}
+
+// the shell isn't around to expand ~ for us
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return filepath.Join(os.Getenv("HOME"), p[1:])
+	}
+	return p
 }
 
 func createConfigFile(dir, fname string) error {
@@ -71,12 +302,55 @@ func createConfigFile(dir, fname string) error {
 	}
 
 	c := config{
-		Domain:   "localhost",
-		Mxdomain: "localhost",
-		BoxesDir: "~/.jums/mailboxes",
-		KeyFile:  "",
-		CertFile: "",
-		LogLevel: "INFO",
+		Domain:      "localhost",
+		Mxdomain:    "localhost",
+		BoxesDir:    "~/.jums/mailboxes",
+		KeyFile:     "~/.jums/key.pem",
+		CertFile:    "~/.jums/cert.pem",
+		LogLevel:    "INFO",
+		UsersFile:   "~/.jums/users",
+		AliasesFile: "~/.jums/aliases",
+
+		SenderLoginFile: "~/.jums/sender_logins",
+		Greylist: greylistConfig{
+			Enabled:       false,
+			Delay:         5 * time.Minute,
+			Expiry:        4 * time.Hour,
+			Lifetime:      36 * 24 * time.Hour,
+			WhitelistFile: "~/.jums/greylist.json",
+		},
+		HeloPolicy: heloPolicyConfig{
+			Enabled:        false,
+			BadSyntax:      "tag",
+			NoFCrDNS:       "tag",
+			ForgedIdentity: "reject",
+		},
+		Milters:       []milterConfig{},
+		QuarantineDir: "~/.jums/quarantine",
+		QueueDir:      "~/.jums/queue",
+		ListsDir:      "~/.jums/lists",
+		Antivirus: antivirusConfig{
+			Enabled: false,
+			Address: "unix:/run/clamav/clamd.ctl",
+			Timeout: time.Minute,
+			OnVirus: "reject",
+			OnError: "tempfail",
+		},
+		Spam: spamConfig{
+			Enabled:   false,
+			Threshold: 0.9,
+		},
+		Listener:        newListeners(),
+		ShutdownTimeout: 30 * time.Second,
+		SRS: srsConfig{
+			Enabled:    false,
+			SecretFile: "~/.jums/srs.key",
+			MaxAge:     21,
+		},
+		Subaddress: subaddressConfig{
+			Delimiter:      "+",
+			FileIntoFolder: false,
+		},
 	}
 
 	err = toml.NewEncoder(cf).Encode(c)
@@ -94,3 +368,20 @@ func createConfigFile(dir, fname string) error {
 
 	return nil
 }
+
+// ServerTLSConfig is the TLS config used by every listener. The certificate
+// is loaded on each handshake so renewed certs get picked up without a
+// restart.
+func ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			conf := GetConfig()
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+	}
+}
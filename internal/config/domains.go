@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// domainConfig is a domain we host mail for besides Domain. Accounts on
+// these domains are named by their full address, users on Domain just by
+// their local part.
+type domainConfig struct {
+	Name string
+	// where this domain's mailboxes live, "@<Name>" under BoxesDir if empty
+	BoxesDir string
+	// local part to the addresses its mail goes to
+	Aliases map[string][]string
+	DKIM    dkimConfig
+	Policy  domainPolicy
+	// limits for all the domain's mailboxes together
+	Quota quotaConfig
+	// limits for each of the domain's mailboxes, unless jumsctl has set
+	// some for that user
+	UserQuota quotaConfig
+}
+
+// quotaConfig limits are 0 for none
+type quotaConfig struct {
+	Storage  Size
+	Messages int64
+}
+
+// Size is a number of bytes, written either as a number or a string with a
+// K, M, G or T suffix like "500M"
+type Size int64
+
+func (s *Size) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		*s = Size(v)
+		return nil
+	case string:
+		n, err := ParseSize(v)
+		*s = Size(n)
+		return err
+	}
+	return fmt.Errorf("config: bad size %v", v)
+}
+
+// ParseSize reads a size like "2G", suffixes are powers of 1024
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if v, ok := strings.CutSuffix(s, suffix); ok {
+			s = v
+			mult = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("config: bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+type dkimConfig struct {
+	// outgoing mail from the domain is signed if this is set, the public
+	// key goes in DNS at <Selector>._domainkey.<Name>
+	Selector string
+	// PEM private key, RSA or Ed25519
+	KeyFile string
+}
+
+type domainPolicy struct {
+	// don't greylist mail for this domain even if greylisting is on
+	SkipGreylist bool
+	// what to do with mail the spam filter flags, "junk" (the default) files
+	// it in Junk, "inbox" delivers it as normal and "discard" drops it
+	Spam string
+}
+
+// LocalDomain returns the settings for domain if we take its mail. Domain
+// itself is always local, even without an entry in Domains.
+func (c *config) LocalDomain(domain string) (*domainConfig, bool) {
+	domain = strings.ToLower(domain)
+	primary := domain == strings.ToLower(c.Domain)
+	for _, d := range c.Domains {
+		if d.Name != domain {
+			continue
+		}
+		if d.BoxesDir == "" {
+			d.BoxesDir = filepath.Join(c.BoxesDir, "@"+d.Name)
+			if primary {
+				d.BoxesDir = c.BoxesDir
+			}
+		}
+		return &d, true
+	}
+	if primary {
+		return &domainConfig{Name: domain, BoxesDir: c.BoxesDir}, true
+	}
+	return nil, false
+}
+
+// IsLocal reports whether we take mail for domain
+func (c *config) IsLocal(domain string) bool {
+	_, ok := c.LocalDomain(domain)
+	return ok
+}
+
+// Account is the name of the account that owns a local address
+func (c *config) Account(user, domain string) string {
+	user = strings.ToLower(user)
+	if strings.EqualFold(domain, c.Domain) {
+		return user
+	}
+	return user + "@" + strings.ToLower(domain)
+}
+
+// Mailbox returns where an account's mail lives, the BoxesDir and name to
+// give maildir.UserDir
+func (c *config) Mailbox(account string) (string, string) {
+	user, domain, ok := strings.Cut(account, "@")
+	if !ok {
+		user, domain = account, c.Domain
+	}
+	if d, ok := c.LocalDomain(domain); ok {
+		return d.BoxesDir, user
+	}
+	return c.BoxesDir, account
+}
+
+// AccountAddress is an account's own email address
+func (c *config) AccountAddress(account string) string {
+	if strings.Contains(account, "@") {
+		return account
+	}
+	return account + "@" + c.Domain
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenerConfig is somewhere the server takes connections
+type listenerConfig struct {
+	// what's served: "mx" for other servers delivering mail to us,
+	// "submission" for mail clients sending mail, "lmtp", "imap", "pop3",
+	// "managesieve" or "jmap"
+	Role string
+	// the IP to bind, every address if empty. With Network "unix" it's the
+	// socket's path.
+	Address string `toml:",omitempty"`
+	Port    int
+	// "tcp" (the default) for IPv4 and IPv6, "tcp4", "tcp6" or "unix"
+	Network string
+	// TLS from the start, like ports 465 and 993. Otherwise clients are
+	// offered STARTTLS. JMAP is always TLS.
+	ImplicitTLS bool
+	// clients have to AUTH before MAIL, always on for submission. SMTP
+	// roles only.
+	RequireAuth bool `toml:",omitempty"`
+
+	// connections beyond this many at once are turned away, 0 for no limit
+	MaxConnections int `toml:",omitzero"`
+	// SMTP and LMTP clients that are quiet for this long are hung up on,
+	// 5 minutes if unset
+	Timeout time.Duration `toml:",omitzero"`
+	// messages bigger than this are refused, 0 for no limit. SMTP and LMTP
+	// only.
+	MaxMessageSize Size `toml:",omitzero"`
+}
+
+// Listen returns what to pass to net.Listen
+func (l *listenerConfig) Listen() (string, string) {
+	if l.Network == "unix" {
+		return "unix", l.Address
+	}
+	return l.Network, net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// String names the listener in logs, e.g. "submission on :587"
+func (l *listenerConfig) String() string {
+	_, addr := l.Listen()
+	return l.Role + " on " + addr
+}
+
+var listenerRoles = []string{"mx", "submission", "lmtp", "imap", "pop3", "managesieve", "jmap"}
+
+// defaultListeners are for config files without any listeners, which only
+// get SMTP. 465 is left out if there's no certificate to do TLS with.
+func (c *config) defaultListeners() []listenerConfig {
+	ls := []listenerConfig{
+		{Role: "mx", Port: 25, Network: "tcp"},
+		{Role: "submission", Port: 587, Network: "tcp"},
+	}
+	if c.CertFile != "" && c.KeyFile != "" {
+		ls = append(ls, listenerConfig{Role: "submission", Port: 465, Network: "tcp", ImplicitTLS: true})
+	}
+	return ls
+}
+
+// newListeners are what new config files are written with, the usual SMTP,
+// IMAP and POP3 ports
+func newListeners() []listenerConfig {
+	return []listenerConfig{
+		{Role: "mx", Port: 25, Network: "tcp"},
+		{Role: "submission", Port: 587, Network: "tcp"},
+		{Role: "submission", Port: 465, Network: "tcp", ImplicitTLS: true},
+		{Role: "imap", Port: 143, Network: "tcp"},
+		{Role: "imap", Port: 993, Network: "tcp", ImplicitTLS: true},
+		{Role: "pop3", Port: 110, Network: "tcp"},
+		{Role: "pop3", Port: 995, Network: "tcp", ImplicitTLS: true},
+	}
+}
+
+// checkListeners fills in defaults and makes sure every listener makes sense
+func (c *config) checkListeners() error {
+	for i := range c.Listener {
+		l := &c.Listener[i]
+		l.Role = strings.ToLower(l.Role)
+		if l.Role == "smtp" {
+			l.Role = "mx"
+		}
+		if !slices.Contains(listenerRoles, l.Role) {
+			return fmt.Errorf("config: unknown listener role %q", l.Role)
+		}
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		switch l.Network {
+		case "tcp", "tcp4", "tcp6":
+			if l.Port <= 0 || l.Port > 65535 {
+				return fmt.Errorf("config: %s listener needs a port", l.Role)
+			}
+		case "unix":
+			if l.Address == "" {
+				return fmt.Errorf("config: %s listener needs a socket path", l.Role)
+			}
+		default:
+			return fmt.Errorf("config: unknown listener network %q", l.Network)
+		}
+		if l.Role == "submission" {
+			l.RequireAuth = true
+		}
+		if l.Role == "jmap" {
+			l.ImplicitTLS = true
+		}
+		if l.ImplicitTLS && (c.CertFile == "" || c.KeyFile == "") {
+			return fmt.Errorf("config: %s is TLS but CertFile and KeyFile aren't set", l.String())
+		}
+		if l.Timeout <= 0 {
+			l.Timeout = 5 * time.Minute
+		}
+	}
+
+	for i, l := range c.Listener {
+		for _, other := range c.Listener[:i] {
+			if l.clashes(&other) {
+				return fmt.Errorf("config: %s and %s are on the same address", other.String(), l.String())
+			}
+		}
+	}
+	return nil
+}
+
+// clashes is whether l and other would both try to bind the same address
+func (l *listenerConfig) clashes(other *listenerConfig) bool {
+	if (l.Network == "unix") != (other.Network == "unix") {
+		return false
+	}
+	if l.Network == "unix" {
+		return l.Address == other.Address
+	}
+	if l.Port != other.Port {
+		return false
+	}
+	// tcp4 and tcp6 can share a port, tcp is both
+	if l.Network != other.Network && l.Network != "tcp" && other.Network != "tcp" {
+		return false
+	}
+	return l.Address == other.Address || l.Address == "" || other.Address == ""
+}
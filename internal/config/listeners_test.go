@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckListeners(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []listenerConfig
+		noCert    bool
+		// part of the error, empty if there shouldn't be one
+		err string
+	}{
+		{"defaults", newListeners(), false, ""},
+		{"smtp is mx", []listenerConfig{{Role: "SMTP", Port: 25}}, false, ""},
+		{"unknown role", []listenerConfig{{Role: "finger", Port: 79}}, false, "unknown listener role"},
+		{"unknown network", []listenerConfig{{Role: "mx", Port: 25, Network: "udp"}}, false, "unknown listener network"},
+		{"no port", []listenerConfig{{Role: "imap"}}, false, "needs a port"},
+		{"no socket path", []listenerConfig{{Role: "lmtp", Network: "unix"}}, false, "needs a socket path"},
+		{"same port", []listenerConfig{
+			{Role: "mx", Port: 25},
+			{Role: "submission", Port: 25},
+		}, false, "same address"},
+		{"every address and one", []listenerConfig{
+			{Role: "mx", Port: 25},
+			{Role: "submission", Address: "127.0.0.1", Port: 25, Network: "tcp4"},
+		}, false, "same address"},
+		{"same socket", []listenerConfig{
+			{Role: "lmtp", Network: "unix", Address: "/run/jums/lmtp.sock"},
+			{Role: "managesieve", Network: "unix", Address: "/run/jums/lmtp.sock"},
+		}, false, "same address"},
+		{"different addresses", []listenerConfig{
+			{Role: "mx", Address: "192.0.2.1", Port: 25},
+			{Role: "mx", Address: "192.0.2.2", Port: 25},
+		}, false, ""},
+		{"ipv4 and ipv6", []listenerConfig{
+			{Role: "mx", Port: 25, Network: "tcp4"},
+			{Role: "mx", Port: 25, Network: "tcp6"},
+		}, false, ""},
+		{"tls without a cert", []listenerConfig{{Role: "imap", Port: 993, ImplicitTLS: true}}, true, "CertFile"},
+		{"jmap without a cert", []listenerConfig{{Role: "jmap", Port: 443}}, true, "CertFile"},
+		{"starttls without a cert", []listenerConfig{{Role: "imap", Port: 143}}, true, ""},
+	}
+	for _, tt := range tests {
+		c := &config{CertFile: "cert.pem", KeyFile: "key.pem", Listener: tt.listeners}
+		if tt.noCert {
+			c.CertFile, c.KeyFile = "", ""
+		}
+		err := c.checkListeners()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: no error, expected %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDefaultListeners(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *config
+		want string
+	}{
+		{"with a cert", &config{CertFile: "cert.pem", KeyFile: "key.pem"}, "mx on :25, submission on :587, submission on :465"},
+		{"without", &config{}, "mx on :25, submission on :587"},
+	}
+	for _, tt := range tests {
+		// a config without any is only for mail coming in and being sent
+		tt.c.Listener = tt.c.defaultListeners()
+		if err := tt.c.checkListeners(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := []string{}
+		for _, l := range tt.c.Listener {
+			got = append(got, l.String())
+			if l.Role == "submission" && !l.RequireAuth {
+				t.Errorf("%s: %s doesn't require AUTH", tt.name, l.String())
+			}
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, strings.Join(got, ", "), tt.want)
+		}
+	}
+}
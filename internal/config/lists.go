@@ -0,0 +1,53 @@
+package config
+
+import "strings"
+
+// listConfig is a mailing list. Besides its own address it takes mail at
+// <list>-request for commands, <list>-owner for its owners and
+// <list>-bounces for bounces.
+type listConfig struct {
+	// where posts go, e.g. team@example.com, on one of our domains
+	Address string
+	// shown in List-Id, the address if empty
+	Description string
+	// always on the list unless they unsubscribe, anyone else can
+	// subscribe by mail
+	Members []string
+	// approve held posts and subscriptions, get -owner mail and can always
+	// post
+	Owners []string
+	// who can post: "members" (the default), "anyone" or "owners"
+	Posting string
+	// hold every post that isn't from an owner until one approves it
+	Moderated bool
+	// what to do with posts Posting doesn't allow: "hold" (the default)
+	// for an owner to approve, "reject" or "discard"
+	NonMemberPosts string
+	// who can subscribe: "open" (the default) after confirming by mail,
+	// "approve" when an owner has approved it too, or "closed"
+	Subscribe string
+	// put in front of the subject of posts, e.g. "[team]"
+	SubjectPrefix string
+	// set Reply-To to the list
+	ReplyToList bool
+}
+
+// List returns the list whose posting address is address
+func (c *config) List(address string) (*listConfig, bool) {
+	for i := range c.Lists {
+		if strings.EqualFold(c.Lists[i].Address, address) {
+			return &c.Lists[i], true
+		}
+	}
+	return nil, false
+}
+
+// IsOwner reports whether addr is one of the list's owners
+func (l *listConfig) IsOwner(addr string) bool {
+	for _, o := range l.Owners {
+		if strings.EqualFold(o, addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+// Package dkim signs outgoing mail, RFC 6376 with relaxed/relaxed
+// canonicalization and RSA or Ed25519 (RFC 8463) keys
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedHeaders are signed when present. From is required by the RFC, the
+// rest are the ones it'd be bad to have changed.
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+var (
+	keysLock = &sync.Mutex{}
+	keys     = map[string]crypto.Signer{}
+)
+
+// LoadKey reads a PEM private key, PKCS#8 or PKCS#1. Keys are cached by path.
+func LoadKey(path string) (crypto.Signer, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if k, ok := keys[path]; ok {
+		return k, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("dkim.LoadKey: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("dkim.LoadKey: %s: no PEM data", path)
+	}
+
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim.LoadKey: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		keys[path] = k
+	case ed25519.PrivateKey:
+		keys[path] = k
+	default:
+		return nil, fmt.Errorf("dkim.LoadKey: %s: unsupported key type %T", path, key)
+	}
+	return keys[path], nil
+}
+
+// Sign returns a DKIM-Signature header field for msg, with its CRLF, ready to
+// be put in front of it
+func Sign(msg []byte, domain, selector string, key crypto.Signer) (string, error) {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = msg, nil
+	}
+	fields := splitHeader(string(header) + "\r\n")
+
+	algo := ""
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algo = "ed25519-sha256"
+	default:
+		return "", errors.New("dkim.Sign: unsupported key")
+	}
+
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// fields are signed from the bottom up, RFC 6376 section 5.4.2
+	h := sha256.New()
+	names := []string{}
+	used := map[int]bool{}
+	for _, name := range signedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(name))
+			h.Write([]byte(relaxedHeader(fields[i])))
+		}
+	}
+	if len(names) == 0 {
+		return "", errors.New("dkim.Sign: message has no From")
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algo, domain, selector, time.Now().Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	// the signature covers its own header with an empty b=, without the
+	// final CRLF
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+value+"\r\n"), "\r\n")))
+
+	var sig []byte
+	var err error
+	if algo == "rsa-sha256" {
+		sig, err = key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	} else {
+		// Ed25519 signs the hash itself, RFC 8463 section 3
+		sig, err = key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", fmt.Errorf("dkim.Sign: %w", err)
+	}
+	return "DKIM-Signature: " + value + fold(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// fold breaks a long base64 value over several lines
+func fold(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// splitHeader splits a header section into fields, each with its
+// continuation lines and final CRLF
+func splitHeader(header string) []string {
+	fields := []string{}
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// collapse turns runs of spaces and tabs into one space
+func collapse(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// relaxedHeader canonicalizes one header field, RFC 6376 section 3.4.2
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(collapse(value))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes a body, RFC 6376 section 3.4.4
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	out := []string{}
+	for _, line := range lines {
+		out = append(out, strings.TrimRight(collapse(line), " "))
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
+}
@@ -0,0 +1,53 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// the example from RFC 6376 section 3.4.5
+func TestRelaxed(t *testing.T) {
+	got := ""
+	for _, f := range splitHeader("A: X\r\nB : Y\t\r\n\tZ  \r\n") {
+		got += relaxedHeader(f)
+	}
+	if got != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("header = %q", got)
+	}
+	if body := string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))); body != " C\r\nD E\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSign(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	msg := "From: alice@example.com\r\nSubject: hi\r\n\r\nhello\r\n"
+	sig, err := Sign([]byte(msg), "example.com", "sel", priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check it the way a verifier would, RFC 6376 section 6.1.3
+	unfolded := strings.NewReplacer("\r\n\t", "").Replace(sig)
+	b := regexp.MustCompile(`b=([A-Za-z0-9+/=]+)`).FindStringSubmatch(unfolded)
+	if b == nil || !strings.Contains(unfolded, "h=from:subject;") {
+		t.Fatalf("signature = %q", sig)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(b[1])
+
+	h := sha256.New()
+	h.Write([]byte("from:alice@example.com\r\nsubject:hi\r\n"))
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader(sig[:strings.LastIndex(sig, "b=")+2]+"\r\n"), "\r\n")))
+	if !ed25519.Verify(pub, h.Sum(nil), raw) {
+		t.Error("signature doesn't verify")
+	}
+
+	bh := sha256.Sum256([]byte("hello\r\n"))
+	if !strings.Contains(unfolded, "bh="+base64.StdEncoding.EncodeToString(bh[:])) {
+		t.Errorf("wrong body hash in %q", sig)
+	}
+}
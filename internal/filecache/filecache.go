@@ -0,0 +1,73 @@
+// Package filecache keeps files loaded in memory and reloads them when they
+// change on disk, so edits made with jumsctl are picked up without a restart
+package filecache
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache holds whatever load made of each path it's been asked for. It's safe
+// for concurrent use.
+type Cache[T any] struct {
+	load func(path string) (T, error)
+
+	mu    sync.Mutex
+	files map[string]*file[T]
+}
+
+type file[T any] struct {
+	v       T
+	modTime time.Time
+}
+
+func New[T any](load func(path string) (T, error)) *Cache[T] {
+	return &Cache[T]{load: load, files: map[string]*file[T]{}}
+}
+
+// Get returns what's loaded from path, loading it again if the file's
+// modification time has changed since last time
+func (c *Cache[T]) Get(path string) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mtime := modTime(path)
+	if f, ok := c.files[path]; ok && mtime.Equal(f.modTime) {
+		return f.v, nil
+	}
+	v, err := c.load(path)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	c.files[path] = &file[T]{v: v, modTime: mtime}
+	return v, nil
+}
+
+// Save writes path's cached value back with save and remembers the new
+// modification time so we don't pointlessly reload our own changes. It does
+// nothing if path was never loaded.
+func (c *Cache[T]) Save(path string, save func(v T) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[path]
+	if !ok {
+		return nil
+	}
+	if err := save(f.v); err != nil {
+		return err
+	}
+	f.modTime = modTime(path)
+	return nil
+}
+
+// modTime is the zero time for files that don't exist, which loaders
+// generally treat as empty
+func modTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
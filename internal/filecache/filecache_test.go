@@ -0,0 +1,52 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.WriteFile(a, []byte("one"), 0600)
+	os.WriteFile(b, []byte("two"), 0600)
+
+	loads := 0
+	c := New(func(path string) (string, error) {
+		loads++
+		data, err := os.ReadFile(path)
+		return string(data), err
+	})
+
+	// two paths take turns without reloading each other
+	for range 3 {
+		if v, _ := c.Get(a); v != "one" {
+			t.Errorf("a = %q", v)
+		}
+		if v, _ := c.Get(b); v != "two" {
+			t.Errorf("b = %q", v)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("loaded %d times, expected 2", loads)
+	}
+
+	os.WriteFile(a, []byte("three"), 0600)
+	os.Chtimes(a, time.Now(), time.Now().Add(time.Minute))
+	if v, _ := c.Get(a); v != "three" {
+		t.Errorf("a wasn't reloaded after changing, got %q", v)
+	}
+
+	// our own saves don't count as changes
+	c.Save(b, func(v string) error {
+		os.Chtimes(b, time.Now(), time.Now().Add(time.Minute))
+		return nil
+	})
+	loads = 0
+	c.Get(b)
+	if loads != 0 {
+		t.Error("b was reloaded after Save")
+	}
+}
@@ -0,0 +1,299 @@
+package imap
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+// CONDSTORE and QRESYNC, RFC 7162
+
+// expunged tells the client messages are gone. seqs must be highest first,
+// the order they were removed in.
+func (c *conn) expunged(seqs []int, uids []uint32) {
+	if len(seqs) == 0 {
+		return
+	}
+	if c.qresync {
+		sorted := slices.Clone(uids)
+		slices.Sort(sorted)
+		c.untagged("VANISHED %s", formatSeqSet(sorted))
+		return
+	}
+	for _, seq := range seqs {
+		c.untagged("%d EXPUNGE", seq)
+	}
+}
+
+// sendFlags sends a FETCH with a message's flags, and whatever else the
+// enabled extensions say has to go with them
+func (c *conn) sendFlags(seq int, msg *maildir.Message, withUID bool) {
+	items := []string{}
+	if withUID || c.qresync {
+		items = append(items, fmt.Sprintf("UID %d", msg.UID))
+	}
+	items = append(items, "FLAGS "+formatFlags(c.mbox.messageFlags(msg)))
+	if c.condstore {
+		items = append(items, fmt.Sprintf("MODSEQ (%d)", msg.ModSeq))
+	}
+	c.untagged("%d FETCH (%s)", seq, strings.Join(items, " "))
+}
+
+func (m *mailbox) highestModSeq() uint64 {
+	var highest uint64
+	for _, msg := range m.msgs {
+		highest = max(highest, msg.ModSeq)
+	}
+	return max(highest, m.modSeq)
+}
+
+// vanishedSince lists the UIDs in set that were expunged after modseq
+func (m *mailbox) vanishedSince(modseq uint64, set seqSet) ([]uint32, error) {
+	mb, err := maildir.Open(m.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	top := mb.UIDNext - 1
+
+	uids, exact := mb.VanishedSince(modseq)
+	if !exact {
+		// we've forgotten some, so anything the client might know about
+		// that isn't here any more has to be reported
+		uids = []uint32{}
+		for _, r := range set {
+			start, stop := r.start, r.stop
+			if start == 0 {
+				start = top
+			}
+			if stop == 0 {
+				stop = top
+			}
+			if start > stop {
+				start, stop = stop, start
+			}
+			for u := start; u <= min(stop, top); u++ {
+				if mb.ByUID(u) == nil {
+					uids = append(uids, u)
+				}
+			}
+		}
+		slices.Sort(uids)
+		uids = slices.Compact(uids)
+	}
+
+	return slices.DeleteFunc(uids, func(u uint32) bool { return !set.contains(u, top) }), nil
+}
+
+// parseModSeq reads a mod-sequence value
+func parseModSeq(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > 1<<63-1 {
+		return 0, errSyntax
+	}
+	return n, nil
+}
+
+// parseFetchModifiers reads FETCH's optional (CHANGEDSINCE n [VANISHED])
+func parseFetchModifiers(p *parser) (changedSince uint64, vanished bool, err error) {
+	if p.done() {
+		return 0, false, nil
+	}
+	if err = p.sp(); err != nil {
+		return 0, false, err
+	}
+	mods, err := p.list()
+	if err != nil {
+		return 0, false, err
+	}
+	for i := 0; i < len(mods); i++ {
+		switch strings.ToUpper(mods[i]) {
+		case "CHANGEDSINCE":
+			if i+1 == len(mods) {
+				return 0, false, errSyntax
+			}
+			i++
+			if changedSince, err = parseModSeq(mods[i]); err != nil {
+				return 0, false, err
+			}
+		case "VANISHED":
+			vanished = true
+		default:
+			return 0, false, errSyntax
+		}
+	}
+	if vanished && changedSince == 0 {
+		// VANISHED only means something with CHANGEDSINCE
+		return 0, false, errSyntax
+	}
+	return changedSince, vanished, nil
+}
+
+// parseStoreModifiers reads STORE's optional (UNCHANGEDSINCE n), which is
+// nil if there wasn't one
+func parseStoreModifiers(p *parser) (*uint64, error) {
+	if p == nil {
+		return nil, nil
+	}
+	mods, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(mods) != 2 || !strings.EqualFold(mods[0], "UNCHANGEDSINCE") {
+		return nil, errSyntax
+	}
+	n, err := parseModSeq(mods[1])
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// qresyncParams is the QRESYNC select parameter:
+// (uidvalidity modseq [known-uids [(known-seqs known-uids)]])
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   seqSet
+}
+
+// parseSelectParams reads the optional parameter list after SELECT or
+// EXAMINE's mailbox name
+func parseSelectParams(p *parser) (condstore bool, qr *qresyncParams, err error) {
+	if p.done() {
+		return false, nil, nil
+	}
+	if err = p.sp(); err == nil {
+		err = p.expect('(')
+	}
+	for err == nil && p.peek() != ')' {
+		if condstore || qr != nil {
+			if err = p.sp(); err != nil {
+				break
+			}
+		}
+		var name string
+		if name, err = p.atom(); err != nil {
+			break
+		}
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			condstore = true
+		case "QRESYNC":
+			qr, err = parseQresync(p)
+		default:
+			err = errSyntax
+		}
+	}
+	if err == nil {
+		err = p.expect(')')
+	}
+	return condstore, qr, err
+}
+
+func parseQresync(p *parser) (*qresyncParams, error) {
+	qr := &qresyncParams{knownUIDs: seqSet{{1, 0}}}
+	if err := p.sp(); err != nil {
+		return nil, err
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	v, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	validity, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil, errSyntax
+	}
+	qr.uidValidity = uint32(validity)
+
+	if err = p.sp(); err != nil {
+		return nil, err
+	}
+	ms, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	if qr.modSeq, err = parseModSeq(ms); err != nil {
+		return nil, err
+	}
+
+	if p.peek() == ' ' {
+		p.pos++
+		known, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+		if qr.knownUIDs, err = parseSeqSet(known); err != nil {
+			return nil, err
+		}
+		// the sequence match data is only an optimisation, skip it
+		if p.peek() == ' ' {
+			p.pos++
+			if _, err = p.list(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return qr, p.expect(')')
+}
+
+// resync answers a QRESYNC select: what vanished and what changed since the
+// client was last here
+func (c *conn) resync(qr *qresyncParams) error {
+	m := c.mbox
+	if qr.uidValidity != m.uidValidity {
+		// the client has to start from scratch anyway
+		return nil
+	}
+
+	vanished, err := m.vanishedSince(qr.modSeq, qr.knownUIDs)
+	if err != nil {
+		return err
+	}
+	if len(vanished) > 0 {
+		c.untagged("VANISHED (EARLIER) %s", formatSeqSet(vanished))
+	}
+
+	maxUID := m.maxUID()
+	for i, msg := range m.msgs {
+		if msg.ModSeq > qr.modSeq && qr.knownUIDs.contains(msg.UID, maxUID) {
+			c.sendFlags(i+1, msg, true)
+		}
+	}
+	return nil
+}
+
+func cmdEnable(c *conn, p *parser) *response {
+	enabled := []string{}
+	for !p.done() {
+		if err := p.sp(); err != nil {
+			return bad("Expected capability names")
+		}
+		name, err := p.atom()
+		if err != nil {
+			return bad("Expected capability names")
+		}
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			if !c.condstore {
+				enabled = append(enabled, "CONDSTORE")
+			}
+			c.condstore = true
+		case "QRESYNC":
+			if !c.qresync {
+				enabled = append(enabled, "QRESYNC")
+			}
+			// QRESYNC implies CONDSTORE
+			c.qresync = true
+			c.condstore = true
+		}
+	}
+	c.untagged("%s", strings.TrimSpace("ENABLED "+strings.Join(enabled, " ")))
+	return ok("ENABLE completed")
+}
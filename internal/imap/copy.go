@@ -0,0 +1,230 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/spam"
+)
+
+func cmdCopy(c *conn, p *parser) *response {
+	return copyMessages(c, p, false, false)
+}
+
+func cmdMove(c *conn, p *parser) *response {
+	return copyMessages(c, p, false, true)
+}
+
+func copyMessages(c *conn, p *parser, uid, move bool) *response {
+	var setStr, dest string
+	err := p.sp()
+	if err == nil {
+		setStr, err = p.atom()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		dest, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected sequence-set mailbox")
+	}
+	set, err := parseSeqSet(setStr)
+	if err != nil {
+		return bad("Invalid sequence set")
+	}
+	dest = normalizeMailbox(dest)
+
+	if move && c.mbox.readOnly {
+		return no("[READ-ONLY] Mailbox is read-only")
+	}
+	destDir, err := maildir.FolderPath(c.userDir, dest)
+	if err != nil || !maildir.Exists(destDir) {
+		return no("[TRYCREATE] No such mailbox")
+	}
+
+	seqs := c.mbox.lookup(set, uid)
+	if len(seqs) == 0 {
+		if uid {
+			return ok("No messages matched")
+		}
+		return bad("No messages matched")
+	}
+
+	// moving doesn't take any more room
+	if !move {
+		size := int64(0)
+		for _, seq := range seqs {
+			size += c.mbox.msgs[seq-1].Size
+		}
+		if c.overQuota(size) {
+			return no("[OVERQUOTA] Not enough room left")
+		}
+	}
+
+	train := spamTraining(c.mbox.name, dest, move)
+
+	srcUIDs, destUIDs := []uint32{}, []uint32{}
+	for _, seq := range seqs {
+		msg := c.mbox.msgs[seq-1]
+		data, err := os.ReadFile(msg.Path)
+		if err != nil {
+			return no("[EXPUNGEISSUED] Some messages have been expunged")
+		}
+		newUID, err := maildir.Append(destDir, data, msg.Flags, msg.Date)
+		if err != nil {
+			slog.Error("Couldn't copy message", "user", c.user, "dest", dest, "err", err.Error())
+			return no("[SERVERBUG] Couldn't copy messages")
+		}
+		if train != nil {
+			train(data)
+		}
+		srcUIDs = append(srcUIDs, msg.UID)
+		destUIDs = append(destUIDs, newUID)
+	}
+	if train != nil {
+		if err := spam.SaveShared(spam.DefaultPath(config.GetConfig().BoxesDir)); err != nil {
+			slog.Error("Couldn't save spam classifier", "err", err.Error())
+		}
+	}
+
+	validity := uint32(0)
+	if mb, err := maildir.Open(destDir, false); err == nil {
+		validity = mb.UIDValidity
+	}
+	copyUID := fmt.Sprintf("[COPYUID %d %s %s]", validity, formatSeqSet(srcUIDs), formatSeqSet(destUIDs))
+
+	if !move {
+		c.mbox.update(c, uid)
+		return ok(copyUID + " COPY completed")
+	}
+
+	c.untagged("OK %s Moved", copyUID)
+	mb := &maildir.Mailbox{Dir: c.mbox.dir}
+	moved, movedUIDs := []int{}, []uint32{}
+	for i := len(seqs) - 1; i >= 0; i-- {
+		seq := seqs[i]
+		msg := c.mbox.msgs[seq-1]
+		if err := mb.Remove(msg); err != nil {
+			slog.Error("Couldn't remove moved message", "user", c.user, "err", err.Error())
+			continue
+		}
+		moved = append(moved, seq)
+		movedUIDs = append(movedUIDs, msg.UID)
+		delete(c.mbox.recent, msg.UID)
+		c.mbox.msgs = slices.Delete(c.mbox.msgs, seq-1, seq)
+	}
+	c.expunged(moved, movedUIDs)
+	c.mbox.update(c, true)
+	return ok("MOVE completed")
+}
+
+// spamTraining decides whether filing a message from one mailbox into another
+// says anything about whether it's spam. Putting something in Junk means it's
+// spam, moving it out of Junk (other than to the Trash) means it wasn't.
+func spamTraining(from, to string, move bool) func(data []byte) {
+	conf := config.GetConfig()
+	if !conf.Spam.Enabled {
+		return nil
+	}
+	fromJunk := specialUse(from) == `\Junk`
+	toJunk := specialUse(to) == `\Junk`
+	if fromJunk == toJunk || specialUse(to) == `\Trash` {
+		return nil
+	}
+
+	c, err := spam.Shared(spam.DefaultPath(conf.BoxesDir))
+	if err != nil {
+		slog.Error("Couldn't load spam classifier", "err", err.Error())
+		return nil
+	}
+	if toJunk {
+		return func(data []byte) { c.Train(data, true) }
+	}
+	if !move {
+		// it's still in Junk too, so it's not much of a verdict
+		return nil
+	}
+	return func(data []byte) {
+		c.Untrain(data, true)
+		c.Train(data, false)
+	}
+}
+
+func cmdAppend(c *conn, p *parser) *response {
+	var name, data string
+	var flags []string
+	var date time.Time
+
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil && p.peek() == '(' {
+		if flags, err = p.list(); err == nil {
+			err = p.sp()
+		}
+	}
+	if err == nil && p.peek() == '"' {
+		var d string
+		if d, err = p.quoted(); err == nil {
+			if date, err = time.Parse("_2-Jan-2006 15:04:05 -0700", d); err == nil {
+				err = p.sp()
+			}
+		}
+	}
+	if err == nil {
+		data, err = p.literal()
+	}
+	if err != nil {
+		return bad("Expected APPEND mailbox [(flags)] [date-time] literal")
+	}
+	name = normalizeMailbox(name)
+
+	flags = slices.DeleteFunc(flags, func(f string) bool { return strings.EqualFold(f, `\Recent`) })
+	for i, f := range flags {
+		if idx := slices.IndexFunc(systemFlags, func(s string) bool { return strings.EqualFold(s, f) }); idx >= 0 {
+			flags[i] = systemFlags[idx]
+		}
+	}
+
+	dir, err := maildir.FolderPath(c.userDir, name)
+	if err != nil || !maildir.Exists(dir) {
+		return no("[TRYCREATE] No such mailbox")
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if c.overQuota(int64(len(data))) {
+		return no("[OVERQUOTA] Not enough room left")
+	}
+
+	newUID, err := maildir.Append(dir, []byte(data), flags, date)
+	if err != nil {
+		if errors.Is(err, maildir.ErrInvalidName) {
+			return no("[CANNOT] Invalid mailbox name")
+		}
+		slog.Error("APPEND failed", "user", c.user, "mailbox", name, "err", err.Error())
+		return no("[SERVERBUG] APPEND failed")
+	}
+
+	validity := uint32(0)
+	if mb, err := maildir.Open(dir, false); err == nil {
+		validity = mb.UIDValidity
+	}
+	if c.state == selected {
+		c.mbox.update(c, true)
+	}
+	return ok(fmt.Sprintf("[APPENDUID %d %d] APPEND completed", validity, newUID))
+}
@@ -0,0 +1,464 @@
+package imap
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+func cmdFetch(c *conn, p *parser) *response {
+	return fetch(c, p, false)
+}
+
+func fetch(c *conn, p *parser, uid bool) *response {
+	var setStr string
+	var items []string
+	err := p.sp()
+	if err == nil {
+		setStr, err = p.atom()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		items, err = p.listOrAtom()
+	}
+	if err != nil {
+		return bad("Expected FETCH sequence-set items")
+	}
+	set, err := parseSeqSet(setStr)
+	if err != nil {
+		return bad("Invalid sequence set")
+	}
+	changedSince, vanished, err := parseFetchModifiers(p)
+	if err != nil {
+		return bad("Invalid FETCH modifiers")
+	}
+	if vanished && (!uid || !c.qresync) {
+		return bad("VANISHED needs UID FETCH and QRESYNC")
+	}
+
+	for i, item := range items {
+		items[i] = strings.ToUpper(item)
+	}
+	if len(items) == 1 {
+		if macro, ok := fetchMacros[items[0]]; ok {
+			items = macro
+		}
+	}
+	if uid && !slices.Contains(items, "UID") {
+		items = append([]string{"UID"}, items...)
+	}
+	if changedSince > 0 && !slices.Contains(items, "MODSEQ") {
+		items = append(items, "MODSEQ")
+	}
+	for _, item := range items {
+		if !validFetchItem(item) {
+			return bad("Unknown FETCH item " + item)
+		}
+	}
+	if slices.Contains(items, "MODSEQ") {
+		c.condstore = true
+	}
+
+	if vanished {
+		gone, err := c.mbox.vanishedSince(changedSince, set)
+		if err != nil {
+			slog.Error("Couldn't list vanished messages", "user", c.user, "err", err.Error())
+		} else if len(gone) > 0 {
+			c.untagged("VANISHED (EARLIER) %s", formatSeqSet(gone))
+		}
+	}
+
+	failed := false
+	for _, seq := range c.mbox.lookup(set, uid) {
+		if c.mbox.msgs[seq-1].ModSeq <= changedSince {
+			continue
+		}
+		if err := c.fetchMessage(seq, items); err != nil {
+			slog.Debug("Couldn't fetch message", "user", c.user, "seq", seq, "err", err.Error())
+			failed = true
+		}
+	}
+
+	c.mbox.update(c, uid)
+	if failed {
+		return no("[EXPUNGEISSUED] Some messages have been expunged")
+	}
+	return ok("FETCH completed")
+}
+
+func validFetchItem(item string) bool {
+	switch item {
+	case "UID", "FLAGS", "MODSEQ", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return true
+	}
+	return strings.HasPrefix(item, "BODY[") || strings.HasPrefix(item, "BODY.PEEK[")
+}
+
+// fetchMessage writes the FETCH response for one message
+func (c *conn) fetchMessage(seq int, items []string) error {
+	msg := c.mbox.msgs[seq-1]
+
+	// only read and parse the message if something needs it
+	var raw []byte
+	var root *part
+	load := func() error {
+		if raw != nil {
+			return nil
+		}
+		b, err := os.ReadFile(msg.Path)
+		if err != nil {
+			return err
+		}
+		raw = b
+		root = parseMessage(raw)
+		return nil
+	}
+
+	out := []string{}
+	setSeen := false
+	for _, item := range items {
+		switch item {
+		case "UID":
+			out = append(out, fmt.Sprintf("UID %d", msg.UID))
+		case "FLAGS", "MODSEQ":
+			// added at the end, the fetch may change them
+		case "INTERNALDATE":
+			out = append(out, "INTERNALDATE "+formatDateTime(msg.Date))
+		case "RFC822.SIZE":
+			out = append(out, fmt.Sprintf("RFC822.SIZE %d", msg.Size))
+		case "ENVELOPE", "BODY", "BODYSTRUCTURE":
+			if err := load(); err != nil {
+				return err
+			}
+			switch item {
+			case "ENVELOPE":
+				out = append(out, "ENVELOPE "+root.envelope())
+			case "BODY":
+				out = append(out, "BODY "+root.bodyStructure(false))
+			default:
+				out = append(out, "BODYSTRUCTURE "+root.bodyStructure(true))
+			}
+		case "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+			if err := load(); err != nil {
+				return err
+			}
+			switch item {
+			case "RFC822":
+				out = append(out, "RFC822 "+literal(raw))
+				setSeen = true
+			case "RFC822.HEADER":
+				out = append(out, "RFC822.HEADER "+literal(root.header))
+			default:
+				out = append(out, "RFC822.TEXT "+literal(root.body))
+				setSeen = true
+			}
+		default:
+			if err := load(); err != nil {
+				return err
+			}
+			peek := strings.HasPrefix(item, "BODY.PEEK[")
+			section, partial, err := parseBodySection(item)
+			if err != nil {
+				return err
+			}
+			data := root.section(section)
+			name := "BODY[" + section + "]"
+			if partial != nil {
+				start := min(partial[0], len(data))
+				end := min(start+partial[1], len(data))
+				data = data[start:end]
+				name += fmt.Sprintf("<%d>", partial[0])
+			}
+			out = append(out, name+" "+literal(data))
+			if !peek {
+				setSeen = true
+			}
+		}
+	}
+
+	flagsChanged := false
+	if setSeen && !c.mbox.readOnly && !msg.HasFlag(`\Seen`) {
+		if err := c.mbox.setFlags(msg, append(slices.Clone(msg.Flags), `\Seen`)); err != nil {
+			slog.Error("Couldn't set \\Seen", "user", c.user, "err", err.Error())
+		} else {
+			flagsChanged = true
+		}
+	}
+	withFlags := slices.Contains(items, "FLAGS") || flagsChanged
+	if withFlags {
+		out = append(out, "FLAGS "+formatFlags(c.mbox.messageFlags(msg)))
+	}
+	if slices.Contains(items, "MODSEQ") || withFlags && c.condstore {
+		out = append(out, fmt.Sprintf("MODSEQ (%d)", msg.ModSeq))
+	}
+
+	c.untagged("%d FETCH (%s)", seq, strings.Join(out, " "))
+	return nil
+}
+
+// parseBodySection splits BODY[1.HEADER]<0.100> into the section and the
+// partial range, if there is one
+func parseBodySection(item string) (string, []int, error) {
+	open := strings.IndexByte(item, '[')
+	end := strings.LastIndexByte(item, ']')
+	if open < 0 || end < open {
+		return "", nil, errSyntax
+	}
+	section := item[open+1 : end]
+	rest := item[end+1:]
+	if rest == "" {
+		return section, nil, nil
+	}
+
+	if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+		return "", nil, errSyntax
+	}
+	startStr, lenStr, ok := strings.Cut(rest[1:len(rest)-1], ".")
+	if !ok {
+		return "", nil, errSyntax
+	}
+	start, err1 := strconv.Atoi(startStr)
+	length, err2 := strconv.Atoi(lenStr)
+	if err1 != nil || err2 != nil || start < 0 || length < 0 {
+		return "", nil, errSyntax
+	}
+	return section, []int{start, length}, nil
+}
+
+// section returns the data for a BODY[section] fetch
+func (p *part) section(section string) []byte {
+	path, spec := parseSectionPath(section)
+
+	target := p
+	if len(path) > 0 {
+		var found bool
+		if target, found = p.find(path); !found {
+			return []byte{}
+		}
+		switch {
+		case spec == "":
+			return target.body
+		case spec == "MIME":
+			return target.header
+		}
+		// HEADER and TEXT of a part refer to the message it encapsulates
+		if target.msg == nil {
+			return []byte{}
+		}
+		target = target.msg
+	}
+
+	switch {
+	case spec == "":
+		return append(slices.Clone(target.header), target.body...)
+	case spec == "HEADER":
+		return target.header
+	case spec == "TEXT":
+		return target.body
+	case strings.HasPrefix(spec, "HEADER.FIELDS"):
+		not := strings.HasPrefix(spec, "HEADER.FIELDS.NOT")
+		open := strings.IndexByte(spec, '(')
+		if open < 0 {
+			return []byte{}
+		}
+		names, _ := (&parser{buf: []byte(spec[open:])}).list()
+		return headerFields(target.header, names, not)
+	default:
+		return []byte{}
+	}
+}
+
+// setFlags changes a message's flags on disk and picks up any keywords that
+// had to be added for it
+func (m *mailbox) setFlags(msg *maildir.Message, flags []string) error {
+	mb := &maildir.Mailbox{Dir: m.dir, Keywords: m.keywords}
+	if err := mb.SetFlags(msg, flags); err != nil {
+		return err
+	}
+	m.keywords = mb.Keywords
+	return nil
+}
+
+func cmdStore(c *conn, p *parser) *response {
+	return store(c, p, false)
+}
+
+func store(c *conn, p *parser, uid bool) *response {
+	var setStr, item string
+	var flags []string
+	var mods *parser
+	err := p.sp()
+	if err == nil {
+		setStr, err = p.atom()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil && p.peek() == '(' {
+		// modifiers come before the item, keep them for later
+		modStart := p.pos
+		if _, err = p.list(); err == nil {
+			mods = &parser{buf: p.buf[modStart:p.pos]}
+			err = p.sp()
+		}
+	}
+	if err == nil {
+		item, err = p.atom()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		flags, err = p.listOrAtom()
+	}
+	if err != nil {
+		return bad("Expected STORE sequence-set item flags")
+	}
+	set, err := parseSeqSet(setStr)
+	if err != nil {
+		return bad("Invalid sequence set")
+	}
+	unchangedSince, err := parseStoreModifiers(mods)
+	if err != nil {
+		return bad("Invalid STORE modifiers")
+	}
+
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return bad("Unknown STORE item " + item)
+	}
+
+	for i, f := range flags {
+		if strings.HasPrefix(f, `\`) {
+			idx := slices.IndexFunc(systemFlags, func(s string) bool { return strings.EqualFold(s, f) })
+			if idx < 0 && !strings.EqualFold(f, `\Recent`) {
+				return bad("Unknown system flag " + f)
+			}
+			if idx >= 0 {
+				flags[i] = systemFlags[idx]
+			}
+		}
+	}
+	// \Recent is the server's to set
+	flags = slices.DeleteFunc(flags, func(f string) bool { return strings.EqualFold(f, `\Recent`) })
+
+	if c.mbox.readOnly {
+		return no("[READ-ONLY] Mailbox is read-only")
+	}
+
+	if unchangedSince != nil {
+		c.condstore = true
+	}
+
+	nKeywords := len(c.mbox.keywords)
+	modified := []uint32{}
+	for _, seq := range c.mbox.lookup(set, uid) {
+		msg := c.mbox.msgs[seq-1]
+		if unchangedSince != nil && msg.ModSeq > *unchangedSince {
+			if uid {
+				modified = append(modified, msg.UID)
+			} else {
+				modified = append(modified, uint32(seq))
+			}
+			continue
+		}
+
+		var newFlags []string
+		switch item {
+		case "FLAGS":
+			newFlags = flags
+		case "+FLAGS":
+			newFlags = append(slices.Clone(msg.Flags), flags...)
+		default:
+			newFlags = slices.DeleteFunc(slices.Clone(msg.Flags), func(f string) bool {
+				return slices.ContainsFunc(flags, func(o string) bool { return strings.EqualFold(f, o) })
+			})
+		}
+
+		if err := c.mbox.setFlags(msg, newFlags); err != nil {
+			slog.Debug("Couldn't store flags", "user", c.user, "err", err.Error())
+			return no("[LIMIT] Couldn't store flags")
+		}
+		if len(c.mbox.keywords) != nKeywords {
+			nKeywords = len(c.mbox.keywords)
+			c.untagged("FLAGS %s", formatFlags(c.mbox.flags()))
+		}
+		switch {
+		case !silent:
+			c.sendFlags(seq, msg, uid)
+		case c.condstore:
+			// the client still needs to know the new modseq
+			if uid {
+				c.untagged("%d FETCH (UID %d MODSEQ (%d))", seq, msg.UID, msg.ModSeq)
+			} else {
+				c.untagged("%d FETCH (MODSEQ (%d))", seq, msg.ModSeq)
+			}
+		}
+	}
+
+	c.mbox.update(c, uid)
+	if len(modified) > 0 {
+		return ok(fmt.Sprintf("[MODIFIED %s] Conditional STORE failed for some messages", formatSeqSet(modified)))
+	}
+	return ok("STORE completed")
+}
+
+func cmdUID(c *conn, p *parser) *response {
+	var sub string
+	err := p.sp()
+	if err == nil {
+		sub, err = p.atom()
+	}
+	if err != nil {
+		return bad("Expected UID command")
+	}
+
+	switch strings.ToUpper(sub) {
+	case "FETCH":
+		return fetch(c, p, true)
+	case "STORE":
+		return store(c, p, true)
+	case "COPY":
+		return copyMessages(c, p, true, false)
+	case "MOVE":
+		return copyMessages(c, p, true, true)
+	case "SEARCH":
+		return search(c, p, true)
+	case "SORT":
+		return sortMessages(c, p, true)
+	case "THREAD":
+		return thread(c, p, true)
+	case "EXPUNGE":
+		var setStr string
+		err := p.sp()
+		if err == nil {
+			setStr, err = p.atom()
+		}
+		if err != nil {
+			return bad("Expected UID EXPUNGE sequence-set")
+		}
+		set, err := parseSeqSet(setStr)
+		if err != nil {
+			return bad("Invalid sequence set")
+		}
+		return expunge(c, set)
+	default:
+		return bad("Unknown UID command")
+	}
+}
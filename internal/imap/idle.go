@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/notify"
+)
+
+// how often an idling session rescans anyway, in case something outside this
+// process changed the maildir
+const idlePoll = 2 * time.Minute
+
+// cmdIdle implements RFC 2177. Changes to the selected mailbox are pushed to
+// the client until it sends DONE.
+func cmdIdle(c *conn, p *parser) *response {
+	var updates <-chan struct{}
+	if c.state == selected {
+		sub := notify.Subscribe(c.mbox.dir)
+		defer sub.Close()
+		updates = sub.C
+		// catch anything that happened before we subscribed
+		c.mbox.update(c, true)
+	}
+
+	c.continuation("idling")
+	if err := c.flush(); err != nil {
+		c.state = loggedOut
+		return nil
+	}
+
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	if err := c.setReadDeadline(autologoutTimeout); err != nil {
+		c.shutdownBye()
+		c.state = loggedOut
+		return nil
+	}
+	go func() {
+		line, err := readLine(c.r)
+		done <- result{line, err}
+	}()
+
+	poll := time.NewTicker(idlePoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-updates:
+			c.mbox.update(c, true)
+		case <-poll.C:
+			if c.state == selected {
+				c.mbox.update(c, true)
+			}
+		case r := <-done:
+			if r.err != nil {
+				if shuttingDown() {
+					c.shutdownBye()
+				}
+				c.state = loggedOut
+				return nil
+			}
+			if !strings.EqualFold(strings.TrimSpace(string(r.line)), "DONE") {
+				return bad("Expected DONE")
+			}
+			return ok("IDLE terminated")
+		}
+		if err := c.flush(); err != nil {
+			c.state = loggedOut
+			return nil
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: hello\r\n" +
+	"Content-Type: multipart/mixed; boundary=XX\r\n" +
+	"\r\n" +
+	"--XX\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"first part\r\n" +
+	"--XX\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>second</p>\r\n" +
+	"--XX--\r\n"
+
+func TestSection(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+
+	tests := map[string]string{
+		"1":                    "first part",
+		"2":                    "<p>second</p>",
+		"1.MIME":               "Content-Type: text/plain\r\n\r\n",
+		"HEADER.FIELDS (FROM)": "From: Alice <alice@example.com>\r\n\r\n",
+		"":                     testMessage,
+		"3":                    "",
+	}
+	for section, want := range tests {
+		if got := string(root.section(section)); got != want {
+			t.Errorf("BODY[%s] = %q, want %q", section, got, want)
+		}
+	}
+
+	want := `(("text" "plain" ("charset" "us-ascii") NIL NIL "7bit" 10 1)("text" "html" ("charset" "us-ascii") NIL NIL "7bit" 13 1) "mixed")`
+	if got := root.bodyStructure(false); got != want {
+		t.Errorf("BODY = %s, want %s", got, want)
+	}
+}
+
+func TestMatchMailbox(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "a/b", true},
+		{"%", "a/b", false},
+		{"a/%", "a/b", true},
+		{"inbox", "INBOX", true},
+		{"Jun%", "Junk", true},
+		{"Junk", "junk", false},
+	}
+	for _, tt := range tests {
+		if got := matchMailbox(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchMailbox(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+// client drives an already logged in session over a pipe
+type client struct {
+	t   *testing.T
+	r   *bufio.Reader
+	w   net.Conn
+	dir string
+}
+
+func newClient(t *testing.T) *client {
+	// keep the default config out of the real home directory
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	userDir := filepath.Join(t.TempDir(), "bob")
+	if err := maildir.Create(userDir); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, cli := net.Pipe()
+	ic := &conn{
+		c:       srv,
+		r:       bufio.NewReader(srv),
+		w:       bufio.NewWriter(srv),
+		state:   authenticated,
+		user:    "bob",
+		userDir: userDir,
+	}
+	go func() {
+		defer srv.Close()
+		for ic.state != loggedOut {
+			if ic.handleNext() != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { cli.Close() })
+	return &client{t: t, r: bufio.NewReader(cli), w: cli, dir: userDir}
+}
+
+// do sends a command and returns the untagged responses and the tagged one
+func (c *client) do(cmd string) ([]string, string) {
+	c.t.Helper()
+	if _, err := c.w.Write([]byte("a " + cmd + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	lines := []string{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "+ ") {
+			continue
+		}
+		if strings.HasPrefix(line, "a ") {
+			return lines, strings.TrimSpace(line)
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (c *client) ok(cmd string) []string {
+	c.t.Helper()
+	lines, tagged := c.do(cmd)
+	if !strings.HasPrefix(tagged, "a OK") {
+		c.t.Fatalf("%s: %s", cmd, tagged)
+	}
+	return lines
+}
+
+func TestSession(t *testing.T) {
+	c := newClient(t)
+
+	c.ok("CREATE Junk")
+	_, tagged := c.do("APPEND INBOX (\\Flagged) {" + strconv.Itoa(len(testMessage)) + "+}\r\n" + testMessage)
+	if !strings.Contains(tagged, "[APPENDUID ") {
+		t.Fatalf("APPEND: %s", tagged)
+	}
+
+	lines := c.ok("SELECT INBOX")
+	if !strings.Contains(strings.Join(lines, ""), "* 1 EXISTS") {
+		t.Fatalf("SELECT didn't report the message: %q", lines)
+	}
+
+	lines = c.ok("FETCH 1 (FLAGS BODY.PEEK[1])")
+	got := strings.Join(lines, "")
+	if !strings.Contains(got, "BODY[1] {10}\r\nfirst part") || !strings.Contains(got, `\Flagged`) {
+		t.Fatalf("FETCH = %q", got)
+	}
+	if strings.Contains(got, `\Seen`) {
+		t.Fatalf("BODY.PEEK set \\Seen: %q", got)
+	}
+
+	lines = c.ok("STORE 1 +FLAGS (\\Deleted $Important)")
+	got = strings.Join(lines, "")
+	if !strings.Contains(got, `\Deleted`) || !strings.Contains(got, "$Important") {
+		t.Fatalf("STORE = %q", got)
+	}
+
+	c.ok("UID COPY 1 Junk")
+	c.ok("EXPUNGE")
+	lines = c.ok("STATUS Junk (MESSAGES)")
+	if !strings.Contains(strings.Join(lines, ""), "MESSAGES 1") {
+		t.Fatalf("STATUS = %q", lines)
+	}
+
+	lines = c.ok("LIST \"\" *")
+	got = strings.Join(lines, "")
+	if !strings.Contains(got, `\Junk`) || !strings.Contains(got, `"INBOX"`) {
+		t.Fatalf("LIST = %q", got)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	c := newClient(t)
+	c.ok("SELECT INBOX")
+
+	c.w.Write([]byte("a IDLE\r\n"))
+	if line, _ := c.r.ReadString('\n'); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("IDLE = %q", line)
+	}
+
+	if _, err := maildir.Deliver(c.dir, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := c.r.ReadString('\n'); line != "* 1 EXISTS\r\n" {
+		t.Fatalf("expected EXISTS, got %q", line)
+	}
+
+	c.w.Write([]byte("DONE\r\n"))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "a ") {
+			if !strings.HasPrefix(line, "a OK") {
+				t.Fatalf("DONE = %q", line)
+			}
+			break
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	tests := map[string]string{
+		"Re: hello":                "hello",
+		"RE: [list] Fwd: hello":    "hello",
+		"hello (fwd)":              "hello",
+		"[Fwd: Re: hello]":         "hello",
+		"[list] hello":             "hello",
+		"  lots   of   spaces ":    "lots of spaces",
+		"Re[2]: not a blob either": "not a blob either",
+	}
+	for in, want := range tests {
+		if got := baseSubject(in); got != want {
+			t.Errorf("baseSubject(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSearchAndThread(t *testing.T) {
+	c := newClient(t)
+
+	msgs := []string{
+		"Message-Id: <1@x>\r\nSubject: plans\r\nFrom: alice@example.com\r\nDate: Mon, 1 Jan 2024 10:00:00 +0000\r\n\r\nlunch?\r\n",
+		"Message-Id: <2@x>\r\nSubject: Re: plans\r\nFrom: bob@example.com\r\nDate: Mon, 1 Jan 2024 11:00:00 +0000\r\nReferences: <1@x>\r\n\r\nsure\r\n",
+		"Message-Id: <3@x>\r\nSubject: other\r\nFrom: carol@example.com\r\nDate: Mon, 1 Jan 2024 09:00:00 +0000\r\n\r\nunrelated\r\n",
+		"Message-Id: <4@x>\r\nSubject: Re: plans\r\nFrom: alice@example.com\r\nDate: Mon, 1 Jan 2024 12:00:00 +0000\r\nReferences: <1@x>\r\n\r\nnoon then\r\n",
+	}
+	for _, m := range msgs {
+		if _, err := maildir.Deliver(c.dir, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.ok("SELECT INBOX")
+
+	tests := map[string]string{
+		"SEARCH FROM alice":                              "* SEARCH 1 4\r\n",
+		"SEARCH OR BODY sure SUBJECT other":              "* SEARCH 2 3\r\n",
+		"SEARCH NOT HEADER References \"\"":              "* SEARCH 1 3\r\n",
+		"SEARCH CHARSET UTF-8 SENTBEFORE 2-Jan-2024 2:3": "* SEARCH 2 3\r\n",
+		"SORT (DATE) UTF-8 ALL":                          "* SORT 3 1 2 4\r\n",
+		"SORT (REVERSE FROM) UTF-8 ALL":                  "* SORT 3 2 1 4\r\n",
+		"THREAD REFERENCES UTF-8 ALL":                    "* THREAD (3)(1 (2)(4))\r\n",
+		"THREAD ORDEREDSUBJECT UTF-8 ALL":                "* THREAD (3)(1 (2)(4))\r\n",
+	}
+	for cmd, want := range tests {
+		lines := c.ok(cmd)
+		if len(lines) == 0 || lines[0] != want {
+			t.Errorf("%s = %q, want %q", cmd, lines, want)
+		}
+	}
+}
+
+func TestCondstore(t *testing.T) {
+	c := newClient(t)
+	for range 3 {
+		if _, err := maildir.Deliver(c.dir, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(lines []string, prefix string) string {
+		t.Helper()
+		for _, l := range lines {
+			if strings.HasPrefix(l, prefix) {
+				return strings.TrimSpace(l)
+			}
+		}
+		t.Fatalf("no %q in %q", prefix, lines)
+		return ""
+	}
+	// pulls the number out of "* OK [NAME n] ..."
+	code := func(lines []string, name string) string {
+		return strings.TrimSuffix(strings.Fields(find(lines, "* OK ["+name+" "))[3], "]")
+	}
+
+	if lines := c.ok("ENABLE QRESYNC"); find(lines, "* ENABLED") != "* ENABLED QRESYNC" {
+		t.Errorf("ENABLE: %q", lines)
+	}
+	lines := c.ok("SELECT INBOX")
+	validity := code(lines, "UIDVALIDITY")
+	highest := code(lines, "HIGHESTMODSEQ")
+
+	lines = c.ok("STORE 1 +FLAGS (\\Seen)")
+	if !strings.Contains(find(lines, "* 1 FETCH"), "MODSEQ (") {
+		t.Errorf("STORE without MODSEQ: %q", lines)
+	}
+	if _, tagged := c.do("UID STORE 2 (UNCHANGEDSINCE 1) +FLAGS (\\Flagged)"); !strings.Contains(tagged, "[MODIFIED 2]") {
+		t.Errorf("conditional STORE: %s", tagged)
+	}
+	c.ok("STORE 3 +FLAGS.SILENT (\\Deleted)")
+	if lines = c.ok("EXPUNGE"); find(lines, "* VANISHED") != "* VANISHED 3" {
+		t.Errorf("EXPUNGE: %q", lines)
+	}
+
+	lines = c.ok("UID SEARCH MODSEQ " + highest)
+	if got := find(lines, "* SEARCH"); !strings.HasPrefix(got, "* SEARCH 1 (MODSEQ ") {
+		t.Errorf("SEARCH MODSEQ: %s", got)
+	}
+
+	lines = c.ok("SELECT INBOX (QRESYNC (" + validity + " " + highest + "))")
+	find(lines, "* OK [CLOSED]")
+	if got := find(lines, "* VANISHED"); got != "* VANISHED (EARLIER) 3" {
+		t.Errorf("resync: %s", got)
+	}
+	if got := find(lines, "* 1 FETCH"); !strings.Contains(got, "UID 1 FLAGS (\\Seen)") {
+		t.Errorf("resync: %s", got)
+	}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "* 2 FETCH") {
+			t.Errorf("unchanged message sent on resync: %s", l)
+		}
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	asked := 0
+	cont := func() error { asked++; return nil }
+	read := func(cmd string, limit int64) error {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(cmd)), limit, cont)
+		return err
+	}
+
+	login := "a LOGIN {5}\r\nalice {6}\r\nsecret\r\n"
+	if err := read(login, maxPreAuthCommandLen); err != nil {
+		t.Errorf("LOGIN: %v", err)
+	}
+	if asked != 2 {
+		t.Errorf("asked for %d literals, expected 2", asked)
+	}
+
+	// refused before the client is told to send it
+	asked = 0
+	big := "a LOGIN {100000}\r\n" + strings.Repeat("x", 100000) + " x\r\n"
+	if err := read(big, maxPreAuthCommandLen); !errors.Is(err, errCommandTooLong) {
+		t.Errorf("big literal before login: %v", err)
+	}
+	if asked != 0 {
+		t.Error("asked for a literal that was too big")
+	}
+	if err := read(big, maxCommandLen); err != nil {
+		t.Errorf("big literal after login: %v", err)
+	}
+
+	// lots of small ones add up
+	many := "a LOGIN" + strings.Repeat(" {1000+}\r\n"+strings.Repeat("x", 1000), 10) + "\r\n"
+	if err := read(many, maxPreAuthCommandLen); !errors.Is(err, errCommandTooLong) {
+		t.Errorf("many literals before login: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Cleanup(func() {
+		connsMu.Lock()
+		draining = false
+		connsMu.Unlock()
+	})
+	// dial hands a connection to Handle and returns its first line
+	dial := func() (*bufio.Reader, string) {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		go Handle(srv)
+		r := bufio.NewReader(cli)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, line
+	}
+
+	r, _ := dial()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Shutdown(ctx) }()
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "* BYE") {
+		t.Errorf("got %q, expected a BYE", line)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// new clients are turned away
+	if _, line := dial(); !strings.HasPrefix(line, "* BYE") {
+		t.Errorf("new client got %q, expected a BYE", line)
+	}
+}
@@ -0,0 +1,603 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+// flags clients can set on messages
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+// mailbox is the selected mailbox as this session sees it. Sequence numbers
+// are positions in msgs, which only changes when we tell the client about
+// it.
+type mailbox struct {
+	name     string
+	dir      string
+	readOnly bool
+
+	uidValidity uint32
+	uidNext     uint32
+	// the mailbox's HIGHESTMODSEQ as of the last rescan, expunges bump it
+	// without any message to show for it
+	modSeq   uint64
+	msgs     []*maildir.Message
+	keywords []string
+	// UIDs that are \Recent for this session
+	recent map[uint32]bool
+}
+
+func openMailbox(userDir, name string, readOnly bool) (*mailbox, error) {
+	dir, err := maildir.FolderPath(userDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	mb, err := maildir.Open(dir, !readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mailbox{
+		name:        name,
+		dir:         dir,
+		readOnly:    readOnly,
+		uidValidity: mb.UIDValidity,
+		uidNext:     mb.UIDNext,
+		modSeq:      mb.HighestModSeq,
+		msgs:        mb.Messages,
+		keywords:    mb.Keywords,
+		recent:      map[uint32]bool{},
+	}
+	for _, msg := range mb.Messages {
+		if msg.Recent {
+			m.recent[msg.UID] = true
+		}
+	}
+	return m, nil
+}
+
+// update rescans the maildir and tells the client about anything that
+// changed behind its back. Expunges can only be reported when allowExpunge is
+// set, otherwise sequence numbers would shift under a FETCH, STORE or SEARCH.
+func (m *mailbox) update(c *conn, allowExpunge bool) {
+	mb, err := maildir.Open(m.dir, !m.readOnly)
+	if err != nil {
+		slog.Error("Couldn't rescan mailbox", "dir", m.dir, "err", err.Error())
+		return
+	}
+
+	current := make(map[uint32]*maildir.Message, len(mb.Messages))
+	for _, msg := range mb.Messages {
+		current[msg.UID] = msg
+		if msg.Recent {
+			m.recent[msg.UID] = true
+		}
+	}
+
+	if !slices.Equal(m.keywords, mb.Keywords) {
+		m.keywords = mb.Keywords
+		c.untagged("FLAGS %s", formatFlags(m.flags()))
+	}
+
+	// expunges go from the highest sequence number down so the ones we
+	// haven't sent yet stay valid
+	if allowExpunge {
+		seqs, uids := []int{}, []uint32{}
+		for i := len(m.msgs) - 1; i >= 0; i-- {
+			if _, ok := current[m.msgs[i].UID]; !ok {
+				seqs = append(seqs, i+1)
+				uids = append(uids, m.msgs[i].UID)
+				delete(m.recent, m.msgs[i].UID)
+				m.msgs = append(m.msgs[:i], m.msgs[i+1:]...)
+			}
+		}
+		c.expunged(seqs, uids)
+	}
+
+	var maxUID uint32
+	for i, old := range m.msgs {
+		maxUID = max(maxUID, old.UID)
+		now, ok := current[old.UID]
+		if !ok {
+			continue
+		}
+		m.msgs[i] = now
+		if !slices.Equal(old.Flags, now.Flags) {
+			c.sendFlags(i+1, now, false)
+		}
+	}
+
+	added := false
+	for _, msg := range mb.Messages {
+		if msg.UID > maxUID {
+			m.msgs = append(m.msgs, msg)
+			added = true
+		}
+	}
+	if added {
+		c.untagged("%d EXISTS", len(m.msgs))
+		c.untagged("%d RECENT", len(m.recent))
+	}
+	m.uidNext = mb.UIDNext
+	m.modSeq = mb.HighestModSeq
+}
+
+// flags lists every flag that can appear in this mailbox
+func (m *mailbox) flags() []string {
+	return append(slices.Clone(systemFlags), m.keywords...)
+}
+
+// messageFlags is a message's flags as the session sees them, with \Recent
+func (m *mailbox) messageFlags(msg *maildir.Message) []string {
+	if m.recent[msg.UID] {
+		return append(slices.Clone(msg.Flags), `\Recent`)
+	}
+	return msg.Flags
+}
+
+// lookup resolves a sequence set (or UID set) to sequence numbers
+func (m *mailbox) lookup(set seqSet, uid bool) []int {
+	seqs := []int{}
+	if len(m.msgs) == 0 {
+		return seqs
+	}
+	maxUID := m.msgs[len(m.msgs)-1].UID
+	for i, msg := range m.msgs {
+		if uid && set.contains(msg.UID, maxUID) || !uid && set.contains(uint32(i+1), uint32(len(m.msgs))) {
+			seqs = append(seqs, i+1)
+		}
+	}
+	return seqs
+}
+
+// expunge removes \Deleted messages, limited to uids if it isn't nil, and
+// tells the client unless silent is set
+func (m *mailbox) expunge(c *conn, uids seqSet, silent bool) error {
+	mb, err := maildir.Open(m.dir, false)
+	if err != nil {
+		return err
+	}
+
+	maxUID := m.maxUID()
+	seqs, removed := []int{}, []uint32{}
+	for i := len(m.msgs) - 1; i >= 0; i-- {
+		msg := m.msgs[i]
+		if !msg.HasFlag(`\Deleted`) || uids != nil && !uids.contains(msg.UID, maxUID) {
+			continue
+		}
+		if cur := mb.ByUID(msg.UID); cur != nil {
+			if err := mb.Remove(cur); err != nil {
+				return err
+			}
+		}
+		seqs = append(seqs, i+1)
+		removed = append(removed, msg.UID)
+		delete(m.recent, msg.UID)
+		m.msgs = append(m.msgs[:i], m.msgs[i+1:]...)
+	}
+	if !silent {
+		c.expunged(seqs, removed)
+	}
+	return nil
+}
+
+// special use attributes for well known folder names
+func specialUse(name string) string {
+	switch strings.ToLower(name) {
+	case "junk", "spam":
+		return `\Junk`
+	case "sent", "sent items", "sent messages":
+		return `\Sent`
+	case "drafts":
+		return `\Drafts`
+	case "trash", "deleted items", "deleted messages":
+		return `\Trash`
+	case "archive":
+		return `\Archive`
+	default:
+		return ""
+	}
+}
+
+func cmdSelect(c *conn, p *parser) *response {
+	return selectMailbox(c, p, false)
+}
+
+func cmdExamine(c *conn, p *parser) *response {
+	return selectMailbox(c, p, true)
+}
+
+func selectMailbox(c *conn, p *parser, readOnly bool) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected mailbox name")
+	}
+	condstore, qr, err := parseSelectParams(p)
+	if err != nil {
+		return bad("Invalid SELECT parameters")
+	}
+	if qr != nil && !c.qresync {
+		return bad("QRESYNC has to be enabled first")
+	}
+	if condstore {
+		c.condstore = true
+	}
+
+	// selecting anything deselects the current mailbox, even on failure
+	if c.mbox != nil && c.qresync {
+		c.untagged("OK [CLOSED] Previous mailbox closed")
+	}
+	c.mbox = nil
+	c.state = authenticated
+
+	m, err := openMailbox(c.userDir, normalizeMailbox(name), readOnly)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, maildir.ErrInvalidName) {
+			return no("[NONEXISTENT] No such mailbox")
+		}
+		slog.Error("Couldn't open mailbox", "user", c.user, "mailbox", name, "err", err.Error())
+		return no("[SERVERBUG] Couldn't open mailbox")
+	}
+
+	c.untagged("FLAGS %s", formatFlags(m.flags()))
+	if readOnly {
+		c.untagged("OK [PERMANENTFLAGS ()] No permanent flags permitted")
+	} else {
+		c.untagged(`OK [PERMANENTFLAGS %s] Limited`, formatFlags(append(m.flags(), `\*`)))
+	}
+	c.untagged("%d EXISTS", len(m.msgs))
+	c.untagged("%d RECENT", len(m.recent))
+	for i, msg := range m.msgs {
+		if !msg.HasFlag(`\Seen`) {
+			c.untagged("OK [UNSEEN %d] First unseen", i+1)
+			break
+		}
+	}
+	c.untagged("OK [UIDVALIDITY %d] UIDs valid", m.uidValidity)
+	c.untagged("OK [UIDNEXT %d] Predicted next UID", m.uidNext)
+	c.untagged("OK [HIGHESTMODSEQ %d] Highest", m.highestModSeq())
+
+	c.mbox = m
+	c.state = selected
+	if qr != nil {
+		if err := c.resync(qr); err != nil {
+			slog.Error("Couldn't resync mailbox", "user", c.user, "mailbox", name, "err", err.Error())
+		}
+	}
+	if readOnly {
+		return ok("[READ-ONLY] EXAMINE completed")
+	}
+	return ok("[READ-WRITE] SELECT completed")
+}
+
+// INBOX is case insensitive, everything else isn't
+func normalizeMailbox(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return strings.Trim(name, "/")
+}
+
+func cmdCreate(c *conn, p *parser) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected mailbox name")
+	}
+	name = normalizeMailbox(name)
+	if name == "INBOX" {
+		return no("[ALREADYEXISTS] INBOX always exists")
+	}
+
+	// create any missing parents along the way
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		err = maildir.CreateFolder(c.userDir, strings.Join(parts[:i+1], "/"))
+		if err != nil && !errors.Is(err, maildir.ErrExists) {
+			break
+		}
+		if i == len(parts)-1 && errors.Is(err, maildir.ErrExists) {
+			return no("[ALREADYEXISTS] Mailbox already exists")
+		}
+		err = nil
+	}
+	if err != nil {
+		if errors.Is(err, maildir.ErrInvalidName) {
+			return no("[CANNOT] Invalid mailbox name")
+		}
+		return no("[SERVERBUG] Couldn't create mailbox")
+	}
+	return ok("CREATE completed")
+}
+
+func cmdDelete(c *conn, p *parser) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected mailbox name")
+	}
+	name = normalizeMailbox(name)
+
+	if err = maildir.DeleteFolder(c.userDir, name); err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return no("[NONEXISTENT] No such mailbox")
+		case errors.Is(err, maildir.ErrInvalidName):
+			return no("[CANNOT] Can't delete that mailbox")
+		default:
+			return no("[SERVERBUG] Couldn't delete mailbox")
+		}
+	}
+	maildir.SetSubscribed(c.userDir, name, false)
+	return ok("DELETE completed")
+}
+
+func cmdRename(c *conn, p *parser) *response {
+	var from, to string
+	err := p.sp()
+	if err == nil {
+		from, err = p.astring()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		to, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected RENAME from to")
+	}
+
+	if err = maildir.RenameFolder(c.userDir, normalizeMailbox(from), normalizeMailbox(to)); err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return no("[NONEXISTENT] No such mailbox")
+		case errors.Is(err, maildir.ErrExists):
+			return no("[ALREADYEXISTS] Destination already exists")
+		case errors.Is(err, maildir.ErrInvalidName):
+			return no("[CANNOT] Can't rename that mailbox")
+		default:
+			return no("[SERVERBUG] Couldn't rename mailbox")
+		}
+	}
+	return ok("RENAME completed")
+}
+
+func cmdSubscribe(c *conn, p *parser) *response {
+	return subscribe(c, p, true)
+}
+
+func cmdUnsubscribe(c *conn, p *parser) *response {
+	return subscribe(c, p, false)
+}
+
+func subscribe(c *conn, p *parser, sub bool) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected mailbox name")
+	}
+	if err = maildir.SetSubscribed(c.userDir, normalizeMailbox(name), sub); err != nil {
+		return no("[SERVERBUG] Couldn't update subscriptions")
+	}
+	return ok("Subscriptions updated")
+}
+
+func cmdList(c *conn, p *parser) *response {
+	return list(c, p, "LIST")
+}
+
+func cmdLsub(c *conn, p *parser) *response {
+	return list(c, p, "LSUB")
+}
+
+func list(c *conn, p *parser, cmd string) *response {
+	var ref, pattern string
+	err := p.sp()
+	if err == nil {
+		ref, err = p.astring()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		pattern, err = p.astring()
+	}
+	if err != nil {
+		return bad(fmt.Sprintf("Expected %s reference pattern", cmd))
+	}
+
+	if pattern == "" {
+		c.untagged(`%s (\Noselect) "/" ""`, cmd)
+		return ok(cmd + " completed")
+	}
+
+	folders, err := maildir.Folders(c.userDir)
+	if err != nil {
+		return no("[SERVERBUG] Couldn't list mailboxes")
+	}
+	if cmd == "LSUB" {
+		subs, err := maildir.Subscriptions(c.userDir)
+		if err != nil {
+			return no("[SERVERBUG] Couldn't list subscriptions")
+		}
+		folders = slices.DeleteFunc(folders, func(f string) bool { return !slices.Contains(subs, f) })
+	}
+
+	pattern = ref + pattern
+	for _, f := range folders {
+		if !matchMailbox(pattern, f) {
+			continue
+		}
+
+		attrs := []string{}
+		hasChildren := slices.ContainsFunc(folders, func(o string) bool { return strings.HasPrefix(o, f+"/") })
+		if hasChildren {
+			attrs = append(attrs, `\HasChildren`)
+		} else {
+			attrs = append(attrs, `\HasNoChildren`)
+		}
+		if su := specialUse(f); su != "" {
+			attrs = append(attrs, su)
+		}
+		c.untagged(`%s (%s) "/" %s`, cmd, strings.Join(attrs, " "), quote(f))
+	}
+	return ok(cmd + " completed")
+}
+
+// matchMailbox matches LIST patterns, * matches anything and % matches
+// anything but the hierarchy delimiter
+func matchMailbox(pattern, name string) bool {
+	if strings.EqualFold(name, "INBOX") && strings.HasPrefix(strings.ToUpper(pattern), "INBOX") {
+		pattern = "INBOX" + pattern[5:]
+	}
+
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*', '%':
+			if len(pattern) == 1 && pattern[0] == '*' {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchMailbox(pattern[1:], name[i:]) {
+					return true
+				}
+				if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+					break
+				}
+			}
+			return false
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+func cmdNamespace(c *conn, p *parser) *response {
+	c.untagged(`NAMESPACE (("" "/")) NIL NIL`)
+	return ok("NAMESPACE completed")
+}
+
+func cmdStatus(c *conn, p *parser) *response {
+	var name string
+	var items []string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		items, err = p.list()
+	}
+	if err != nil {
+		return bad("Expected STATUS mailbox (items)")
+	}
+	name = normalizeMailbox(name)
+
+	dir, err := maildir.FolderPath(c.userDir, name)
+	if err != nil {
+		return no("[NONEXISTENT] No such mailbox")
+	}
+	mb, err := maildir.Open(dir, false)
+	if err != nil {
+		return no("[NONEXISTENT] No such mailbox")
+	}
+
+	out := []string{}
+	for _, item := range items {
+		item = strings.ToUpper(item)
+		var n int
+		switch item {
+		case "MESSAGES":
+			n = len(mb.Messages)
+		case "RECENT":
+			for _, msg := range mb.Messages {
+				if inNew(msg) {
+					n++
+				}
+			}
+		case "UIDNEXT":
+			n = int(mb.UIDNext)
+		case "UIDVALIDITY":
+			n = int(mb.UIDValidity)
+		case "HIGHESTMODSEQ":
+			n = int(mb.HighestModSeq)
+			c.condstore = true
+		case "UNSEEN":
+			for _, msg := range mb.Messages {
+				if !msg.HasFlag(`\Seen`) {
+					n++
+				}
+			}
+		default:
+			return bad("Unknown STATUS item " + item)
+		}
+		out = append(out, fmt.Sprintf("%s %d", item, n))
+	}
+
+	c.untagged("STATUS %s (%s)", quote(name), strings.Join(out, " "))
+	return ok("STATUS completed")
+}
+
+// messages still in new haven't been seen by any IMAP session
+func inNew(msg *maildir.Message) bool {
+	return strings.Contains(msg.Path, string(os.PathSeparator)+"new"+string(os.PathSeparator))
+}
+
+func cmdClose(c *conn, p *parser) *response {
+	if !c.mbox.readOnly {
+		if err := c.mbox.expunge(c, nil, true); err != nil {
+			slog.Error("Expunge on CLOSE failed", "user", c.user, "err", err.Error())
+		}
+	}
+	c.mbox = nil
+	c.state = authenticated
+	return ok("CLOSE completed")
+}
+
+func cmdUnselect(c *conn, p *parser) *response {
+	c.mbox = nil
+	c.state = authenticated
+	return ok("UNSELECT completed")
+}
+
+func cmdExpunge(c *conn, p *parser) *response {
+	return expunge(c, nil)
+}
+
+func expunge(c *conn, uids seqSet) *response {
+	if c.mbox.readOnly {
+		return no("[READ-ONLY] Mailbox is read-only")
+	}
+	if err := c.mbox.expunge(c, uids, false); err != nil {
+		slog.Error("Expunge failed", "user", c.user, "err", err.Error())
+		return no("[SERVERBUG] Expunge failed")
+	}
+	return ok("EXPUNGE completed")
+}
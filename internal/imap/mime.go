@@ -0,0 +1,351 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const maxMimeDepth = 20
+
+// part is a node in a message's MIME tree. Everything points into the raw
+// message so sections can be served without re-encoding anything.
+type part struct {
+	// header including the blank line that ends it
+	header []byte
+	body   []byte
+	fields textproto.MIMEHeader
+
+	mediaType string
+	subType   string
+	params    map[string]string
+
+	// for multipart/*
+	children []*part
+	// for message/rfc822, the encapsulated message
+	msg *part
+}
+
+// parseMessage builds the MIME tree for a raw message
+func parseMessage(raw []byte) *part {
+	return parsePart(raw, "text/plain", 0)
+}
+
+func parsePart(raw []byte, defaultType string, depth int) *part {
+	header, body := splitHeader(raw)
+	p := &part{header: header, body: body}
+
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+	p.fields, _ = tr.ReadMIMEHeader()
+	if p.fields == nil {
+		p.fields = textproto.MIMEHeader{}
+	}
+
+	mt, params, err := mime.ParseMediaType(p.fields.Get("Content-Type"))
+	if err != nil || !strings.Contains(mt, "/") {
+		mt, params, _ = mime.ParseMediaType(defaultType)
+	}
+	p.mediaType, p.subType, _ = strings.Cut(mt, "/")
+	p.params = params
+	if p.mediaType == "text" && p.params["charset"] == "" {
+		p.params["charset"] = "us-ascii"
+	}
+
+	if depth >= maxMimeDepth {
+		return p
+	}
+
+	switch {
+	case p.mediaType == "multipart" && p.params["boundary"] != "":
+		childType := "text/plain"
+		if p.subType == "digest" {
+			childType = "message/rfc822"
+		}
+		for _, c := range splitMultipart(body, p.params["boundary"]) {
+			p.children = append(p.children, parsePart(c, childType, depth+1))
+		}
+	case p.mediaType == "message" && p.subType == "rfc822":
+		p.msg = parsePart(body, "text/plain", depth+1)
+	}
+	return p
+}
+
+// splitHeader finds the blank line between header and body. Both CRLF and
+// bare LF line endings are accepted.
+func splitHeader(raw []byte) ([]byte, []byte) {
+	pos := 0
+	for pos < len(raw) {
+		end := bytes.IndexByte(raw[pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := raw[pos : pos+end+1]
+		pos += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:pos], raw[pos:]
+		}
+	}
+	return raw, nil
+}
+
+// splitMultipart returns the raw parts between boundary delimiters. The line
+// break before each delimiter belongs to the delimiter, not the part.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	parts := [][]byte{}
+	start := -1
+	pos := 0
+	for pos < len(body) {
+		end := bytes.IndexByte(body[pos:], '\n')
+		next := len(body)
+		if end >= 0 {
+			next = pos + end + 1
+		}
+		line := bytes.TrimRight(body[pos:next], " \t\r\n")
+
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+				if start >= 0 {
+					partEnd := pos
+					if partEnd > start && body[partEnd-1] == '\n' {
+						partEnd--
+						if partEnd > start && body[partEnd-1] == '\r' {
+							partEnd--
+						}
+					}
+					parts = append(parts, body[start:partEnd])
+				}
+				if len(rest) > 0 {
+					return parts
+				}
+				start = next
+			}
+		}
+		pos = next
+	}
+	// no closing delimiter, take what we've got
+	if start >= 0 && start <= len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// find locates the part with the given section number, e.g. 1.2.3
+func (p *part) find(path []int) (*part, bool) {
+	cur := p
+	for i, n := range path {
+		// numbering inside an encapsulated message refers to its body parts
+		if i > 0 && cur.msg != nil {
+			cur = cur.msg
+		}
+		if len(cur.children) > 0 {
+			if n < 1 || n > len(cur.children) {
+				return nil, false
+			}
+			cur = cur.children[n-1]
+		} else if n != 1 {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// headerFields returns the header lines whose names are (or with not, aren't)
+// in names, followed by the blank line
+func headerFields(header []byte, names []string, not bool) []byte {
+	out := []byte{}
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if keep {
+				out = append(out, line...)
+			}
+			continue
+		}
+
+		name, _, _ := bytes.Cut(trimmed, []byte(":"))
+		match := slices.ContainsFunc(names, func(n string) bool {
+			return strings.EqualFold(n, strings.TrimSpace(string(name)))
+		})
+		keep = match != not
+		if keep {
+			out = append(out, line...)
+		}
+	}
+	return append(out, "\r\n"...)
+}
+
+// envelope builds the ENVELOPE structure for a message part
+func (p *part) envelope() string {
+	h := p.fields
+	from := addressList(h.Get("From"))
+	sender := addressList(h.Get("Sender"))
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(h.Get("Reply-To"))
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nstring(h.Get("Date")),
+		nstring(h.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(h.Get("To")),
+		addressList(h.Get("Cc")),
+		addressList(h.Get("Bcc")),
+		nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-Id")),
+	)
+}
+
+func addressList(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, a := range addrs {
+		local, domain, _ := strings.Cut(a.Address, "@")
+		name := a.Name
+		if name != "" && !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(name), nstring(local), nstring(domain))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// bodyStructure formats the BODY or, with ext set, BODYSTRUCTURE of a part
+func (p *part) bodyStructure(ext bool) string {
+	var b strings.Builder
+	b.WriteByte('(')
+
+	if len(p.children) > 0 {
+		for _, c := range p.children {
+			b.WriteString(c.bodyStructure(ext))
+		}
+		b.WriteString(" " + quote(p.subType))
+		if ext {
+			fmt.Fprintf(&b, " %s %s %s %s", paramList(p.params), p.disposition(), p.language(), nstring(p.fields.Get("Content-Location")))
+		}
+		b.WriteByte(')')
+		return b.String()
+	}
+
+	encoding := p.fields.Get("Content-Transfer-Encoding")
+	if encoding == "" {
+		encoding = "7bit"
+	}
+	fmt.Fprintf(&b, "%s %s %s %s %s %s %d",
+		quote(p.mediaType),
+		quote(p.subType),
+		paramList(p.params),
+		nstring(p.fields.Get("Content-Id")),
+		nstring(p.fields.Get("Content-Description")),
+		quote(strings.ToLower(strings.TrimSpace(encoding))),
+		len(p.body),
+	)
+
+	switch {
+	case p.msg != nil:
+		fmt.Fprintf(&b, " %s %s %d", p.msg.envelope(), p.msg.bodyStructure(ext), countLines(p.body))
+	case p.mediaType == "text":
+		fmt.Fprintf(&b, " %d", countLines(p.body))
+	}
+
+	if ext {
+		fmt.Fprintf(&b, " %s %s %s %s", nstring(p.fields.Get("Content-Md5")), p.disposition(), p.language(), nstring(p.fields.Get("Content-Location")))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (p *part) disposition() string {
+	v := p.fields.Get("Content-Disposition")
+	if v == "" {
+		return "NIL"
+	}
+	disp, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)", quote(disp), paramList(params))
+}
+
+func (p *part) language() string {
+	v := p.fields.Get("Content-Language")
+	if v == "" {
+		return "NIL"
+	}
+	langs := []string{}
+	for _, l := range strings.Split(v, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			langs = append(langs, quote(l))
+		}
+	}
+	if len(langs) == 0 {
+		return "NIL"
+	}
+	return "(" + strings.Join(langs, " ") + ")"
+}
+
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	items := []string{}
+	for _, k := range keys {
+		items = append(items, quote(k), quote(params[k]))
+	}
+	return "(" + strings.Join(items, " ") + ")"
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// parseSectionPath splits "1.2.HEADER" into [1 2] and "HEADER"
+func parseSectionPath(s string) ([]int, string) {
+	path := []int{}
+	for s != "" {
+		numStr, rest, _ := strings.Cut(s, ".")
+		n, err := strconv.Atoi(numStr)
+		if err != nil {
+			break
+		}
+		path = append(path, n)
+		s = rest
+	}
+	return path, strings.ToUpper(s)
+}
@@ -0,0 +1,265 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLineLen = 64 * 1024
+	// a whole command with all its literals, APPEND's message is the big one
+	maxCommandLen = 64 * 1024 * 1024
+	// nothing before logging in needs more than a username and password
+	maxPreAuthCommandLen = 8 * 1024
+)
+
+var (
+	errSyntax         = errors.New("syntax error")
+	errLineTooLong    = errors.New("line too long")
+	errCommandTooLong = errors.New("command too long")
+)
+
+// readCommand reads a full command from the client, including any literals
+// embedded in it, up to limit bytes altogether. cont is called before each
+// synchronising literal so the client knows to go ahead and send it.
+func readCommand(r *bufio.Reader, limit int64, cont func() error) ([]byte, error) {
+	cmd := []byte{}
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, line...)
+		if int64(len(cmd)) > limit {
+			return nil, errCommandTooLong
+		}
+
+		n, plus, ok := literalSuffix(line)
+		if !ok {
+			return cmd, nil
+		}
+		// checked before reading any of it, and before asking for it
+		if n > limit-int64(len(cmd)) {
+			return nil, fmt.Errorf("literal of %d bytes: %w", n, errCommandTooLong)
+		}
+		if !plus {
+			if err = cont(); err != nil {
+				return nil, err
+			}
+		}
+
+		cmd = append(cmd, "\r\n"...)
+		lit := make([]byte, n)
+		if _, err = io.ReadFull(r, lit); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, lit...)
+	}
+}
+
+// readLine reads up to CRLF, the CRLF isn't included
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if len(line) > maxLineLen {
+			return nil, errLineTooLong
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// literalSuffix checks whether a line ends with {n} or {n+}
+func literalSuffix(line []byte) (int64, bool, bool) {
+	if !bytes.HasSuffix(line, []byte("}")) {
+		return 0, false, false
+	}
+	open := bytes.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false, false
+	}
+	inner := string(line[open+1 : len(line)-1])
+	plus := strings.HasSuffix(inner, "+")
+	n, err := strconv.ParseInt(strings.TrimSuffix(inner, "+"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, plus, true
+}
+
+// parser walks through the arguments of a command
+type parser struct {
+	buf []byte
+	pos int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.buf)
+}
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.buf[p.pos]
+}
+
+// sp consumes a single space
+func (p *parser) sp() error {
+	if p.peek() != ' ' {
+		return errSyntax
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) expect(c byte) error {
+	if p.peek() != c {
+		return errSyntax
+	}
+	p.pos++
+	return nil
+}
+
+// atom reads up to the next space or parenthesis. Anything in square
+// brackets is kept whole, spaces and all, so fetch items like
+// BODY[HEADER.FIELDS (From To)]<0.100> come back as one atom.
+func (p *parser) atom() (string, error) {
+	start := p.pos
+	depth := 0
+	for !p.done() {
+		c := p.buf[p.pos]
+		if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n') {
+			break
+		}
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errSyntax
+	}
+	return string(p.buf[start:p.pos]), nil
+}
+
+// str reads a quoted string or a literal
+func (p *parser) str() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.quoted()
+	case '{':
+		return p.literal()
+	default:
+		return "", errSyntax
+	}
+}
+
+// astring reads an atom, quoted string or literal
+func (p *parser) astring() (string, error) {
+	if c := p.peek(); c == '"' || c == '{' {
+		return p.str()
+	}
+	return p.atom()
+}
+
+func (p *parser) quoted() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for !p.done() {
+		c := p.buf[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errSyntax
+			}
+			b.WriteByte(p.buf[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSyntax
+}
+
+func (p *parser) literal() (string, error) {
+	if err := p.expect('{'); err != nil {
+		return "", err
+	}
+	end := bytes.IndexByte(p.buf[p.pos:], '}')
+	if end < 0 {
+		return "", errSyntax
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(string(p.buf[p.pos:p.pos+end]), "+"))
+	if err != nil {
+		return "", errSyntax
+	}
+	p.pos += end + 1
+	if !bytes.HasPrefix(p.buf[p.pos:], []byte("\r\n")) {
+		return "", errSyntax
+	}
+	p.pos += 2
+	if p.pos+n > len(p.buf) {
+		return "", errSyntax
+	}
+	s := string(p.buf[p.pos : p.pos+n])
+	p.pos += n
+	return s, nil
+}
+
+// list reads a parenthesised list of astrings, e.g. flags or header names
+func (p *parser) list() ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	items := []string{}
+	for {
+		if p.peek() == ')' {
+			p.pos++
+			return items, nil
+		}
+		if len(items) > 0 {
+			if err := p.sp(); err != nil {
+				return nil, err
+			}
+		}
+		item, err := p.astring()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+// listOrAtom reads either a parenthesised list or a single atom, which is how
+// flags and fetch items can be given
+func (p *parser) listOrAtom() ([]string, error) {
+	if p.peek() == '(' {
+		return p.list()
+	}
+	a, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	return []string{a}, nil
+}
@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/quota"
+)
+
+// RFC 9208 QUOTA. Every mailbox is under the user's own root "", and under
+// the domain's if it has limits. Limits are set with jumsctl, so there's no
+// SETQUOTA.
+
+func cmdGetQuota(c *conn, p *parser) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected GETQUOTA root")
+	}
+
+	r, err := quota.Get(c.user, name)
+	if errors.Is(err, quota.ErrNoSuchRoot) {
+		return no("[NONEXISTENT] No such quota root")
+	}
+	if err != nil {
+		slog.Error("Couldn't get quota", "user", c.user, "err", err.Error())
+		return no("[SERVERBUG] Couldn't get quota")
+	}
+	c.untagged("QUOTA %s", formatQuota(r))
+	return ok("GETQUOTA completed")
+}
+
+func cmdGetQuotaRoot(c *conn, p *parser) *response {
+	var name string
+	err := p.sp()
+	if err == nil {
+		name, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected GETQUOTAROOT mailbox")
+	}
+	name = normalizeMailbox(name)
+	dir, err := maildir.FolderPath(c.userDir, name)
+	if err != nil || !maildir.Exists(dir) {
+		return no("[NONEXISTENT] No such mailbox")
+	}
+
+	roots, err := quota.Roots(c.user)
+	if err != nil {
+		slog.Error("Couldn't get quota", "user", c.user, "err", err.Error())
+		return no("[SERVERBUG] Couldn't get quota")
+	}
+	names := []string{quote(name)}
+	for _, r := range roots {
+		names = append(names, quote(r.Name))
+	}
+	c.untagged("QUOTAROOT %s", strings.Join(names, " "))
+	for _, r := range roots {
+		c.untagged("QUOTA %s", formatQuota(r))
+	}
+	return ok("GETQUOTAROOT completed")
+}
+
+func cmdSetQuota(c *conn, p *parser) *response {
+	return no("[NOPERM] Quotas are set by the administrator")
+}
+
+// formatQuota lists the resources a root limits, storage in units of 1024
+// octets
+func formatQuota(r quota.Root) string {
+	res := []string{}
+	if r.Limit.Storage > 0 {
+		res = append(res, fmt.Sprintf("STORAGE %d %d", (r.Usage.Bytes+1023)/1024, r.Limit.Storage/1024))
+	}
+	if r.Limit.Messages > 0 {
+		res = append(res, fmt.Sprintf("MESSAGE %d %d", r.Usage.Messages, r.Limit.Messages))
+	}
+	return fmt.Sprintf("%s (%s)", quote(r.Name), strings.Join(res, " "))
+}
+
+// overQuota reports whether size more bytes won't fit
+func (c *conn) overQuota(size int64) bool {
+	return errors.Is(quota.Check(c.user, size), quota.ErrOverQuota)
+}
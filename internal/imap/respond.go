@@ -0,0 +1,48 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const dateTimeLayout = "02-Jan-2006 15:04:05 -0700"
+
+// quote formats s as a quoted string, falling back to a literal for anything
+// that can't go in quotes
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") || !isASCII(s) {
+		return literal([]byte(s))
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring is quote but with NIL for empty strings
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+func literal(b []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(b), b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func formatDateTime(t time.Time) string {
+	return quote(t.Format(dateTimeLayout))
+}
+
+func formatFlags(flags []string) string {
+	return "(" + strings.Join(flags, " ") + ")"
+}
@@ -0,0 +1,491 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+// searchMsg is a message being tested against search keys. The message file
+// is only read if a key needs more than the index has.
+type searchMsg struct {
+	m     *mailbox
+	seq   int
+	msg   *maildir.Message
+	entry *maildir.IndexEntry
+
+	root *part
+	text string
+}
+
+func (s *searchMsg) load() *part {
+	if s.root == nil {
+		raw, err := os.ReadFile(s.msg.Path)
+		if err != nil {
+			raw = []byte{}
+		}
+		s.root = parseMessage(raw)
+	}
+	return s.root
+}
+
+// bodyText is the decoded text of every text part, lowercased
+func (s *searchMsg) bodyText() string {
+	if s.text == "" {
+		var b strings.Builder
+		collectText(s.load(), &b)
+		s.text = strings.ToLower(b.String())
+	}
+	return s.text
+}
+
+func collectText(p *part, b *strings.Builder) {
+	switch {
+	case len(p.children) > 0:
+		for _, c := range p.children {
+			collectText(c, b)
+		}
+	case p.msg != nil:
+		b.Write(p.msg.header)
+		collectText(p.msg, b)
+	case p.mediaType == "text":
+		b.Write(decodeTransfer(p))
+		b.WriteByte('\n')
+	}
+}
+
+func decodeTransfer(p *part) []byte {
+	switch strings.ToLower(strings.TrimSpace(p.fields.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		if b, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.body))); err == nil {
+			return b
+		}
+	case "base64":
+		if b, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(p.body))); err == nil {
+			return b
+		}
+	}
+	return p.body
+}
+
+type matcher func(s *searchMsg) bool
+
+func matchAll(ms []matcher) matcher {
+	return func(s *searchMsg) bool {
+		for _, m := range ms {
+			if !m(s) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func containsFold(hay, needle string) bool {
+	return strings.Contains(strings.ToLower(hay), strings.ToLower(needle))
+}
+
+// parseSearch reads the search program that ends a SEARCH, SORT or THREAD
+// command, including any CHARSET. usesModSeq is set if there was a MODSEQ
+// key, which changes what the response looks like.
+func parseSearch(p *parser, m *mailbox, allowCharset bool) (match matcher, usesModSeq bool, resp *response) {
+	if err := p.sp(); err != nil {
+		return nil, false, bad("Missing search keys")
+	}
+
+	ms := []matcher{}
+	first := true
+	for !p.done() {
+		if !first {
+			if err := p.sp(); err != nil {
+				return nil, false, bad("Invalid search keys")
+			}
+		}
+		first = false
+
+		save := p.pos
+		if allowCharset {
+			if a, err := p.atom(); err == nil && strings.EqualFold(a, "CHARSET") {
+				var cs string
+				err := p.sp()
+				if err == nil {
+					cs, err = p.astring()
+				}
+				if err != nil {
+					return nil, false, bad("Expected charset")
+				}
+				if !knownCharset(cs) {
+					return nil, false, no("[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+				}
+				allowCharset = false
+				continue
+			}
+			p.pos = save
+			allowCharset = false
+		}
+
+		km, err := parseSearchKey(p, m, &usesModSeq)
+		if err != nil {
+			return nil, false, bad("Invalid search key: " + err.Error())
+		}
+		ms = append(ms, km)
+	}
+	if len(ms) == 0 {
+		return nil, false, bad("Missing search keys")
+	}
+	return matchAll(ms), usesModSeq, nil
+}
+
+func knownCharset(cs string) bool {
+	cs = strings.ToUpper(cs)
+	return cs == "US-ASCII" || cs == "UTF-8"
+}
+
+type searchError string
+
+func (e searchError) Error() string {
+	return string(e)
+}
+
+func parseSearchKey(p *parser, m *mailbox, usesModSeq *bool) (matcher, error) {
+	if p.peek() == '(' {
+		p.pos++
+		ms := []matcher{}
+		for {
+			km, err := parseSearchKey(p, m, usesModSeq)
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, km)
+			if p.peek() == ')' {
+				p.pos++
+				return matchAll(ms), nil
+			}
+			if err := p.sp(); err != nil {
+				return nil, searchError("unterminated list")
+			}
+		}
+	}
+
+	key, err := p.atom()
+	if err != nil {
+		return nil, searchError("expected key")
+	}
+	key = strings.ToUpper(key)
+
+	// arguments
+	str := func() (string, error) {
+		if err := p.sp(); err != nil {
+			return "", searchError(key + " needs an argument")
+		}
+		return p.astring()
+	}
+	num := func() (int64, error) {
+		s, err := str()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return 0, searchError("bad number " + s)
+		}
+		return n, nil
+	}
+	date := func() (time.Time, error) {
+		s, err := str()
+		if err != nil {
+			return time.Time{}, err
+		}
+		d, err := time.Parse("_2-Jan-2006", s)
+		if err != nil {
+			return time.Time{}, searchError("bad date " + s)
+		}
+		return d, nil
+	}
+	flag := func(f string, set bool) matcher {
+		return func(s *searchMsg) bool { return s.msg.HasFlag(f) == set }
+	}
+	field := func(get func(e *maildir.IndexEntry) string) (matcher, error) {
+		v, err := str()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return containsFold(get(s.entry), v) }, nil
+	}
+
+	switch key {
+	case "ALL":
+		return func(*searchMsg) bool { return true }, nil
+	case "ANSWERED":
+		return flag(`\Answered`, true), nil
+	case "DELETED":
+		return flag(`\Deleted`, true), nil
+	case "DRAFT":
+		return flag(`\Draft`, true), nil
+	case "FLAGGED":
+		return flag(`\Flagged`, true), nil
+	case "SEEN":
+		return flag(`\Seen`, true), nil
+	case "UNANSWERED":
+		return flag(`\Answered`, false), nil
+	case "UNDELETED":
+		return flag(`\Deleted`, false), nil
+	case "UNDRAFT":
+		return flag(`\Draft`, false), nil
+	case "UNFLAGGED":
+		return flag(`\Flagged`, false), nil
+	case "UNSEEN":
+		return flag(`\Seen`, false), nil
+	case "KEYWORD", "UNKEYWORD":
+		kw, err := str()
+		if err != nil {
+			return nil, err
+		}
+		return flag(kw, key == "KEYWORD"), nil
+	case "RECENT":
+		return func(s *searchMsg) bool { return s.m.recent[s.msg.UID] }, nil
+	case "OLD":
+		return func(s *searchMsg) bool { return !s.m.recent[s.msg.UID] }, nil
+	case "NEW":
+		return func(s *searchMsg) bool { return s.m.recent[s.msg.UID] && !s.msg.HasFlag(`\Seen`) }, nil
+
+	case "FROM":
+		return field(func(e *maildir.IndexEntry) string { return e.From })
+	case "TO":
+		return field(func(e *maildir.IndexEntry) string { return e.To })
+	case "CC":
+		return field(func(e *maildir.IndexEntry) string { return e.Cc })
+	case "BCC":
+		return field(func(e *maildir.IndexEntry) string { return e.Bcc })
+	case "SUBJECT":
+		return field(func(e *maildir.IndexEntry) string { return e.Subject })
+	case "HEADER":
+		name, err := str()
+		if err != nil {
+			return nil, err
+		}
+		v, err := str()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool {
+			vals, ok := s.load().fields[textproto.CanonicalMIMEHeaderKey(name)]
+			if !ok {
+				return false
+			}
+			return v == "" || containsFold(strings.Join(vals, "\n"), v)
+		}, nil
+	case "BODY":
+		v, err := str()
+		if err != nil {
+			return nil, err
+		}
+		v = strings.ToLower(v)
+		return func(s *searchMsg) bool { return strings.Contains(s.bodyText(), v) }, nil
+	case "TEXT":
+		v, err := str()
+		if err != nil {
+			return nil, err
+		}
+		v = strings.ToLower(v)
+		return func(s *searchMsg) bool {
+			return containsFold(string(s.load().header), v) || strings.Contains(s.bodyText(), v)
+		}, nil
+
+	case "BEFORE", "ON", "SINCE":
+		d, err := date()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return compareDay(s.msg.Date.Local(), d, key) }, nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		d, err := date()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool {
+			sent := s.entry.Date
+			if sent.IsZero() {
+				sent = s.msg.Date.Local()
+			}
+			return compareDay(sent, d, strings.TrimPrefix(key, "SENT"))
+		}, nil
+
+	case "LARGER":
+		n, err := num()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return s.msg.Size > n }, nil
+	case "SMALLER":
+		n, err := num()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return s.msg.Size < n }, nil
+
+	case "NOT":
+		if err := p.sp(); err != nil {
+			return nil, searchError("NOT needs a key")
+		}
+		km, err := parseSearchKey(p, m, usesModSeq)
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return !km(s) }, nil
+	case "OR":
+		if err := p.sp(); err != nil {
+			return nil, searchError("OR needs two keys")
+		}
+		a, err := parseSearchKey(p, m, usesModSeq)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.sp(); err != nil {
+			return nil, searchError("OR needs two keys")
+		}
+		b, err := parseSearchKey(p, m, usesModSeq)
+		if err != nil {
+			return nil, err
+		}
+		return func(s *searchMsg) bool { return a(s) || b(s) }, nil
+
+	case "MODSEQ":
+		// the entry name and type are optional, and we only keep one
+		// modseq per message anyway
+		v, err := str()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(v, "/flags/") {
+			if _, err = str(); err != nil {
+				return nil, err
+			}
+			if v, err = str(); err != nil {
+				return nil, err
+			}
+		}
+		n, err := parseModSeq(v)
+		if err != nil {
+			return nil, searchError("bad modseq " + v)
+		}
+		*usesModSeq = true
+		return func(s *searchMsg) bool { return s.msg.ModSeq >= n }, nil
+
+	case "UID":
+		setStr, err := str()
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(setStr)
+		if err != nil {
+			return nil, searchError("bad UID set")
+		}
+		maxUID := m.maxUID()
+		return func(s *searchMsg) bool { return set.contains(s.msg.UID, maxUID) }, nil
+	default:
+		set, err := parseSeqSet(key)
+		if err != nil {
+			return nil, searchError("unknown key " + key)
+		}
+		n := uint32(len(m.msgs))
+		return func(s *searchMsg) bool { return set.contains(uint32(s.seq), n) }, nil
+	}
+}
+
+// compareDay compares just the date part of t with day, ignoring the time
+func compareDay(t, day time.Time, op string) bool {
+	td := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch op {
+	case "BEFORE":
+		return td.Before(day)
+	case "ON":
+		return td.Equal(day)
+	default:
+		return !td.Before(day)
+	}
+}
+
+func (m *mailbox) maxUID() uint32 {
+	if len(m.msgs) == 0 {
+		return 0
+	}
+	return m.msgs[len(m.msgs)-1].UID
+}
+
+// search runs a search program over the selected mailbox, returning the
+// matching messages in sequence order
+func (m *mailbox) search(match matcher) []*searchMsg {
+	index, err := maildir.Index(m.dir, m.msgs)
+	if err != nil {
+		slog.Error("Couldn't load mailbox index", "dir", m.dir, "err", err.Error())
+		index = map[string]*maildir.IndexEntry{}
+	}
+
+	found := []*searchMsg{}
+	for i, msg := range m.msgs {
+		e, ok := index[msg.Key]
+		if !ok {
+			e = &maildir.IndexEntry{Key: msg.Key}
+		}
+		s := &searchMsg{m: m, seq: i + 1, msg: msg, entry: e}
+		if match(s) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func cmdSearch(c *conn, p *parser) *response {
+	return search(c, p, false)
+}
+
+func search(c *conn, p *parser, uid bool) *response {
+	match, usesModSeq, resp := parseSearch(p, c.mbox, true)
+	if resp != nil {
+		return resp
+	}
+	if usesModSeq {
+		c.condstore = true
+	}
+
+	found := c.mbox.search(match)
+	out := []string{}
+	for _, s := range found {
+		out = append(out, resultNum(s, uid))
+	}
+	c.untagged("%s", strings.TrimSpace("SEARCH "+strings.Join(out, " ")+highestModSeqOf(found, usesModSeq)))
+
+	c.mbox.update(c, uid)
+	return ok("SEARCH completed")
+}
+
+// highestModSeqOf is the (MODSEQ n) that ends a SEARCH or SORT response when
+// the search used MODSEQ
+func highestModSeqOf(found []*searchMsg, usesModSeq bool) string {
+	if !usesModSeq || len(found) == 0 {
+		return ""
+	}
+	var highest uint64
+	for _, s := range found {
+		highest = max(highest, s.msg.ModSeq)
+	}
+	return fmt.Sprintf(" (MODSEQ %d)", highest)
+}
+
+func resultNum(s *searchMsg, uid bool) string {
+	if uid {
+		return strconv.FormatUint(uint64(s.msg.UID), 10)
+	}
+	return strconv.Itoa(s.seq)
+}
@@ -0,0 +1,86 @@
+package imap
+
+import (
+	"strconv"
+	"strings"
+)
+
+// seqRange is an inclusive range from a sequence set, 0 stands for "*"
+type seqRange struct {
+	start uint32
+	stop  uint32
+}
+
+type seqSet []seqRange
+
+// parseSeqSet parses sets like "1:4,7,9:*"
+func parseSeqSet(s string) (seqSet, error) {
+	set := seqSet{}
+	for _, part := range strings.Split(s, ",") {
+		a, b, isRange := strings.Cut(part, ":")
+		start, err := parseSeqNum(a)
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if isRange {
+			if stop, err = parseSeqNum(b); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start, stop})
+	}
+	return set, nil
+}
+
+func parseSeqNum(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, errSyntax
+	}
+	return uint32(n), nil
+}
+
+// contains reports whether n is in the set, with max standing in for "*"
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if n >= start && n <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSeqSet turns a sorted list of numbers back into a compact set
+func formatSeqSet(nums []uint32) string {
+	var b strings.Builder
+	for i := 0; i < len(nums); {
+		j := i
+		for j+1 < len(nums) && nums[j+1] == nums[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(uint64(nums[i]), 10))
+		if j > i {
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatUint(uint64(nums[j]), 10))
+		}
+		i = j + 1
+	}
+	return b.String()
+}
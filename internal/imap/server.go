@@ -0,0 +1,426 @@
+// Package imap serves the maildirs under BoxesDir over IMAP4rev1
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+// RFC 3501 says at least 30 minutes
+const autologoutTimeout = 30 * time.Minute
+
+type connState int
+
+const (
+	notAuthenticated connState = iota
+	authenticated
+	selected
+	loggedOut
+)
+
+type response struct {
+	status string
+	text   string
+}
+
+func ok(text string) *response {
+	return &response{"OK", text}
+}
+
+func no(text string) *response {
+	return &response{"NO", text}
+}
+
+func bad(text string) *response {
+	return &response{"BAD", text}
+}
+
+type handler struct {
+	fn func(c *conn, p *parser) *response
+	// states the command is valid in
+	states []connState
+}
+
+var anyState = []connState{notAuthenticated, authenticated, selected}
+var authedStates = []connState{authenticated, selected}
+var selectedStates = []connState{selected}
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"CAPABILITY":   {cmdCapability, anyState},
+		"NOOP":         {cmdNoop, anyState},
+		"LOGOUT":       {cmdLogout, anyState},
+		"ID":           {cmdID, anyState},
+		"ENABLE":       {cmdEnable, authedStates},
+		"IDLE":         {cmdIdle, authedStates},
+		"STARTTLS":     {cmdStartTLS, []connState{notAuthenticated}},
+		"LOGIN":        {cmdLogin, []connState{notAuthenticated}},
+		"AUTHENTICATE": {cmdAuthenticate, []connState{notAuthenticated}},
+		"SELECT":       {cmdSelect, authedStates},
+		"EXAMINE":      {cmdExamine, authedStates},
+		"CREATE":       {cmdCreate, authedStates},
+		"DELETE":       {cmdDelete, authedStates},
+		"RENAME":       {cmdRename, authedStates},
+		"SUBSCRIBE":    {cmdSubscribe, authedStates},
+		"UNSUBSCRIBE":  {cmdUnsubscribe, authedStates},
+		"LIST":         {cmdList, authedStates},
+		"LSUB":         {cmdLsub, authedStates},
+		"NAMESPACE":    {cmdNamespace, authedStates},
+		"STATUS":       {cmdStatus, authedStates},
+		"APPEND":       {cmdAppend, authedStates},
+		"CHECK":        {cmdNoop, selectedStates},
+		"CLOSE":        {cmdClose, selectedStates},
+		"UNSELECT":     {cmdUnselect, selectedStates},
+		"EXPUNGE":      {cmdExpunge, selectedStates},
+		"FETCH":        {cmdFetch, selectedStates},
+		"STORE":        {cmdStore, selectedStates},
+		"COPY":         {cmdCopy, selectedStates},
+		"MOVE":         {cmdMove, selectedStates},
+		"SEARCH":       {cmdSearch, selectedStates},
+		"SORT":         {cmdSort, selectedStates},
+		"THREAD":       {cmdThread, selectedStates},
+		"UID":          {cmdUID, selectedStates},
+		"GETQUOTA":     {cmdGetQuota, authedStates},
+		"GETQUOTAROOT": {cmdGetQuotaRoot, authedStates},
+		"SETQUOTA":     {cmdSetQuota, authedStates},
+	}
+}
+
+type conn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	state connState
+	tag   string
+
+	user    string
+	userDir string
+	mbox    *mailbox
+
+	// extensions the client has turned on
+	condstore bool
+	qresync   bool
+}
+
+// Handle serves an IMAP client until it logs out or the connection drops
+func Handle(c net.Conn) {
+	defer c.Close()
+	slog.Debug("handling IMAP connection...", "addr", c.RemoteAddr().String())
+
+	ic := &conn{
+		c:     c,
+		r:     bufio.NewReader(c),
+		w:     bufio.NewWriter(c),
+		state: notAuthenticated,
+	}
+	if !track(ic) {
+		ic.shutdownBye()
+		return
+	}
+	defer untrack(ic)
+	ic.untagged("OK [CAPABILITY %s] Josh's Unremarkable Mail Server IMAP ready", ic.capabilities())
+	ic.flush()
+
+	for ic.state != loggedOut {
+		if err := ic.handleNext(); err != nil {
+			if shuttingDown() {
+				ic.shutdownBye()
+				return
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("IMAP connection error", "addr", c.RemoteAddr().String(), "err", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// shutdownBye tells the client we're going away, RFC 3501 7.1.5
+func (c *conn) shutdownBye() {
+	c.untagged("BYE Server shutting down")
+	c.flush()
+}
+
+func (c *conn) handleNext() error {
+	if err := c.setReadDeadline(autologoutTimeout); err != nil {
+		return err
+	}
+	limit := int64(maxCommandLen)
+	if c.state == notAuthenticated {
+		limit = maxPreAuthCommandLen
+	}
+	line, err := readCommand(c.r, limit, func() error {
+		c.continuation("Ready for literal data")
+		return c.flush()
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLineTooLong):
+			c.untagged("BAD Line too long")
+			c.flush()
+		case errors.Is(err, errCommandTooLong):
+			c.untagged("BAD Command too long")
+			c.flush()
+		}
+		return err
+	}
+	slog.Debug("IMAP line received", "addr", c.c.RemoteAddr().String(), "line", safeLine(line))
+
+	p := &parser{buf: line}
+	tag, err := p.atom()
+	if err != nil || tag == "*" || tag == "+" {
+		c.untagged("BAD Missing tag")
+		return c.flush()
+	}
+	c.tag = tag
+
+	var name string
+	if err = p.sp(); err == nil {
+		name, err = p.atom()
+	}
+	if err != nil {
+		c.tagged(bad("Missing command"))
+		return c.flush()
+	}
+	name = strings.ToUpper(name)
+
+	h, found := handlers[name]
+	if !found {
+		c.tagged(bad("Unknown command"))
+		return c.flush()
+	}
+	if !validIn(h.states, c.state) {
+		c.tagged(bad(fmt.Sprintf("%s not allowed now", name)))
+		return c.flush()
+	}
+
+	resp := h.fn(c, p)
+	if resp != nil {
+		c.tagged(resp)
+	}
+	return c.flush()
+}
+
+func validIn(states []connState, s connState) bool {
+	for _, v := range states {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// passwords shouldn't end up in the debug logs
+func safeLine(line []byte) string {
+	fields := strings.SplitN(string(line), " ", 3)
+	if len(fields) >= 2 && (strings.EqualFold(fields[1], "LOGIN") || strings.EqualFold(fields[1], "AUTHENTICATE")) {
+		return fields[0] + " " + fields[1] + " ***"
+	}
+	if len(line) > 200 {
+		return string(line[:200]) + "..."
+	}
+	return string(line)
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) capabilities() string {
+	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR", "ID", "ENABLE", "UIDPLUS", "MOVE", "UNSELECT", "NAMESPACE", "SPECIAL-USE", "CHILDREN", "IDLE", "SORT", "THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES", "CONDSTORE", "QRESYNC", "QUOTA", "QUOTA=RES-STORAGE", "QUOTA=RES-MESSAGE"}
+	if c.state == notAuthenticated {
+		if c.isTLS() {
+			caps = append(caps, "AUTH=PLAIN")
+		} else {
+			caps = append(caps, "STARTTLS", "LOGINDISABLED")
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+func (c *conn) untagged(format string, args ...any) {
+	fmt.Fprintf(c.w, "* "+format+"\r\n", args...)
+}
+
+func (c *conn) continuation(text string) {
+	fmt.Fprintf(c.w, "+ %s\r\n", text)
+}
+
+func (c *conn) tagged(r *response) {
+	fmt.Fprintf(c.w, "%s %s %s\r\n", c.tag, r.status, r.text)
+}
+
+func (c *conn) flush() error {
+	c.c.SetWriteDeadline(time.Now().Add(autologoutTimeout))
+	return c.w.Flush()
+}
+
+func cmdCapability(c *conn, p *parser) *response {
+	c.untagged("CAPABILITY %s", c.capabilities())
+	return ok("CAPABILITY completed")
+}
+
+func cmdNoop(c *conn, p *parser) *response {
+	if c.state == selected {
+		c.mbox.update(c, true)
+	}
+	return ok("NOOP completed")
+}
+
+func cmdLogout(c *conn, p *parser) *response {
+	c.untagged("BYE Logging out")
+	c.state = loggedOut
+	return ok("LOGOUT completed")
+}
+
+func cmdID(c *conn, p *parser) *response {
+	c.untagged(`ID ("name" "jums")`)
+	return ok("ID completed")
+}
+
+func cmdStartTLS(c *conn, p *parser) *response {
+	if c.isTLS() {
+		return bad("TLS already active")
+	}
+
+	c.tagged(ok("Begin TLS negotiation now"))
+	if err := c.flush(); err != nil {
+		c.state = loggedOut
+		return nil
+	}
+
+	tlsc := tls.Server(c.c, config.ServerTLSConfig())
+	if err := tlsc.Handshake(); err != nil {
+		slog.Debug("IMAP TLS handshake failed", "addr", c.c.RemoteAddr().String(), "err", err.Error())
+		c.state = loggedOut
+		return nil
+	}
+	c.c = tlsc
+	c.r = bufio.NewReader(tlsc)
+	c.w = bufio.NewWriter(tlsc)
+	return nil
+}
+
+func cmdLogin(c *conn, p *parser) *response {
+	if !c.isTLS() {
+		return no("[PRIVACYREQUIRED] Use STARTTLS first")
+	}
+
+	var user, pass string
+	err := p.sp()
+	if err == nil {
+		user, err = p.astring()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		pass, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected LOGIN username password")
+	}
+
+	return c.login(user, pass)
+}
+
+func cmdAuthenticate(c *conn, p *parser) *response {
+	if !c.isTLS() {
+		return no("[PRIVACYREQUIRED] Use STARTTLS first")
+	}
+
+	var mech string
+	err := p.sp()
+	if err == nil {
+		mech, err = p.atom()
+	}
+	if err != nil {
+		return bad("Expected AUTHENTICATE mechanism")
+	}
+	if !strings.EqualFold(mech, "PLAIN") {
+		return no("Unsupported authentication mechanism")
+	}
+
+	var ir string
+	if p.sp() == nil {
+		// SASL-IR initial response
+		ir, _ = p.atom()
+	} else {
+		c.continuation("")
+		if err := c.flush(); err != nil {
+			return nil
+		}
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil
+		}
+		ir = string(line)
+	}
+	if ir == "*" {
+		return bad("Authentication cancelled")
+	}
+
+	user, pass, err := decodePlain(ir)
+	if err != nil {
+		return bad("Invalid SASL response")
+	}
+	return c.login(user, pass)
+}
+
+// decodePlain decodes a SASL PLAIN response: authzid NUL authcid NUL password
+func decodePlain(b64 string) (string, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return "", "", errSyntax
+	}
+	if parts[0] != "" && !strings.EqualFold(parts[0], parts[1]) {
+		// we don't do proxy authorization
+		return "", "", errSyntax
+	}
+	return parts[1], parts[2], nil
+}
+
+func (c *conn) login(user, pass string) *response {
+	name, authed := users.Authenticate(user, pass)
+	if !authed {
+		slog.Info("IMAP login failed", "addr", c.c.RemoteAddr().String(), "user", user)
+		// slow down password guessing
+		time.Sleep(2 * time.Second)
+		return no("[AUTHENTICATIONFAILED] Invalid credentials")
+	}
+
+	conf := config.GetConfig()
+	dir, err := maildir.UserDir(conf.Mailbox(name))
+	if err != nil {
+		return no("[SERVERBUG] Can't open mailbox")
+	}
+	if err = maildir.Create(dir); err != nil {
+		slog.Error("Couldn't create INBOX", "user", name, "err", err.Error())
+		return no("[SERVERBUG] Can't open mailbox")
+	}
+
+	slog.Info("IMAP login", "addr", c.c.RemoteAddr().String(), "user", name)
+	c.user = name
+	c.userDir = dir
+	c.state = authenticated
+	return ok(fmt.Sprintf("[CAPABILITY %s] Logged in", c.capabilities()))
+}
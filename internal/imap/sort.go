@@ -0,0 +1,186 @@
+package imap
+
+import (
+	"cmp"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// baseSubject reduces a subject to what's left once reply and forward
+// markers are removed, RFC 5256 section 2.1
+func baseSubject(subject string) string {
+	s := strings.Join(strings.Fields(subject), " ")
+	for {
+		prev := s
+		// trailing (fwd) markers
+		for {
+			t := strings.TrimSpace(s)
+			if !strings.HasSuffix(strings.ToLower(t), "(fwd)") {
+				s = t
+				break
+			}
+			s = t[:len(t)-len("(fwd)")]
+		}
+
+		// leading re:, fw:, fwd: and [blob]s
+		for {
+			t := stripBlobs(s)
+			loc := subjLeader.FindStringIndex(t)
+			if loc == nil {
+				if t != s && t != "" {
+					// a leading blob is only removed if something's left
+					s = t
+				}
+				break
+			}
+			s = t[loc[1]:]
+		}
+
+		// [fwd: subject]
+		if l := strings.ToLower(s); strings.HasPrefix(l, "[fwd:") && strings.HasSuffix(s, "]") {
+			s = strings.TrimSpace(s[len("[fwd:") : len(s)-1])
+		}
+		if s == prev {
+			return s
+		}
+	}
+}
+
+var subjLeader = regexp.MustCompile(`(?i)^(re|fwd?)\s*(\[[^\[\]]*\]\s*)*:\s*`)
+
+func stripBlobs(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, "[") {
+			return s
+		}
+		end := strings.IndexByte(s, ']')
+		if end < 0 || strings.ContainsRune(s[1:end], '[') {
+			return s
+		}
+		rest := strings.TrimLeft(s[end+1:], " \t")
+		if rest == "" {
+			return s
+		}
+		s = rest
+	}
+}
+
+// addrMailbox is the local part of the first address in a header, which is
+// what SORT compares for FROM, TO and CC
+func addrMailbox(v string) string {
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil || len(addrs) == 0 {
+		return strings.ToLower(strings.TrimSpace(v))
+	}
+	local, _, _ := strings.Cut(addrs[0].Address, "@")
+	return strings.ToLower(local)
+}
+
+// sentDate is the Date header, or the internal date if there isn't one
+func (s *searchMsg) sentDate() time.Time {
+	if !s.entry.Date.IsZero() {
+		return s.entry.Date
+	}
+	return s.msg.Date
+}
+
+func cmdSort(c *conn, p *parser) *response {
+	return sortMessages(c, p, false)
+}
+
+func sortMessages(c *conn, p *parser, uid bool) *response {
+	var criteria []string
+	var charset string
+	err := p.sp()
+	if err == nil {
+		criteria, err = p.list()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		charset, err = p.astring()
+	}
+	if err != nil || len(criteria) == 0 {
+		return bad("Expected SORT (criteria) charset keys")
+	}
+	if !knownCharset(charset) {
+		return no("[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+	}
+
+	type criterion struct {
+		cmp     func(a, b *searchMsg) int
+		reverse bool
+	}
+	cmps := []criterion{}
+	reverse := false
+	for _, name := range criteria {
+		var compare func(a, b *searchMsg) int
+		switch strings.ToUpper(name) {
+		case "REVERSE":
+			reverse = true
+			continue
+		case "ARRIVAL":
+			compare = func(a, b *searchMsg) int { return a.msg.Date.Compare(b.msg.Date) }
+		case "DATE":
+			compare = func(a, b *searchMsg) int { return a.sentDate().Compare(b.sentDate()) }
+		case "SIZE":
+			compare = func(a, b *searchMsg) int { return cmp.Compare(a.msg.Size, b.msg.Size) }
+		case "SUBJECT":
+			compare = func(a, b *searchMsg) int {
+				return strings.Compare(strings.ToLower(baseSubject(a.entry.Subject)), strings.ToLower(baseSubject(b.entry.Subject)))
+			}
+		case "FROM":
+			compare = func(a, b *searchMsg) int {
+				return strings.Compare(addrMailbox(a.entry.From), addrMailbox(b.entry.From))
+			}
+		case "TO":
+			compare = func(a, b *searchMsg) int { return strings.Compare(addrMailbox(a.entry.To), addrMailbox(b.entry.To)) }
+		case "CC":
+			compare = func(a, b *searchMsg) int { return strings.Compare(addrMailbox(a.entry.Cc), addrMailbox(b.entry.Cc)) }
+		default:
+			return bad("Unknown sort criterion " + name)
+		}
+		cmps = append(cmps, criterion{compare, reverse})
+		reverse = false
+	}
+	if reverse || len(cmps) == 0 {
+		return bad("REVERSE must come before a sort criterion")
+	}
+
+	match, usesModSeq, resp := parseSearch(p, c.mbox, false)
+	if resp != nil {
+		return resp
+	}
+	if usesModSeq {
+		c.condstore = true
+	}
+
+	found := c.mbox.search(match)
+	slices.SortStableFunc(found, func(a, b *searchMsg) int {
+		for _, cr := range cmps {
+			n := cr.cmp(a, b)
+			if cr.reverse {
+				n = -n
+			}
+			if n != 0 {
+				return n
+			}
+		}
+		// ties go by sequence number
+		return a.seq - b.seq
+	})
+
+	out := []string{}
+	for _, s := range found {
+		out = append(out, resultNum(s, uid))
+	}
+	c.untagged("%s", strings.TrimSpace("SORT "+strings.Join(out, " ")+highestModSeqOf(found, usesModSeq)))
+
+	c.mbox.update(c, uid)
+	return ok("SORT completed")
+}
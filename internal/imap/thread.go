@@ -0,0 +1,334 @@
+package imap
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// container is a node in a thread tree. Containers without a message stand in
+// for messages that were referred to but aren't in the mailbox.
+type container struct {
+	msg      *searchMsg
+	parent   *container
+	children []*container
+}
+
+func (c *container) addChild(child *container) {
+	if child.parent != nil {
+		child.parent.removeChild(child)
+	}
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *container) removeChild(child *container) {
+	c.children = slices.DeleteFunc(c.children, func(o *container) bool { return o == child })
+	child.parent = nil
+}
+
+// isAncestorOf reports whether c is above other in the tree, or is other
+func (c *container) isAncestorOf(other *container) bool {
+	for o := other; o != nil; o = o.parent {
+		if o == c {
+			return true
+		}
+	}
+	return false
+}
+
+// first is the message that dates the container, itself or, for stand-ins,
+// its first child after sorting
+func (c *container) first() *searchMsg {
+	if c.msg != nil {
+		return c.msg
+	}
+	if len(c.children) > 0 {
+		return c.children[0].first()
+	}
+	return nil
+}
+
+func compareContainers(a, b *container) int {
+	ma, mb := a.first(), b.first()
+	if ma == nil || mb == nil {
+		return 0
+	}
+	if n := ma.sentDate().Compare(mb.sentDate()); n != 0 {
+		return n
+	}
+	return ma.seq - mb.seq
+}
+
+func sortThread(cs []*container) {
+	for _, c := range cs {
+		sortThread(c.children)
+	}
+	slices.SortStableFunc(cs, compareContainers)
+}
+
+var msgIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+func msgIDs(v string) []string {
+	return msgIDPattern.FindAllString(v, -1)
+}
+
+// threadReferences is the REFERENCES algorithm from RFC 5256, which is
+// Jamie Zawinski's threading algorithm
+func threadReferences(msgs []*searchMsg) []*container {
+	byID := map[string]*container{}
+	get := func(id string) *container {
+		c, ok := byID[id]
+		if !ok {
+			c = &container{}
+			byID[id] = c
+		}
+		return c
+	}
+
+	for _, s := range msgs {
+		id := ""
+		if ids := msgIDs(s.entry.MessageID); len(ids) > 0 {
+			id = ids[0]
+		}
+		// messages without an ID, or with one we've already seen, get a
+		// unique one
+		if id == "" || byID[id] != nil && byID[id].msg != nil {
+			id = "<jums-" + strconv.Itoa(s.seq) + ">"
+		}
+		c := get(id)
+		c.msg = s
+
+		refs := msgIDs(s.entry.References)
+		if len(refs) == 0 {
+			if irt := msgIDs(s.entry.InReplyTo); len(irt) > 0 {
+				refs = irt[:1]
+			}
+		}
+
+		var prev *container
+		for _, ref := range refs {
+			rc := get(ref)
+			if prev != nil && rc.parent == nil && !rc.isAncestorOf(prev) {
+				prev.addChild(rc)
+			}
+			prev = rc
+		}
+
+		if c.parent != nil {
+			c.parent.removeChild(c)
+		}
+		if prev != nil && !c.isAncestorOf(prev) {
+			prev.addChild(c)
+		}
+	}
+	roots := []*container{}
+	for _, c := range byID {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = pruneEmpty(roots, true)
+	sortThread(roots)
+	roots = groupBySubject(roots)
+	sortThread(roots)
+	return roots
+}
+
+// pruneEmpty drops stand-ins with no children and promotes the children of
+// the others, except at the root where that would split a thread up
+func pruneEmpty(cs []*container, root bool) []*container {
+	out := []*container{}
+	for _, c := range cs {
+		c.children = pruneEmpty(c.children, false)
+		for _, child := range c.children {
+			child.parent = c
+		}
+		if c.msg != nil {
+			out = append(out, c)
+			continue
+		}
+		switch {
+		case len(c.children) == 0:
+		case !root || len(c.children) == 1:
+			for _, child := range c.children {
+				child.parent = c.parent
+			}
+			out = append(out, c.children...)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// groupBySubject merges threads whose roots share a base subject. Roots end
+// up sorted again afterwards so the order here doesn't matter.
+func groupBySubject(roots []*container) []*container {
+	subjectOf := func(c *container) (string, bool) {
+		m := c.first()
+		if m == nil {
+			return "", false
+		}
+		base := baseSubject(m.entry.Subject)
+		return strings.ToLower(base), base != strings.Join(strings.Fields(m.entry.Subject), " ")
+	}
+
+	// pick the root everything else with the subject gets merged into,
+	// preferring stand-ins and then anything that isn't a reply
+	table := map[string]*container{}
+	for _, c := range roots {
+		subj, reply := subjectOf(c)
+		if subj == "" {
+			continue
+		}
+		old, ok := table[subj]
+		if !ok {
+			table[subj] = c
+			continue
+		}
+		_, oldReply := subjectOf(old)
+		if c.msg == nil && old.msg != nil || old.msg != nil && c.msg != nil && oldReply && !reply {
+			table[subj] = c
+		}
+	}
+
+	extra := []*container{}
+	for _, c := range roots {
+		subj, reply := subjectOf(c)
+		target, ok := table[subj]
+		if subj == "" || !ok || target == c {
+			continue
+		}
+
+		_, targetReply := subjectOf(target)
+		switch {
+		case target.msg == nil && c.msg == nil:
+			for _, child := range slices.Clone(c.children) {
+				target.addChild(child)
+			}
+		case target.msg == nil, reply && !targetReply:
+			target.addChild(c)
+		default:
+			// neither is obviously the parent, put both under a stand-in
+			dummy := &container{}
+			dummy.addChild(target)
+			dummy.addChild(c)
+			table[subj] = dummy
+			extra = append(extra, dummy)
+		}
+	}
+
+	out := []*container{}
+	for _, c := range append(roots, extra...) {
+		if c.parent == nil && (c.msg != nil || len(c.children) > 0) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// threadOrderedSubject groups by base subject, each thread being the first
+// message with everything else as its children
+func threadOrderedSubject(msgs []*searchMsg) []*container {
+	sorted := slices.Clone(msgs)
+	slices.SortStableFunc(sorted, func(a, b *searchMsg) int {
+		if n := strings.Compare(strings.ToLower(baseSubject(a.entry.Subject)), strings.ToLower(baseSubject(b.entry.Subject))); n != 0 {
+			return n
+		}
+		if n := a.sentDate().Compare(b.sentDate()); n != 0 {
+			return n
+		}
+		return a.seq - b.seq
+	})
+
+	roots := []*container{}
+	var cur *container
+	subj := ""
+	for _, s := range sorted {
+		base := strings.ToLower(baseSubject(s.entry.Subject))
+		if cur == nil || base != subj {
+			cur = &container{msg: s}
+			roots = append(roots, cur)
+			subj = base
+			continue
+		}
+		cur.addChild(&container{msg: s})
+	}
+	slices.SortStableFunc(roots, compareContainers)
+	return roots
+}
+
+// formatThread writes a thread the way RFC 5256 wants it: a chain with one
+// child each is a flat list, branches get a parenthesised list each
+func formatThread(c *container, uid bool) string {
+	parts := []string{}
+	if c.msg != nil {
+		parts = append(parts, resultNum(c.msg, uid))
+	}
+	if len(c.children) == 1 && c.msg != nil {
+		return parts[0] + " " + formatThread(c.children[0], uid)
+	}
+	branches := ""
+	for _, child := range c.children {
+		branches += "(" + formatThread(child, uid) + ")"
+	}
+	if branches != "" {
+		parts = append(parts, branches)
+	}
+	return strings.Join(parts, " ")
+}
+
+func cmdThread(c *conn, p *parser) *response {
+	return thread(c, p, false)
+}
+
+func thread(c *conn, p *parser, uid bool) *response {
+	var alg, charset string
+	err := p.sp()
+	if err == nil {
+		alg, err = p.atom()
+	}
+	if err == nil {
+		err = p.sp()
+	}
+	if err == nil {
+		charset, err = p.astring()
+	}
+	if err != nil {
+		return bad("Expected THREAD algorithm charset keys")
+	}
+	if !knownCharset(charset) {
+		return no("[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+	}
+
+	var algorithm func([]*searchMsg) []*container
+	switch strings.ToUpper(alg) {
+	case "REFERENCES":
+		algorithm = threadReferences
+	case "ORDEREDSUBJECT":
+		algorithm = threadOrderedSubject
+	default:
+		return bad(fmt.Sprintf("Unsupported threading algorithm %s", alg))
+	}
+
+	match, _, resp := parseSearch(p, c.mbox, false)
+	if resp != nil {
+		return resp
+	}
+
+	var b strings.Builder
+	b.WriteString("THREAD")
+	for i, root := range algorithm(c.mbox.search(match)) {
+		if i == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("(" + formatThread(root, uid) + ")")
+	}
+	c.untagged("%s", b.String())
+
+	c.mbox.update(c, uid)
+	return ok("THREAD completed")
+}
@@ -0,0 +1,256 @@
+package jmap
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/notify"
+)
+
+const (
+	// kept in the user's maildir root, it doesn't start with a dot so it's
+	// never mistaken for a folder
+	uploadsDir = "jums-uploads"
+	// uploads nobody has used by then are thrown away
+	uploadLifetime = 24 * time.Hour
+	// the least time we'll wait between event source pings
+	minPing = 30
+)
+
+var errNoBlob = errors.New("no such blob")
+
+// blob finds the content for a blob ID. Messages and their parts are
+// addressed by key, so a blob stays valid when its message is moved.
+func (a *account) blob(id string) ([]byte, string, error) {
+	if strings.HasPrefix(id, "u") {
+		if _, err := hex.DecodeString(id[1:]); err != nil || len(id) < 2 {
+			return nil, "", errNoBlob
+		}
+		data, err := os.ReadFile(filepath.Join(a.dir, uploadsDir, id))
+		if os.IsNotExist(err) {
+			return nil, "", errNoBlob
+		}
+		return data, "application/octet-stream", err
+	}
+
+	if !strings.HasPrefix(id, "b") {
+		return nil, "", errNoBlob
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(id[1:])
+	if err != nil {
+		return nil, "", errNoBlob
+	}
+	key, partID, _ := strings.Cut(string(raw), "/")
+
+	folders, err := a.openFolders()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, f := range folders {
+		i := slices.IndexFunc(f.mb.Messages, func(m *maildir.Message) bool { return m.Key == key })
+		if i < 0 {
+			continue
+		}
+		data, err := emailRef{f, f.mb.Messages[i]}.read()
+		if err != nil {
+			return nil, "", err
+		}
+		if partID == "" {
+			return data, "message/rfc822", nil
+		}
+		p := parseBody(data, "", "text/plain").find(partID)
+		if p == nil {
+			return nil, "", errNoBlob
+		}
+		return p.content, p.typ, nil
+	}
+	return nil, "", errNoBlob
+}
+
+// writeBase64 writes data base64 encoded in 76 character lines
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
+
+func serveDownload(w http.ResponseWriter, r *http.Request, a *account) {
+	if r.PathValue("account") != a.user {
+		http.NotFound(w, r)
+		return
+	}
+	data, typ, err := a.blob(r.PathValue("blob"))
+	if errors.Is(err, errNoBlob) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("Couldn't read blob", "user", a.user, "err", err.Error())
+		http.Error(w, "Can't read blob", http.StatusInternalServerError)
+		return
+	}
+
+	if accept := r.URL.Query().Get("accept"); accept != "" {
+		typ = accept
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": r.PathValue("name")}))
+	// blobs never change
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	w.Write(data)
+}
+
+func serveUpload(w http.ResponseWriter, r *http.Request, a *account) {
+	if r.PathValue("account") != a.user {
+		requestError(w, http.StatusNotFound, "about:blank", "No such account")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSizeUpload+1))
+	if err != nil {
+		return
+	}
+	if len(data) > maxSizeUpload {
+		requestError(w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", "Upload too large")
+		return
+	}
+
+	dir := filepath.Join(a.dir, uploadsDir)
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := "u" + hex.EncodeToString(b)
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, id), data, 0600)
+	}
+	if err != nil {
+		slog.Error("Couldn't store upload", "user", a.user, "err", err.Error())
+		http.Error(w, "Can't store upload", http.StatusInternalServerError)
+		return
+	}
+	expireUploads(dir)
+
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"accountId": a.user,
+		"blobId":    id,
+		"type":      typ,
+		"size":      len(data),
+	})
+}
+
+func expireUploads(dir string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		info, err := f.Info()
+		if err == nil && time.Since(info.ModTime()) > uploadLifetime {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// serveEventSource pushes a StateChange whenever the account changes,
+// RFC 8620 section 7.3
+func serveEventSource(w http.ResponseWriter, r *http.Request, a *account) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	types := []string{"Mailbox", "Email", "Thread"}
+	if t := q.Get("types"); t != "" && t != "*" {
+		types = slices.DeleteFunc(strings.Split(t, ","), func(s string) bool {
+			return !slices.Contains([]string{"Mailbox", "Email", "Thread"}, s)
+		})
+	}
+	closeAfter := q.Get("closeafter") == "state"
+	var ping <-chan time.Time
+	if p, err := strconv.Atoi(q.Get("ping")); err == nil && p > 0 {
+		t := time.NewTicker(time.Duration(max(p, minPing)) * time.Second)
+		defer t.Stop()
+		ping = t.C
+	}
+
+	folders, err := a.openFolders()
+	if err != nil {
+		http.Error(w, "Can't open mailbox", http.StatusInternalServerError)
+		return
+	}
+	changed := make(chan struct{}, 1)
+	for _, f := range folders {
+		sub := notify.Subscribe(f.mb.Dir)
+		defer sub.Close()
+		go func() {
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-sub.C:
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	last := stateOf(folders)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping:
+			fmt.Fprintf(w, "event: ping\ndata: {\"@type\":\"Ping\"}\n\n")
+			flusher.Flush()
+		case <-changed:
+			state, err := a.state()
+			if err != nil || state == last {
+				continue
+			}
+			last = state
+			change := map[string]string{}
+			for _, t := range types {
+				change[t] = state
+			}
+			data, _ := json.Marshal(map[string]any{
+				"@type":   "StateChange",
+				"changed": map[string]any{a.user: change},
+			})
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+			if closeAfter {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// bodyPart is a node in a message's MIME structure, RFC 8621 section 4.1.4
+type bodyPart struct {
+	partID      string
+	header      textproto.MIMEHeader
+	rawHeader   []headerField
+	typ         string
+	charset     string
+	name        string
+	disposition string
+	cid         string
+	language    []string
+	location    string
+	// decoded content, leaves only
+	content  []byte
+	subParts []*bodyPart
+}
+
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+var wordDecoder = &mime.WordDecoder{
+	// we can't convert other charsets, passing them through beats dropping
+	// the whole header
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	},
+}
+
+func decodeHeader(v string) string {
+	if d, err := wordDecoder.DecodeHeader(v); err == nil {
+		v = d
+	}
+	return strings.TrimSpace(v)
+}
+
+// splitHeader splits a raw message into its header fields, in order and
+// unparsed, and its body
+func splitHeader(data []byte) ([]headerField, []byte) {
+	fields := []headerField{}
+	for len(data) > 0 {
+		nl := bytes.IndexByte(data, '\n')
+		if nl < 0 {
+			nl = len(data) - 1
+		}
+		line := data[:nl+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, data[nl+1:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += string(line)
+		} else if name, value, ok := strings.Cut(string(line), ":"); ok {
+			fields = append(fields, headerField{name, value})
+		}
+		data = data[nl+1:]
+	}
+	return fields, nil
+}
+
+func mimeHeader(fields []headerField) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	for _, f := range fields {
+		v := strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(f.Value))
+		h.Add(textproto.CanonicalMIMEHeaderKey(f.Name), v)
+	}
+	return h
+}
+
+// parseBody parses a message or body part. Anything malformed is treated as
+// an opaque leaf rather than failing the whole message.
+func parseBody(data []byte, partID string, defaultType string) *bodyPart {
+	fields, body := splitHeader(data)
+	h := mimeHeader(fields)
+	p := &bodyPart{partID: partID, header: h, rawHeader: fields, typ: defaultType}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil {
+		p.typ = mediaType
+		p.charset = params["charset"]
+		p.name = decodeHeader(params["name"])
+	}
+	if d, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		p.disposition = d
+		if n := dparams["filename"]; n != "" {
+			p.name = decodeHeader(n)
+		}
+	}
+	p.cid = strings.Trim(h.Get("Content-Id"), "<> ")
+	if lang := h.Get("Content-Language"); lang != "" {
+		for _, l := range strings.Split(lang, ",") {
+			p.language = append(p.language, strings.TrimSpace(l))
+		}
+	}
+	p.location = h.Get("Content-Location")
+
+	if strings.HasPrefix(p.typ, "multipart/") && params["boundary"] != "" {
+		sub := "text/plain"
+		if p.typ == "multipart/digest" {
+			sub = "message/rfc822"
+		}
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i := 1; ; i++ {
+			part, err := r.NextRawPart()
+			if err != nil {
+				break
+			}
+			raw := &bytes.Buffer{}
+			for k, vs := range part.Header {
+				for _, v := range vs {
+					raw.WriteString(k + ": " + v + "\r\n")
+				}
+			}
+			raw.WriteString("\r\n")
+			io.Copy(raw, part)
+			id := strconv.Itoa(i)
+			if partID != "" {
+				id = partID + "." + id
+			}
+			p.subParts = append(p.subParts, parseBody(raw.Bytes(), id, sub))
+		}
+		p.partID = ""
+		return p
+	}
+
+	if partID == "" {
+		// a single part message is part 1
+		p.partID = "1"
+	}
+	p.content = decodeTransfer(h.Get("Content-Transfer-Encoding"), body)
+	if p.typ == "text/plain" && p.charset == "" {
+		p.charset = "us-ascii"
+	}
+	return p
+}
+
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.StdEncoding.Decode(out, clean)
+		return out[:n]
+	case "quoted-printable":
+		out, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil && len(out) == 0 {
+			return body
+		}
+		return out
+	default:
+		return body
+	}
+}
+
+// text returns the content of a text part as UTF-8. Only latin1 gets
+// converted, anything else we can't read is passed through with invalid
+// sequences replaced.
+func (p *bodyPart) text() (string, bool) {
+	s := string(p.content)
+	switch strings.ToLower(p.charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(p.content))
+		for i, b := range p.content {
+			runes[i] = rune(b)
+		}
+		return string(runes), false
+	}
+	if utf8.ValidString(s) {
+		return s, false
+	}
+	return strings.ToValidUTF8(s, "�"), true
+}
+
+// leaves returns every non-multipart part
+func (p *bodyPart) leaves() []*bodyPart {
+	if p.subParts == nil && !strings.HasPrefix(p.typ, "multipart/") {
+		return []*bodyPart{p}
+	}
+	out := []*bodyPart{}
+	for _, sp := range p.subParts {
+		out = append(out, sp.leaves()...)
+	}
+	return out
+}
+
+func (p *bodyPart) find(partID string) *bodyPart {
+	for _, l := range p.leaves() {
+		if l.partID == partID {
+			return l
+		}
+	}
+	return nil
+}
+
+func isInlineMediaType(t string) bool {
+	return strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/")
+}
+
+// parseStructure picks out the text, HTML and attachment parts, this is the
+// algorithm from RFC 8621 section 4.1.4. A nil slice pointer means that list
+// has been abandoned for this branch.
+func parseStructure(parts []*bodyPart, multipartType string, inAlternative bool, htmlBody, textBody, attachments *[]*bodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+
+	for i, part := range parts {
+		isMultipart := strings.HasPrefix(part.typ, "multipart/")
+		isInline := part.disposition != "attachment" &&
+			(part.typ == "text/plain" || part.typ == "text/html" || isInlineMediaType(part.typ)) &&
+			(i == 0 || (multipartType != "related" && (isInlineMediaType(part.typ) || part.name == "")))
+
+		switch {
+		case isMultipart:
+			sub := strings.TrimPrefix(part.typ, "multipart/")
+			parseStructure(part.subParts, sub, inAlternative || sub == "alternative", htmlBody, textBody, attachments)
+		case isInline:
+			if multipartType == "alternative" {
+				switch part.typ {
+				case "text/plain":
+					if textBody != nil {
+						*textBody = append(*textBody, part)
+					}
+				case "text/html":
+					if htmlBody != nil {
+						*htmlBody = append(*htmlBody, part)
+					}
+				default:
+					*attachments = append(*attachments, part)
+				}
+				continue
+			}
+			if inAlternative {
+				if part.typ == "text/plain" {
+					htmlBody = nil
+				}
+				if part.typ == "text/html" {
+					textBody = nil
+				}
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, part)
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part)
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(part.typ) {
+				*attachments = append(*attachments, part)
+			}
+		default:
+			*attachments = append(*attachments, part)
+		}
+	}
+
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+// bodies splits a parsed message into textBody, htmlBody and attachments
+func bodies(root *bodyPart) (text, html, attachments []*bodyPart) {
+	text, html, attachments = []*bodyPart{}, []*bodyPart{}, []*bodyPart{}
+	parts := []*bodyPart{root}
+	parseStructure(parts, "mixed", false, &html, &text, &attachments)
+	return text, html, attachments
+}
+
+// addresses parses an address list header into JMAP EmailAddress objects,
+// or nil if there isn't one
+func addresses(h textproto.MIMEHeader, name string) any {
+	v := h.Get(name)
+	if v == "" {
+		return nil
+	}
+	p := &mail.AddressParser{WordDecoder: wordDecoder}
+	list, err := p.ParseList(v)
+	if err != nil {
+		// keep what we can rather than losing the header
+		return []map[string]any{{"name": nil, "email": decodeHeader(v)}}
+	}
+	out := []map[string]any{}
+	for _, a := range list {
+		var name any
+		if a.Name != "" {
+			name = a.Name
+		}
+		out = append(out, map[string]any{"name": name, "email": a.Address})
+	}
+	return out
+}
+
+// messageIDs parses a Message-ID, In-Reply-To or References header
+func messageIDs(h textproto.MIMEHeader, name string) any {
+	ids := []string{}
+	for _, f := range strings.Fields(h.Get(name)) {
+		if strings.HasPrefix(f, "<") && strings.HasSuffix(f, ">") {
+			ids = append(ids, f[1:len(f)-1])
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// preview is the start of the text body with whitespace squashed
+func preview(text []*bodyPart) string {
+	var b strings.Builder
+	for _, p := range text {
+		if p.typ != "text/plain" && p.typ != "text/html" {
+			continue
+		}
+		s, _ := p.text()
+		if p.typ == "text/html" {
+			s = stripTags(s)
+		}
+		b.WriteString(s)
+		b.WriteByte(' ')
+		if b.Len() > 1024 {
+			break
+		}
+	}
+	s := strings.Join(strings.Fields(b.String()), " ")
+	if utf8.RuneCountInString(s) > 256 {
+		s = string([]rune(s)[:256])
+	}
+	return s
+}
+
+// stripTags is just good enough for previews and searching
+func stripTags(s string) string {
+	var b strings.Builder
+	in := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			in = true
+		case r == '>':
+			in = false
+			b.WriteByte(' ')
+		case !in:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
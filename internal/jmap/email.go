@@ -0,0 +1,492 @@
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+var defaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender", "from",
+	"to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment",
+	"preview", "bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+var defaultBodyProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset", "disposition",
+	"cid", "language", "location",
+}
+
+// properties that don't need the message to be read
+var metadataProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+}
+
+// IMAP flags and the JMAP keywords they're shown as. \Deleted and \Recent
+// have no JMAP equivalent.
+var flagKeywords = map[string]string{
+	`\Seen`:      "$seen",
+	`\Flagged`:   "$flagged",
+	`\Answered`:  "$answered",
+	`\Draft`:     "$draft",
+	`$Forwarded`: "$forwarded",
+}
+
+func keywords(flags []string) map[string]bool {
+	kw := map[string]bool{}
+	for _, f := range flags {
+		if strings.EqualFold(f, `\Deleted`) || strings.EqualFold(f, `\Recent`) {
+			continue
+		}
+		k, ok := flagKeywords[f]
+		if !ok {
+			k = strings.ToLower(f)
+		}
+		kw[k] = true
+	}
+	return kw
+}
+
+// flags turns JMAP keywords back into IMAP flags. keep are the current
+// flags, any that JMAP can't see are carried over.
+func flags(kw map[string]bool, keep []string) []string {
+	out := []string{}
+	for _, f := range keep {
+		if strings.EqualFold(f, `\Deleted`) {
+			out = append(out, f)
+		}
+	}
+	for k, set := range kw {
+		if !set {
+			continue
+		}
+		flag := k
+		for f, kk := range flagKeywords {
+			if strings.EqualFold(kk, k) {
+				flag = f
+			}
+		}
+		out = append(out, flag)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// validKeyword checks a keyword against RFC 8621's rules, which are IMAP's
+// atom rules
+func validKeyword(k string) bool {
+	if k == "" || len(k) > 255 {
+		return false
+	}
+	for _, r := range k {
+		if r <= ' ' || r > '~' || strings.ContainsRune(`(){]%*"\`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func blobID(key, partID string) string {
+	if partID != "" {
+		key += "/" + partID
+	}
+	return "b" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// threadID groups messages by the first message in their References, or
+// what they're replying to. It's not as clever as IMAP THREAD, but it's
+// stable, a message's thread never changes.
+func threadID(e *maildir.IndexEntry, key string) string {
+	root := key
+	if e != nil {
+		refs, replyTo := strings.Fields(e.References), strings.Fields(e.InReplyTo)
+		switch {
+		case len(refs) > 0:
+			root = refs[0]
+		case len(replyTo) > 0:
+			root = replyTo[0]
+		case e.MessageID != "":
+			root = e.MessageID
+		}
+	}
+	h := sha256.Sum256([]byte(root))
+	return "t" + hex.EncodeToString(h[:8])
+}
+
+func (s *snapshot) threadOf(ref emailRef) string {
+	return threadID(ref.f.index[ref.msg.Key], ref.msg.Key)
+}
+
+// read returns the raw message
+func (ref emailRef) read() ([]byte, error) {
+	data, err := os.ReadFile(ref.msg.Path)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	// its flags changed since the snapshot, look for it again
+	mb, oerr := maildir.Open(ref.f.mb.Dir, false)
+	if oerr != nil {
+		return nil, oerr
+	}
+	cur := mb.ByUID(ref.msg.UID)
+	if cur == nil {
+		return nil, err
+	}
+	return os.ReadFile(cur.Path)
+}
+
+type emailGetArgs struct {
+	getArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+func emailGet(rq *request, raw json.RawMessage) (any, error) {
+	var args emailGetArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if args.IDs == nil {
+		// there could be any number of emails, clients have to query
+		return nil, &methodError{"requestTooLarge", "ids is required"}
+	}
+	if len(*args.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	props := defaultEmailProperties
+	if args.Properties != nil {
+		props = *args.Properties
+	}
+	bodyProps := defaultBodyProperties
+	if args.BodyProperties != nil {
+		bodyProps = *args.BodyProperties
+	}
+
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	list, notFound := []any{}, []string{}
+	for _, id := range *args.IDs {
+		ref, ok := s.emails[rq.id(id)]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj, err := s.email(ref, props, bodyProps, &args)
+		if os.IsNotExist(err) {
+			notFound = append(notFound, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return map[string]any{
+		"accountId": rq.acct.user,
+		"state":     stateOf(s.folders),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+func (s *snapshot) email(ref emailRef, props, bodyProps []string, args *emailGetArgs) (map[string]any, error) {
+	msg := ref.msg
+	obj := map[string]any{"id": emailID(msg.Key)}
+	needBody := false
+	for _, p := range props {
+		switch p {
+		case "blobId":
+			obj[p] = blobID(msg.Key, "")
+		case "threadId":
+			obj[p] = s.threadOf(ref)
+		case "mailboxIds":
+			obj[p] = map[string]bool{ref.f.id: true}
+		case "keywords":
+			obj[p] = keywords(msg.Flags)
+		case "size":
+			obj[p] = msg.Size
+		case "receivedAt":
+			obj[p] = msg.Date.UTC().Format(time.RFC3339)
+		default:
+			needBody = needBody || !slices.Contains(metadataProperties, p)
+		}
+	}
+	if !needBody {
+		return obj, nil
+	}
+
+	data, err := ref.read()
+	if err != nil {
+		return nil, err
+	}
+	root := parseBody(data, "", "text/plain")
+	text, html, attachments := bodies(root)
+	h := root.header
+
+	for _, p := range props {
+		switch p {
+		case "messageId", "inReplyTo", "references":
+			name := map[string]string{"messageId": "Message-Id", "inReplyTo": "In-Reply-To", "references": "References"}[p]
+			obj[p] = messageIDs(h, name)
+		case "sender", "from", "to", "cc", "bcc", "replyTo":
+			name := map[string]string{"sender": "Sender", "from": "From", "to": "To", "cc": "Cc", "bcc": "Bcc", "replyTo": "Reply-To"}[p]
+			obj[p] = addresses(h, name)
+		case "subject":
+			if v, ok := h["Subject"]; ok {
+				obj[p] = decodeHeader(v[0])
+			} else {
+				obj[p] = nil
+			}
+		case "sentAt":
+			obj[p] = nil
+			if d, err := mail.ParseDate(h.Get("Date")); err == nil {
+				obj[p] = d.Format(time.RFC3339)
+			}
+		case "hasAttachment":
+			obj[p] = slices.ContainsFunc(attachments, func(a *bodyPart) bool {
+				return a.disposition == "attachment" || !isInlineMediaType(a.typ)
+			})
+		case "preview":
+			obj[p] = preview(text)
+		case "headers":
+			obj[p] = root.rawHeader
+		case "bodyStructure":
+			obj[p] = partObject(root, msg.Key, append(slices.Clone(bodyProps), "subParts"))
+		case "textBody", "htmlBody", "attachments":
+			parts := map[string][]*bodyPart{"textBody": text, "htmlBody": html, "attachments": attachments}[p]
+			list := []map[string]any{}
+			for _, bp := range parts {
+				list = append(list, partObject(bp, msg.Key, bodyProps))
+			}
+			obj[p] = list
+		case "bodyValues":
+			obj[p] = bodyValues(root, text, html, args)
+		default:
+			if strings.HasPrefix(p, "header:") {
+				v, err := headerProperty(root.rawHeader, p)
+				if err != nil {
+					return nil, err
+				}
+				obj[p] = v
+			}
+		}
+	}
+	return obj, nil
+}
+
+// partObject is a JMAP EmailBodyPart
+func partObject(p *bodyPart, key string, props []string) map[string]any {
+	isMultipart := strings.HasPrefix(p.typ, "multipart/")
+	obj := map[string]any{}
+	orNil := func(s string) any {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	for _, prop := range props {
+		switch prop {
+		case "partId":
+			obj[prop] = orNil(p.partID)
+		case "blobId":
+			if isMultipart {
+				obj[prop] = nil
+			} else {
+				obj[prop] = blobID(key, p.partID)
+			}
+		case "size":
+			obj[prop] = len(p.content)
+		case "headers":
+			obj[prop] = p.rawHeader
+		case "name":
+			obj[prop] = orNil(p.name)
+		case "type":
+			obj[prop] = p.typ
+		case "charset":
+			obj[prop] = orNil(p.charset)
+		case "disposition":
+			obj[prop] = orNil(p.disposition)
+		case "cid":
+			obj[prop] = orNil(p.cid)
+		case "language":
+			if p.language == nil {
+				obj[prop] = nil
+			} else {
+				obj[prop] = p.language
+			}
+		case "location":
+			obj[prop] = orNil(p.location)
+		case "subParts":
+			if isMultipart {
+				subs := []map[string]any{}
+				for _, sp := range p.subParts {
+					subs = append(subs, partObject(sp, key, props))
+				}
+				obj[prop] = subs
+			}
+		default:
+			if strings.HasPrefix(prop, "header:") {
+				obj[prop], _ = headerProperty(p.rawHeader, prop)
+			}
+		}
+	}
+	return obj
+}
+
+func bodyValues(root *bodyPart, text, html []*bodyPart, args *emailGetArgs) map[string]any {
+	values := map[string]any{}
+	add := func(p *bodyPart) {
+		if !strings.HasPrefix(p.typ, "text/") {
+			return
+		}
+		v, problem := p.text()
+		truncated := false
+		if args.MaxBodyValueBytes > 0 && len(v) > args.MaxBodyValueBytes {
+			v = strings.ToValidUTF8(v[:args.MaxBodyValueBytes], "")
+			truncated = true
+		}
+		values[p.partID] = map[string]any{"value": v, "isEncodingProblem": problem, "isTruncated": truncated}
+	}
+
+	switch {
+	case args.FetchAllBodyValues:
+		for _, p := range root.leaves() {
+			add(p)
+		}
+	default:
+		if args.FetchTextBodyValues {
+			for _, p := range text {
+				add(p)
+			}
+		}
+		if args.FetchHTMLBodyValues {
+			for _, p := range html {
+				add(p)
+			}
+		}
+	}
+	return values
+}
+
+// headerProperty handles "header:Name:asForm:all" properties
+func headerProperty(fields []headerField, prop string) (any, error) {
+	parts := strings.Split(prop, ":")
+	name := parts[1]
+	form, all := "asRaw", false
+	for _, p := range parts[2:] {
+		switch {
+		case p == "all":
+			all = true
+		case strings.HasPrefix(p, "as"):
+			form = p
+		default:
+			return nil, invalidArguments("bad header property %s", prop)
+		}
+	}
+
+	values := []any{}
+	for _, f := range fields {
+		if !strings.EqualFold(f.Name, name) {
+			continue
+		}
+		raw := strings.TrimRight(f.Value, "\r\n")
+		h := mimeHeader([]headerField{{name, raw}})
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		var v any
+		switch form {
+		case "asRaw":
+			v = raw
+		case "asText":
+			v = decodeHeader(strings.NewReplacer("\r\n", "", "\n", "").Replace(raw))
+		case "asAddresses":
+			v = addresses(h, key)
+		case "asMessageIds":
+			v = messageIDs(h, key)
+		case "asDate":
+			v = nil
+			if d, err := mail.ParseDate(h.Get(key)); err == nil {
+				v = d.Format(time.RFC3339)
+			}
+		case "asURLs":
+			urls := []string{}
+			for _, u := range strings.Split(h.Get(key), ",") {
+				if u = strings.TrimSpace(u); strings.HasPrefix(u, "<") && strings.HasSuffix(u, ">") {
+					urls = append(urls, u[1:len(u)-1])
+				}
+			}
+			v = urls
+		default:
+			return nil, invalidArguments("bad header form %s", form)
+		}
+		values = append(values, v)
+	}
+
+	if all {
+		return values, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values[len(values)-1], nil
+}
+
+func threadGet(rq *request, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if args.IDs == nil {
+		return nil, &methodError{"requestTooLarge", "ids is required"}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	threads := map[string][]emailRef{}
+	for _, ref := range s.emails {
+		t := s.threadOf(ref)
+		threads[t] = append(threads[t], ref)
+	}
+
+	list, notFound := []any{}, []string{}
+	for _, id := range *args.IDs {
+		refs, ok := threads[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		slices.SortFunc(refs, func(a, b emailRef) int {
+			if c := a.msg.Date.Compare(b.msg.Date); c != 0 {
+				return c
+			}
+			return strings.Compare(a.msg.Key, b.msg.Key)
+		})
+		ids := []string{}
+		for _, ref := range refs {
+			ids = append(ids, emailID(ref.msg.Key))
+		}
+		list = append(list, map[string]any{"id": id, "emailIds": ids})
+	}
+	return map[string]any{
+		"accountId": rq.acct.user,
+		"state":     stateOf(s.folders),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
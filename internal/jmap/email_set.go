@@ -0,0 +1,532 @@
+package jmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+func emailSet(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		IfInState *string                               `json:"ifInState"`
+		Create    map[string]json.RawMessage            `json:"create"`
+		Update    map[string]map[string]json.RawMessage `json:"update"`
+		Destroy   []string                              `json:"destroy"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > maxObjectsInSet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	oldState := stateOf(s.folders)
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+
+	created, notCreated := map[string]any{}, map[string]setError{}
+	for cid, obj := range args.Create {
+		res, serr := rq.createEmail(obj)
+		if serr != nil {
+			notCreated[cid] = *serr
+			continue
+		}
+		rq.createdIDs[cid] = res["id"].(string)
+		created[cid] = res
+	}
+
+	updated, notUpdated := map[string]any{}, map[string]setError{}
+	for id, patch := range args.Update {
+		if serr := rq.updateEmail(rq.id(id), patch); serr != nil {
+			notUpdated[id] = *serr
+			continue
+		}
+		updated[id] = nil
+	}
+
+	destroyed, notDestroyed := []string{}, map[string]setError{}
+	for _, id := range args.Destroy {
+		if serr := rq.destroyEmail(rq.id(id)); serr != nil {
+			notDestroyed[id] = *serr
+			continue
+		}
+		destroyed = append(destroyed, id)
+	}
+
+	s, err = rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return setResponse(rq, oldState, stateOf(s.folders), created, notCreated, updated, notUpdated, destroyed, notDestroyed), nil
+}
+
+// fresh finds an email again in a newly opened mailbox, so changes are made
+// to where it is now rather than where the snapshot saw it
+func (rq *request) fresh(id string) (*maildir.Mailbox, *maildir.Message, *folder, *setError) {
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, nil, nil, &setError{Type: "serverFail"}
+	}
+	ref, ok := s.emails[id]
+	if !ok {
+		return nil, nil, nil, &setError{Type: "notFound"}
+	}
+	mb, err := maildir.Open(ref.f.mb.Dir, false)
+	if err != nil {
+		return nil, nil, nil, &setError{Type: "serverFail", Description: err.Error()}
+	}
+	msg := mb.ByUID(ref.msg.UID)
+	if msg == nil {
+		return nil, nil, nil, &setError{Type: "notFound"}
+	}
+	return mb, msg, ref.f, nil
+}
+
+func (rq *request) updateEmail(id string, patch map[string]json.RawMessage) *setError {
+	mb, msg, f, serr := rq.fresh(id)
+	if serr != nil {
+		return serr
+	}
+
+	kw := keywords(msg.Flags)
+	mailboxes := map[string]bool{f.id: true}
+	for path, value := range patch {
+		prop, sub, isSub := strings.Cut(path, "/")
+		var err error
+		switch {
+		case prop == "keywords" && !isSub:
+			kw = map[string]bool{}
+			err = json.Unmarshal(value, &kw)
+			for k := range kw {
+				if !validKeyword(k) {
+					err = fmt.Errorf("bad keyword %s", k)
+				}
+			}
+			kw = lowerKeys(kw)
+		case prop == "keywords":
+			if !validKeyword(sub) {
+				err = fmt.Errorf("bad keyword %s", sub)
+			}
+			kw[strings.ToLower(sub)] = string(value) == "true"
+		case prop == "mailboxIds" && !isSub:
+			mailboxes = map[string]bool{}
+			err = json.Unmarshal(value, &mailboxes)
+		case prop == "mailboxIds":
+			mailboxes[rq.id(sub)] = string(value) == "true"
+		default:
+			return &setError{Type: "invalidProperties", Properties: []string{path}}
+		}
+		if err != nil {
+			return &setError{Type: "invalidProperties", Properties: []string{prop}, Description: err.Error()}
+		}
+	}
+
+	dest, serr := rq.onlyMailbox(mailboxes)
+	if serr != nil {
+		return serr
+	}
+
+	if err := mb.SetFlags(msg, flags(kw, msg.Flags)); err != nil {
+		return &setError{Type: "serverFail", Description: err.Error()}
+	}
+	if dest.id != f.id {
+		if err := mb.Move(msg, dest.mb.Dir); err != nil {
+			return &setError{Type: "serverFail", Description: err.Error()}
+		}
+	}
+	rq.changed()
+	return nil
+}
+
+func lowerKeys(m map[string]bool) map[string]bool {
+	out := map[string]bool{}
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// onlyMailbox checks a mailboxIds value names exactly one mailbox, a
+// message is a file so it can only be in one folder
+func (rq *request) onlyMailbox(mailboxes map[string]bool) (*folder, *setError) {
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, &setError{Type: "serverFail"}
+	}
+	var dest *folder
+	n := 0
+	for id, in := range mailboxes {
+		if !in {
+			continue
+		}
+		n++
+		f, ok := s.byID[rq.id(id)]
+		if !ok {
+			return nil, &setError{Type: "invalidProperties", Properties: []string{"mailboxIds"}, Description: "no mailbox " + id}
+		}
+		dest = f
+	}
+	switch {
+	case n == 0:
+		return nil, &setError{Type: "invalidProperties", Properties: []string{"mailboxIds"}, Description: "an email has to be in a mailbox"}
+	case n > 1:
+		return nil, &setError{Type: "tooManyMailboxes", Description: "an email can only be in one mailbox"}
+	}
+	return dest, nil
+}
+
+func (rq *request) destroyEmail(id string) *setError {
+	mb, msg, _, serr := rq.fresh(id)
+	if serr != nil {
+		return serr
+	}
+	if err := mb.Remove(msg); err != nil {
+		return &setError{Type: "serverFail", Description: err.Error()}
+	}
+	rq.changed()
+	return nil
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type createPart struct {
+	PartID      *string `json:"partId"`
+	BlobID      *string `json:"blobId"`
+	Type        string  `json:"type"`
+	Name        *string `json:"name"`
+	Disposition *string `json:"disposition"`
+	Cid         *string `json:"cid"`
+}
+
+// emailCreate is the subset of Email/set create we can build a message from
+type emailCreate struct {
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+
+	MessageID  []string       `json:"messageId"`
+	InReplyTo  []string       `json:"inReplyTo"`
+	References []string       `json:"references"`
+	Sender     []emailAddress `json:"sender"`
+	From       []emailAddress `json:"from"`
+	To         []emailAddress `json:"to"`
+	Cc         []emailAddress `json:"cc"`
+	Bcc        []emailAddress `json:"bcc"`
+	ReplyTo    []emailAddress `json:"replyTo"`
+	Subject    *string        `json:"subject"`
+	SentAt     *time.Time     `json:"sentAt"`
+	Headers    []headerField  `json:"headers"`
+
+	BodyStructure json.RawMessage `json:"bodyStructure"`
+	TextBody      []createPart    `json:"textBody"`
+	HTMLBody      []createPart    `json:"htmlBody"`
+	Attachments   []createPart    `json:"attachments"`
+	BodyValues    map[string]struct {
+		Value string `json:"value"`
+	} `json:"bodyValues"`
+}
+
+func (rq *request) createEmail(raw json.RawMessage) (map[string]any, *setError) {
+	var e emailCreate
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, &setError{Type: "invalidProperties", Description: err.Error()}
+	}
+	if e.BodyStructure != nil {
+		return nil, &setError{Type: "invalidProperties", Properties: []string{"bodyStructure"}, Description: "use textBody, htmlBody and attachments"}
+	}
+	if len(e.TextBody) > 1 || len(e.HTMLBody) > 1 {
+		return nil, &setError{Type: "invalidProperties", Properties: []string{"textBody"}, Description: "only one text and one HTML part"}
+	}
+	dest, serr := rq.onlyMailbox(e.MailboxIDs)
+	if serr != nil {
+		return nil, serr
+	}
+	for k := range e.Keywords {
+		if !validKeyword(k) {
+			return nil, &setError{Type: "invalidProperties", Properties: []string{"keywords"}}
+		}
+	}
+
+	data, serr := rq.compose(&e)
+	if serr != nil {
+		return nil, serr
+	}
+	received := time.Now()
+	if e.ReceivedAt != nil {
+		received = *e.ReceivedAt
+	}
+	return rq.appendEmail(dest, data, lowerKeys(e.Keywords), received)
+}
+
+// appendEmail stores a new message and returns the properties the client
+// needs to know about it
+func (rq *request) appendEmail(dest *folder, data []byte, kw map[string]bool, received time.Time) (map[string]any, *setError) {
+	uid, err := maildir.Append(dest.mb.Dir, data, flags(kw, nil), received)
+	if err != nil {
+		return nil, &setError{Type: "serverFail", Description: err.Error()}
+	}
+	rq.changed()
+
+	mb, err := maildir.Open(dest.mb.Dir, false)
+	if err != nil {
+		return nil, &setError{Type: "serverFail", Description: err.Error()}
+	}
+	msg := mb.ByUID(uid)
+	if msg == nil {
+		return nil, &setError{Type: "serverFail"}
+	}
+	return map[string]any{
+		"id":       emailID(msg.Key),
+		"blobId":   blobID(msg.Key, ""),
+		"threadId": threadID(maildir.NewIndexEntry(msg.Key, data), msg.Key),
+		"size":     msg.Size,
+	}, nil
+}
+
+func formatAddresses(list []emailAddress) string {
+	out := []string{}
+	for _, a := range list {
+		if a.Name != nil && *a.Name != "" {
+			out = append(out, mime.QEncoding.Encode("utf-8", *a.Name)+" <"+a.Email+">")
+		} else {
+			out = append(out, a.Email)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func formatIDs(ids []string) string {
+	out := []string{}
+	for _, id := range ids {
+		out = append(out, "<"+id+">")
+	}
+	return strings.Join(out, " ")
+}
+
+func newMessageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "@" + config.GetConfig().Domain
+}
+
+// compose builds a MIME message from an Email/set create
+func (rq *request) compose(e *emailCreate) ([]byte, *setError) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+		}
+	}
+
+	if len(e.MessageID) == 0 {
+		e.MessageID = []string{newMessageID()}
+	}
+	sent := time.Now()
+	if e.SentAt != nil {
+		sent = *e.SentAt
+	}
+	header("Date", sent.Format(time.RFC1123Z))
+	header("Message-ID", formatIDs(e.MessageID))
+	header("In-Reply-To", formatIDs(e.InReplyTo))
+	header("References", formatIDs(e.References))
+	header("Sender", formatAddresses(e.Sender))
+	header("From", formatAddresses(e.From))
+	header("To", formatAddresses(e.To))
+	header("Cc", formatAddresses(e.Cc))
+	header("Bcc", formatAddresses(e.Bcc))
+	header("Reply-To", formatAddresses(e.ReplyTo))
+	if e.Subject != nil {
+		header("Subject", mime.QEncoding.Encode("utf-8", *e.Subject))
+	}
+	for _, h := range e.Headers {
+		if strings.ContainsAny(h.Name, ":\r\n ") {
+			return nil, &setError{Type: "invalidProperties", Properties: []string{"headers"}}
+		}
+		header(h.Name, strings.TrimSpace(h.Value))
+	}
+	header("MIME-Version", "1.0")
+
+	text := func(p createPart, typ string) (textproto.MIMEHeader, []byte, *setError) {
+		if p.PartID == nil {
+			return nil, nil, &setError{Type: "invalidProperties", Properties: []string{"bodyValues"}}
+		}
+		v, ok := e.BodyValues[*p.PartID]
+		if !ok {
+			return nil, nil, &setError{Type: "invalidProperties", Properties: []string{"bodyValues"}, Description: "no value for part " + *p.PartID}
+		}
+		var qp bytes.Buffer
+		w := quotedprintable.NewWriter(&qp)
+		w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(v.Value, "\r\n", "\n"), "\n", "\r\n")))
+		w.Close()
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", typ+"; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		return h, qp.Bytes(), nil
+	}
+
+	// the body is text, HTML, or both as alternatives
+	var bodyHeader textproto.MIMEHeader
+	var body []byte
+	var serr *setError
+	switch {
+	case len(e.TextBody) == 1 && len(e.HTMLBody) == 1:
+		var alt bytes.Buffer
+		w := multipart.NewWriter(&alt)
+		for _, p := range []struct {
+			part createPart
+			typ  string
+		}{{e.TextBody[0], "text/plain"}, {e.HTMLBody[0], "text/html"}} {
+			h, content, serr := text(p.part, p.typ)
+			if serr != nil {
+				return nil, serr
+			}
+			pw, _ := w.CreatePart(h)
+			pw.Write(content)
+		}
+		w.Close()
+		bodyHeader = textproto.MIMEHeader{}
+		bodyHeader.Set("Content-Type", "multipart/alternative; boundary="+w.Boundary())
+		body = alt.Bytes()
+	case len(e.HTMLBody) == 1:
+		bodyHeader, body, serr = text(e.HTMLBody[0], "text/html")
+	case len(e.TextBody) == 1:
+		bodyHeader, body, serr = text(e.TextBody[0], "text/plain")
+	default:
+		// no body at all, e.g. a draft that's just a subject
+		bodyHeader = textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}}
+	}
+	if serr != nil {
+		return nil, serr
+	}
+
+	if len(e.Attachments) == 0 {
+		for k, v := range bodyHeader {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v[0])
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	var mixed bytes.Buffer
+	w := multipart.NewWriter(&mixed)
+	pw, _ := w.CreatePart(bodyHeader)
+	pw.Write(body)
+	for _, a := range e.Attachments {
+		if a.BlobID == nil {
+			return nil, &setError{Type: "invalidProperties", Properties: []string{"attachments"}}
+		}
+		content, typ, err := rq.acct.blob(rq.id(*a.BlobID))
+		if err != nil {
+			return nil, &setError{Type: "blobNotFound", Description: *a.BlobID}
+		}
+		if a.Type != "" {
+			typ = a.Type
+		}
+		disposition := "attachment"
+		if a.Disposition != nil {
+			disposition = *a.Disposition
+		}
+		h := textproto.MIMEHeader{}
+		params := map[string]string{}
+		if a.Name != nil {
+			params["filename"] = *a.Name
+		}
+		h.Set("Content-Type", typ)
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+		h.Set("Content-Transfer-Encoding", "base64")
+		if a.Cid != nil {
+			h.Set("Content-ID", "<"+*a.Cid+">")
+		}
+		pw, _ := w.CreatePart(h)
+		writeBase64(pw, content)
+	}
+	w.Close()
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	buf.Write(mixed.Bytes())
+	return buf.Bytes(), nil
+}
+
+func emailImport(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		IfInState *string `json:"ifInState"`
+		Emails    map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+			ReceivedAt *time.Time      `json:"receivedAt"`
+		} `json:"emails"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if len(args.Emails) > maxObjectsInSet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	oldState := stateOf(s.folders)
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+
+	created, notCreated := map[string]any{}, map[string]setError{}
+	for cid, e := range args.Emails {
+		dest, serr := rq.onlyMailbox(e.MailboxIDs)
+		if serr != nil {
+			notCreated[cid] = *serr
+			continue
+		}
+		data, _, err := rq.acct.blob(rq.id(e.BlobID))
+		if errors.Is(err, errNoBlob) {
+			notCreated[cid] = setError{Type: "blobNotFound", Description: e.BlobID}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		received := time.Now()
+		if e.ReceivedAt != nil {
+			received = *e.ReceivedAt
+		}
+		res, serr := rq.appendEmail(dest, data, lowerKeys(e.Keywords), received)
+		if serr != nil {
+			notCreated[cid] = *serr
+			continue
+		}
+		rq.createdIDs[cid] = res["id"].(string)
+		created[cid] = res
+	}
+
+	s, err = rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	resp := setResponse(rq, oldState, stateOf(s.folders), created, notCreated, nil, nil, nil, nil)
+	delete(resp, "updated")
+	delete(resp, "notUpdated")
+	delete(resp, "destroyed")
+	delete(resp, "notDestroyed")
+	return resp, nil
+}
@@ -0,0 +1,185 @@
+package jmap
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: =?utf-8?q?h=C3=A9llo?=\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=XX\r\n" +
+	"\r\n" +
+	"--XX\r\n" +
+	"Content-Type: multipart/alternative; boundary=YY\r\n" +
+	"\r\n" +
+	"--YY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"first part\r\n" +
+	"--YY\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>first part</p>\r\n" +
+	"--YY--\r\n" +
+	"--XX\r\n" +
+	"Content-Type: application/pdf; name=a.pdf\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8=\r\n" +
+	"--XX--\r\n"
+
+func TestBodies(t *testing.T) {
+	root := parseBody([]byte(testMessage), "", "text/plain")
+	text, html, attachments := bodies(root)
+
+	ids := func(parts []*bodyPart) string {
+		out := []string{}
+		for _, p := range parts {
+			out = append(out, p.partID)
+		}
+		return strings.Join(out, ",")
+	}
+	if got := ids(text); got != "1.1" {
+		t.Errorf("textBody = %s, want 1.1", got)
+	}
+	if got := ids(html); got != "1.2" {
+		t.Errorf("htmlBody = %s, want 1.2", got)
+	}
+	if got := ids(attachments); got != "2" {
+		t.Errorf("attachments = %s, want 2", got)
+	}
+	if a := attachments[0]; string(a.content) != "hello" || a.name != "a.pdf" {
+		t.Errorf("attachment = %q %q, want hello a.pdf", a.content, a.name)
+	}
+}
+
+func TestEvalPointer(t *testing.T) {
+	var v any
+	json.Unmarshal([]byte(`{"list":[{"ids":["a","b"]},{"ids":["c"]}]}`), &v)
+	got, err := evalPointer(v, "/list/*/ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(got)
+	if string(b) != `["a","b","c"]` {
+		t.Errorf("got %s", b)
+	}
+}
+
+// call makes one API request as bob and returns the method responses
+func call(t *testing.T, a *account, calls string) []any {
+	t.Helper()
+	body := `{"using":["urn:ietf:params:jmap:core","urn:ietf:params:jmap:mail","urn:ietf:params:jmap:submission"],"methodCalls":` + calls + `}`
+	r := httptest.NewRequest("POST", apiPath, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	serveAPI(w, r, a)
+
+	var resp struct {
+		MethodResponses []any `json:"methodResponses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	for _, mr := range resp.MethodResponses {
+		if mr.([]any)[0] == "error" {
+			t.Fatalf("%s: %v", calls, mr)
+		}
+	}
+	return resp.MethodResponses
+}
+
+func args(resp any) map[string]any {
+	return resp.([]any)[1].(map[string]any)
+}
+
+func TestAPI(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	dir := filepath.Join(t.TempDir(), "bob")
+	if err := maildir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maildir.Deliver(dir, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	a := &account{"bob", dir}
+
+	resp := call(t, a, `[
+		["Email/query", {"accountId":"bob"}, "q"],
+		["Email/get", {"accountId":"bob", "#ids":{"resultOf":"q","name":"Email/query","path":"/ids"},
+			"properties":["subject","from","preview","keywords","hasAttachment"]}, "g"]
+	]`)
+	ids := args(resp[0])["ids"].([]any)
+	if len(ids) != 1 {
+		t.Fatalf("query ids = %v", ids)
+	}
+	email := args(resp[1])["list"].([]any)[0].(map[string]any)
+	if email["subject"] != "héllo" || email["preview"] != "first part" || email["hasAttachment"] != true {
+		t.Errorf("email = %v", email)
+	}
+	from := email["from"].([]any)[0].(map[string]any)
+	if from["name"] != "Alice" || from["email"] != "alice@example.com" {
+		t.Errorf("from = %v", from)
+	}
+
+	// make a folder and file the message into it, read
+	id := ids[0].(string)
+	resp = call(t, a, `[
+		["Mailbox/set", {"accountId":"bob", "create":{"new":{"name":"Archive"}}}, "m"],
+		["Email/set", {"accountId":"bob", "update":{"`+id+`":{"keywords/$seen":true, "mailboxIds":{"#new":true}}}}, "s"],
+		["Email/query", {"accountId":"bob", "filter":{"inMailbox":"#new", "hasKeyword":"$seen"}}, "q"],
+		["Mailbox/get", {"accountId":"bob", "properties":["name","role","totalEmails"]}, "g"]
+	]`)
+	if u := args(resp[1])["updated"].(map[string]any); len(u) != 1 {
+		t.Errorf("updated = %v, notUpdated = %v", u, args(resp[1])["notUpdated"])
+	}
+	if got := args(resp[2])["ids"].([]any); len(got) != 1 || got[0] != id {
+		t.Errorf("ids in Archive = %v, want [%s]", got, id)
+	}
+	for _, m := range args(resp[3])["list"].([]any) {
+		mbox := m.(map[string]any)
+		want := 0.0
+		if mbox["name"] == "Archive" {
+			want = 1
+			if mbox["role"] != "archive" {
+				t.Errorf("role = %v, want archive", mbox["role"])
+			}
+		}
+		if mbox["totalEmails"] != want {
+			t.Errorf("%s has %v emails, want %v", mbox["name"], mbox["totalEmails"], want)
+		}
+	}
+}
+
+func TestSubmitForgedFrom(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	dir := filepath.Join(t.TempDir(), "bob")
+	if err := maildir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maildir.Deliver(dir, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	a := &account{"bob", dir}
+
+	resp := call(t, a, `[["Email/query", {"accountId":"bob"}, "q"]]`)
+	id := args(resp[0])["ids"].([]any)[0].(string)
+
+	// the message is from alice, bob can't send it as is
+	resp = call(t, a, `[["EmailSubmission/set", {"accountId":"bob",
+		"create":{"new":{"identityId":"ibob", "emailId":"`+id+`"}}}, "s"]]`)
+	notCreated, _ := args(resp[0])["notCreated"].(map[string]any)
+	serr, _ := notCreated["new"].(map[string]any)
+	if serr["type"] != "forbiddenFrom" {
+		t.Errorf("notCreated = %v, created = %v", notCreated, args(resp[0])["created"])
+	}
+}
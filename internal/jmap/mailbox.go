@@ -0,0 +1,550 @@
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+// folder is one maildir folder as a JMAP Mailbox
+type folder struct {
+	// IMAP style, nested folders separated with "/"
+	name  string
+	id    string
+	mb    *maildir.Mailbox
+	index map[string]*maildir.IndexEntry
+}
+
+// snapshot is every folder in the account, opened once per request
+type snapshot struct {
+	folders []*folder
+	byID    map[string]*folder
+	// email ID to where it is
+	emails map[string]emailRef
+}
+
+type emailRef struct {
+	f   *folder
+	msg *maildir.Message
+}
+
+func mailboxID(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	return "m" + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// emailID is the same whichever folder the message is in, the key doesn't
+// change when it's moved
+func emailID(key string) string {
+	return "e" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func (a *account) openFolders() ([]*folder, error) {
+	names, err := maildir.Folders(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	folders := []*folder{}
+	for _, name := range names {
+		dir, err := maildir.FolderPath(a.dir, name)
+		if err != nil {
+			continue
+		}
+		mb, err := maildir.Open(dir, false)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, &folder{name: name, id: mailboxID(name), mb: mb})
+	}
+	return folders, nil
+}
+
+// state changes whenever anything in the account does. Per type states
+// would let clients skip refetching more often, but there's no history to
+// calculate changes from anyway.
+func (a *account) state() (string, error) {
+	folders, err := a.openFolders()
+	if err != nil {
+		return "", fmt.Errorf("jmap.state: %w", err)
+	}
+	return stateOf(folders), nil
+}
+
+func stateOf(folders []*folder) string {
+	h := sha256.New()
+	for _, f := range folders {
+		fmt.Fprintf(h, "%s %d %d %d %d\n", f.name, f.mb.UIDValidity, f.mb.UIDNext, f.mb.HighestModSeq, len(f.mb.Messages))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// snapshot loads every folder and its index, or returns the one already
+// loaded for this request
+func (rq *request) snapshot() (*snapshot, error) {
+	if rq.snap != nil {
+		return rq.snap, nil
+	}
+	folders, err := rq.acct.openFolders()
+	if err != nil {
+		return nil, fmt.Errorf("jmap.snapshot: %w", err)
+	}
+
+	s := &snapshot{folders: folders, byID: map[string]*folder{}, emails: map[string]emailRef{}}
+	for _, f := range folders {
+		if f.index, err = maildir.Index(f.mb.Dir, f.mb.Messages); err != nil {
+			return nil, fmt.Errorf("jmap.snapshot: %w", err)
+		}
+		s.byID[f.id] = f
+		for _, msg := range f.mb.Messages {
+			s.emails[emailID(msg.Key)] = emailRef{f, msg}
+		}
+	}
+	rq.snap = s
+	return s, nil
+}
+
+// changed throws away the snapshot after a write
+func (rq *request) changed() {
+	rq.snap = nil
+}
+
+// role is the RFC 8621 role for a folder, going by its name as IMAP does
+func role(name string) any {
+	switch strings.ToLower(name) {
+	case "inbox":
+		return "inbox"
+	case "junk", "spam":
+		return "junk"
+	case "sent", "sent items", "sent messages":
+		return "sent"
+	case "drafts":
+		return "drafts"
+	case "trash", "deleted items", "deleted messages":
+		return "trash"
+	case "archive":
+		return "archive"
+	default:
+		return nil
+	}
+}
+
+// parent returns the folder containing f, if there is one
+func (s *snapshot) parent(f *folder) *folder {
+	i := strings.LastIndex(f.name, "/")
+	if i < 0 {
+		return nil
+	}
+	return s.byID[mailboxID(f.name[:i])]
+}
+
+func (s *snapshot) mailbox(f *folder, subscribed []string) map[string]any {
+	name, parentID := f.name, any(nil)
+	if p := s.parent(f); p != nil {
+		name, parentID = f.name[len(p.name)+1:], p.id
+	}
+
+	unread := 0
+	threads, unreadThreads := map[string]bool{}, map[string]bool{}
+	for _, msg := range f.mb.Messages {
+		t := threadID(f.index[msg.Key], msg.Key)
+		threads[t] = true
+		if !msg.HasFlag(`\Seen`) {
+			unread++
+			unreadThreads[t] = true
+		}
+	}
+
+	sortOrder := 10
+	if f.name == "INBOX" {
+		sortOrder = 0
+	}
+	return map[string]any{
+		"id":            f.id,
+		"name":          name,
+		"parentId":      parentID,
+		"role":          role(f.name),
+		"sortOrder":     sortOrder,
+		"totalEmails":   len(f.mb.Messages),
+		"unreadEmails":  unread,
+		"totalThreads":  len(threads),
+		"unreadThreads": len(unreadThreads),
+		"myRights": map[string]bool{
+			"mayReadItems":   true,
+			"mayAddItems":    true,
+			"mayRemoveItems": true,
+			"maySetSeen":     true,
+			"maySetKeywords": true,
+			"mayCreateChild": true,
+			"mayRename":      f.name != "INBOX",
+			"mayDelete":      f.name != "INBOX",
+			"maySubmit":      true,
+		},
+		"isSubscribed": f.name == "INBOX" || slices.Contains(subscribed, f.name),
+	}
+}
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+// filterProperties cuts obj down to the requested properties, the id is
+// always returned
+func filterProperties(obj map[string]any, props *[]string) map[string]any {
+	if props == nil {
+		return obj
+	}
+	out := map[string]any{"id": obj["id"]}
+	for _, p := range *props {
+		if v, ok := obj[p]; ok {
+			out[p] = v
+		}
+	}
+	return out
+}
+
+func mailboxGet(rq *request, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	subscribed, err := maildir.Subscriptions(rq.acct.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list, notFound := []any{}, []string{}
+	if args.IDs == nil {
+		for _, f := range s.folders {
+			list = append(list, filterProperties(s.mailbox(f, subscribed), args.Properties))
+		}
+	} else {
+		if len(*args.IDs) > maxObjectsInGet {
+			return nil, &methodError{Type: "requestTooLarge"}
+		}
+		for _, id := range *args.IDs {
+			f, ok := s.byID[rq.id(id)]
+			if !ok {
+				notFound = append(notFound, id)
+				continue
+			}
+			list = append(list, filterProperties(s.mailbox(f, subscribed), args.Properties))
+		}
+	}
+	return map[string]any{
+		"accountId": rq.acct.user,
+		"state":     stateOf(s.folders),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+type mailboxFilter struct {
+	ParentID     *string `json:"parentId"`
+	Name         *string `json:"name"`
+	Role         *string `json:"role"`
+	HasAnyRole   *bool   `json:"hasAnyRole"`
+	IsSubscribed *bool   `json:"isSubscribed"`
+}
+
+func mailboxQuery(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		Filter *mailboxFilter `json:"filter"`
+		Sort   []struct {
+			Property    string `json:"property"`
+			IsAscending *bool  `json:"isAscending"`
+		} `json:"sort"`
+		Position int  `json:"position"`
+		Limit    *int `json:"limit"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	subscribed, err := maildir.Subscriptions(rq.acct.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []map[string]any{}
+	for _, f := range s.folders {
+		mbox := s.mailbox(f, subscribed)
+		if fl := args.Filter; fl != nil {
+			parentID, _ := mbox["parentId"].(string)
+			r, _ := mbox["role"].(string)
+			switch {
+			case fl.ParentID != nil && *fl.ParentID != parentID,
+				fl.Name != nil && !strings.Contains(strings.ToLower(mbox["name"].(string)), strings.ToLower(*fl.Name)),
+				fl.Role != nil && *fl.Role != r,
+				fl.HasAnyRole != nil && *fl.HasAnyRole != (r != ""),
+				fl.IsSubscribed != nil && *fl.IsSubscribed != mbox["isSubscribed"].(bool):
+				continue
+			}
+		}
+		matches = append(matches, mbox)
+	}
+
+	for i := len(args.Sort) - 1; i >= 0; i-- {
+		c := args.Sort[i]
+		desc := c.IsAscending != nil && !*c.IsAscending
+		var cmp func(a, b map[string]any) int
+		switch c.Property {
+		case "name":
+			cmp = func(a, b map[string]any) int { return strings.Compare(a["name"].(string), b["name"].(string)) }
+		case "sortOrder":
+			cmp = func(a, b map[string]any) int { return a["sortOrder"].(int) - b["sortOrder"].(int) }
+		default:
+			return nil, &methodError{Type: "unsupportedSort"}
+		}
+		slices.SortStableFunc(matches, func(a, b map[string]any) int {
+			if desc {
+				return cmp(b, a)
+			}
+			return cmp(a, b)
+		})
+	}
+
+	ids := []string{}
+	for _, m := range matches {
+		ids = append(ids, m["id"].(string))
+	}
+	position := min(max(args.Position, 0), len(ids))
+	ids = ids[position:]
+	if args.Limit != nil && *args.Limit < len(ids) {
+		ids = ids[:max(*args.Limit, 0)]
+	}
+	return map[string]any{
+		"accountId":           rq.acct.user,
+		"queryState":          stateOf(s.folders),
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+		"total":               len(matches),
+	}, nil
+}
+
+type mailboxPatch struct {
+	Name         *string `json:"name"`
+	ParentID     *string `json:"parentId"`
+	IsSubscribed *bool   `json:"isSubscribed"`
+}
+
+func mailboxSet(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		IfInState             *string                    `json:"ifInState"`
+		Create                map[string]json.RawMessage `json:"create"`
+		Update                map[string]json.RawMessage `json:"update"`
+		Destroy               []string                   `json:"destroy"`
+		OnDestroyRemoveEmails bool                       `json:"onDestroyRemoveEmails"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > maxObjectsInSet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	oldState := stateOf(s.folders)
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+
+	created, notCreated := map[string]any{}, map[string]setError{}
+	for cid, obj := range args.Create {
+		var p mailboxPatch
+		if err := json.Unmarshal(obj, &p); err != nil || p.Name == nil {
+			notCreated[cid] = setError{Type: "invalidProperties", Properties: []string{"name"}}
+			continue
+		}
+		name, serr := rq.folderName(*p.Name, p.ParentID)
+		if serr != nil {
+			notCreated[cid] = *serr
+			continue
+		}
+		if err := maildir.CreateFolder(rq.acct.dir, name); err != nil {
+			notCreated[cid] = folderSetError(err)
+			continue
+		}
+		if p.IsSubscribed != nil && *p.IsSubscribed {
+			maildir.SetSubscribed(rq.acct.dir, name, true)
+		}
+		rq.changed()
+		rq.createdIDs[cid] = mailboxID(name)
+		created[cid] = map[string]any{"id": mailboxID(name)}
+	}
+
+	updated, notUpdated := map[string]any{}, map[string]setError{}
+	for id, obj := range args.Update {
+		s, err := rq.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		f, ok := s.byID[rq.id(id)]
+		if !ok {
+			notUpdated[id] = setError{Type: "notFound"}
+			continue
+		}
+		var p mailboxPatch
+		if err := json.Unmarshal(obj, &p); err != nil {
+			notUpdated[id] = setError{Type: "invalidPatch", Description: err.Error()}
+			continue
+		}
+
+		if p.Name != nil || p.ParentID != nil {
+			leaf := f.name
+			parentID := (*string)(nil)
+			if par := s.parent(f); par != nil {
+				leaf = f.name[len(par.name)+1:]
+				parentID = &par.id
+			}
+			if p.Name != nil {
+				leaf = *p.Name
+			}
+			if p.ParentID != nil {
+				parentID = p.ParentID
+			}
+			name, serr := rq.folderName(leaf, parentID)
+			if serr != nil {
+				notUpdated[id] = *serr
+				continue
+			}
+			if name != f.name {
+				if f.name == "INBOX" {
+					notUpdated[id] = setError{Type: "forbidden", Description: "INBOX can't be renamed"}
+					continue
+				}
+				if err := maildir.RenameFolder(rq.acct.dir, f.name, name); err != nil {
+					notUpdated[id] = folderSetError(err)
+					continue
+				}
+				rq.changed()
+				// the ID is derived from the name, tell the client the new one
+				updated[id] = map[string]any{"id": mailboxID(name)}
+				f = &folder{name: name}
+			}
+		}
+		if p.IsSubscribed != nil {
+			if err := maildir.SetSubscribed(rq.acct.dir, f.name, *p.IsSubscribed); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := updated[id]; !ok {
+			updated[id] = nil
+		}
+	}
+
+	destroyed, notDestroyed := []string{}, map[string]setError{}
+	for _, id := range args.Destroy {
+		s, err := rq.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		f, ok := s.byID[rq.id(id)]
+		switch {
+		case !ok:
+			notDestroyed[id] = setError{Type: "notFound"}
+			continue
+		case f.name == "INBOX":
+			notDestroyed[id] = setError{Type: "forbidden", Description: "INBOX can't be destroyed"}
+			continue
+		case len(f.mb.Messages) > 0 && !args.OnDestroyRemoveEmails:
+			notDestroyed[id] = setError{Type: "mailboxHasEmail"}
+			continue
+		}
+		hasChild := slices.ContainsFunc(s.folders, func(c *folder) bool { return s.parent(c) == f })
+		if hasChild {
+			notDestroyed[id] = setError{Type: "mailboxHasChild"}
+			continue
+		}
+		if err := maildir.DeleteFolder(rq.acct.dir, f.name); err != nil {
+			notDestroyed[id] = folderSetError(err)
+			continue
+		}
+		maildir.SetSubscribed(rq.acct.dir, f.name, false)
+		rq.changed()
+		destroyed = append(destroyed, id)
+	}
+
+	s, err = rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return setResponse(rq, oldState, stateOf(s.folders), created, notCreated, updated, notUpdated, destroyed, notDestroyed), nil
+}
+
+// folderName works out the full folder name for a mailbox called name under
+// parentID
+func (rq *request) folderName(name string, parentID *string) (string, *setError) {
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return "", &setError{Type: "invalidProperties", Properties: []string{"name"}, Description: `names can't be empty or contain "/" or "."`}
+	}
+	if parentID == nil {
+		return name, nil
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return "", &setError{Type: "serverFail"}
+	}
+	p, ok := s.byID[rq.id(*parentID)]
+	if !ok {
+		return "", &setError{Type: "invalidProperties", Properties: []string{"parentId"}}
+	}
+	if p.name == "INBOX" {
+		// INBOX is the maildir root, children would be top level folders
+		return "", &setError{Type: "invalidProperties", Properties: []string{"parentId"}, Description: "INBOX can't have children"}
+	}
+	return p.name + "/" + name, nil
+}
+
+func folderSetError(err error) setError {
+	switch {
+	case errors.Is(err, maildir.ErrExists):
+		return setError{Type: "invalidProperties", Properties: []string{"name"}, Description: "a mailbox with that name already exists"}
+	case errors.Is(err, maildir.ErrInvalidName):
+		return setError{Type: "invalidProperties", Properties: []string{"name"}}
+	default:
+		return setError{Type: "serverFail", Description: err.Error()}
+	}
+}
+
+// setResponse builds the response every /set method sends. JSON wants null
+// rather than empty maps.
+func setResponse(rq *request, oldState, newState string, created map[string]any, notCreated map[string]setError, updated map[string]any, notUpdated map[string]setError, destroyed []string, notDestroyed map[string]setError) map[string]any {
+	orNil := func(n int, v any) any {
+		if n == 0 {
+			return nil
+		}
+		return v
+	}
+	return map[string]any{
+		"accountId":    rq.acct.user,
+		"oldState":     oldState,
+		"newState":     newState,
+		"created":      orNil(len(created), created),
+		"notCreated":   orNil(len(notCreated), notCreated),
+		"updated":      orNil(len(updated), updated),
+		"notUpdated":   orNil(len(notUpdated), notUpdated),
+		"destroyed":    orNil(len(destroyed), destroyed),
+		"notDestroyed": orNil(len(notDestroyed), notDestroyed),
+	}
+}
@@ -0,0 +1,343 @@
+package jmap
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+var sortOptions = []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword"}
+
+// emailFilter is either a FilterOperator or a FilterCondition, RFC 8621
+// section 4.4.1
+type emailFilter struct {
+	Operator   string         `json:"operator"`
+	Conditions []*emailFilter `json:"conditions"`
+
+	InMailbox          *string  `json:"inMailbox"`
+	InMailboxOtherThan []string `json:"inMailboxOtherThan"`
+	Before             *string  `json:"before"`
+	After              *string  `json:"after"`
+	MinSize            *int64   `json:"minSize"`
+	MaxSize            *int64   `json:"maxSize"`
+	HasKeyword         *string  `json:"hasKeyword"`
+	NotKeyword         *string  `json:"notKeyword"`
+	HasAttachment      *bool    `json:"hasAttachment"`
+	Text               *string  `json:"text"`
+	From               *string  `json:"from"`
+	To                 *string  `json:"to"`
+	Cc                 *string  `json:"cc"`
+	Bcc                *string  `json:"bcc"`
+	Subject            *string  `json:"subject"`
+	Body               *string  `json:"body"`
+	Header             []string `json:"header"`
+	before, after      time.Time
+}
+
+type emailSort struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Keyword     string `json:"keyword"`
+}
+
+// prepare checks the filter and parses its dates once
+func (f *emailFilter) prepare(rq *request) *methodError {
+	if f == nil {
+		return nil
+	}
+	if f.Operator != "" {
+		switch f.Operator {
+		case "AND", "OR", "NOT":
+		default:
+			return &methodError{"unsupportedFilter", "unknown operator " + f.Operator}
+		}
+		for _, c := range f.Conditions {
+			if err := c.prepare(rq); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if f.Before != nil {
+		if f.before, err = time.Parse(time.RFC3339, *f.Before); err != nil {
+			return invalidArguments("bad before date")
+		}
+	}
+	if f.After != nil {
+		if f.after, err = time.Parse(time.RFC3339, *f.After); err != nil {
+			return invalidArguments("bad after date")
+		}
+	}
+	if f.InMailbox != nil {
+		id := rq.id(*f.InMailbox)
+		f.InMailbox = &id
+	}
+	if f.HasAttachment != nil {
+		return &methodError{"unsupportedFilter", "hasAttachment"}
+	}
+	return nil
+}
+
+// matcher holds what a filter needs to look at for one message, the body is
+// only read if something asks for it
+type matcher struct {
+	ref  emailRef
+	e    *maildir.IndexEntry
+	body *string
+}
+
+func (m *matcher) text() string {
+	if m.body == nil {
+		s := ""
+		if data, err := m.ref.read(); err == nil {
+			root := parseBody(data, "", "text/plain")
+			text, html, _ := bodies(root)
+			var b strings.Builder
+			for _, p := range append(text, html...) {
+				t, _ := p.text()
+				if p.typ == "text/html" {
+					t = stripTags(t)
+				}
+				b.WriteString(t)
+				b.WriteByte('\n')
+			}
+			s = strings.ToLower(b.String())
+		}
+		m.body = &s
+	}
+	return *m.body
+}
+
+func contains(haystack, needle string) bool {
+	return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+}
+
+func (f *emailFilter) match(m *matcher) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Operator {
+	case "AND":
+		for _, c := range f.Conditions {
+			if !c.match(m) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, c := range f.Conditions {
+			if c.match(m) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, c := range f.Conditions {
+			if c.match(m) {
+				return false
+			}
+		}
+		return true
+	}
+
+	msg, e := m.ref.msg, m.e
+	kw := keywords(msg.Flags)
+	switch {
+	case f.InMailbox != nil && *f.InMailbox != m.ref.f.id,
+		slices.Contains(f.InMailboxOtherThan, m.ref.f.id),
+		f.Before != nil && !msg.Date.Before(f.before),
+		f.After != nil && msg.Date.Before(f.after),
+		f.MinSize != nil && msg.Size < *f.MinSize,
+		f.MaxSize != nil && msg.Size >= *f.MaxSize,
+		f.HasKeyword != nil && !kw[strings.ToLower(*f.HasKeyword)],
+		f.NotKeyword != nil && kw[strings.ToLower(*f.NotKeyword)],
+		f.From != nil && !contains(e.From, *f.From),
+		f.To != nil && !contains(e.To, *f.To),
+		f.Cc != nil && !contains(e.Cc, *f.Cc),
+		f.Bcc != nil && !contains(e.Bcc, *f.Bcc),
+		f.Subject != nil && !contains(e.Subject, *f.Subject),
+		f.Body != nil && !strings.Contains(m.text(), strings.ToLower(*f.Body)):
+		return false
+	}
+	if f.Text != nil {
+		t := *f.Text
+		if !contains(e.From, t) && !contains(e.To, t) && !contains(e.Cc, t) && !contains(e.Bcc, t) &&
+			!contains(e.Subject, t) && !strings.Contains(m.text(), strings.ToLower(t)) {
+			return false
+		}
+	}
+	if len(f.Header) > 0 {
+		data, err := m.ref.read()
+		if err != nil {
+			return false
+		}
+		fields, _ := splitHeader(data)
+		found := false
+		for _, hf := range fields {
+			if strings.EqualFold(strings.TrimSpace(hf.Name), f.Header[0]) &&
+				(len(f.Header) < 2 || contains(decodeHeader(hf.Value), f.Header[1])) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// baseSubject strips reply and forward prefixes, roughly RFC 5256's base
+// subject
+func baseSubject(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for {
+		trimmed := s
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		if trimmed == s {
+			return s
+		}
+		s = trimmed
+	}
+}
+
+func emailQuery(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		Filter          *emailFilter `json:"filter"`
+		Sort            []emailSort  `json:"sort"`
+		Position        int          `json:"position"`
+		Anchor          *string      `json:"anchor"`
+		AnchorOffset    int          `json:"anchorOffset"`
+		Limit           *int         `json:"limit"`
+		CalculateTotal  bool         `json:"calculateTotal"`
+		CollapseThreads bool         `json:"collapseThreads"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if err := args.Filter.prepare(rq); err != nil {
+		return nil, err
+	}
+	for _, c := range args.Sort {
+		if !slices.Contains(sortOptions, c.Property) {
+			return nil, &methodError{"unsupportedSort", c.Property}
+		}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []*matcher{}
+	for _, f := range s.folders {
+		for _, msg := range f.mb.Messages {
+			m := &matcher{ref: emailRef{f, msg}, e: f.index[msg.Key]}
+			if m.e == nil {
+				m.e = &maildir.IndexEntry{Key: msg.Key}
+			}
+			if args.Filter.match(m) {
+				matches = append(matches, m)
+			}
+		}
+	}
+
+	// newest first unless told otherwise
+	slices.SortStableFunc(matches, func(a, b *matcher) int {
+		for _, c := range args.Sort {
+			if r := compareBy(c, a, b); r != 0 {
+				if c.IsAscending != nil && !*c.IsAscending {
+					return -r
+				}
+				return r
+			}
+		}
+		if len(args.Sort) == 0 {
+			if r := b.ref.msg.Date.Compare(a.ref.msg.Date); r != 0 {
+				return r
+			}
+		}
+		return strings.Compare(a.ref.msg.Key, b.ref.msg.Key)
+	})
+
+	ids := []string{}
+	seenThreads := map[string]bool{}
+	for _, m := range matches {
+		if args.CollapseThreads {
+			t := s.threadOf(m.ref)
+			if seenThreads[t] {
+				continue
+			}
+			seenThreads[t] = true
+		}
+		ids = append(ids, emailID(m.ref.msg.Key))
+	}
+	total := len(ids)
+
+	position := args.Position
+	if args.Anchor != nil {
+		i := slices.Index(ids, rq.id(*args.Anchor))
+		if i < 0 {
+			return nil, &methodError{Type: "anchorNotFound"}
+		}
+		position = max(i+args.AnchorOffset, 0)
+	} else if position < 0 {
+		position = max(total+position, 0)
+	}
+	position = min(position, total)
+	ids = ids[position:]
+	if args.Limit != nil {
+		if *args.Limit < 0 {
+			return nil, invalidArguments("limit can't be negative")
+		}
+		ids = ids[:min(*args.Limit, len(ids))]
+	}
+
+	resp := map[string]any{
+		"accountId":           rq.acct.user,
+		"queryState":          stateOf(s.folders),
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+		"collapseThreads":     args.CollapseThreads,
+	}
+	if args.CalculateTotal {
+		resp["total"] = total
+	}
+	return resp, nil
+}
+
+func compareBy(c emailSort, a, b *matcher) int {
+	switch c.Property {
+	case "receivedAt":
+		return a.ref.msg.Date.Compare(b.ref.msg.Date)
+	case "sentAt":
+		return a.e.Date.Compare(b.e.Date)
+	case "size":
+		return cmp.Compare(a.ref.msg.Size, b.ref.msg.Size)
+	case "from":
+		return strings.Compare(strings.ToLower(a.e.From), strings.ToLower(b.e.From))
+	case "to":
+		return strings.Compare(strings.ToLower(a.e.To), strings.ToLower(b.e.To))
+	case "subject":
+		return strings.Compare(baseSubject(a.e.Subject), baseSubject(b.e.Subject))
+	case "hasKeyword":
+		ka, kb := keywords(a.ref.msg.Flags)[strings.ToLower(c.Keyword)], keywords(b.ref.msg.Flags)[strings.ToLower(c.Keyword)]
+		switch {
+		case ka == kb:
+			return 0
+		case ka:
+			return 1
+		default:
+			return -1
+		}
+	}
+	return 0
+}
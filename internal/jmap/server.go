@@ -0,0 +1,467 @@
+// Package jmap serves the maildirs under BoxesDir over JMAP, RFC 8620 (core)
+// and RFC 8621 (mail)
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+const (
+	capCore       = "urn:ietf:params:jmap:core"
+	capMail       = "urn:ietf:params:jmap:mail"
+	capSubmission = "urn:ietf:params:jmap:submission"
+
+	maxSizeUpload     = 50 * 1024 * 1024
+	maxSizeRequest    = 10 * 1024 * 1024
+	maxCallsInRequest = 64
+	maxObjectsInGet   = 1000
+	maxObjectsInSet   = 1000
+
+	apiPath         = "/jmap/api"
+	downloadPath    = "/jmap/download/"
+	uploadPath      = "/jmap/upload/"
+	eventSourcePath = "/jmap/eventsource"
+)
+
+// methodError is a method level error, it's sent back as an "error"
+// response in place of the method's result
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(format string, args ...any) *methodError {
+	return &methodError{"invalidArguments", fmt.Sprintf(format, args...)}
+}
+
+var errServerFail = &methodError{Type: "serverFail"}
+
+// setError is an error for one object in a /set call
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+type method struct {
+	fn func(r *request, args json.RawMessage) (any, error)
+	// capability the client has to be using to call it
+	capability string
+}
+
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"Core/echo":            {coreEcho, capCore},
+		"Mailbox/get":          {mailboxGet, capMail},
+		"Mailbox/changes":      {noChanges, capMail},
+		"Mailbox/query":        {mailboxQuery, capMail},
+		"Mailbox/queryChanges": {noQueryChanges, capMail},
+		"Mailbox/set":          {mailboxSet, capMail},
+		"Thread/get":           {threadGet, capMail},
+		"Thread/changes":       {noChanges, capMail},
+		"Email/get":            {emailGet, capMail},
+		"Email/changes":        {noChanges, capMail},
+		"Email/query":          {emailQuery, capMail},
+		"Email/queryChanges":   {noQueryChanges, capMail},
+		"Email/set":            {emailSet, capMail},
+		"Email/import":         {emailImport, capMail},
+		"Identity/get":         {identityGet, capSubmission},
+		"Identity/changes":     {noChanges, capSubmission},
+		"EmailSubmission/get":  {submissionGet, capSubmission},
+		"EmailSubmission/set":  {submissionSet, capSubmission},
+	}
+}
+
+// Handler serves JMAP. Every request needs HTTP Basic auth with a user's
+// credentials, so only serve it over TLS.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jmap", withAuth(serveSession))
+	mux.HandleFunc("POST "+apiPath, withAuth(serveAPI))
+	mux.HandleFunc("GET "+downloadPath+"{account}/{blob}/{name}", withAuth(serveDownload))
+	mux.HandleFunc("POST "+uploadPath+"{account}/", withAuth(serveUpload))
+	mux.HandleFunc("GET "+eventSourcePath, withAuth(serveEventSource))
+	return mux
+}
+
+// account is the logged in user. Their account ID is their user name.
+type account struct {
+	user string
+	dir  string
+}
+
+func withAuth(h func(w http.ResponseWriter, r *http.Request, a *account)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		name, authed := "", false
+		if ok {
+			name, authed = users.Authenticate(user, pass)
+		}
+		if !authed {
+			if ok {
+				slog.Info("JMAP login failed", "addr", r.RemoteAddr, "user", user)
+				// slow down password guessing
+				time.Sleep(2 * time.Second)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="jums"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		conf := config.GetConfig()
+		dir, err := maildir.UserDir(conf.Mailbox(name))
+		if err == nil {
+			err = maildir.Create(dir)
+		}
+		if err != nil {
+			slog.Error("Couldn't create INBOX", "user", name, "err", err.Error())
+			http.Error(w, "Can't open mailbox", http.StatusInternalServerError)
+			return
+		}
+		h(w, r, &account{name, dir})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Couldn't write JMAP response", "err", err.Error())
+	}
+}
+
+// requestError is a problem with the request as a whole, RFC 7807
+func requestError(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": typ, "status": status, "detail": detail})
+}
+
+func serveSession(w http.ResponseWriter, r *http.Request, a *account) {
+	conf := config.GetConfig()
+	state, err := a.state()
+	if err != nil {
+		slog.Error("Couldn't load JMAP state", "user", a.user, "err", err.Error())
+		http.Error(w, "Can't open mailbox", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"capabilities": map[string]any{
+			capCore: map[string]any{
+				"maxSizeUpload":         maxSizeUpload,
+				"maxConcurrentUpload":   4,
+				"maxSizeRequest":        maxSizeRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       maxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			capMail:       map[string]any{},
+			capSubmission: map[string]any{},
+		},
+		"accounts": map[string]any{
+			a.user: map[string]any{
+				"name":       conf.AccountAddress(a.user),
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]any{
+					capMail: map[string]any{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": maxSizeUpload,
+						"emailQuerySortOptions":      sortOptions,
+						"mayCreateTopLevelMailbox":   true,
+					},
+					capSubmission: map[string]any{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]any{},
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{
+			capMail:       a.user,
+			capSubmission: a.user,
+		},
+		"username":       a.user,
+		"apiUrl":         apiPath,
+		"downloadUrl":    downloadPath + "{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":      uploadPath + "{accountId}/",
+		"eventSourceUrl": eventSourcePath + "?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          state,
+	})
+}
+
+// request is one API request, which can make several method calls
+type request struct {
+	acct  *account
+	using []string
+	// the client's address, for the Received header on submissions
+	remote string
+	// creation IDs from /set and /import calls, to what they were created as
+	createdIDs map[string]string
+	// calls can produce more than one response, e.g. EmailSubmission/set
+	// with onSuccessUpdateEmail
+	extra [][3]any
+	// loaded on first use, and thrown away by anything that changes it
+	snap *snapshot
+}
+
+type apiRequest struct {
+	Using       []string             `json:"using"`
+	MethodCalls [][3]json.RawMessage `json:"methodCalls"`
+	CreatedIDs  map[string]string    `json:"createdIds,omitempty"`
+}
+
+func serveAPI(w http.ResponseWriter, r *http.Request, a *account) {
+	var req apiRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSizeRequest+1))
+	if err != nil {
+		return
+	}
+	if len(body) > maxSizeRequest {
+		requestError(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "Request too large")
+		return
+	}
+	if err = json.Unmarshal(body, &req); err != nil {
+		requestError(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", err.Error())
+		return
+	}
+	for _, u := range req.Using {
+		if u != capCore && u != capMail && u != capSubmission {
+			requestError(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:unknownCapability", u)
+			return
+		}
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		requestError(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "Too many method calls")
+		return
+	}
+
+	rq := &request{acct: a, using: req.Using, remote: r.RemoteAddr, createdIDs: req.CreatedIDs}
+	if rq.createdIDs == nil {
+		rq.createdIDs = map[string]string{}
+	}
+	responses := [][3]any{}
+	for _, call := range req.MethodCalls {
+		var name, callID string
+		if json.Unmarshal(call[0], &name) != nil || json.Unmarshal(call[2], &callID) != nil {
+			requestError(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", "Bad method call")
+			return
+		}
+
+		result, err := rq.call(name, call[1], responses)
+		if err != nil {
+			var me *methodError
+			if !errors.As(err, &me) {
+				slog.Error("JMAP method failed", "user", a.user, "method", name, "err", err.Error())
+				me = errServerFail
+			}
+			responses = append(responses, [3]any{"error", me, callID})
+			continue
+		}
+		responses = append(responses, [3]any{name, result, callID})
+		for _, extra := range rq.extra {
+			extra[2] = callID
+			responses = append(responses, extra)
+		}
+		rq.extra = nil
+	}
+
+	state, err := a.state()
+	if err != nil {
+		slog.Error("Couldn't load JMAP state", "user", a.user, "err", err.Error())
+	}
+	resp := map[string]any{"methodResponses": responses, "sessionState": state}
+	if req.CreatedIDs != nil {
+		resp["createdIds"] = rq.createdIDs
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (rq *request) call(name string, raw json.RawMessage, previous [][3]any) (any, error) {
+	m, ok := methods[name]
+	if !ok {
+		return nil, &methodError{Type: "unknownMethod"}
+	}
+	if !rq.uses(m.capability) {
+		return nil, &methodError{"unknownMethod", "Not using " + m.capability}
+	}
+
+	args, err := resolveReferences(raw, previous)
+	if err != nil {
+		return nil, err
+	}
+	// every method but Core/echo has an accountId and it has to be ours
+	if name != "Core/echo" {
+		var acct struct {
+			AccountID string `json:"accountId"`
+		}
+		json.Unmarshal(args, &acct)
+		if acct.AccountID != rq.acct.user {
+			return nil, &methodError{Type: "accountNotFound"}
+		}
+	}
+	return m.fn(rq, args)
+}
+
+func (rq *request) uses(capability string) bool {
+	for _, u := range rq.using {
+		if u == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// id looks up an ID that might be a "#creationId" from earlier in the request
+func (rq *request) id(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if real, ok := rq.createdIDs[id[1:]]; ok {
+			return real
+		}
+	}
+	return id
+}
+
+// resultReference is a "#name" argument, RFC 8620 section 3.7
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces any "#arg" result references in args with the
+// values they point at
+func resolveReferences(raw json.RawMessage, previous [][3]any) (json.RawMessage, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+
+	changed := false
+	for k, v := range args {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		if _, both := args[k[1:]]; both {
+			return nil, invalidArguments("both %s and #%s given", k[1:], k[1:])
+		}
+		var ref resultReference
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, &methodError{"invalidResultReference", err.Error()}
+		}
+
+		var found any
+		ok := false
+		for _, p := range previous {
+			if p[2] == ref.ResultOf && p[0] == ref.Name {
+				// round trip to get plain maps and slices
+				b, _ := json.Marshal(p[1])
+				json.Unmarshal(b, &found)
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, &methodError{"invalidResultReference", "no result for " + ref.ResultOf}
+		}
+		value, err := evalPointer(found, ref.Path)
+		if err != nil {
+			return nil, &methodError{"invalidResultReference", err.Error()}
+		}
+		b, _ := json.Marshal(value)
+		delete(args, k)
+		args[k[1:]] = b
+		changed = true
+	}
+	if !changed {
+		return raw, nil
+	}
+	return json.Marshal(args)
+}
+
+// evalPointer evaluates a JSON pointer with JMAP's "*" extension, which maps
+// over an array and flattens the results
+func evalPointer(v any, path string) (any, error) {
+	if path == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+	token, rest, more := strings.Cut(path[1:], "/")
+	if more {
+		rest = "/" + rest
+	}
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+	switch t := v.(type) {
+	case map[string]any:
+		next, ok := t[token]
+		if !ok {
+			return nil, fmt.Errorf("no %s in result", token)
+		}
+		return evalPointer(next, rest)
+	case []any:
+		if token != "*" {
+			var i int
+			if _, err := fmt.Sscanf(token, "%d", &i); err != nil || i < 0 || i >= len(t) {
+				return nil, fmt.Errorf("bad index %s", token)
+			}
+			return evalPointer(t[i], rest)
+		}
+		out := []any{}
+		for _, item := range t {
+			r, err := evalPointer(item, rest)
+			if err != nil {
+				return nil, err
+			}
+			if arr, ok := r.([]any); ok {
+				out = append(out, arr...)
+			} else {
+				out = append(out, r)
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("can't look up %s in a %T", token, v)
+	}
+}
+
+func coreEcho(r *request, args json.RawMessage) (any, error) {
+	return args, nil
+}
+
+// changes aren't tracked per object, clients have to refetch
+func noChanges(r *request, args json.RawMessage) (any, error) {
+	return nil, &methodError{Type: "cannotCalculateChanges"}
+}
+
+func noQueryChanges(r *request, args json.RawMessage) (any, error) {
+	return nil, &methodError{Type: "cannotCalculateChanges"}
+}
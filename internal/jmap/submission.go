@@ -0,0 +1,270 @@
+package jmap
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+)
+
+// every account has the one identity, its own address
+func (a *account) identityID() string {
+	return "i" + a.user
+}
+
+func (a *account) address() string {
+	return config.GetConfig().AccountAddress(a.user)
+}
+
+func identityGet(rq *request, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	identity := map[string]any{
+		"id":            rq.acct.identityID(),
+		"name":          "",
+		"email":         rq.acct.address(),
+		"replyTo":       nil,
+		"bcc":           nil,
+		"textSignature": "",
+		"htmlSignature": "",
+		"mayDelete":     false,
+	}
+
+	list, notFound := []any{}, []string{}
+	if args.IDs == nil {
+		list = append(list, filterProperties(identity, args.Properties))
+	} else {
+		for _, id := range *args.IDs {
+			if id != rq.acct.identityID() {
+				notFound = append(notFound, id)
+				continue
+			}
+			list = append(list, filterProperties(identity, args.Properties))
+		}
+	}
+	return map[string]any{
+		"accountId": rq.acct.user,
+		"state":     "0",
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// submissions go straight into the outbound queue, there's nothing to keep
+// track of once they're there
+func submissionGet(rq *request, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	notFound := []string{}
+	if args.IDs != nil {
+		notFound = *args.IDs
+	}
+	return map[string]any{
+		"accountId": rq.acct.user,
+		"state":     "0",
+		"list":      []any{},
+		"notFound":  notFound,
+	}, nil
+}
+
+type envelopeAddress struct {
+	Email string `json:"email"`
+}
+
+type submissionCreate struct {
+	IdentityID string `json:"identityId"`
+	EmailID    string `json:"emailId"`
+	Envelope   *struct {
+		MailFrom envelopeAddress   `json:"mailFrom"`
+		RcptTo   []envelopeAddress `json:"rcptTo"`
+	} `json:"envelope"`
+}
+
+func submissionSet(rq *request, raw json.RawMessage) (any, error) {
+	var args struct {
+		Create                map[string]submissionCreate           `json:"create"`
+		Update                map[string]json.RawMessage            `json:"update"`
+		Destroy               []string                              `json:"destroy"`
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%s", err.Error())
+	}
+	if len(args.Create) > maxObjectsInSet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+
+	created, notCreated := map[string]any{}, map[string]setError{}
+	// submission ID to the email it sent
+	sent := map[string]string{}
+	for cid, sub := range args.Create {
+		id, serr := rq.submit(sub)
+		if serr != nil {
+			notCreated[cid] = *serr
+			continue
+		}
+		rq.createdIDs[cid] = id
+		sent[id] = rq.id(sub.EmailID)
+		created[cid] = map[string]any{
+			"id":         id,
+			"sendAt":     time.Now().UTC().Format(time.RFC3339),
+			"undoStatus": "final",
+		}
+	}
+
+	// once queued a submission can't be changed or cancelled
+	notUpdated, notDestroyed := map[string]setError{}, map[string]setError{}
+	for id := range args.Update {
+		notUpdated[id] = setError{Type: "cannotUnsend"}
+	}
+	for _, id := range args.Destroy {
+		notDestroyed[id] = setError{Type: "notFound"}
+	}
+	resp := setResponse(rq, "0", "0", created, notCreated, nil, notUpdated, nil, notDestroyed)
+
+	if len(args.OnSuccessUpdateEmail)+len(args.OnSuccessDestroyEmail) > 0 {
+		rq.emailsAfterSubmission(sent, args.OnSuccessUpdateEmail, args.OnSuccessDestroyEmail)
+	}
+	return resp, nil
+}
+
+// submit queues an email for sending and returns the submission's ID
+func (rq *request) submit(sub submissionCreate) (string, *setError) {
+	if sub.IdentityID != rq.acct.identityID() {
+		return "", &setError{Type: "invalidProperties", Properties: []string{"identityId"}}
+	}
+	s, err := rq.snapshot()
+	if err != nil {
+		return "", &setError{Type: "serverFail"}
+	}
+	ref, ok := s.emails[rq.id(sub.EmailID)]
+	if !ok {
+		return "", &setError{Type: "invalidProperties", Properties: []string{"emailId"}}
+	}
+	data, err := ref.read()
+	if err != nil {
+		return "", &setError{Type: "serverFail", Description: err.Error()}
+	}
+
+	from, _ := mail.NewAddress(rq.acct.address())
+	m := &mail.Mail{From: from, Data: data}
+
+	// the envelope defaults to the message's recipients, From is always the
+	// account's own address so nobody can send as someone else
+	rcpts := []string{}
+	if sub.Envelope != nil {
+		if !strings.EqualFold(sub.Envelope.MailFrom.Email, rq.acct.address()) {
+			return "", &setError{Type: "forbiddenMailFrom"}
+		}
+		for _, r := range sub.Envelope.RcptTo {
+			rcpts = append(rcpts, r.Email)
+		}
+	} else {
+		root := parseBody(data, "", "text/plain")
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			list, _ := addresses(root.header, name).([]map[string]any)
+			for _, a := range list {
+				rcpts = append(rcpts, a["email"].(string))
+			}
+		}
+	}
+	for _, r := range rcpts {
+		addr, err := mail.NewAddress(r)
+		if err != nil {
+			return "", &setError{Type: "invalidRecipients", Description: err.Error()}
+		}
+		m.Rcpt = append(m.Rcpt, *addr)
+	}
+	if len(m.Rcpt) == 0 {
+		return "", &setError{Type: "noRecipients"}
+	}
+	m.RemoveHeader("Bcc")
+
+	if err = m.GenerateId(); err != nil {
+		return "", &setError{Type: "serverFail", Description: err.Error()}
+	}
+	conf := config.GetConfig()
+	host, _, err := net.SplitHostPort(rq.remote)
+	if err != nil {
+		host = rq.remote
+	}
+	m.Received = mail.PartialReceived{
+		From:      "from [" + host + "]",
+		By:        "by " + conf.Mxdomain,
+		With:      "with JMAP",
+		TlsInfo:   "(authenticated as " + rq.acct.user + ")",
+		Id:        "id " + m.Id,
+		Timestamp: time.Now().Local().Format("Mon, 02 Jan 2006 15:04:05 -0700 (MST)"),
+	}
+
+	// the same checks and filters as mail sent over SMTP submission
+	if sts := smtp.Submit(m, rq.acct.user, rq.remote); sts != nil {
+		desc := strings.TrimSpace(sts.String())
+		switch {
+		case sts.Code() == 553:
+			return "", &setError{Type: "forbiddenFrom", Description: desc}
+		case sts.Code() >= 500:
+			return "", &setError{Type: "forbiddenToSend", Description: desc}
+		default:
+			return "", &setError{Type: "serverFail", Description: desc}
+		}
+	}
+	return "s" + m.Id[:16], nil
+}
+
+// emailsAfterSubmission applies onSuccessUpdateEmail and
+// onSuccessDestroyEmail, which get their own implicit Email/set response
+func (rq *request) emailsAfterSubmission(sent map[string]string, update map[string]map[string]json.RawMessage, destroy []string) {
+	s, err := rq.snapshot()
+	if err != nil {
+		return
+	}
+	oldState := stateOf(s.folders)
+
+	emailFor := func(ref string) (string, bool) {
+		id, ok := sent[rq.id(ref)]
+		return id, ok
+	}
+	updated, notUpdated := map[string]any{}, map[string]setError{}
+	for ref, patch := range update {
+		id, ok := emailFor(ref)
+		if !ok {
+			continue
+		}
+		if serr := rq.updateEmail(id, patch); serr != nil {
+			notUpdated[id] = *serr
+			continue
+		}
+		updated[id] = nil
+	}
+	destroyed, notDestroyed := []string{}, map[string]setError{}
+	for _, ref := range destroy {
+		id, ok := emailFor(ref)
+		if !ok {
+			continue
+		}
+		if serr := rq.destroyEmail(id); serr != nil {
+			notDestroyed[id] = *serr
+			continue
+		}
+		destroyed = append(destroyed, id)
+	}
+
+	if s, err = rq.snapshot(); err != nil {
+		return
+	}
+	rq.extra = append(rq.extra, [3]any{
+		"Email/set",
+		setResponse(rq, oldState, stateOf(s.folders), nil, nil, updated, notUpdated, destroyed, notDestroyed),
+		nil,
+	})
+}
@@ -0,0 +1,67 @@
+package lists
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/Queueue0/jums/internal/config"
+)
+
+// UnsubscribePath is where one-click unsubscribe links go, under ListsURL
+const UnsubscribePath = "/lists/unsubscribe"
+
+// UnsubscribeURL is member's one-click unsubscribe link for list
+func UnsubscribeURL(list, member string) (string, error) {
+	conf := config.GetConfig()
+	token, err := Token(conf.ListsDir, list, member)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{"list": {list}, "member": {member}, "token": {token}}
+	return conf.ListsURL + UnsubscribePath + "?" + v.Encode(), nil
+}
+
+// Handler serves unsubscribe links, RFC 8058. Mail clients POST to them.
+// Following one with GET only shows a button, so a link scanner doesn't
+// unsubscribe anyone.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(UnsubscribePath, serveUnsubscribe)
+	return mux
+}
+
+func serveUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	conf := config.GetConfig()
+	q := r.URL.Query()
+	list, member, token := q.Get("list"), q.Get("member"), q.Get("token")
+	lc, ok := conf.List(list)
+	if !ok || !CheckToken(conf.ListsDir, list, member, token) {
+		http.Error(w, "This link isn't valid", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintf(w, `<!DOCTYPE html><title>Unsubscribe</title><form method="post"><p>Unsubscribe %s from %s?</p><button>Unsubscribe</button></form>`,
+			html.EscapeString(member), html.EscapeString(list))
+	case http.MethodPost:
+		l, err := Open(conf.ListsDir, lc.Address, lc.Members)
+		if err == nil {
+			_, err = l.Unsubscribe(member)
+		}
+		if err != nil {
+			slog.Error("Couldn't unsubscribe", "list", list, "member", member, "err", err.Error())
+			http.Error(w, "Something went wrong, please try again later", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Unsubscribed from list", "list", list, "member", member, "how", "one-click")
+		fmt.Fprintf(w, `<!DOCTYPE html><title>Unsubscribed</title><p>%s has been unsubscribed from %s.</p>`,
+			html.EscapeString(member), html.EscapeString(list))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
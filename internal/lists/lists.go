@@ -0,0 +1,332 @@
+// Package lists keeps the state of the mailing lists set up in config: who
+// has subscribed or unsubscribed by mail, requests waiting on a confirmation
+// or an owner, and bounce counts. Each list has a directory under ListsDir
+// named after its address.
+package lists
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	membersFile = "members"
+	bouncesFile = "bounces"
+	pendingDir  = "pending"
+	keyFile     = "key"
+
+	// confirmations and held posts are forgotten after this long
+	pendingExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	ErrNoSuchToken = errors.New("no such request, it may have expired")
+	ErrBadAddress  = errors.New("invalid list address")
+)
+
+var locks sync.Map
+
+type List struct {
+	dir string
+	// the members from config, who are on the list unless they've
+	// unsubscribed
+	static []string
+}
+
+// Open returns the state for the list at address. static is its members
+// from config.
+func Open(listsDir, address string, static []string) (*List, error) {
+	address = strings.ToLower(address)
+	if address == "" || strings.ContainsAny(address, "/\\\x00") || strings.HasPrefix(address, ".") {
+		return nil, fmt.Errorf("lists.Open: %w", ErrBadAddress)
+	}
+	dir := filepath.Join(listsDir, address)
+	if err := os.MkdirAll(filepath.Join(dir, pendingDir), 0700); err != nil {
+		return nil, fmt.Errorf("lists.Open: %w", err)
+	}
+	return &List{dir: dir, static: static}, nil
+}
+
+func (l *List) lock() func() {
+	m, _ := locks.LoadOrStore(l.dir, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// the members file has a line per address that subscribed by mail, and a
+// "-address" line for each static member that unsubscribed
+func (l *List) load() (added, removed []string, err error) {
+	f, err := os.Open(filepath.Join(l.dir, membersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if addr, ok := strings.CutPrefix(line, "-"); ok {
+			removed = append(removed, addr)
+		} else if line != "" {
+			added = append(added, line)
+		}
+	}
+	return added, removed, sc.Err()
+}
+
+func (l *List) save(added, removed []string) error {
+	var b strings.Builder
+	for _, a := range added {
+		fmt.Fprintf(&b, "%s\n", a)
+	}
+	for _, r := range removed {
+		fmt.Fprintf(&b, "-%s\n", r)
+	}
+	path := filepath.Join(l.dir, membersFile)
+	if err := os.WriteFile(path+".tmp", []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Members returns everyone on the list, sorted
+func (l *List) Members() ([]string, error) {
+	defer l.lock()()
+	added, removed, err := l.load()
+	if err != nil {
+		return nil, fmt.Errorf("lists.Members: %w", err)
+	}
+	members := []string{}
+	for _, m := range append(slices.Clone(l.static), added...) {
+		if !slices.Contains(removed, m) && !slices.Contains(members, m) {
+			members = append(members, m)
+		}
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+// IsMember reports whether addr is on the list
+func (l *List) IsMember(addr string) (bool, error) {
+	members, err := l.Members()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(members, strings.ToLower(addr)), nil
+}
+
+// Subscribe adds addr to the list, it's false if they were already on it
+func (l *List) Subscribe(addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+	defer l.lock()()
+	added, removed, err := l.load()
+	if err != nil {
+		return false, fmt.Errorf("lists.Subscribe: %w", err)
+	}
+	wasRemoved := slices.Contains(removed, addr)
+	if slices.Contains(added, addr) || (slices.Contains(l.static, addr) && !wasRemoved) {
+		return false, nil
+	}
+	removed = slices.DeleteFunc(removed, func(r string) bool { return r == addr })
+	if !slices.Contains(l.static, addr) {
+		added = append(added, addr)
+	}
+	if err = l.save(added, removed); err != nil {
+		return false, fmt.Errorf("lists.Subscribe: %w", err)
+	}
+	return true, nil
+}
+
+// Unsubscribe takes addr off the list, it's false if they weren't on it
+func (l *List) Unsubscribe(addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+	defer l.lock()()
+	added, removed, err := l.load()
+	if err != nil {
+		return false, fmt.Errorf("lists.Unsubscribe: %w", err)
+	}
+	static := slices.Contains(l.static, addr) && !slices.Contains(removed, addr)
+	if !static && !slices.Contains(added, addr) {
+		return false, nil
+	}
+	added = slices.DeleteFunc(added, func(a string) bool { return a == addr })
+	if static {
+		removed = append(removed, addr)
+	}
+	if err = l.save(added, removed); err != nil {
+		return false, fmt.Errorf("lists.Unsubscribe: %w", err)
+	}
+	l.clearBounces(addr)
+	return true, nil
+}
+
+// Request is something waiting on a confirmation or an owner's approval
+type Request struct {
+	// what's being asked for, e.g. "subscribe" or "post"
+	Kind string
+	// who it's for
+	Address string
+	// the message for held posts
+	Data []byte
+}
+
+// Hold stores a request and returns the token that releases it
+func (l *List) Hold(r Request) (string, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("lists.Hold: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	data := append([]byte(r.Kind+" "+r.Address+"\n"), r.Data...)
+	if err := os.WriteFile(filepath.Join(l.dir, pendingDir, token), data, 0600); err != nil {
+		return "", fmt.Errorf("lists.Hold: %w", err)
+	}
+	return token, nil
+}
+
+// Take returns the request for token and forgets it, so it can only be
+// acted on once
+func (l *List) Take(token string) (*Request, error) {
+	if token == "" || strings.ContainsAny(token, "/\\.") {
+		return nil, ErrNoSuchToken
+	}
+	defer l.lock()()
+	path := filepath.Join(l.dir, pendingDir, token)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ErrNoSuchToken
+	}
+	if time.Since(info.ModTime()) > pendingExpiry {
+		os.Remove(path)
+		return nil, ErrNoSuchToken
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("lists.Take: %w", err)
+	}
+	if err = os.Remove(path); err != nil {
+		return nil, fmt.Errorf("lists.Take: %w", err)
+	}
+
+	first, data, _ := strings.Cut(string(b), "\n")
+	kind, addr, _ := strings.Cut(first, " ")
+	return &Request{Kind: kind, Address: addr, Data: []byte(data)}, nil
+}
+
+// Expire forgets requests nobody acted on in time
+func (l *List) Expire() {
+	entries, err := os.ReadDir(filepath.Join(l.dir, pendingDir))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > pendingExpiry {
+			os.Remove(filepath.Join(l.dir, pendingDir, e.Name()))
+		}
+	}
+}
+
+// Bounced counts a bounce from a member and returns how many there have
+// been. The count starts over if they unsubscribe.
+func (l *List) Bounced(addr string) (int, error) {
+	addr = strings.ToLower(addr)
+	defer l.lock()()
+	counts := map[string]int{}
+	path := filepath.Join(l.dir, bouncesFile)
+	if b, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(b, &counts)
+	}
+	counts[addr]++
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return 0, fmt.Errorf("lists.Bounced: %w", err)
+	}
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		return 0, fmt.Errorf("lists.Bounced: %w", err)
+	}
+	return counts[addr], nil
+}
+
+// must be called with the lock held
+func (l *List) clearBounces(addr string) {
+	path := filepath.Join(l.dir, bouncesFile)
+	counts := map[string]int{}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(b, &counts)
+	if _, ok := counts[addr]; !ok {
+		return
+	}
+	delete(counts, addr)
+	if b, err = json.Marshal(counts); err == nil {
+		os.WriteFile(path, b, 0600)
+	}
+}
+
+var (
+	keyLock = &sync.Mutex{}
+	keys    = map[string][]byte{}
+)
+
+// key signs unsubscribe links. It's made the first time it's needed.
+func key(listsDir string) ([]byte, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	if k, ok := keys[listsDir]; ok {
+		return k, nil
+	}
+
+	path := filepath.Join(listsDir, keyFile)
+	k, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		k = make([]byte, 32)
+		if _, err = rand.Read(k); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(listsDir, 0700); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, k, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys[listsDir] = k
+	return k, nil
+}
+
+// Token is what proves an unsubscribe link was sent to member
+func Token(listsDir, list, member string) (string, error) {
+	k, err := key(listsDir)
+	if err != nil {
+		return "", fmt.Errorf("lists.Token: %w", err)
+	}
+	h := hmac.New(sha256.New, k)
+	h.Write([]byte(strings.ToLower(list) + "\x00" + strings.ToLower(member)))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18]), nil
+}
+
+// CheckToken reports whether token came from Token for list and member
+func CheckToken(listsDir, list, member, token string) bool {
+	want, err := Token(listsDir, list, member)
+	return err == nil && hmac.Equal([]byte(want), []byte(token))
+}
@@ -0,0 +1,59 @@
+package lists
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestMembers(t *testing.T) {
+	l, err := Open(t.TempDir(), "team@example.com", []string{"alice@example.com", "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := l.Subscribe("Carol@example.org"); !ok {
+		t.Error("couldn't subscribe carol")
+	}
+	if ok, _ := l.Subscribe("alice@example.com"); ok {
+		t.Error("alice subscribed twice")
+	}
+	if ok, _ := l.Unsubscribe("bob@example.com"); !ok {
+		t.Error("couldn't unsubscribe bob")
+	}
+	members, _ := l.Members()
+	if !slices.Equal(members, []string{"alice@example.com", "carol@example.org"}) {
+		t.Errorf("members = %q", members)
+	}
+
+	// a config member who left can come back
+	l.Subscribe("bob@example.com")
+	if ok, _ := l.IsMember("bob@example.com"); !ok {
+		t.Error("bob didn't resubscribe")
+	}
+}
+
+func TestHold(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := Open(dir, "team@example.com", nil)
+
+	token, err := l.Hold(Request{Kind: "post", Address: "alice@example.com", Data: []byte("Subject: hi\r\n\r\nhello\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := l.Take(token)
+	if err != nil || r.Kind != "post" || r.Address != "alice@example.com" || string(r.Data) != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Fatalf("Take = %+v, %v", r, err)
+	}
+	if _, err = l.Take(token); !errors.Is(err, ErrNoSuchToken) {
+		t.Errorf("second Take: %v", err)
+	}
+	if _, err = l.Take("../members"); !errors.Is(err, ErrNoSuchToken) {
+		t.Errorf("Take outside pending: %v", err)
+	}
+
+	tok, _ := Token(dir, "team@example.com", "alice@example.com")
+	if !CheckToken(dir, "team@example.com", "alice@example.com", tok) || CheckToken(dir, "team@example.com", "bob@example.com", tok) {
+		t.Error("unsubscribe token doesn't check out")
+	}
+}
@@ -0,0 +1,154 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const subscriptionsFile = "subscriptions"
+
+var ErrExists = errors.New("mailbox already exists")
+
+// Folders lists every folder in a user's maildir, INBOX first then the rest
+// sorted by name. Nested folders are separated with "/".
+func Folders(userDir string) ([]string, error) {
+	entries, err := os.ReadDir(userDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{"INBOX"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Folders: %w", err)
+	}
+
+	folders := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || len(name) < 2 || name[0] != '.' || name == ".." {
+			continue
+		}
+		if !Exists(filepath.Join(userDir, name)) {
+			continue
+		}
+		folders = append(folders, strings.ReplaceAll(name[1:], ".", "/"))
+	}
+	slices.Sort(folders)
+
+	return append([]string{"INBOX"}, folders...), nil
+}
+
+// CreateFolder makes a new empty folder
+func CreateFolder(userDir, folder string) error {
+	dir, err := FolderPath(userDir, folder)
+	if err != nil {
+		return fmt.Errorf("maildir.CreateFolder: %w", err)
+	}
+	if Exists(dir) {
+		return fmt.Errorf("maildir.CreateFolder: %w", ErrExists)
+	}
+	if err = Create(dir); err != nil {
+		return fmt.Errorf("maildir.CreateFolder: %w", err)
+	}
+	return nil
+}
+
+// DeleteFolder removes a folder and every message in it. Child folders are
+// left alone. INBOX can't be deleted.
+func DeleteFolder(userDir, folder string) error {
+	if strings.EqualFold(folder, "INBOX") {
+		return fmt.Errorf("maildir.DeleteFolder: %w", ErrInvalidName)
+	}
+	dir, err := FolderPath(userDir, folder)
+	if err != nil {
+		return fmt.Errorf("maildir.DeleteFolder: %w", err)
+	}
+	if !Exists(dir) {
+		return fmt.Errorf("maildir.DeleteFolder: %w", os.ErrNotExist)
+	}
+
+	unlock := Lock(dir)
+	defer unlock()
+	if err = os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("maildir.DeleteFolder: %w", err)
+	}
+	forgetUsage(userDir)
+	return nil
+}
+
+// RenameFolder renames a folder along with any children it has
+func RenameFolder(userDir, from, to string) error {
+	if strings.EqualFold(from, "INBOX") || strings.EqualFold(to, "INBOX") {
+		return fmt.Errorf("maildir.RenameFolder: %w", ErrInvalidName)
+	}
+	src, err := FolderPath(userDir, from)
+	if err != nil {
+		return fmt.Errorf("maildir.RenameFolder: %w", err)
+	}
+	dst, err := FolderPath(userDir, to)
+	if err != nil {
+		return fmt.Errorf("maildir.RenameFolder: %w", err)
+	}
+	if !Exists(src) {
+		return fmt.Errorf("maildir.RenameFolder: %w", os.ErrNotExist)
+	}
+	if Exists(dst) {
+		return fmt.Errorf("maildir.RenameFolder: %w", ErrExists)
+	}
+
+	folders, err := Folders(userDir)
+	if err != nil {
+		return fmt.Errorf("maildir.RenameFolder: %w", err)
+	}
+	for _, f := range folders {
+		if f != from && !strings.HasPrefix(f, from+"/") {
+			continue
+		}
+		oldDir, _ := FolderPath(userDir, f)
+		newDir, err := FolderPath(userDir, to+strings.TrimPrefix(f, from))
+		if err != nil {
+			return fmt.Errorf("maildir.RenameFolder: %w", err)
+		}
+		if err = os.Rename(oldDir, newDir); err != nil {
+			return fmt.Errorf("maildir.RenameFolder: %w", err)
+		}
+	}
+	return nil
+}
+
+// Subscriptions returns the folders a user is subscribed to
+func Subscriptions(userDir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(userDir, subscriptionsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Subscriptions: %w", err)
+	}
+	return strings.FieldsFunc(string(b), func(r rune) bool { return r == '\n' }), nil
+}
+
+// SetSubscribed subscribes or unsubscribes a user from folder
+func SetSubscribed(userDir, folder string, subscribed bool) error {
+	unlock := Lock(userDir)
+	defer unlock()
+
+	subs, err := Subscriptions(userDir)
+	if err != nil {
+		return err
+	}
+	subs = slices.DeleteFunc(subs, func(s string) bool { return s == folder })
+	if subscribed {
+		subs = append(subs, folder)
+	}
+
+	if err = os.MkdirAll(userDir, 0700); err != nil {
+		return fmt.Errorf("maildir.SetSubscribed: %w", err)
+	}
+	if err = writeFileAtomic(filepath.Join(userDir, subscriptionsFile), []byte(strings.Join(subs, "\n")+"\n")); err != nil {
+		return fmt.Errorf("maildir.SetSubscribed: %w", err)
+	}
+	return nil
+}
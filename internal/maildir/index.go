@@ -0,0 +1,197 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const indexFile = "jums-index"
+
+// IndexEntry holds the header fields that searching, sorting and threading
+// need, so they don't have to re-read every message
+type IndexEntry struct {
+	Key string `json:"k"`
+	// from the Date header, zero if it's missing or unparseable
+	Date       time.Time `json:"d,omitzero"`
+	Subject    string    `json:"s,omitempty"`
+	From       string    `json:"f,omitempty"`
+	To         string    `json:"t,omitempty"`
+	Cc         string    `json:"c,omitempty"`
+	Bcc        string    `json:"b,omitempty"`
+	MessageID  string    `json:"m,omitempty"`
+	InReplyTo  string    `json:"i,omitempty"`
+	References string    `json:"r,omitempty"`
+}
+
+var wordDecoder = &mime.WordDecoder{
+	// we can't convert other charsets, passing them through beats dropping
+	// the whole header
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	},
+}
+
+// NewIndexEntry parses the header of a raw message
+func NewIndexEntry(key string, data []byte) *IndexEntry {
+	e := &IndexEntry{Key: key}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return e
+	}
+
+	h := msg.Header
+	decode := func(name string) string {
+		v := h.Get(name)
+		if d, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = d
+		}
+		return strings.TrimSpace(v)
+	}
+
+	if d, err := h.Date(); err == nil {
+		e.Date = d
+	}
+	e.Subject = decode("Subject")
+	e.From = decode("From")
+	e.To = decode("To")
+	e.Cc = decode("Cc")
+	e.Bcc = decode("Bcc")
+	e.MessageID = strings.TrimSpace(h.Get("Message-Id"))
+	e.InReplyTo = strings.TrimSpace(h.Get("In-Reply-To"))
+	e.References = strings.TrimSpace(h.Get("References"))
+	return e
+}
+
+// Index returns index entries for msgs, keyed by message key. Messages that
+// aren't in the index yet are parsed and added to it.
+func Index(dir string, msgs []*Message) (map[string]*IndexEntry, error) {
+	unlock := Lock(dir)
+	defer unlock()
+
+	entries, lines, err := loadIndex(dir)
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Index: %w", err)
+	}
+
+	missing := []*IndexEntry{}
+	for _, m := range msgs {
+		if _, ok := entries[m.Key]; ok {
+			continue
+		}
+		data, err := readHeader(m.Path)
+		if err != nil {
+			// it's been expunged, leave it out
+			continue
+		}
+		e := NewIndexEntry(m.Key, data)
+		entries[m.Key] = e
+		missing = append(missing, e)
+	}
+
+	// the index only ever grows, rewrite it once it's mostly dead entries
+	if lines+len(missing) > 2*len(msgs)+100 {
+		live := make([]*IndexEntry, 0, len(msgs))
+		for _, m := range msgs {
+			if e, ok := entries[m.Key]; ok {
+				live = append(live, e)
+			}
+		}
+		err = rewriteIndex(dir, live)
+	} else if len(missing) > 0 {
+		err = appendIndex(dir, missing...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Index: %w", err)
+	}
+	return entries, nil
+}
+
+// addToIndex records a freshly delivered message, must not be called with the
+// lock held
+func addToIndex(dir, key string, data []byte) error {
+	unlock := Lock(dir)
+	defer unlock()
+	return appendIndex(dir, NewIndexEntry(key, data))
+}
+
+func loadIndex(dir string) (map[string]*IndexEntry, int, error) {
+	entries := map[string]*IndexEntry{}
+	f, err := os.Open(filepath.Join(dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	lines := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		lines++
+		e := &IndexEntry{}
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil || e.Key == "" {
+			// probably a torn write, the message just gets indexed again
+			continue
+		}
+		entries[e.Key] = e
+	}
+	return entries, lines, sc.Err()
+}
+
+func appendIndex(dir string, entries ...*IndexEntry) error {
+	f, err := os.OpenFile(filepath.Join(dir, indexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func rewriteIndex(dir string, entries []*IndexEntry) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, indexFile), b.Bytes())
+}
+
+// readHeader reads just enough of a message file to get its header
+func readHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		b.Write(line)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	return b.Bytes(), nil
+}
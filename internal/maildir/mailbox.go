@@ -0,0 +1,481 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Queueue0/jums/internal/notify"
+)
+
+const (
+	keywordsFile = "jums-keywords"
+	// maildir only has room for 26 keyword letters
+	maxKeywords = 26
+)
+
+// IMAP system flags and the maildir info letters they're stored as
+var flagLetters = map[string]byte{
+	`\Draft`:     'D',
+	`\Flagged`:   'F',
+	`$Forwarded`: 'P',
+	`\Answered`:  'R',
+	`\Seen`:      'S',
+	`\Deleted`:   'T',
+}
+
+var ErrNoSuchMessage = errors.New("no such message")
+
+var locks sync.Map
+
+// Lock takes the in-process lock for a maildir and returns the function to
+// release it. Anything that renames or removes messages, or touches the
+// uidlist, should hold it.
+func Lock(dir string) func() {
+	l, _ := locks.LoadOrStore(filepath.Clean(dir), &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+type Message struct {
+	UID uint32
+	// the part of the file name that doesn't change when flags do
+	Key string
+	// where the file is right now
+	Path string
+	// IMAP style flags, system flags and keywords
+	Flags []string
+	// true if this message was moved out of new by the Open call that
+	// returned it
+	Recent bool
+	Size   int64
+	// when the message was delivered, from the file's modification time
+	Date time.Time
+	// bumped every time the message's flags change, RFC 7162
+	ModSeq uint64
+}
+
+// HasFlag reports whether the message has flag, ignoring case
+func (m *Message) HasFlag(flag string) bool {
+	return slices.ContainsFunc(m.Flags, func(f string) bool {
+		return strings.EqualFold(f, flag)
+	})
+}
+
+// Mailbox is a snapshot of a maildir folder with stable IMAP style UIDs
+type Mailbox struct {
+	Dir           string
+	UIDValidity   uint32
+	UIDNext       uint32
+	HighestModSeq uint64
+	// sorted by UID
+	Messages []*Message
+	Keywords []string
+
+	vanished  []vanishedUID
+	forgotten uint64
+}
+
+// Open scans the maildir at dir, assigning UIDs to any messages that don't
+// have one yet. If claimNew is set messages in new are moved to cur and
+// marked Recent.
+func Open(dir string, claimNew bool) (*Mailbox, error) {
+	if !Exists(dir) {
+		return nil, fmt.Errorf("maildir.Open: %s: %w", dir, os.ErrNotExist)
+	}
+
+	unlock := Lock(dir)
+	defer unlock()
+
+	list, err := loadUIDList(dir)
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Open: %w", err)
+	}
+	mb := &Mailbox{Dir: dir}
+	if mb.Keywords, err = loadKeywords(dir); err != nil {
+		return nil, fmt.Errorf("maildir.Open: %w", err)
+	}
+
+	msgs, err := mb.scan(claimNew)
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Open: %w", err)
+	}
+
+	// oldest first so UIDs go up with delivery order
+	sort.Slice(msgs, func(i, j int) bool {
+		if !msgs[i].Date.Equal(msgs[j].Date) {
+			return msgs[i].Date.Before(msgs[j].Date)
+		}
+		return msgs[i].Key < msgs[j].Key
+	})
+
+	changed := false
+	seen := make(map[string]bool, len(msgs))
+	for _, m := range msgs {
+		seen[m.Key] = true
+		e, ok := list.entries[m.Key]
+		if !ok {
+			e = &uidEntry{uid: list.next, modSeq: list.bump()}
+			list.entries[m.Key] = e
+			list.next++
+			changed = true
+		}
+		m.UID = e.uid
+		m.ModSeq = e.modSeq
+	}
+	// anything that's gone was removed behind our back
+	for k := range list.entries {
+		if !seen[k] {
+			list.expunge(k)
+			changed = true
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].UID < msgs[j].UID })
+	mb.Messages = msgs
+	mb.setFrom(list)
+
+	if changed {
+		if err = list.save(dir); err != nil {
+			return nil, fmt.Errorf("maildir.Open: %w", err)
+		}
+	}
+	return mb, nil
+}
+
+func (mb *Mailbox) setFrom(list *uidList) {
+	mb.UIDValidity = list.validity
+	mb.UIDNext = list.next
+	mb.HighestModSeq = list.modSeq
+	mb.vanished = list.vanished
+	mb.forgotten = list.forgotten
+}
+
+// VanishedSince returns the UIDs expunged after modseq. If exact is false
+// the mailbox has forgotten some of them and the caller has to work out what
+// vanished some other way.
+func (mb *Mailbox) VanishedSince(modseq uint64) (uids []uint32, exact bool) {
+	uids = []uint32{}
+	for _, v := range mb.vanished {
+		if v.modSeq > modseq {
+			uids = append(uids, v.uid)
+		}
+	}
+	slices.Sort(uids)
+	return uids, modseq >= mb.forgotten
+}
+
+// ByUID finds a message by UID
+func (mb *Mailbox) ByUID(uid uint32) *Message {
+	i, ok := slices.BinarySearchFunc(mb.Messages, uid, func(m *Message, uid uint32) int {
+		return int(int64(m.UID) - int64(uid))
+	})
+	if !ok {
+		return nil
+	}
+	return mb.Messages[i]
+}
+
+// SetFlags replaces a message's flags, renaming the file to match
+func (mb *Mailbox) SetFlags(m *Message, flags []string) error {
+	unlock := Lock(mb.Dir)
+	defer unlock()
+
+	// another session may have added keywords since we opened the mailbox
+	if kw, err := loadKeywords(mb.Dir); err == nil {
+		mb.Keywords = kw
+	}
+
+	info, err := mb.infoFor(flags)
+	if err != nil {
+		return fmt.Errorf("maildir.SetFlags: %w", err)
+	}
+
+	newPath := filepath.Join(mb.Dir, "cur", m.Key+":2,"+info)
+	if newPath == m.Path {
+		// nothing changed
+		return nil
+	}
+	if err = os.Rename(m.Path, newPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("maildir.SetFlags: %w", ErrNoSuchMessage)
+		}
+		return fmt.Errorf("maildir.SetFlags: %w", err)
+	}
+	m.Path = newPath
+	m.Flags = mb.parseInfo(info)
+
+	list, err := loadUIDList(mb.Dir)
+	if err != nil {
+		return fmt.Errorf("maildir.SetFlags: %w", err)
+	}
+	if e, ok := list.entries[m.Key]; ok {
+		e.modSeq = list.bump()
+		m.ModSeq = e.modSeq
+		if err = list.save(mb.Dir); err != nil {
+			return fmt.Errorf("maildir.SetFlags: %w", err)
+		}
+		mb.setFrom(list)
+	}
+	notify.Publish(mb.Dir)
+	return nil
+}
+
+// Remove deletes a message from the maildir
+func (mb *Mailbox) Remove(m *Message) error {
+	unlock := Lock(mb.Dir)
+	defer unlock()
+
+	if err := os.Remove(m.Path); err == nil {
+		updateUsage(mb.Dir, -m.Size, -1)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("maildir.Remove: %w", err)
+	}
+	mb.Messages = slices.DeleteFunc(mb.Messages, func(o *Message) bool { return o == m })
+
+	list, err := loadUIDList(mb.Dir)
+	if err != nil {
+		return fmt.Errorf("maildir.Remove: %w", err)
+	}
+	if _, ok := list.entries[m.Key]; ok {
+		list.expunge(m.Key)
+		if err = list.save(mb.Dir); err != nil {
+			return fmt.Errorf("maildir.Remove: %w", err)
+		}
+		mb.setFrom(list)
+	}
+	notify.Publish(mb.Dir)
+	return nil
+}
+
+// Move moves a message into the maildir at toDir, keeping its key and flags.
+// It gets a new UID there the next time that maildir is opened.
+func (mb *Mailbox) Move(m *Message, toDir string) error {
+	if filepath.Clean(toDir) == filepath.Clean(mb.Dir) {
+		return nil
+	}
+	if err := Create(toDir); err != nil {
+		return fmt.Errorf("maildir.Move: %w", err)
+	}
+
+	// always lock in the same order so moves going the other way can't
+	// deadlock with us
+	first, second := filepath.Clean(mb.Dir), filepath.Clean(toDir)
+	if second < first {
+		first, second = second, first
+	}
+	unlockFirst := Lock(first)
+	defer unlockFirst()
+	unlockSecond := Lock(second)
+	defer unlockSecond()
+
+	// keyword letters are per maildir
+	dest := &Mailbox{Dir: toDir}
+	kw, err := loadKeywords(toDir)
+	if err != nil {
+		return fmt.Errorf("maildir.Move: %w", err)
+	}
+	dest.Keywords = kw
+	info, err := dest.infoFor(m.Flags)
+	if err != nil {
+		return fmt.Errorf("maildir.Move: %w", err)
+	}
+
+	if err = os.Rename(m.Path, filepath.Join(toDir, "cur", m.Key+":2,"+info)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("maildir.Move: %w", ErrNoSuchMessage)
+		}
+		return fmt.Errorf("maildir.Move: %w", err)
+	}
+	mb.Messages = slices.DeleteFunc(mb.Messages, func(o *Message) bool { return o == m })
+
+	list, err := loadUIDList(mb.Dir)
+	if err != nil {
+		return fmt.Errorf("maildir.Move: %w", err)
+	}
+	if _, ok := list.entries[m.Key]; ok {
+		list.expunge(m.Key)
+		if err = list.save(mb.Dir); err != nil {
+			return fmt.Errorf("maildir.Move: %w", err)
+		}
+		mb.setFrom(list)
+	}
+	notify.Publish(mb.Dir)
+	notify.Publish(toDir)
+	return nil
+}
+
+// Append adds a message straight into cur with the given flags and internal
+// date, and returns the UID it was given
+func Append(dir string, data []byte, flags []string, date time.Time) (uint32, error) {
+	if err := Create(dir); err != nil {
+		return 0, fmt.Errorf("maildir.Append: %w", err)
+	}
+
+	// nobody gets told about it until the flags are set, so an idling
+	// session can't move it out from under us
+	name, err := deliver(dir, data)
+	if err != nil {
+		return 0, fmt.Errorf("maildir.Append: %w", err)
+	}
+
+	newPath := filepath.Join(dir, "new", name)
+	if !date.IsZero() {
+		os.Chtimes(newPath, date, date)
+	}
+
+	mb, err := Open(dir, false)
+	if err != nil {
+		return 0, fmt.Errorf("maildir.Append: %w", err)
+	}
+	for _, m := range mb.Messages {
+		if m.Key != name {
+			continue
+		}
+		if err = mb.SetFlags(m, flags); err != nil {
+			return 0, fmt.Errorf("maildir.Append: %w", err)
+		}
+		return m.UID, nil
+	}
+	return 0, fmt.Errorf("maildir.Append: %w", ErrNoSuchMessage)
+}
+
+// must be called with the lock held
+func (mb *Mailbox) scan(claimNew bool) ([]*Message, error) {
+	msgs := []*Message{}
+	// anything claimed from new would otherwise turn up again in cur
+	seen := map[string]bool{}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(mb.Dir, sub))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			key, info, _ := strings.Cut(e.Name(), ":2,")
+			if seen[key] {
+				continue
+			}
+			path := filepath.Join(mb.Dir, sub, e.Name())
+			recent := false
+			if sub == "new" && claimNew {
+				np := filepath.Join(mb.Dir, "cur", key+":2,"+info)
+				if err := os.Rename(path, np); err != nil {
+					// someone else got to it first
+					continue
+				}
+				path = np
+				recent = true
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			seen[key] = true
+			msgs = append(msgs, &Message{
+				Key:    key,
+				Path:   path,
+				Flags:  mb.parseInfo(info),
+				Recent: recent,
+				Size:   fi.Size(),
+				Date:   fi.ModTime(),
+			})
+		}
+	}
+	return msgs, nil
+}
+
+func (mb *Mailbox) parseInfo(info string) []string {
+	flags := []string{}
+	for i := 0; i < len(info); i++ {
+		c := info[i]
+		if c >= 'a' && c <= 'z' {
+			if idx := int(c - 'a'); idx < len(mb.Keywords) {
+				flags = append(flags, mb.Keywords[idx])
+			}
+			continue
+		}
+		for f, l := range flagLetters {
+			if l == c {
+				flags = append(flags, f)
+			}
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// must be called with the lock held
+func (mb *Mailbox) infoFor(flags []string) (string, error) {
+	letters := []byte{}
+	for _, f := range flags {
+		if l, ok := systemFlagLetter(f); ok {
+			letters = append(letters, l)
+			continue
+		}
+		if strings.HasPrefix(f, `\`) {
+			// \Recent and friends aren't stored
+			continue
+		}
+
+		idx := slices.IndexFunc(mb.Keywords, func(k string) bool { return strings.EqualFold(k, f) })
+		if idx < 0 {
+			if len(mb.Keywords) >= maxKeywords {
+				return "", fmt.Errorf("too many keywords, can't add %s", f)
+			}
+			mb.Keywords = append(mb.Keywords, f)
+			if err := saveKeywords(mb.Dir, mb.Keywords); err != nil {
+				return "", err
+			}
+			idx = len(mb.Keywords) - 1
+		}
+		letters = append(letters, byte('a'+idx))
+	}
+
+	slices.Sort(letters)
+	return string(slices.Compact(letters)), nil
+}
+
+func systemFlagLetter(flag string) (byte, bool) {
+	for f, l := range flagLetters {
+		if strings.EqualFold(f, flag) {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+func loadKeywords(dir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, keywordsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+func saveKeywords(dir string, keywords []string) error {
+	return writeFileAtomic(filepath.Join(dir, keywordsFile), []byte(strings.Join(keywords, "\n")+"\n"))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
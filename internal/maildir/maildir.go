@@ -0,0 +1,126 @@
+// Package maildir reads and writes mailboxes in Maildir++ format. Each user
+// has a directory under BoxesDir, the INBOX lives directly in it and other
+// folders are dot-prefixed subdirectories, e.g. Junk is <user>/.Junk
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Queueue0/jums/internal/notify"
+)
+
+var ErrInvalidName = errors.New("invalid mailbox name")
+
+var deliveryCounter atomic.Uint64
+
+// UserDir returns the root maildir for user. Usernames are case folded so
+// Bob and bob share a mailbox.
+func UserDir(boxesDir, user string) (string, error) {
+	user = strings.ToLower(user)
+	if user == "" || strings.ContainsAny(user, "/\\\x00") || strings.HasPrefix(user, ".") {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(boxesDir, user), nil
+}
+
+// FolderPath returns the directory for folder within a user's maildir. An
+// empty folder or INBOX is the user directory itself, nested folders are
+// separated with "/" and stored as .Parent.Child
+func FolderPath(userDir, folder string) (string, error) {
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return userDir, nil
+	}
+
+	parts := strings.Split(folder, "/")
+	for _, p := range parts {
+		if p == "" || strings.ContainsAny(p, ".\\\x00") {
+			return "", ErrInvalidName
+		}
+	}
+	return filepath.Join(userDir, "."+strings.Join(parts, ".")), nil
+}
+
+// Create makes the tmp, new and cur directories for a maildir if they don't
+// already exist
+func Create(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("maildir.Create: %w", err)
+		}
+	}
+	return nil
+}
+
+// Exists reports whether dir looks like a maildir
+func Exists(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// Deliver writes data into dir's new directory, creating the maildir if
+// needed. It returns the file name it was delivered as.
+func Deliver(dir string, data []byte) (string, error) {
+	name, err := deliver(dir, data)
+	if err != nil {
+		return "", err
+	}
+	notify.Publish(dir)
+	return name, nil
+}
+
+func deliver(dir string, data []byte) (string, error) {
+	if err := Create(dir); err != nil {
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+
+	name := uniqueName(len(data))
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+	// the message must be on disk before it shows up in new
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+
+	if err = os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("maildir.Deliver: %w", err)
+	}
+	// not fatal, Index picks up anything that's missing
+	addToIndex(dir, name, data)
+	updateUsage(dir, int64(len(data)), 1)
+	return name, nil
+}
+
+// names look like 1700000000.M123456P42Q7.hostname,S=1234
+func uniqueName(size int) string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// these characters have special meaning in maildir names
+	host = strings.NewReplacer("/", "\\057", ":", "\\072", ",", "\\054").Replace(host)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveryCounter.Add(1), host, size)
+}
@@ -0,0 +1,252 @@
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maildir++ quota accounting, the limit on the first line and a line of
+	// "bytes count" for every change after that
+	sizeFile = "maildirsize"
+	// the limits jumsctl has set for this user, in the same format as the
+	// first line of maildirsize
+	limitFile = "jums-quota"
+
+	// the Maildir++ spec says to start over past this size, or when it's
+	// this old and says the user is over quota
+	maxSizeFile = 5120
+	maxSizeAge  = 15 * time.Minute
+)
+
+// Quota is a storage limit in bytes and a message count limit, 0 for no
+// limit
+type Quota struct {
+	Storage  int64
+	Messages int64
+}
+
+type Usage struct {
+	Bytes    int64
+	Messages int64
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%dS,%dC", q.Storage, q.Messages)
+}
+
+// IsZero reports whether there's no limit at all
+func (q Quota) IsZero() bool {
+	return q.Storage == 0 && q.Messages == 0
+}
+
+// Exceeded reports whether u plus a message of size would go over q
+func (q Quota) Exceeded(u Usage, size int64) bool {
+	return (q.Storage > 0 && u.Bytes+size > q.Storage) ||
+		(q.Messages > 0 && u.Messages+1 > q.Messages)
+}
+
+// ParseQuota reads a Maildir++ quota definition like "1000000S,1000C"
+func ParseQuota(s string) (Quota, error) {
+	q := Quota{}
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if len(part) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(part[:len(part)-1], 10, 64)
+		if err != nil || n < 0 {
+			return Quota{}, fmt.Errorf("maildir.ParseQuota: bad quota %q", s)
+		}
+		switch part[len(part)-1] {
+		case 'S':
+			q.Storage = n
+		case 'C':
+			q.Messages = n
+		}
+	}
+	return q, nil
+}
+
+// UserQuota returns the limits set for this user in particular, nil if
+// there aren't any
+func UserQuota(userDir string) (*Quota, error) {
+	b, err := os.ReadFile(filepath.Join(userDir, limitFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("maildir.UserQuota: %w", err)
+	}
+	q, err := ParseQuota(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// SetUserQuota sets this user's own limits, nil goes back to the defaults
+func SetUserQuota(userDir string, q *Quota) error {
+	path := filepath.Join(userDir, limitFile)
+	if q == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("maildir.SetUserQuota: %w", err)
+		}
+		return nil
+	}
+	if err := writeFileAtomic(path, []byte(q.String()+"\n")); err != nil {
+		return fmt.Errorf("maildir.SetUserQuota: %w", err)
+	}
+	return nil
+}
+
+// CurrentUsage returns what a user's maildir is using, from maildirsize if
+// it can be trusted or by counting everything and starting a new one
+func CurrentUsage(userDir string, q Quota) (Usage, error) {
+	path := filepath.Join(userDir, sizeFile)
+	if u, ok := readSizeFile(path, q); ok {
+		return u, nil
+	}
+
+	unlock := Lock(userDir)
+	defer unlock()
+	u, err := countUsage(userDir)
+	if err != nil {
+		return Usage{}, fmt.Errorf("maildir.CurrentUsage: %w", err)
+	}
+	if err = Create(userDir); err != nil {
+		return Usage{}, fmt.Errorf("maildir.CurrentUsage: %w", err)
+	}
+	data := fmt.Sprintf("%s\n%d %d\n", q.String(), u.Bytes, u.Messages)
+	if err = writeFileAtomic(path, []byte(data)); err != nil {
+		return Usage{}, fmt.Errorf("maildir.CurrentUsage: %w", err)
+	}
+	return u, nil
+}
+
+// readSizeFile adds up maildirsize, ok is false when it needs recalculating
+func readSizeFile(path string, q Quota) (Usage, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Usage{}, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() > maxSizeFile {
+		return Usage{}, false
+	}
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return Usage{}, false
+	}
+	if limit, err := ParseQuota(sc.Text()); err != nil || limit != q {
+		return Usage{}, false
+	}
+	u := Usage{}
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			// a half written line
+			return Usage{}, false
+		}
+		bytes, err1 := strconv.ParseInt(fields[0], 10, 64)
+		count, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return Usage{}, false
+		}
+		u.Bytes += bytes
+		u.Messages += count
+	}
+	if sc.Err() != nil || u.Bytes < 0 || u.Messages < 0 {
+		return Usage{}, false
+	}
+	if q.Exceeded(u, 0) && time.Since(info.ModTime()) > maxSizeAge {
+		return Usage{}, false
+	}
+	return u, true
+}
+
+// countUsage adds up every message in every folder
+func countUsage(userDir string) (Usage, error) {
+	folders, err := Folders(userDir)
+	if err != nil {
+		return Usage{}, err
+	}
+	u := Usage{}
+	for _, folder := range folders {
+		dir, err := FolderPath(userDir, folder)
+		if err != nil {
+			continue
+		}
+		for _, sub := range []string{"new", "cur"} {
+			entries, err := os.ReadDir(filepath.Join(dir, sub))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return Usage{}, err
+			}
+			for _, e := range entries {
+				if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+					continue
+				}
+				size, ok := sizeFromName(e.Name())
+				if !ok {
+					info, err := e.Info()
+					if err != nil {
+						// gone since we listed it
+						continue
+					}
+					size = info.Size()
+				}
+				u.Bytes += size
+				u.Messages++
+			}
+		}
+	}
+	return u, nil
+}
+
+// sizeFromName reads the S=1234 we put in message file names
+func sizeFromName(name string) (int64, bool) {
+	base, _, _ := strings.Cut(name, ":")
+	for _, field := range strings.Split(base, ",")[1:] {
+		if v, ok := strings.CutPrefix(field, "S="); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// userRoot is the user directory a folder belongs to
+func userRoot(dir string) string {
+	dir = filepath.Clean(dir)
+	if strings.HasPrefix(filepath.Base(dir), ".") {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// updateUsage records a change in maildirsize if there is one. Nobody's
+// using quotas if there isn't, and it'll be made from scratch when they do.
+func updateUsage(dir string, bytes, count int64) {
+	f, err := os.OpenFile(filepath.Join(userRoot(dir), sizeFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// one write so appends from other deliveries don't interleave
+	f.Write([]byte(fmt.Sprintf("%d %d\n", bytes, count)))
+}
+
+// forgetUsage makes the next CurrentUsage count everything again
+func forgetUsage(userDir string) {
+	os.Remove(filepath.Join(userDir, sizeFile))
+}
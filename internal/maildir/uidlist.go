@@ -0,0 +1,163 @@
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	uidlistFile = "jums-uidlist"
+	// how many expunged UIDs we remember for QRESYNC
+	maxVanished = 10000
+)
+
+// uidList is what's kept in the uidlist file:
+//
+//	V<uidvalidity> N<uidnext> M<highestmodseq> E<forgotten>
+//	<uid> <key> <modseq>
+//	- <uid> <modseq>
+//	...
+//
+// The "-" lines are recently expunged messages. forgotten is the newest
+// modseq of any expunge that's been dropped from that list.
+type uidList struct {
+	validity  uint32
+	next      uint32
+	modSeq    uint64
+	forgotten uint64
+	entries   map[string]*uidEntry
+	vanished  []vanishedUID
+}
+
+type uidEntry struct {
+	uid    uint32
+	modSeq uint64
+}
+
+type vanishedUID struct {
+	uid    uint32
+	modSeq uint64
+}
+
+// must be called with the lock held
+func loadUIDList(dir string) (*uidList, error) {
+	l := &uidList{entries: map[string]*uidEntry{}}
+	f, err := os.Open(filepath.Join(dir, uidlistFile))
+	if errors.Is(err, os.ErrNotExist) {
+		l.validity = uint32(time.Now().Unix())
+		l.next = 1
+		l.modSeq = 1
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return nil, fmt.Errorf("%s: empty uidlist", dir)
+	}
+	for _, field := range strings.Fields(sc.Text()) {
+		if len(field) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(field[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad uidlist header: %w", dir, err)
+		}
+		switch field[0] {
+		case 'V':
+			l.validity = uint32(n)
+		case 'N':
+			l.next = uint32(n)
+		case 'M':
+			l.modSeq = n
+		case 'E':
+			l.forgotten = n
+		}
+	}
+	if l.validity == 0 || l.next == 0 {
+		return nil, fmt.Errorf("%s: bad uidlist header", dir)
+	}
+	// lists from before modseqs were tracked
+	l.modSeq = max(l.modSeq, 1)
+
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "-" {
+			if len(fields) < 3 {
+				continue
+			}
+			uid, err1 := strconv.ParseUint(fields[1], 10, 32)
+			ms, err2 := strconv.ParseUint(fields[2], 10, 64)
+			if err1 == nil && err2 == nil {
+				l.vanished = append(l.vanished, vanishedUID{uint32(uid), ms})
+			}
+			continue
+		}
+
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		e := &uidEntry{uid: uint32(uid), modSeq: 1}
+		if len(fields) > 2 {
+			if ms, err := strconv.ParseUint(fields[2], 10, 64); err == nil {
+				e.modSeq = ms
+			}
+		}
+		l.entries[fields[1]] = e
+	}
+	return l, sc.Err()
+}
+
+func (l *uidList) save(dir string) error {
+	keys := make([]string, 0, len(l.entries))
+	for k := range l.entries {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return int(int64(l.entries[a].uid) - int64(l.entries[b].uid))
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "V%d N%d M%d E%d\n", l.validity, l.next, l.modSeq, l.forgotten)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%d %s %d\n", l.entries[k].uid, k, l.entries[k].modSeq)
+	}
+	for _, v := range l.vanished {
+		fmt.Fprintf(&b, "- %d %d\n", v.uid, v.modSeq)
+	}
+	return writeFileAtomic(filepath.Join(dir, uidlistFile), []byte(b.String()))
+}
+
+// bump hands out the next modseq
+func (l *uidList) bump() uint64 {
+	l.modSeq++
+	return l.modSeq
+}
+
+// expunge drops a message and remembers that it went
+func (l *uidList) expunge(key string) {
+	e, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	delete(l.entries, key)
+	l.vanished = append(l.vanished, vanishedUID{e.uid, l.bump()})
+	if over := len(l.vanished) - maxVanished; over > 0 {
+		l.forgotten = max(l.forgotten, l.vanished[over-1].modSeq)
+		l.vanished = slices.Clone(l.vanished[over:])
+	}
+}
@@ -0,0 +1,148 @@
+package managesieve
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/jums/internal/sieve"
+)
+
+// session drives a logged in ManageSieve session over a pipe
+type session struct {
+	t *testing.T
+	r *bufio.Reader
+	w net.Conn
+}
+
+func newSession(t *testing.T, dir string) *session {
+	srv, cli := net.Pipe()
+	mc := &conn{c: srv, r: bufio.NewReader(srv), w: bufio.NewWriter(srv), user: "bob", userDir: dir}
+	go func() {
+		defer srv.Close()
+		for !mc.done {
+			if mc.handleNext() != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { cli.Close() })
+	return &session{t: t, r: bufio.NewReader(cli), w: cli}
+}
+
+// do sends a command and returns the lines of the response, the last being
+// the OK or NO
+func (s *session) do(cmd string) []string {
+	s.t.Helper()
+	if _, err := s.w.Write([]byte(cmd + "\r\n")); err != nil {
+		s.t.Fatal(err)
+	}
+	lines := []string{}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			return lines
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	dir := t.TempDir()
+	// a script written by hand before ManageSieve gets adopted
+	os.WriteFile(filepath.Join(dir, sieve.ActiveFile), []byte("keep;\r\n"), 0600)
+	s := newSession(t, dir)
+
+	script := "require \"fileinto\";\r\nfileinto \"Lists\";\r\n"
+	if got := s.do("PUTSCRIPT \"lists\" {" + strconv.Itoa(len(script)) + "+}\r\n" + script); !strings.HasPrefix(got[0], "OK") {
+		t.Fatalf("PUTSCRIPT: %q", got)
+	}
+	if got := s.do("CHECKSCRIPT \"fileinto \\\"x\\\";\""); !strings.HasPrefix(got[0], "NO") || !strings.Contains(got[0], "fileinto") {
+		t.Errorf("CHECKSCRIPT of bad script: %q", got)
+	}
+	if got := s.do("PUTSCRIPT \"bad\" \"stop\""); !strings.HasPrefix(got[0], "NO") {
+		t.Errorf("PUTSCRIPT of bad script: %q", got)
+	}
+
+	if got := s.do("LISTSCRIPTS"); strings.Join(got, "|") != `"jums" ACTIVE|"lists"|OK` {
+		t.Errorf("LISTSCRIPTS: %q", got)
+	}
+	if got := s.do("SETACTIVE \"lists\""); got[0] != "OK" {
+		t.Errorf("SETACTIVE: %q", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, sieve.ActiveFile)); string(b) != script {
+		t.Errorf("active script is %q", b)
+	}
+	if got := s.do("DELETESCRIPT \"lists\""); got[0] != `NO (ACTIVE) "Can't delete the active script"` {
+		t.Errorf("DELETESCRIPT of active script: %q", got)
+	}
+	if got := s.do("RENAMESCRIPT \"lists\" \"filters\""); got[0] != "OK" {
+		t.Errorf("RENAMESCRIPT: %q", got)
+	}
+	if got := s.do("GETSCRIPT \"filters\""); len(got) != 5 || got[0] != "{"+strconv.Itoa(len(script))+"}" {
+		t.Errorf("GETSCRIPT: %q", got)
+	}
+	if got := s.do("GETSCRIPT \"lists\""); got[0] != `NO (NONEXISTENT) "No such script"` {
+		t.Errorf("GETSCRIPT of renamed script: %q", got)
+	}
+	if got := s.do("LISTSCRIPTS"); strings.Join(got, "|") != `"filters" ACTIVE|"jums"|OK` {
+		t.Errorf("LISTSCRIPTS after rename: %q", got)
+	}
+	if got := s.do("LOGOUT"); got[0] != `OK "Bye"` {
+		t.Errorf("LOGOUT: %q", got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Cleanup(func() {
+		connsMu.Lock()
+		draining = false
+		connsMu.Unlock()
+	})
+	// dial hands a connection to Handle and returns the line that ends its
+	// greeting
+	dial := func() (*bufio.Reader, string) {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		go Handle(srv)
+		r := bufio.NewReader(cli)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, `"`) {
+				return r, line
+			}
+		}
+	}
+
+	r, _ := dial()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Shutdown(ctx) }()
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "BYE") {
+		t.Errorf("got %q, expected a BYE", line)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// new clients are turned away
+	if _, line := dial(); !strings.HasPrefix(line, "BYE") {
+		t.Errorf("new client got %q, expected a BYE", line)
+	}
+}
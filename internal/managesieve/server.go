@@ -0,0 +1,558 @@
+// Package managesieve lets users edit their Sieve scripts from their mail
+// client, RFC 5804
+package managesieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/sieve"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+const (
+	idleTimeout = 30 * time.Minute
+	maxLineLen  = 4096
+	// the biggest script we'll store
+	maxScriptSize = 1 << 20
+)
+
+var errSyntax = errors.New("syntax error")
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+
+	// empty until AUTHENTICATE succeeds
+	user    string
+	userDir string
+	done    bool
+}
+
+type handler struct {
+	fn   func(c *conn, args []string) error
+	auth bool
+}
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"CAPABILITY":   {cmdCapability, false},
+		"STARTTLS":     {cmdStarttls, false},
+		"AUTHENTICATE": {cmdAuthenticate, false},
+		"NOOP":         {cmdNoop, false},
+		"HAVESPACE":    {cmdHavespace, true},
+		"PUTSCRIPT":    {cmdPutscript, true},
+		"CHECKSCRIPT":  {cmdCheckscript, true},
+		"LISTSCRIPTS":  {cmdListscripts, true},
+		"SETACTIVE":    {cmdSetactive, true},
+		"GETSCRIPT":    {cmdGetscript, true},
+		"DELETESCRIPT": {cmdDeletescript, true},
+		"RENAMESCRIPT": {cmdRenamescript, true},
+	}
+}
+
+// Handle serves a ManageSieve client until it logs out or the connection
+// drops
+func Handle(c net.Conn) {
+	defer c.Close()
+	slog.Debug("handling ManageSieve connection...", "addr", c.RemoteAddr().String())
+
+	mc := &conn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	if !track(mc) {
+		mc.shutdownBye()
+		return
+	}
+	defer untrack(mc)
+	mc.capabilities()
+	mc.ok("", "Josh's Unremarkable Mail Server ManageSieve ready")
+	if mc.flush() != nil {
+		return
+	}
+	for !mc.done {
+		if err := mc.handleNext(); err != nil {
+			if shuttingDown() {
+				mc.shutdownBye()
+				return
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("ManageSieve connection error", "addr", c.RemoteAddr().String(), "err", err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) handleNext() error {
+	args, err := c.readCommand()
+	if errors.Is(err, errSyntax) {
+		c.no("", "Syntax error")
+		return c.flush()
+	}
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		c.no("", "Missing command")
+		return c.flush()
+	}
+	name := strings.ToUpper(args[0])
+	slog.Debug("ManageSieve command received", "addr", c.c.RemoteAddr().String(), "cmd", name)
+
+	if name == "LOGOUT" {
+		c.done = true
+		c.ok("", "Bye")
+		return c.flush()
+	}
+	h, found := handlers[name]
+	if !found {
+		c.no("", "Unknown command")
+		return c.flush()
+	}
+	if h.auth && c.user == "" {
+		c.no("", "Log in first")
+		return c.flush()
+	}
+	if err = h.fn(c, args[1:]); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// readCommand reads a command and its arguments, which are atoms, numbers,
+// quoted strings or literals. A literal carries on the command past the end
+// of its line.
+func (c *conn) readCommand() ([]string, error) {
+	args := []string{}
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args, nil
+		}
+
+		switch line[0] {
+		case '"':
+			s, rest, err := unquote(line)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+			line = rest
+		case '{':
+			end := strings.IndexByte(line, '}')
+			if end < 0 || end != len(line)-1 {
+				return nil, errSyntax
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(line[1:end], "+"))
+			if err != nil || n < 0 {
+				return nil, errSyntax
+			}
+			if n > maxScriptSize {
+				return nil, fmt.Errorf("literal of %d bytes is too big", n)
+			}
+			// {n} is meant to wait for a go ahead, but RFC 5804 never
+			// gives one so treat it like {n+}
+			buf := make([]byte, n)
+			if err = c.setReadDeadline(idleTimeout); err != nil {
+				return nil, err
+			}
+			if _, err = io.ReadFull(c.r, buf); err != nil {
+				return nil, err
+			}
+			args = append(args, string(buf))
+			if line, err = c.readLine(); err != nil {
+				return nil, err
+			}
+		default:
+			atom, rest, _ := strings.Cut(line, " ")
+			args = append(args, atom)
+			line = rest
+		}
+	}
+}
+
+// unquote reads a quoted string from the start of s and returns it with the
+// rest of s
+func unquote(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) || s[i] != '"' && s[i] != '\\' {
+				return "", "", errSyntax
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", "", errSyntax
+}
+
+// readLine reads a line without its CRLF
+func (c *conn) readLine() (string, error) {
+	if err := c.setReadDeadline(idleTimeout); err != nil {
+		return "", err
+	}
+	line := []byte{}
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+		if len(line) > maxLineLen {
+			return "", fmt.Errorf("line longer than %d bytes", maxLineLen)
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// quote makes s a string to send, a literal if it won't go in quotes
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") || len(s) > 1024 {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// respond writes an OK, NO or BYE with an optional response code and text
+func (c *conn) respond(status, code, text string) {
+	c.w.WriteString(status)
+	if code != "" {
+		fmt.Fprintf(c.w, " (%s)", code)
+	}
+	if text != "" {
+		c.w.WriteString(" " + quote(text))
+	}
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) ok(code, text string) {
+	c.respond("OK", code, text)
+}
+
+func (c *conn) no(code, text string) {
+	c.respond("NO", code, text)
+}
+
+// shutdownBye tells the client we're going away, TRYLATER as it's only
+// for now
+func (c *conn) shutdownBye() {
+	c.respond("BYE", "TRYLATER", "Server shutting down")
+	c.flush()
+}
+
+func (c *conn) flush() error {
+	c.c.SetWriteDeadline(time.Now().Add(idleTimeout))
+	return c.w.Flush()
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) capabilities() {
+	fmt.Fprintf(c.w, "\"IMPLEMENTATION\" %s\r\n", quote("jums"))
+	fmt.Fprintf(c.w, "\"SIEVE\" %s\r\n", quote(strings.Join(sieve.Extensions, " ")))
+	// PLAIN would send the password in the clear without TLS
+	if c.isTLS() {
+		c.w.WriteString("\"SASL\" \"PLAIN\"\r\n")
+	} else {
+		c.w.WriteString("\"SASL\" \"\"\r\n")
+		c.w.WriteString("\"STARTTLS\"\r\n")
+	}
+	c.w.WriteString("\"MAXREDIRECTS\" \"4\"\r\n")
+	if c.user != "" {
+		fmt.Fprintf(c.w, "\"OWNER\" %s\r\n", quote(c.user))
+	}
+	c.w.WriteString("\"VERSION\" \"1.0\"\r\n")
+}
+
+func cmdCapability(c *conn, args []string) error {
+	c.capabilities()
+	c.ok("", "")
+	return nil
+}
+
+func cmdNoop(c *conn, args []string) error {
+	if len(args) == 1 {
+		c.ok("TAG "+quote(args[0]), "Done")
+		return nil
+	}
+	c.ok("", "Done")
+	return nil
+}
+
+func cmdStarttls(c *conn, args []string) error {
+	if c.isTLS() {
+		c.no("", "TLS already active")
+		return nil
+	}
+	c.ok("", "Begin TLS negotiation now")
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	tlsc := tls.Server(c.c, config.ServerTLSConfig())
+	if err := tlsc.Handshake(); err != nil {
+		slog.Debug("ManageSieve TLS handshake failed", "addr", c.c.RemoteAddr().String(), "err", err.Error())
+		return err
+	}
+	c.c = tlsc
+	c.r = bufio.NewReader(tlsc)
+	c.w = bufio.NewWriter(tlsc)
+	// the client has to be told the capabilities again, RFC 5804 2.2
+	c.capabilities()
+	c.ok("", "TLS active")
+	return nil
+}
+
+func cmdAuthenticate(c *conn, args []string) error {
+	if c.user != "" {
+		c.no("", "Already logged in")
+		return nil
+	}
+	if !c.isTLS() {
+		c.no("ENCRYPT-NEEDED", "Use STARTTLS first")
+		return nil
+	}
+	if len(args) == 0 || len(args) > 2 {
+		c.no("", "Expected AUTHENTICATE mechanism")
+		return nil
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		c.no("", "Unsupported authentication mechanism")
+		return nil
+	}
+
+	var ir string
+	if len(args) == 2 {
+		ir = args[1]
+	} else {
+		c.w.WriteString("\"\"\r\n")
+		if err := c.flush(); err != nil {
+			return err
+		}
+		resp, err := c.readCommand()
+		if errors.Is(err, errSyntax) || err == nil && len(resp) != 1 {
+			c.no("", "Invalid SASL response")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ir = resp[0]
+	}
+	if ir == "*" {
+		c.no("", "Authentication cancelled")
+		return nil
+	}
+
+	user, pass, err := decodePlain(ir)
+	if err != nil {
+		c.no("", "Invalid SASL response")
+		return nil
+	}
+	c.login(user, pass)
+	return nil
+}
+
+// decodePlain decodes a SASL PLAIN response: authzid NUL authcid NUL password
+func decodePlain(b64 string) (string, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return "", "", errSyntax
+	}
+	if parts[0] != "" && !strings.EqualFold(parts[0], parts[1]) {
+		// we don't do proxy authorization
+		return "", "", errSyntax
+	}
+	return parts[1], parts[2], nil
+}
+
+func (c *conn) login(user, pass string) {
+	name, authed := users.Authenticate(user, pass)
+	if !authed {
+		slog.Info("ManageSieve login failed", "addr", c.c.RemoteAddr().String(), "user", user)
+		// slow down password guessing
+		time.Sleep(2 * time.Second)
+		c.no("", "Invalid credentials")
+		return
+	}
+
+	dir, err := maildir.UserDir(config.GetConfig().Mailbox(name))
+	if err == nil {
+		err = maildir.Create(dir)
+	}
+	if err != nil {
+		slog.Error("Couldn't create INBOX", "user", name, "err", err.Error())
+		c.no("TRYLATER", "Can't open mailbox")
+		return
+	}
+	slog.Info("ManageSieve login", "addr", c.c.RemoteAddr().String(), "user", name)
+	c.user = name
+	c.userDir = dir
+	c.ok("", "Logged in")
+}
+
+// fail turns a storage error into a response
+func (c *conn) fail(err error) {
+	var pe *sieve.ParseError
+	switch {
+	case errors.As(err, &pe):
+		c.no("", pe.Error())
+	case errors.Is(err, sieve.ErrNoSuchScript):
+		c.no("NONEXISTENT", "No such script")
+	case errors.Is(err, sieve.ErrScriptExists):
+		c.no("ALREADYEXISTS", "A script with that name already exists")
+	case errors.Is(err, sieve.ErrActive):
+		c.no("ACTIVE", "Can't delete the active script")
+	case errors.Is(err, sieve.ErrInvalidName):
+		c.no("", "Invalid script name")
+	default:
+		slog.Error("ManageSieve storage error", "user", c.user, "err", err.Error())
+		c.no("TRYLATER", "Server error")
+	}
+}
+
+func cmdHavespace(c *conn, args []string) error {
+	if len(args) != 2 {
+		c.no("", "Expected HAVESPACE name size")
+		return nil
+	}
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		c.no("", "Invalid size")
+		return nil
+	}
+	if size > maxScriptSize {
+		c.no("QUOTA/MAXSIZE", "Script is too big")
+		return nil
+	}
+	c.ok("", "")
+	return nil
+}
+
+func cmdPutscript(c *conn, args []string) error {
+	if len(args) != 2 {
+		c.no("", "Expected PUTSCRIPT name script")
+		return nil
+	}
+	if err := sieve.PutScript(c.userDir, args[0], args[1]); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.ok("", "Script stored")
+	return nil
+}
+
+func cmdCheckscript(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.no("", "Expected CHECKSCRIPT script")
+		return nil
+	}
+	if _, err := sieve.Parse(args[0]); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.ok("", "Script is valid")
+	return nil
+}
+
+func cmdListscripts(c *conn, args []string) error {
+	names, active, err := sieve.Scripts(c.userDir)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	for _, name := range names {
+		c.w.WriteString(quote(name))
+		if name == active {
+			c.w.WriteString(" ACTIVE")
+		}
+		c.w.WriteString("\r\n")
+	}
+	c.ok("", "")
+	return nil
+}
+
+func cmdSetactive(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.no("", "Expected SETACTIVE name")
+		return nil
+	}
+	if err := sieve.SetActive(c.userDir, args[0]); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.ok("", "")
+	return nil
+}
+
+func cmdGetscript(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.no("", "Expected GETSCRIPT name")
+		return nil
+	}
+	src, err := sieve.GetScript(c.userDir, args[0])
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	fmt.Fprintf(c.w, "{%d}\r\n%s\r\n", len(src), src)
+	c.ok("", "")
+	return nil
+}
+
+func cmdDeletescript(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.no("", "Expected DELETESCRIPT name")
+		return nil
+	}
+	if err := sieve.DeleteScript(c.userDir, args[0]); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.ok("", "")
+	return nil
+}
+
+func cmdRenamescript(c *conn, args []string) error {
+	if len(args) != 2 {
+		c.no("", "Expected RENAMESCRIPT old new")
+		return nil
+	}
+	if err := sieve.RenameScript(c.userDir, args[0], args[1]); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.ok("", "")
+	return nil
+}
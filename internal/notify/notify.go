@@ -0,0 +1,60 @@
+// Package notify is an in-process bus for telling interested sessions that a
+// maildir changed, so IMAP IDLE doesn't have to poll
+package notify
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+var (
+	lock sync.Mutex
+	subs = map[string]map[*Subscription]bool{}
+)
+
+// Subscription receives a value on C whenever its maildir changes. Changes
+// that happen while nobody is reading are coalesced into one.
+type Subscription struct {
+	C   <-chan struct{}
+	c   chan struct{}
+	dir string
+}
+
+// Subscribe starts watching dir. Call Close when done.
+func Subscribe(dir string) *Subscription {
+	dir = filepath.Clean(dir)
+	c := make(chan struct{}, 1)
+	s := &Subscription{C: c, c: c, dir: dir}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if subs[dir] == nil {
+		subs[dir] = map[*Subscription]bool{}
+	}
+	subs[dir][s] = true
+	return s
+}
+
+func (s *Subscription) Close() {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(subs[s.dir], s)
+	if len(subs[s.dir]) == 0 {
+		delete(subs, s.dir)
+	}
+}
+
+// Publish tells everyone watching dir that it changed. It never blocks.
+func Publish(dir string) {
+	dir = filepath.Clean(dir)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for s := range subs[dir] {
+		select {
+		case s.c <- struct{}{}:
+		default:
+			// there's already a notification waiting
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+var errInUse = errors.New("maildrop in use")
+
+// maildrops with a POP3 session in TRANSACTION. RFC 1939 wants the maildrop
+// locked for the whole session, but IMAP and delivery only ever hold
+// maildir.Lock briefly, so this only keeps POP3 sessions out of each other's
+// way.
+var inUse sync.Map
+
+// maildrop is the snapshot of a user's INBOX a session works on. Message
+// numbers don't change during the session, new mail turns up next time and
+// deletions only happen on QUIT.
+type maildrop struct {
+	dir     string
+	msgs    []*maildir.Message
+	deleted []bool
+}
+
+func openMaildrop(dir string) (*maildrop, error) {
+	dir = filepath.Clean(dir)
+	if _, busy := inUse.LoadOrStore(dir, true); busy {
+		return nil, errInUse
+	}
+
+	// leave new alone so IMAP clients still see the mail as \Recent
+	mb, err := maildir.Open(dir, false)
+	if err != nil {
+		inUse.Delete(dir)
+		return nil, fmt.Errorf("pop3.openMaildrop: %w", err)
+	}
+	return &maildrop{
+		dir:     dir,
+		msgs:    mb.Messages,
+		deleted: make([]bool, len(mb.Messages)),
+	}, nil
+}
+
+func (d *maildrop) release() {
+	inUse.Delete(d.dir)
+}
+
+// stat counts the messages that haven't been deleted and their total size
+func (d *maildrop) stat() (int, int64) {
+	count, size := 0, int64(0)
+	for i, msg := range d.msgs {
+		if !d.deleted[i] {
+			count++
+			size += msg.Size
+		}
+	}
+	return count, size
+}
+
+// read returns message i. If an IMAP session has changed its flags since we
+// opened the maildrop the file will have moved, so look it up again by UID.
+func (d *maildrop) read(i int) ([]byte, error) {
+	msg := d.msgs[i]
+	data, err := os.ReadFile(msg.Path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return data, err
+	}
+
+	mb, err := maildir.Open(d.dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("pop3.read: %w", err)
+	}
+	cur := mb.ByUID(msg.UID)
+	if cur == nil {
+		return nil, maildir.ErrNoSuchMessage
+	}
+	msg.Path = cur.Path
+	return os.ReadFile(msg.Path)
+}
+
+// commit removes the messages marked deleted, the UPDATE state. Anything
+// already expunged by another session is skipped.
+func (d *maildrop) commit() (int, error) {
+	if !slices.Contains(d.deleted, true) {
+		return 0, nil
+	}
+	mb, err := maildir.Open(d.dir, false)
+	if err != nil {
+		return 0, fmt.Errorf("pop3.commit: %w", err)
+	}
+
+	removed := 0
+	for i, msg := range d.msgs {
+		if !d.deleted[i] {
+			continue
+		}
+		cur := mb.ByUID(msg.UID)
+		if cur == nil {
+			continue
+		}
+		if err := mb.Remove(cur); err != nil {
+			return removed, fmt.Errorf("pop3.commit: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// top cuts a message down to its header and the first n lines of its body
+func top(data []byte, n int) []byte {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	sep := 4
+	if lf := bytes.Index(data, []byte("\n\n")); lf >= 0 && (end < 0 || lf < end) {
+		end, sep = lf, 2
+	}
+	if end < 0 {
+		// all header
+		return data
+	}
+
+	pos := end + sep
+	for ; n > 0 && pos < len(data); n-- {
+		nl := bytes.IndexByte(data[pos:], '\n')
+		if nl < 0 {
+			return data
+		}
+		pos += nl + 1
+	}
+	return data[:pos]
+}
+
+// writeDotStuffed writes a multi-line response body with CRLF line endings
+// and the terminating dot line
+func writeDotStuffed(w *bufio.Writer, data []byte) {
+	for len(data) > 0 {
+		line := data
+		rest := []byte{}
+		if nl := bytes.IndexByte(data, '\n'); nl >= 0 {
+			line, rest = data[:nl], data[nl+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(line, []byte(".")) {
+			w.WriteByte('.')
+		}
+		w.Write(line)
+		w.WriteString("\r\n")
+		data = rest
+	}
+	w.WriteString(".\r\n")
+}
@@ -0,0 +1,164 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+const testMessage = "Subject: hello\r\n" +
+	"\r\n" +
+	"first\r\n" +
+	".dotted\r\n" +
+	"third\r\n"
+
+// session drives a logged in POP3 session over a pipe
+type session struct {
+	t *testing.T
+	r *bufio.Reader
+	w net.Conn
+}
+
+func newSession(t *testing.T, dir string) *session {
+	srv, cli := net.Pipe()
+	pc := &conn{c: srv, r: bufio.NewReader(srv), w: bufio.NewWriter(srv)}
+	if err := pc.open("bob", dir); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer srv.Close()
+		defer func() {
+			if pc.drop != nil {
+				pc.drop.release()
+			}
+		}()
+		for pc.state != loggedOut {
+			if pc.handleNext() != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { cli.Close() })
+	return &session{t: t, r: bufio.NewReader(cli), w: cli}
+}
+
+// do sends a command and returns the status line and, for multi-line
+// responses, the lines up to the dot
+func (s *session) do(cmd string, multi bool) (string, []string) {
+	s.t.Helper()
+	if _, err := s.w.Write([]byte(cmd + "\r\n")); err != nil {
+		s.t.Fatal(err)
+	}
+	read := func() string {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\r\n")
+	}
+	status := read()
+	lines := []string{}
+	if multi && strings.HasPrefix(status, "+OK") {
+		for line := read(); line != "."; line = read() {
+			lines = append(lines, line)
+		}
+	}
+	return status, lines
+}
+
+func TestSession(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bob")
+	var keys []string
+	for range 2 {
+		key, err := maildir.Deliver(dir, []byte(testMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	s := newSession(t, dir)
+	if _, err := openMaildrop(dir); err != errInUse {
+		t.Errorf("second session got %v, want errInUse", err)
+	}
+
+	if status, _ := s.do("STAT", false); status != "+OK 2 82" {
+		t.Errorf("STAT = %q", status)
+	}
+	if _, lines := s.do("UIDL", true); len(lines) != 2 || lines[0] != "1 "+keys[0] {
+		t.Errorf("UIDL = %q", lines)
+	}
+	if _, lines := s.do("RETR 1", true); strings.Join(lines, "\n") != "Subject: hello\n\nfirst\n..dotted\nthird" {
+		t.Errorf("RETR = %q", lines)
+	}
+	if _, lines := s.do("TOP 1 1", true); len(lines) != 3 {
+		t.Errorf("TOP = %q", lines)
+	}
+
+	s.do("DELE 1", false)
+	if status, _ := s.do("RETR 1", true); !strings.HasPrefix(status, "-ERR") {
+		t.Errorf("RETR of deleted message = %q", status)
+	}
+	s.do("RSET", false)
+	s.do("DELE 2", false)
+	if status, _ := s.do("QUIT", false); status != "+OK Bye, 1 messages deleted" {
+		t.Errorf("QUIT = %q", status)
+	}
+
+	mb, err := maildir.Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mb.Messages) != 1 || mb.Messages[0].Key != keys[0] {
+		t.Errorf("left with %d messages", len(mb.Messages))
+	}
+	// the lock goes with the session
+	d, err := openMaildrop(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.release()
+}
+
+func TestShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		connsMu.Lock()
+		draining = false
+		connsMu.Unlock()
+	})
+	// dial hands a connection to Handle and returns its first line
+	dial := func() (*bufio.Reader, string) {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		go Handle(srv)
+		r := bufio.NewReader(cli)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, line
+	}
+
+	r, _ := dial()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Shutdown(ctx) }()
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("got %q, expected an -ERR", line)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// new clients are turned away
+	if _, line := dial(); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("new client got %q, expected an -ERR", line)
+	}
+}
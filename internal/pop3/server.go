@@ -0,0 +1,521 @@
+// Package pop3 serves each user's INBOX over POP3, RFC 1939
+package pop3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+// RFC 1939 says at least 10 minutes
+const autologoutTimeout = 10 * time.Minute
+
+// RFC 2449 allows 255 octets for a command, AUTH responses can be longer
+const maxLineLen = 4096
+
+type connState int
+
+const (
+	authorization connState = iota
+	transaction
+	loggedOut
+)
+
+var errSyntax = errors.New("syntax error")
+
+type conn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	state connState
+
+	// from USER, waiting for PASS
+	pendingUser string
+
+	user string
+	drop *maildrop
+}
+
+type handler struct {
+	fn    func(c *conn, args []string) error
+	state connState
+	// PASS gets the whole rest of the line, passwords can have spaces
+	raw bool
+}
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"CAPA": {cmdCapa, authorization, false},
+		"STLS": {cmdStls, authorization, false},
+		"USER": {cmdUser, authorization, false},
+		"PASS": {cmdPass, authorization, true},
+		"AUTH": {cmdAuth, authorization, false},
+		"STAT": {cmdStat, transaction, false},
+		"LIST": {cmdList, transaction, false},
+		"UIDL": {cmdUidl, transaction, false},
+		"RETR": {cmdRetr, transaction, false},
+		"TOP":  {cmdTop, transaction, false},
+		"DELE": {cmdDele, transaction, false},
+		"RSET": {cmdRset, transaction, false},
+		"NOOP": {cmdNoop, transaction, false},
+	}
+}
+
+// Handle serves a POP3 client until it quits or the connection drops
+func Handle(c net.Conn) {
+	defer c.Close()
+	slog.Debug("handling POP3 connection...", "addr", c.RemoteAddr().String())
+
+	pc := &conn{
+		c:     c,
+		r:     bufio.NewReader(c),
+		w:     bufio.NewWriter(c),
+		state: authorization,
+	}
+	// a dropped connection doesn't delete anything, only QUIT does
+	defer func() {
+		if pc.drop != nil {
+			pc.drop.release()
+		}
+	}()
+
+	if !track(pc) {
+		pc.shutdownErr()
+		return
+	}
+	defer untrack(pc)
+	pc.ok("Josh's Unremarkable Mail Server POP3 ready")
+	if pc.flush() != nil {
+		return
+	}
+	for pc.state != loggedOut {
+		if err := pc.handleNext(); err != nil {
+			if shuttingDown() {
+				// nothing marked with DELE is removed, that's only on QUIT
+				pc.shutdownErr()
+				return
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("POP3 connection error", "addr", c.RemoteAddr().String(), "err", err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) handleNext() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	slog.Debug("POP3 line received", "addr", c.c.RemoteAddr().String(), "line", safeLine(line))
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		c.err("Missing command")
+		return c.flush()
+	}
+	name := strings.ToUpper(fields[0])
+
+	if name == "QUIT" {
+		c.quit()
+		return c.flush()
+	}
+	h, found := handlers[name]
+	if !found {
+		c.err("Unknown command")
+		return c.flush()
+	}
+	if h.state != c.state {
+		c.err(fmt.Sprintf("%s not allowed now", name))
+		return c.flush()
+	}
+	args := fields[1:]
+	if h.raw {
+		_, rest, _ := strings.Cut(line, " ")
+		args = []string{rest}
+	}
+	if err = h.fn(c, args); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// readLine reads a line without its CRLF
+func (c *conn) readLine() (string, error) {
+	if err := c.setReadDeadline(autologoutTimeout); err != nil {
+		return "", err
+	}
+	line := []byte{}
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+		if len(line) > maxLineLen {
+			return "", fmt.Errorf("line longer than %d bytes", maxLineLen)
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// passwords shouldn't end up in the debug logs
+func safeLine(line string) string {
+	name, _, _ := strings.Cut(line, " ")
+	if strings.EqualFold(name, "PASS") || strings.EqualFold(name, "AUTH") {
+		return name + " ***"
+	}
+	return line
+}
+
+func (c *conn) ok(text string) {
+	fmt.Fprintf(c.w, "+OK %s\r\n", text)
+}
+
+func (c *conn) err(text string) {
+	fmt.Fprintf(c.w, "-ERR %s\r\n", text)
+}
+
+// shutdownErr tells the client we're going away, RFC 1939 has nothing
+// better than an -ERR for it
+func (c *conn) shutdownErr() {
+	c.err("Server shutting down")
+	c.flush()
+}
+
+func (c *conn) flush() error {
+	c.c.SetWriteDeadline(time.Now().Add(autologoutTimeout))
+	return c.w.Flush()
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func cmdCapa(c *conn, args []string) error {
+	c.ok("Capability list follows")
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "USER", "IMPLEMENTATION jums"}
+	if c.isTLS() {
+		caps = append(caps, "SASL PLAIN")
+	} else {
+		caps = append(caps, "STLS")
+	}
+	for _, cap := range caps {
+		fmt.Fprintf(c.w, "%s\r\n", cap)
+	}
+	c.w.WriteString(".\r\n")
+	return nil
+}
+
+func cmdStls(c *conn, args []string) error {
+	if c.isTLS() {
+		c.err("TLS already active")
+		return nil
+	}
+	c.ok("Begin TLS negotiation now")
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	tlsc := tls.Server(c.c, config.ServerTLSConfig())
+	if err := tlsc.Handshake(); err != nil {
+		slog.Debug("POP3 TLS handshake failed", "addr", c.c.RemoteAddr().String(), "err", err.Error())
+		return err
+	}
+	c.c = tlsc
+	c.r = bufio.NewReader(tlsc)
+	c.w = bufio.NewWriter(tlsc)
+	c.pendingUser = ""
+	return nil
+}
+
+func cmdUser(c *conn, args []string) error {
+	if !c.isTLS() {
+		c.err("[AUTH] Use STLS first")
+		return nil
+	}
+	if len(args) != 1 {
+		c.err("Expected USER name")
+		return nil
+	}
+	c.pendingUser = args[0]
+	c.ok("Send PASS")
+	return nil
+}
+
+func cmdPass(c *conn, args []string) error {
+	if c.pendingUser == "" {
+		c.err("USER first")
+		return nil
+	}
+	user := c.pendingUser
+	c.pendingUser = ""
+	c.login(user, args[0])
+	return nil
+}
+
+func cmdAuth(c *conn, args []string) error {
+	if !c.isTLS() {
+		c.err("[AUTH] Use STLS first")
+		return nil
+	}
+	if len(args) == 0 || len(args) > 2 {
+		c.err("Expected AUTH mechanism")
+		return nil
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		c.err("Unsupported authentication mechanism")
+		return nil
+	}
+
+	var ir string
+	if len(args) == 2 {
+		ir = args[1]
+	} else {
+		c.w.WriteString("+ \r\n")
+		if err := c.flush(); err != nil {
+			return err
+		}
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		ir = line
+	}
+	if ir == "*" {
+		c.err("Authentication cancelled")
+		return nil
+	}
+
+	user, pass, err := decodePlain(ir)
+	if err != nil {
+		c.err("Invalid SASL response")
+		return nil
+	}
+	c.login(user, pass)
+	return nil
+}
+
+// decodePlain decodes a SASL PLAIN response: authzid NUL authcid NUL password
+func decodePlain(b64 string) (string, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return "", "", errSyntax
+	}
+	if parts[0] != "" && !strings.EqualFold(parts[0], parts[1]) {
+		// we don't do proxy authorization
+		return "", "", errSyntax
+	}
+	return parts[1], parts[2], nil
+}
+
+func (c *conn) login(user, pass string) {
+	name, authed := users.Authenticate(user, pass)
+	if !authed {
+		slog.Info("POP3 login failed", "addr", c.c.RemoteAddr().String(), "user", user)
+		// slow down password guessing
+		time.Sleep(2 * time.Second)
+		c.err("[AUTH] Invalid credentials")
+		return
+	}
+
+	conf := config.GetConfig()
+	dir, err := maildir.UserDir(conf.Mailbox(name))
+	if err == nil {
+		err = maildir.Create(dir)
+	}
+	if err != nil {
+		slog.Error("Couldn't create INBOX", "user", name, "err", err.Error())
+		c.err("[SYS/TEMP] Can't open maildrop")
+		return
+	}
+
+	if err = c.open(name, dir); err != nil {
+		if errors.Is(err, errInUse) {
+			c.err("[IN-USE] Maildrop is already in use")
+			return
+		}
+		slog.Error("Couldn't open maildrop", "user", name, "err", err.Error())
+		c.err("[SYS/TEMP] Can't open maildrop")
+		return
+	}
+	slog.Info("POP3 login", "addr", c.c.RemoteAddr().String(), "user", name)
+	c.ok(fmt.Sprintf("Logged in, %d messages", len(c.drop.msgs)))
+}
+
+// open locks and loads the user's maildrop, moving to the TRANSACTION state
+func (c *conn) open(user, dir string) error {
+	drop, err := openMaildrop(dir)
+	if err != nil {
+		return err
+	}
+	c.user = user
+	c.drop = drop
+	c.state = transaction
+	return nil
+}
+
+// quit ends the session, removing deleted messages if there was a maildrop
+func (c *conn) quit() {
+	c.state = loggedOut
+	if c.drop == nil {
+		c.ok("Bye")
+		return
+	}
+	removed, err := c.drop.commit()
+	c.drop.release()
+	c.drop = nil
+	if err != nil {
+		slog.Error("Couldn't remove deleted messages", "user", c.user, "err", err.Error())
+		c.err("[SYS/TEMP] Some deleted messages were not removed")
+		return
+	}
+	c.ok(fmt.Sprintf("Bye, %d messages deleted", removed))
+}
+
+// message parses a message number argument, which can't be one that's been
+// deleted
+func (c *conn) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(c.drop.msgs) {
+		c.err("No such message")
+		return 0, false
+	}
+	if c.drop.deleted[n-1] {
+		c.err("Message already deleted")
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func cmdStat(c *conn, args []string) error {
+	count, size := c.drop.stat()
+	c.ok(fmt.Sprintf("%d %d", count, size))
+	return nil
+}
+
+func cmdList(c *conn, args []string) error {
+	return c.listing(args, func(i int) string { return strconv.FormatInt(c.drop.msgs[i].Size, 10) })
+}
+
+func cmdUidl(c *conn, args []string) error {
+	return c.listing(args, func(i int) string { return c.drop.msgs[i].Key })
+}
+
+// listing does LIST and UIDL, which only differ in what's after the number
+func (c *conn) listing(args []string, info func(i int) string) error {
+	if len(args) > 1 {
+		c.err("Too many arguments")
+		return nil
+	}
+	if len(args) == 1 {
+		if i, ok := c.message(args[0]); ok {
+			c.ok(fmt.Sprintf("%d %s", i+1, info(i)))
+		}
+		return nil
+	}
+
+	count, size := c.drop.stat()
+	c.ok(fmt.Sprintf("%d messages (%d octets)", count, size))
+	for i := range c.drop.msgs {
+		if !c.drop.deleted[i] {
+			fmt.Fprintf(c.w, "%d %s\r\n", i+1, info(i))
+		}
+	}
+	c.w.WriteString(".\r\n")
+	return nil
+}
+
+func cmdRetr(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.err("Expected RETR msg")
+		return nil
+	}
+	return c.send(args[0], -1)
+}
+
+func cmdTop(c *conn, args []string) error {
+	if len(args) != 2 {
+		c.err("Expected TOP msg n")
+		return nil
+	}
+	lines, err := strconv.Atoi(args[1])
+	if err != nil || lines < 0 {
+		c.err("Invalid line count")
+		return nil
+	}
+	return c.send(args[0], lines)
+}
+
+// send writes a message, or its header and the first lines of its body if
+// lines isn't negative
+func (c *conn) send(arg string, lines int) error {
+	i, ok := c.message(arg)
+	if !ok {
+		return nil
+	}
+	data, err := c.drop.read(i)
+	if err != nil {
+		if errors.Is(err, maildir.ErrNoSuchMessage) {
+			c.err("Message was deleted by another session")
+			return nil
+		}
+		slog.Error("Couldn't read message", "user", c.user, "err", err.Error())
+		c.err("[SYS/TEMP] Couldn't read message")
+		return nil
+	}
+	if lines >= 0 {
+		data = top(data, lines)
+	}
+
+	c.ok("Message follows")
+	writeDotStuffed(c.w, data)
+	return nil
+}
+
+func cmdDele(c *conn, args []string) error {
+	if len(args) != 1 {
+		c.err("Expected DELE msg")
+		return nil
+	}
+	if i, ok := c.message(args[0]); ok {
+		c.drop.deleted[i] = true
+		c.ok(fmt.Sprintf("Message %d deleted", i+1))
+	}
+	return nil
+}
+
+func cmdRset(c *conn, args []string) error {
+	clear(c.drop.deleted)
+	count, size := c.drop.stat()
+	c.ok(fmt.Sprintf("%d messages (%d octets)", count, size))
+	return nil
+}
+
+func cmdNoop(c *conn, args []string) error {
+	c.ok("")
+	return nil
+}
@@ -0,0 +1,86 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Connections are tracked so Shutdown can hang up on them. Setting a read
+// deadline of now wakes one that's waiting on its client, and it says
+// goodbye from there.
+var (
+	connsMu  sync.Mutex
+	conns    = map[*conn]struct{}{}
+	connsWg  sync.WaitGroup
+	draining bool
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// track adds a connection for Shutdown to wait on. It's false if we're
+// already shutting down and the client should be turned away.
+func track(c *conn) bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if draining {
+		return false
+	}
+	conns[c] = struct{}{}
+	connsWg.Add(1)
+	return true
+}
+
+func untrack(c *conn) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	delete(conns, c)
+	connsWg.Done()
+}
+
+// Shutdown sends every POP3 client an -ERR, once the command it's on is
+// done. Clients still connected when ctx is done are cut off.
+func Shutdown(ctx context.Context) error {
+	connsMu.Lock()
+	draining = true
+	for c := range conns {
+		c.c.SetReadDeadline(time.Now())
+	}
+	connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		connsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		connsMu.Lock()
+		for c := range conns {
+			c.c.Close()
+		}
+		connsMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// setReadDeadline gives the client d to send its next line, unless we're
+// shutting down
+func (c *conn) setReadDeadline(d time.Duration) error {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if draining {
+		return errShuttingDown
+	}
+	return c.c.SetReadDeadline(time.Now().Add(d))
+}
+
+// shuttingDown is whether Shutdown has been called
+func shuttingDown() bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	return draining
+}
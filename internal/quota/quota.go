@@ -0,0 +1,161 @@
+// Package quota decides how much mail an account can keep. Each account has
+// its own limits, set with jumsctl or defaulting to its domain's UserQuota,
+// and the domain can limit all its accounts together too. Usage is tracked
+// by the maildir package in each user's maildirsize.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+var (
+	ErrOverQuota   = errors.New("mailbox full")
+	ErrNoSuchRoot  = errors.New("no such quota root")
+	errNoSuchOwner = errors.New("account isn't on a local domain")
+)
+
+// Root is a set of limits and what's counted against them. The account's
+// own root is called "", a domain's is the domain name.
+type Root struct {
+	Name  string
+	Limit maildir.Quota
+	Usage maildir.Usage
+}
+
+// domainOf is the domain an account's addresses are at
+func domainOf(account string) string {
+	if _, domain, ok := strings.Cut(account, "@"); ok {
+		return domain
+	}
+	return config.GetConfig().Domain
+}
+
+// Limit is the limit for one account, its own or its domain's default
+func Limit(account string) (maildir.Quota, error) {
+	conf := config.GetConfig()
+	dir, err := maildir.UserDir(conf.Mailbox(account))
+	if err != nil {
+		return maildir.Quota{}, fmt.Errorf("quota.Limit: %w", err)
+	}
+	return limit(dir, account)
+}
+
+func limit(userDir, account string) (maildir.Quota, error) {
+	q, err := maildir.UserQuota(userDir)
+	if err != nil {
+		return maildir.Quota{}, fmt.Errorf("quota.Limit: %w", err)
+	}
+	if q != nil {
+		return *q, nil
+	}
+	domain, ok := config.GetConfig().LocalDomain(domainOf(account))
+	if !ok {
+		return maildir.Quota{}, fmt.Errorf("quota.Limit: %w", errNoSuchOwner)
+	}
+	return maildir.Quota{Storage: int64(domain.UserQuota.Storage), Messages: domain.UserQuota.Messages}, nil
+}
+
+func userRoot(account string) (Root, error) {
+	conf := config.GetConfig()
+	dir, err := maildir.UserDir(conf.Mailbox(account))
+	if err != nil {
+		return Root{}, fmt.Errorf("quota.Roots: %w", err)
+	}
+	q, err := limit(dir, account)
+	if err != nil {
+		return Root{}, err
+	}
+	u, err := maildir.CurrentUsage(dir, q)
+	if err != nil {
+		return Root{}, err
+	}
+	return Root{Name: "", Limit: q, Usage: u}, nil
+}
+
+// domainRoot adds up every account on a domain. Accounts without limits
+// still keep a maildirsize so this doesn't mean reading every maildir.
+func domainRoot(name string) (Root, bool, error) {
+	conf := config.GetConfig()
+	domain, ok := conf.LocalDomain(name)
+	if !ok || (domain.Quota.Storage == 0 && domain.Quota.Messages == 0) {
+		return Root{}, false, nil
+	}
+	store, err := users.Shared(conf.UsersFile)
+	if err != nil {
+		return Root{}, false, fmt.Errorf("quota.Roots: %w", err)
+	}
+
+	r := Root{
+		Name:  domain.Name,
+		Limit: maildir.Quota{Storage: int64(domain.Quota.Storage), Messages: domain.Quota.Messages},
+	}
+	for _, account := range store.Names() {
+		if domainOf(account) != domain.Name {
+			continue
+		}
+		ur, err := userRoot(account)
+		if err != nil {
+			return Root{}, false, err
+		}
+		r.Usage.Bytes += ur.Usage.Bytes
+		r.Usage.Messages += ur.Usage.Messages
+	}
+	return r, true, nil
+}
+
+// Roots returns the quota roots that apply to an account, its own and then
+// its domain's if the domain has limits. A root is returned even without
+// limits so its usage can be shown.
+func Roots(account string) ([]Root, error) {
+	ur, err := userRoot(account)
+	if err != nil {
+		return nil, err
+	}
+	roots := []Root{ur}
+	dr, ok, err := domainRoot(domainOf(account))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		roots = append(roots, dr)
+	}
+	return roots, nil
+}
+
+// Get returns one of the roots that apply to an account by name
+func Get(account, name string) (Root, error) {
+	roots, err := Roots(account)
+	if err != nil {
+		return Root{}, err
+	}
+	for _, r := range roots {
+		if strings.EqualFold(r.Name, name) {
+			return r, nil
+		}
+	}
+	return Root{}, ErrNoSuchRoot
+}
+
+// Check returns ErrOverQuota if a message of size won't fit in an account.
+// Size 1 asks whether there's any room at all. Anything going wrong working
+// it out is logged rather than turning mail away.
+func Check(account string, size int64) error {
+	roots, err := Roots(account)
+	if err != nil {
+		slog.Error("Couldn't check quota", "account", account, "err", err.Error())
+		return nil
+	}
+	for _, r := range roots {
+		if r.Limit.Exceeded(r.Usage, size) {
+			return ErrOverQuota
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package quota
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+func TestCheck(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	os.MkdirAll(filepath.Join(home, "config", "jums"), 0700)
+	conf := `Domain = "example.com"
+BoxesDir = "~/boxes"
+UsersFile = "~/users"
+
+[[Domains]]
+Name = "example.com"
+Quota = { Messages = 3 }
+UserQuota = { Storage = "1K" }
+`
+	if err := os.WriteFile(filepath.Join(home, "config", "jums", "config.toml"), []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := users.Load(config.GetConfig().UsersFile)
+	store.SetPassword("alice", "pw")
+	store.SetPassword("bob", "pw")
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := maildir.UserDir(config.GetConfig().Mailbox("alice"))
+	bob, _ := maildir.UserDir(config.GetConfig().Mailbox("bob"))
+
+	if err := Check("alice", 600); err != nil {
+		t.Fatalf("empty mailbox: %v", err)
+	}
+	// makes the maildirsize that later deliveries are added to
+	Roots("alice")
+	maildir.Deliver(alice, make([]byte, 600))
+	if err := Check("alice", 600); !errors.Is(err, ErrOverQuota) {
+		t.Errorf("over storage: %v", err)
+	}
+
+	// bob has a limit of their own, but the domain only has room for 3 messages
+	maildir.SetUserQuota(bob, &maildir.Quota{Storage: 10000})
+	maildir.Deliver(bob, []byte("hi"))
+	maildir.Deliver(bob, []byte("hi"))
+	if err := Check("bob", 600); !errors.Is(err, ErrOverQuota) {
+		t.Errorf("over domain count: %v", err)
+	}
+
+	mb, err := maildir.Open(alice, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb.Remove(mb.Messages[0])
+	r, err := Get("alice", "")
+	if err != nil || r.Usage != (maildir.Usage{}) || r.Limit.Storage != 1024 {
+		t.Errorf("after removing: %+v, %v", r, err)
+	}
+}
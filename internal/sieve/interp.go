@@ -0,0 +1,620 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// RFC 5228 says to limit redirects so a script can't be used to
+	// multiply mail
+	maxRedirects = 4
+	maxActions   = 32
+	// RFC 5229 lets us cap variable values
+	maxVariableLen = 4096
+)
+
+// Header is one header field of the message being filtered
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Message is what a script gets to look at
+type Message struct {
+	// envelope sender, empty for the null sender
+	From string
+	// envelope recipient
+	To      string
+	Headers []Header
+	Size    int64
+}
+
+type ActionKind int
+
+const (
+	Keep ActionKind = iota
+	FileInto
+	Redirect
+	Reject
+	Vacation
+)
+
+// Action is something the script wants done with the message. Discard
+// doesn't have one, it just means there are no Keep actions.
+type Action struct {
+	Kind ActionKind
+	// folder for FileInto
+	Mailbox string
+	// IMAP flags for Keep and FileInto
+	Flags []string
+	// where to send a Redirect
+	Address string
+	// text of a Reject or Vacation
+	Reason string
+	// the rest of a Vacation
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	Mime      bool
+	Handle    string
+}
+
+// RuntimeError is an error running a script. The message should be kept as
+// if there were no script.
+type RuntimeError struct {
+	Line int
+	Msg  string
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type interp struct {
+	s   *Script
+	msg *Message
+	// lower cased names
+	vars    map[string]string
+	matches []string
+	// the imap4flags internal variable
+	flags []string
+
+	actions      []Action
+	implicitKeep bool
+	stopped      bool
+}
+
+// Run runs a script against a message and returns what should happen to it.
+// Unless the script cancelled it, the result includes the implicit keep.
+func (s *Script) Run(msg *Message) ([]Action, error) {
+	in := &interp{s: s, msg: msg, vars: map[string]string{}, actions: []Action{}, implicitKeep: true}
+	if err := in.block(s.cmds); err != nil {
+		return nil, err
+	}
+	if in.implicitKeep {
+		in.add(Action{Kind: Keep, Flags: slices.Clone(in.flags)})
+	}
+	return in.actions, nil
+}
+
+func (in *interp) errorf(n *node, format string, args ...any) error {
+	return &RuntimeError{Line: n.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (in *interp) block(cmds []*node) error {
+	// whether the last if or elsif in this chain ran its block
+	taken := false
+	for _, n := range cmds {
+		if in.stopped {
+			return nil
+		}
+		switch n.name {
+		case "if", "elsif":
+			if n.name == "elsif" && taken {
+				continue
+			}
+			ok, err := in.test(n.tests[0])
+			if err != nil {
+				return err
+			}
+			taken = ok
+			if ok {
+				if err := in.block(n.block); err != nil {
+					return err
+				}
+			}
+			continue
+		case "else":
+			if !taken {
+				if err := in.block(n.block); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		taken = false
+		if err := in.command(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add records an action, dropping exact duplicates
+func (in *interp) add(a Action) {
+	for _, b := range in.actions {
+		if a.Kind == b.Kind && a.Mailbox == b.Mailbox && a.Address == b.Address && a.Kind != Vacation {
+			return
+		}
+	}
+	in.actions = append(in.actions, a)
+}
+
+func (in *interp) count(kind ActionKind) int {
+	n := 0
+	for _, a := range in.actions {
+		if a.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func (in *interp) command(n *node) error {
+	if len(in.actions) >= maxActions {
+		return in.errorf(n, "too many actions")
+	}
+	switch n.name {
+	case "require":
+	case "stop":
+		in.stopped = true
+	case "discard":
+		in.implicitKeep = false
+	case "keep":
+		in.implicitKeep = false
+		in.add(Action{Kind: Keep, Flags: in.actionFlags(n)})
+	case "fileinto":
+		in.implicitKeep = false
+		in.add(Action{Kind: FileInto, Mailbox: in.expand(n.pos[0].str()), Flags: in.actionFlags(n)})
+	case "redirect":
+		addr := in.expand(n.pos[0].str())
+		if _, err := mail.ParseAddress(addr); err != nil || !strings.Contains(addr, "@") {
+			return in.errorf(n, "bad redirect address %q", addr)
+		}
+		if in.count(Redirect) >= maxRedirects {
+			return in.errorf(n, "too many redirects")
+		}
+		in.implicitKeep = false
+		in.add(Action{Kind: Redirect, Address: addr})
+	case "reject":
+		in.implicitKeep = false
+		in.add(Action{Kind: Reject, Reason: in.expand(n.pos[0].str())})
+	case "vacation":
+		return in.vacation(n)
+	case "set":
+		in.set(n)
+	case "setflag", "addflag", "removeflag":
+		in.setFlags(n)
+	default:
+		return in.errorf(n, "unknown command %s", n.name)
+	}
+
+	if in.count(Reject) > 0 && (in.count(Keep)+in.count(FileInto)+in.count(Redirect)+in.count(Vacation) > 0) {
+		return in.errorf(n, "reject can't be combined with other actions")
+	}
+	return nil
+}
+
+func (in *interp) vacation(n *node) error {
+	if in.count(Vacation) > 0 {
+		return in.errorf(n, "only one vacation allowed")
+	}
+	a := Action{Kind: Vacation, Reason: in.expand(n.pos[0].str()), Days: 7}
+	if d, ok := n.tags["days"]; ok {
+		a.Days = max(int(d.num), 1)
+	}
+	if s, ok := n.tags["subject"]; ok {
+		a.Subject = in.expand(s.str())
+	}
+	if f, ok := n.tags["from"]; ok {
+		a.From = in.expand(f.str())
+	}
+	if addrs, ok := n.tags["addresses"]; ok {
+		a.Addresses = in.expandAll(addrs.strs)
+	}
+	_, a.Mime = n.tags["mime"]
+	if h, ok := n.tags["handle"]; ok {
+		a.Handle = in.expand(h.str())
+	} else {
+		// RFC 5230 4.2, the same reply settings are the same vacation
+		a.Handle = a.Subject + "\x00" + a.From + "\x00" + a.Reason
+	}
+	in.add(a)
+	return nil
+}
+
+// actionFlags are the flags for keep or fileinto, :flags or the internal
+// variable
+func (in *interp) actionFlags(n *node) []string {
+	if f, ok := n.tags["flags"]; ok {
+		return splitFlags(in.expandAll(f.strs))
+	}
+	return slices.Clone(in.flags)
+}
+
+// splitFlags turns a list of space separated flag strings into flags
+func splitFlags(list []string) []string {
+	out := []string{}
+	for _, s := range list {
+		for _, f := range strings.Fields(s) {
+			if !slices.ContainsFunc(out, func(o string) bool { return strings.EqualFold(o, f) }) {
+				out = append(out, f)
+			}
+		}
+	}
+	return out
+}
+
+func (in *interp) setFlags(n *node) {
+	flags := splitFlags(in.expandAll(n.pos[1].strs))
+	varName := ""
+	if n.pos[0].kind != noArg {
+		varName = strings.ToLower(in.expand(n.pos[0].str()))
+	}
+	cur := in.flags
+	if varName != "" {
+		cur = splitFlags([]string{in.vars[varName]})
+	}
+
+	switch n.name {
+	case "setflag":
+		cur = flags
+	case "addflag":
+		cur = splitFlags(append(cur, flags...))
+	case "removeflag":
+		cur = slices.DeleteFunc(slices.Clone(cur), func(f string) bool {
+			return slices.ContainsFunc(flags, func(r string) bool { return strings.EqualFold(r, f) })
+		})
+	}
+
+	if varName != "" {
+		in.vars[varName] = strings.Join(cur, " ")
+	} else {
+		in.flags = cur
+	}
+}
+
+func (in *interp) set(n *node) {
+	name := strings.ToLower(n.pos[0].str())
+	v := in.expand(n.pos[1].str())
+
+	// modifiers apply highest precedence first, RFC 5229 section 4
+	if _, ok := n.tags["lower"]; ok {
+		v = strings.ToLower(v)
+	}
+	if _, ok := n.tags["upper"]; ok {
+		v = strings.ToUpper(v)
+	}
+	if _, ok := n.tags["lowerfirst"]; ok && v != "" {
+		r, size := utf8.DecodeRuneInString(v)
+		v = string(unicode.ToLower(r)) + v[size:]
+	}
+	if _, ok := n.tags["upperfirst"]; ok && v != "" {
+		r, size := utf8.DecodeRuneInString(v)
+		v = string(unicode.ToUpper(r)) + v[size:]
+	}
+	if _, ok := n.tags["quotewildcard"]; ok {
+		v = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(v)
+	}
+	if _, ok := n.tags["length"]; ok {
+		v = strconv.Itoa(utf8.RuneCountInString(v))
+	}
+	if len(v) > maxVariableLen {
+		v = strings.ToValidUTF8(v[:maxVariableLen], "")
+	}
+	in.vars[name] = v
+}
+
+// expand substitutes ${name} and ${N} if the script uses variables
+func (in *interp) expand(s string) string {
+	if !in.s.exts["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		name := s[start+2 : start+end]
+		b.WriteString(s[:start])
+		if v, ok := in.variable(name); ok {
+			b.WriteString(v)
+		} else {
+			// not a variable reference, leave it as it is
+			b.WriteString(s[start : start+end+1])
+		}
+		s = s[start+end+1:]
+	}
+}
+
+func (in *interp) variable(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < len(in.matches) {
+			return in.matches[n], true
+		}
+		return "", true
+	}
+	for i := 0; i < len(name); i++ {
+		if !isIdentChar(name[i]) && name[i] != '.' {
+			return "", false
+		}
+	}
+	if !isIdentStart(name[0]) {
+		return "", false
+	}
+	return in.vars[strings.ToLower(name)], true
+}
+
+func (in *interp) expandAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = in.expand(s)
+	}
+	return out
+}
+
+func (in *interp) test(n *node) (bool, error) {
+	switch n.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := in.test(n.tests[0])
+		return !ok, err
+	case "allof", "anyof":
+		all := n.name == "allof"
+		for _, t := range n.tests {
+			ok, err := in.test(t)
+			if err != nil {
+				return false, err
+			}
+			if ok != all {
+				return ok, nil
+			}
+		}
+		return all, nil
+	case "exists":
+		for _, name := range in.expandAll(n.pos[0].strs) {
+			if len(in.headers(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		if over, ok := n.tags["over"]; ok {
+			return in.msg.Size > over.num, nil
+		}
+		return in.msg.Size < n.tags["under"].num, nil
+	case "header":
+		values := []string{}
+		for _, name := range in.expandAll(n.pos[0].strs) {
+			values = append(values, in.headers(name)...)
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "address":
+		values := []string{}
+		for _, name := range in.expandAll(n.pos[0].strs) {
+			for _, h := range in.headers(name) {
+				values = append(values, addressParts(n, parseAddresses(h))...)
+			}
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "envelope":
+		values := []string{}
+		for _, part := range in.expandAll(n.pos[0].strs) {
+			switch strings.ToLower(part) {
+			case "from":
+				if in.msg.From == "" {
+					// the null sender only matches an empty :all
+					values = append(values, "")
+					continue
+				}
+				values = append(values, addressParts(n, []string{in.msg.From})...)
+			case "to":
+				values = append(values, addressParts(n, []string{in.msg.To})...)
+			default:
+				return false, in.errorf(n, "unknown envelope part %s", part)
+			}
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "string":
+		return in.match(n, in.expandAll(n.pos[0].strs), n.pos[1].strs)
+	case "hasflag":
+		flags := in.flags
+		if n.pos[0].kind != noArg {
+			vals := []string{}
+			for _, v := range in.expandAll(n.pos[0].strs) {
+				vals = append(vals, in.vars[strings.ToLower(v)])
+			}
+			flags = splitFlags(vals)
+		}
+		return in.match(n, flags, n.pos[1].strs)
+	}
+	return false, in.errorf(n, "unknown test %s", n.name)
+}
+
+// headers returns the decoded values of every header called name
+func (in *interp) headers(name string) []string {
+	out := []string{}
+	for _, h := range in.msg.Headers {
+		if strings.EqualFold(h.Name, name) {
+			out = append(out, decodeHeader(h.Value))
+		}
+	}
+	return out
+}
+
+var wordDecoder = &mime.WordDecoder{
+	// we can't convert other charsets, passing them through beats dropping
+	// the whole header
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	},
+}
+
+func decodeHeader(v string) string {
+	v = strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+	if d, err := wordDecoder.DecodeHeader(v); err == nil {
+		v = d
+	}
+	return strings.TrimSpace(v)
+}
+
+// parseAddresses pulls the addresses out of a header, falling back to the
+// whole value if it won't parse
+func parseAddresses(v string) []string {
+	list, err := (&mail.AddressParser{WordDecoder: wordDecoder}).ParseList(v)
+	if err != nil {
+		return []string{v}
+	}
+	out := []string{}
+	for _, a := range list {
+		out = append(out, a.Address)
+	}
+	return out
+}
+
+func addressParts(n *node, addrs []string) []string {
+	out := []string{}
+	for _, a := range addrs {
+		local, domain, _ := strings.Cut(a, "@")
+		if i := strings.LastIndexByte(a, '@'); i >= 0 {
+			local, domain = a[:i], a[i+1:]
+		}
+		switch {
+		case hasTag(n, "localpart"):
+			out = append(out, local)
+		case hasTag(n, "domain"):
+			out = append(out, domain)
+		default:
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func hasTag(n *node, tag string) bool {
+	_, ok := n.tags[tag]
+	return ok
+}
+
+// match compares values against keys with the test's comparator and match
+// type. A successful :matches sets the match variables.
+func (in *interp) match(n *node, values, keys []string) (bool, error) {
+	keys = in.expandAll(keys)
+	fold := n.tags["comparator"].str() != "i;octet"
+
+	for _, v := range values {
+		for _, k := range keys {
+			switch {
+			case hasTag(n, "contains"):
+				if fold {
+					if strings.Contains(strings.ToLower(v), strings.ToLower(k)) {
+						return true, nil
+					}
+				} else if strings.Contains(v, k) {
+					return true, nil
+				}
+			case hasTag(n, "matches"):
+				if groups, ok := wildcard(k, v, fold); ok {
+					if in.s.exts["variables"] {
+						in.matches = append([]string{v}, groups...)
+					}
+					return true, nil
+				}
+			default:
+				if fold && strings.EqualFold(v, k) || v == k {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+var errNoMatch = errors.New("no match")
+
+// wildcard matches s against a :matches pattern, where * is any run of
+// characters, ? is any one and \ escapes. It returns what each wildcard
+// matched.
+func wildcard(pattern, s string, fold bool) ([]string, bool) {
+	p, str := []rune(pattern), []rune(s)
+	groups, err := wild(p, str, fold)
+	if err != nil {
+		return nil, false
+	}
+	return groups, true
+}
+
+func wild(p, s []rune, fold bool) ([]string, error) {
+	eq := func(a, b rune) bool {
+		if fold {
+			return unicode.ToLower(a) == unicode.ToLower(b)
+		}
+		return a == b
+	}
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			// shortest match first, as RFC 5229 wants
+			for i := 0; i <= len(s); i++ {
+				if rest, err := wild(p[1:], s[i:], fold); err == nil {
+					return append([]string{string(s[:i])}, rest...), nil
+				}
+			}
+			return nil, errNoMatch
+		case '?':
+			if len(s) == 0 {
+				return nil, errNoMatch
+			}
+			rest, err := wild(p[1:], s[1:], fold)
+			if err != nil {
+				return nil, err
+			}
+			return append([]string{string(s[:1])}, rest...), nil
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+		}
+		if len(s) == 0 || !eq(p[0], s[0]) {
+			return nil, errNoMatch
+		}
+		p, s = p[1:], s[1:]
+	}
+	if len(s) > 0 {
+		return nil, errNoMatch
+	}
+	return []string{}, nil
+}
@@ -0,0 +1,218 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdentifier
+	tokTag
+	tokNumber
+	tokString
+	// one of [ ] ( ) , ; { }
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  int64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of script"
+	case tokString:
+		return "string"
+	case tokTag:
+		return ":" + t.text
+	default:
+		return t.text
+	}
+}
+
+// lexer splits a script into tokens, RFC 5228 section 8.1
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...any) error {
+	return &ParseError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// skip passes over whitespace and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	start, c := l.pos, l.src[l.pos]
+	switch {
+	case strings.ContainsRune("[](),;{}", rune(c)):
+		l.pos++
+		return token{kind: tokPunct, text: string(c), line: l.line}, nil
+
+	case c == '"':
+		return l.quoted()
+
+	case c == ':':
+		l.pos++
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		if l.pos == start+1 || !isIdentStart(l.src[start+1]) {
+			return token{}, l.errorf("bad tag")
+		}
+		return token{kind: tokTag, text: strings.ToLower(l.src[start+1 : l.pos]), line: l.line}, nil
+
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, l.errorf("number too big")
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				n <<= 10
+				l.pos++
+			case 'M', 'm':
+				n <<= 20
+				l.pos++
+			case 'G', 'g':
+				n <<= 30
+				l.pos++
+			}
+		}
+		return token{kind: tokNumber, num: n, text: l.src[start:l.pos], line: l.line}, nil
+
+	case isIdentStart(c):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		word := strings.ToLower(l.src[start:l.pos])
+		if word == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline()
+		}
+		return token{kind: tokIdentifier, text: word, line: l.line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+// quoted reads a "string", backslash escapes the next character
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokString, text: b.String(), line: line}, nil
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return token{}, &ParseError{Line: line, Msg: "unterminated string"}
+}
+
+// multiline reads a text: string, lines up to one holding only a dot
+func (l *lexer) multiline() (token, error) {
+	line := l.line
+	// the rest of the text: line can only hold whitespace or a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return token{}, l.errorf("text: must be followed by a new line")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if text == "." {
+			return token{kind: tokString, text: b.String(), line: line}, nil
+		}
+		// dot stuffing
+		if strings.HasPrefix(text, "..") {
+			text = text[1:]
+		}
+		b.WriteString(text)
+		b.WriteString("\r\n")
+	}
+	return token{}, &ParseError{Line: line, Msg: "unterminated text: string"}
+}
@@ -0,0 +1,436 @@
+// Package sieve is an RFC 5228 Sieve interpreter for filtering mail at
+// delivery time, with the fileinto, reject, envelope, imap4flags, vacation
+// and variables extensions
+package sieve
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Extensions are the capabilities scripts can require
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+	"variables",
+}
+
+// ParseError is a syntax or validation error in a script
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Script is a parsed and checked script, ready to run
+type Script struct {
+	cmds []*node
+	exts map[string]bool
+}
+
+type argKind int
+
+const (
+	noArg argKind = iota
+	argString
+	argStrings
+	argNumber
+)
+
+type arg struct {
+	kind argKind
+	strs []string
+	num  int64
+}
+
+func (a arg) str() string {
+	if len(a.strs) == 0 {
+		return ""
+	}
+	return a.strs[0]
+}
+
+// node is a command or a test
+type node struct {
+	name  string
+	line  int
+	tags  map[string]arg
+	pos   []arg
+	tests []*node
+	block []*node
+}
+
+// spec describes the arguments a command or test takes
+type spec struct {
+	// extension that has to be required to use it
+	ext  string
+	test bool
+	tags map[string]argKind
+	pos  []argKind
+	// leading positional arguments that can be left out
+	optional int
+	// 1 for a single test, -1 for a test list
+	tests int
+	block bool
+}
+
+var matchTags = map[string]argKind{"comparator": argString, "is": noArg, "contains": noArg, "matches": noArg}
+
+var addressTags = map[string]argKind{"localpart": noArg, "domain": noArg, "all": noArg}
+
+func withTags(sets ...map[string]argKind) map[string]argKind {
+	out := map[string]argKind{}
+	for _, s := range sets {
+		for k, v := range s {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// tags that need an extension on top of their command's
+var tagExts = map[string]string{"flags": "imap4flags"}
+
+// mutually exclusive tags
+var tagGroups = [][]string{
+	{"is", "contains", "matches"},
+	{"localpart", "domain", "all"},
+	{"over", "under"},
+}
+
+var specs = map[string]spec{
+	"require":  {pos: []argKind{argStrings}},
+	"if":       {tests: 1, block: true},
+	"elsif":    {tests: 1, block: true},
+	"else":     {block: true},
+	"stop":     {},
+	"keep":     {tags: map[string]argKind{"flags": argStrings}},
+	"discard":  {},
+	"redirect": {pos: []argKind{argString}},
+	"fileinto": {ext: "fileinto", tags: map[string]argKind{"flags": argStrings}, pos: []argKind{argString}},
+	"reject":   {ext: "reject", pos: []argKind{argString}},
+	"vacation": {ext: "vacation", pos: []argKind{argString}, tags: map[string]argKind{
+		"days": argNumber, "subject": argString, "from": argString,
+		"addresses": argStrings, "mime": noArg, "handle": argString,
+	}},
+	"set": {ext: "variables", pos: []argKind{argString, argString}, tags: map[string]argKind{
+		"lower": noArg, "upper": noArg, "lowerfirst": noArg, "upperfirst": noArg,
+		"quotewildcard": noArg, "length": noArg,
+	}},
+	"setflag":    {ext: "imap4flags", pos: []argKind{argString, argStrings}, optional: 1},
+	"addflag":    {ext: "imap4flags", pos: []argKind{argString, argStrings}, optional: 1},
+	"removeflag": {ext: "imap4flags", pos: []argKind{argString, argStrings}, optional: 1},
+
+	"true":     {test: true},
+	"false":    {test: true},
+	"not":      {test: true, tests: 1},
+	"allof":    {test: true, tests: -1},
+	"anyof":    {test: true, tests: -1},
+	"exists":   {test: true, pos: []argKind{argStrings}},
+	"size":     {test: true, tags: map[string]argKind{"over": argNumber, "under": argNumber}},
+	"header":   {test: true, tags: matchTags, pos: []argKind{argStrings, argStrings}},
+	"address":  {test: true, tags: withTags(matchTags, addressTags), pos: []argKind{argStrings, argStrings}},
+	"envelope": {test: true, ext: "envelope", tags: withTags(matchTags, addressTags), pos: []argKind{argStrings, argStrings}},
+	"string":   {test: true, ext: "variables", tags: matchTags, pos: []argKind{argStrings, argStrings}},
+	"hasflag":  {test: true, ext: "imap4flags", tags: matchTags, pos: []argKind{argStrings, argStrings}, optional: 1},
+}
+
+type parser struct {
+	lex  *lexer
+	tok  token
+	exts map[string]bool
+	// require is only allowed before anything else
+	started bool
+}
+
+// Parse parses and checks a script. Errors are *ParseError.
+func Parse(src string) (*Script, error) {
+	p := &parser{lex: &lexer{src: src, line: 1}, exts: map[string]bool{}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Script{cmds: cmds, exts: p.exts}, nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &ParseError{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) advance() error {
+	t, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = t
+	return nil
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q, got %s", s, p.tok)
+	}
+	return p.advance()
+}
+
+// commands parses commands up to a "}" or the end of the script
+func (p *parser) commands() ([]*node, error) {
+	cmds := []*node{}
+	for p.tok.kind == tokIdentifier {
+		n, err := p.node(false)
+		if err != nil {
+			return nil, err
+		}
+
+		prev := ""
+		if len(cmds) > 0 {
+			prev = cmds[len(cmds)-1].name
+		}
+		switch n.name {
+		case "elsif", "else":
+			if prev != "if" && prev != "elsif" {
+				return nil, &ParseError{Line: n.line, Msg: n.name + " without if"}
+			}
+		case "require":
+			if p.started {
+				return nil, &ParseError{Line: n.line, Msg: "require must come before other commands"}
+			}
+			for _, ext := range n.pos[0].strs {
+				if !slices.Contains(Extensions, ext) {
+					return nil, &ParseError{Line: n.line, Msg: "unsupported extension " + ext}
+				}
+				p.exts[ext] = true
+			}
+		}
+		if n.name != "require" {
+			p.started = true
+		}
+		cmds = append(cmds, n)
+	}
+	return cmds, nil
+}
+
+// node parses a command, or a test if test is set
+func (p *parser) node(test bool) (*node, error) {
+	if p.tok.kind != tokIdentifier {
+		return nil, p.errorf("expected a test, got %s", p.tok)
+	}
+	n := &node{name: p.tok.text, line: p.tok.line, tags: map[string]arg{}}
+	sp, ok := specs[n.name]
+	if !ok || sp.test != test {
+		what := "command"
+		if test {
+			what = "test"
+		}
+		return nil, p.errorf("unknown %s %s", what, n.name)
+	}
+	if sp.ext != "" && !p.exts[sp.ext] {
+		return nil, p.errorf("%s needs require %q", n.name, sp.ext)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	if err := p.arguments(n, sp); err != nil {
+		return nil, err
+	}
+
+	switch sp.tests {
+	case 1:
+		t, err := p.node(true)
+		if err != nil {
+			return nil, err
+		}
+		n.tests = []*node{t}
+	case -1:
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			t, err := p.node(true)
+			if err != nil {
+				return nil, err
+			}
+			n.tests = append(n.tests, t)
+			if !p.isPunct(",") {
+				break
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if test {
+		return n, nil
+	}
+
+	if sp.block {
+		if err := p.expect("{"); err != nil {
+			return nil, err
+		}
+		block, err := p.commands()
+		if err != nil {
+			return nil, err
+		}
+		n.block = block
+		return n, p.expect("}")
+	}
+	return n, p.expect(";")
+}
+
+// arguments reads the tagged and positional arguments of n
+func (p *parser) arguments(n *node, sp spec) error {
+	for {
+		switch {
+		case p.tok.kind == tokTag:
+			name, line := p.tok.text, p.tok.line
+			kind, ok := sp.tags[name]
+			if !ok {
+				return p.errorf("%s doesn't take :%s", n.name, name)
+			}
+			if ext := tagExts[name]; ext != "" && !p.exts[ext] {
+				return p.errorf(":%s needs require %q", name, ext)
+			}
+			if _, dup := n.tags[name]; dup {
+				return p.errorf("duplicate :%s", name)
+			}
+			if err := p.advance(); err != nil {
+				return err
+			}
+			a := arg{kind: noArg}
+			if kind != noArg {
+				var err error
+				if a, err = p.value(kind); err != nil {
+					return err
+				}
+			}
+			if name == "comparator" && !slices.Contains(Extensions, "comparator-"+a.str()) {
+				return &ParseError{Line: line, Msg: "unsupported comparator " + a.str()}
+			}
+			n.tags[name] = a
+
+		case p.tok.kind == tokString || p.tok.kind == tokNumber || p.isPunct("["):
+			kind := argStrings
+			if p.tok.kind == tokNumber {
+				kind = argNumber
+			}
+			a, err := p.value(kind)
+			if err != nil {
+				return err
+			}
+			n.pos = append(n.pos, a)
+
+		default:
+			return p.check(n, sp)
+		}
+	}
+}
+
+// value reads a string, string list or number
+func (p *parser) value(kind argKind) (arg, error) {
+	switch {
+	case kind == argNumber:
+		if p.tok.kind != tokNumber {
+			return arg{}, p.errorf("expected a number, got %s", p.tok)
+		}
+		a := arg{kind: argNumber, num: p.tok.num}
+		return a, p.advance()
+
+	case p.tok.kind == tokString:
+		a := arg{kind: argString, strs: []string{p.tok.text}}
+		return a, p.advance()
+
+	case p.isPunct("["):
+		a := arg{kind: argStrings}
+		if err := p.advance(); err != nil {
+			return arg{}, err
+		}
+		for {
+			if p.tok.kind != tokString {
+				return arg{}, p.errorf("expected a string, got %s", p.tok)
+			}
+			a.strs = append(a.strs, p.tok.text)
+			if err := p.advance(); err != nil {
+				return arg{}, err
+			}
+			if !p.isPunct(",") {
+				break
+			}
+			if err := p.advance(); err != nil {
+				return arg{}, err
+			}
+		}
+		if kind == argString && len(a.strs) != 1 {
+			return arg{}, p.errorf("expected a single string")
+		}
+		return a, p.expect("]")
+	}
+	return arg{}, p.errorf("expected a string, got %s", p.tok)
+}
+
+// check makes sure the arguments of n fit its spec
+func (p *parser) check(n *node, sp spec) error {
+	errorf := func(format string, args ...any) error {
+		return &ParseError{Line: n.line, Msg: n.name + ": " + fmt.Sprintf(format, args...)}
+	}
+
+	pos := sp.pos
+	if len(n.pos) < len(pos) && len(pos)-len(n.pos) <= sp.optional {
+		pos = pos[len(pos)-len(n.pos):]
+	}
+	if len(n.pos) != len(pos) {
+		return errorf("expected %d arguments, got %d", len(sp.pos), len(n.pos))
+	}
+	for i, kind := range pos {
+		switch {
+		case kind == argNumber && n.pos[i].kind != argNumber:
+			return errorf("argument %d should be a number", i+1)
+		case kind != argNumber && n.pos[i].kind == argNumber:
+			return errorf("argument %d should be a string", i+1)
+		case kind == argString && len(n.pos[i].strs) != 1:
+			return errorf("argument %d should be a single string", i+1)
+		}
+	}
+	if len(pos) < len(sp.pos) {
+		// keep positions lined up with the spec
+		n.pos = append(make([]arg, len(sp.pos)-len(pos)), n.pos...)
+	}
+
+	for _, group := range tagGroups {
+		count := 0
+		for _, t := range group {
+			if _, ok := n.tags[t]; ok {
+				count++
+			}
+		}
+		if count > 1 {
+			return errorf("only one of :%s allowed", strings.Join(group, ", :"))
+		}
+	}
+	if n.name == "size" && len(n.tags) != 1 {
+		return errorf("needs :over or :under")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package sieve
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testMessage = &Message{
+	From: "alice@example.com",
+	To:   "bob@example.org",
+	Headers: []Header{
+		{"From", " Alice <alice@example.com>"},
+		{"To", " bob@example.org"},
+		{"Subject", " =?utf-8?q?[jums]_h=C3=A9llo?="},
+		{"List-Id", " <jums.lists.example.com>"},
+	},
+	Size: 2000,
+}
+
+// summary is a short description of a list of actions to compare against
+func summary(actions []Action) string {
+	out := []string{}
+	for _, a := range actions {
+		s := ""
+		switch a.Kind {
+		case Keep:
+			s = "keep"
+		case FileInto:
+			s = "fileinto " + a.Mailbox
+		case Redirect:
+			s = "redirect " + a.Address
+		case Reject:
+			s = "reject " + a.Reason
+		case Vacation:
+			s = "vacation " + a.Subject
+		}
+		if len(a.Flags) > 0 {
+			s += " " + strings.Join(a.Flags, ",")
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, "; ")
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		script, want string
+	}{
+		{``, "keep"},
+		{`discard;`, ""},
+		{`require "fileinto";
+		  if header :contains "subject" "[JUMS]" { fileinto "Lists/jums"; stop; }
+		  fileinto "Other";`, "fileinto Lists/jums"},
+		{`require ["fileinto", "variables"];
+		  if header :matches "List-Id" "<*.lists.*>" { fileinto "Lists/${1}"; }`, "fileinto Lists/jums"},
+		{`require "envelope";
+		  if envelope :domain :is "from" "example.com" { redirect "carol@example.net"; }`, "redirect carol@example.net"},
+		{`require "reject"; if allof (size :over 1K, not exists "x-spam") { reject "too big"; }`, "reject too big"},
+		{`if anyof (false, address :localpart "to" "nobody") { discard; }`, "keep"},
+		{`require "imap4flags";
+		  addflag ["\\Seen", "$Work"]; removeflag "$work"; keep;`, "keep \\Seen"},
+		{`require ["imap4flags", "fileinto"];
+		  fileinto :flags "\\Flagged" "Important";`, "fileinto Important \\Flagged"},
+		{`require "vacation";
+		  vacation :days 3 :subject "Away" "I'm away";`, "vacation Away; keep"},
+		{`require ["variables", "fileinto"];
+		  set :upperfirst "box" "archive";
+		  if string :is "${box}" "Archive" { fileinto "${box}"; } else { fileinto "wrong"; }`, "fileinto Archive"},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.script)
+		if err != nil {
+			t.Errorf("%s: %s", tt.script, err)
+			continue
+		}
+		actions, err := s.Run(testMessage)
+		if err != nil {
+			t.Errorf("%s: %s", tt.script, err)
+			continue
+		}
+		if got := summary(actions); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, script := range []string{
+		`fileinto "INBOX";`,
+		`require "notify";`,
+		`keep`,
+		`if true { keep; } require "fileinto";`,
+		`else { keep; }`,
+		`if header :is :contains "a" "b" { keep; }`,
+		`if header :comparator "i;unicode" "a" "b" { keep; }`,
+		`reject;`,
+		"require \"vacation\"; vacation text:\nunterminated\n",
+	} {
+		if _, err := Parse(script); err == nil {
+			t.Errorf("%q parsed", script)
+		}
+	}
+}
+
+func TestRejectWithKeep(t *testing.T) {
+	s, err := Parse(`require ["fileinto", "reject"]; reject "no"; fileinto "x";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run(testMessage); err == nil {
+		t.Error("reject with fileinto ran")
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	groups, ok := wildcard("a*c?\\*", "abbbcd*", false)
+	if !ok || !slices.Equal(groups, []string{"bbb", "d"}) {
+		t.Errorf("got %q %v", groups, ok)
+	}
+	if _, ok := wildcard("A*", "abc", false); ok {
+		t.Error("i;octet matched different case")
+	}
+	if _, ok := wildcard("A*", "abc", true); !ok {
+		t.Error("i;ascii-casemap didn't match")
+	}
+}
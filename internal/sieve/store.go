@@ -0,0 +1,230 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// ActiveFile is the script run at delivery, in the user's maildir. When
+	// scripts are managed over ManageSieve it's a symlink into scriptsDir.
+	ActiveFile = "jums.sieve"
+	scriptsDir = "jums-sieve"
+	// a script that used to be a plain ActiveFile is kept under this name
+	defaultName = "jums"
+)
+
+var (
+	ErrNoSuchScript = errors.New("no such script")
+	ErrScriptExists = errors.New("script already exists")
+	ErrActive       = errors.New("script is active")
+	ErrInvalidName  = errors.New("invalid script name")
+)
+
+// validName keeps script names usable as file names, RFC 5804 section 1.6
+// allows almost anything else
+func validName(name string) bool {
+	if name == "" || len(name) > 128 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r == '/' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func scriptPath(userDir, name string) (string, error) {
+	if !validName(name) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(userDir, scriptsDir, name), nil
+}
+
+// adopt moves a hand written ActiveFile into the scripts directory so it can
+// be managed like the others
+func adopt(userDir string) error {
+	active := filepath.Join(userDir, ActiveFile)
+	info, err := os.Lstat(active)
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err = os.MkdirAll(filepath.Join(userDir, scriptsDir), 0700); err != nil {
+		return err
+	}
+	path, _ := scriptPath(userDir, defaultName)
+	if err = os.Rename(active, path); err != nil {
+		return err
+	}
+	return os.Symlink(filepath.Join(scriptsDir, defaultName), active)
+}
+
+// Scripts lists the names of a user's scripts and which one is active, ""
+// if none is
+func Scripts(userDir string) ([]string, string, error) {
+	if err := adopt(userDir); err != nil {
+		return nil, "", fmt.Errorf("sieve.Scripts: %w", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(userDir, scriptsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("sieve.Scripts: %w", err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && validName(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+
+	active := ""
+	if target, err := os.Readlink(filepath.Join(userDir, ActiveFile)); err == nil {
+		if name := filepath.Base(target); slices.Contains(names, name) {
+			active = name
+		}
+	}
+	return names, active, nil
+}
+
+// GetScript returns the source of a script
+func GetScript(userDir, name string) (string, error) {
+	if err := adopt(userDir); err != nil {
+		return "", fmt.Errorf("sieve.GetScript: %w", err)
+	}
+	path, err := scriptPath(userDir, name)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNoSuchScript
+	}
+	if err != nil {
+		return "", fmt.Errorf("sieve.GetScript: %w", err)
+	}
+	return string(b), nil
+}
+
+// PutScript checks a script and stores it, replacing any script with the
+// same name. The error is a *ParseError if the script is no good.
+func PutScript(userDir, name, src string) error {
+	if _, err := Parse(src); err != nil {
+		return err
+	}
+	if err := adopt(userDir); err != nil {
+		return fmt.Errorf("sieve.PutScript: %w", err)
+	}
+	path, err := scriptPath(userDir, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("sieve.PutScript: %w", err)
+	}
+
+	// a delivery running the script mustn't see half of it
+	tmp := filepath.Join(filepath.Dir(path), ".tmp-"+name)
+	if err = os.WriteFile(tmp, []byte(src), 0600); err != nil {
+		return fmt.Errorf("sieve.PutScript: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sieve.PutScript: %w", err)
+	}
+	return nil
+}
+
+// DeleteScript removes a script, which can't be the active one
+func DeleteScript(userDir, name string) error {
+	_, active, err := Scripts(userDir)
+	if err != nil {
+		return err
+	}
+	if name == active {
+		return ErrActive
+	}
+	path, err := scriptPath(userDir, name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoSuchScript
+	}
+	if err != nil {
+		return fmt.Errorf("sieve.DeleteScript: %w", err)
+	}
+	return nil
+}
+
+// RenameScript renames a script, keeping it active if it was
+func RenameScript(userDir, from, to string) error {
+	names, active, err := Scripts(userDir)
+	if err != nil {
+		return err
+	}
+	fromPath, err := scriptPath(userDir, from)
+	if err != nil {
+		return err
+	}
+	toPath, err := scriptPath(userDir, to)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(names, from) {
+		return ErrNoSuchScript
+	}
+	if slices.Contains(names, to) {
+		return ErrScriptExists
+	}
+
+	if err = os.Rename(fromPath, toPath); err != nil {
+		return fmt.Errorf("sieve.RenameScript: %w", err)
+	}
+	if from == active {
+		return SetActive(userDir, to)
+	}
+	return nil
+}
+
+// SetActive makes a script the one that runs at delivery. An empty name
+// turns filtering off.
+func SetActive(userDir, name string) error {
+	if err := adopt(userDir); err != nil {
+		return fmt.Errorf("sieve.SetActive: %w", err)
+	}
+	active := filepath.Join(userDir, ActiveFile)
+	if name == "" {
+		if err := os.Remove(active); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("sieve.SetActive: %w", err)
+		}
+		return nil
+	}
+
+	path, err := scriptPath(userDir, name)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(path); err != nil {
+		return ErrNoSuchScript
+	}
+
+	// swap the link in one go so deliveries always see a script
+	tmp := filepath.Join(userDir, ".tmp-"+ActiveFile)
+	os.Remove(tmp)
+	if err = os.Symlink(filepath.Join(scriptsDir, name), tmp); err != nil {
+		return fmt.Errorf("sieve.SetActive: %w", err)
+	}
+	if err = os.Rename(tmp, active); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sieve.SetActive: %w", err)
+	}
+	return nil
+}
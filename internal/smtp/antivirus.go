@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp/clamd"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+)
+
+// scanMessage runs the finished message past clamd. A non-nil status means
+// the message shouldn't be accepted. Infected mail is quarantined instead of
+// rejected if configured to.
+func (s *Session) scanMessage() *packets.Status {
+	conf := config.GetConfig()
+	if !conf.Antivirus.Enabled {
+		return nil
+	}
+
+	virus, err := scan(conf.Antivirus.Address, conf.Antivirus.Timeout, s.mail.Data)
+	if err != nil {
+		slog.Error("Virus scan failed", "id", s.mail.Id, "err", err.Error())
+		if strings.EqualFold(conf.Antivirus.OnError, "accept") {
+			return nil
+		}
+		return packets.NewStatus(451, "Temporary local problem, try again later")
+	}
+
+	if virus == "" {
+		return nil
+	}
+
+	slog.Info("Virus found", "id", s.mail.Id, "virus", virus, "addr", s.remoteIP().String())
+	if strings.EqualFold(conf.Antivirus.OnVirus, "quarantine") {
+		s.quarantine = fmt.Sprintf("virus found: %s", virus)
+		return nil
+	}
+	return packets.NewStatus(554, fmt.Sprintf("Message rejected, virus found: %s", virus))
+}
+
+func scan(address string, timeout time.Duration, data []byte) (string, error) {
+	c, err := clamd.New(address, timeout)
+	if err != nil {
+		return "", err
+	}
+	return c.Scan(data)
+}
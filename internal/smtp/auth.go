@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/smtp/packets"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+// auth handles the AUTH command, RFC 4954. Only PLAIN is supported and only
+// over TLS.
+func auth(st state, c *packets.Command) *packets.Status {
+	s := st.session()
+	if !isTls(s.conn) {
+		return packets.NewStatus(538, "Encryption required for requested authentication mechanism")
+	}
+	if s.authed {
+		return packets.NewStatus(503, "Already authenticated")
+	}
+
+	args := c.Args()
+	if len(args) < 1 {
+		return packets.NewStatus(501, "Syntax error")
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		return packets.NewStatus(504, "Unrecognized authentication type")
+	}
+
+	if len(args) < 2 {
+		// no initial response, ask for it
+		s.state = &authState{s: s, prev: st}
+		return packets.NewStatus(334, "")
+	}
+	return s.authPlain(args[1])
+}
+
+func (s *Session) authPlain(resp string) *packets.Status {
+	if resp == "*" {
+		return packets.NewStatus(501, "Authentication cancelled")
+	}
+	if resp == "=" {
+		resp = ""
+	}
+
+	user, pass, err := decodePlain(resp)
+	if err != nil {
+		return packets.NewStatus(501, "Cannot decode response")
+	}
+
+	name, ok := users.Authenticate(user, pass)
+	if !ok {
+		slog.Info("SMTP AUTH failed", "addr", s.conn.RemoteAddr().String(), "user", user)
+		// slow down password guessing
+		time.Sleep(2 * time.Second)
+		return packets.NewStatus(535, "Authentication credentials invalid")
+	}
+
+	slog.Info("SMTP AUTH", "addr", s.conn.RemoteAddr().String(), "user", name)
+	s.authed = true
+	s.user = name
+	return packets.NewStatus(235, "Authentication successful")
+}
+
+// decodePlain decodes a SASL PLAIN response: authzid NUL authcid NUL password
+func decodePlain(b64 string) (string, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed PLAIN response")
+	}
+	if parts[0] != "" && !strings.EqualFold(parts[0], parts[1]) {
+		return "", "", errors.New("authorization identity not supported")
+	}
+	return parts[1], parts[2], nil
+}
+
+// authState waits for the client's response to a 334 challenge
+type authState struct {
+	s    *Session
+	prev state
+}
+
+func (st *authState) session() *Session {
+	return st.s
+}
+
+func (st *authState) Handle(b []byte) *packets.Status {
+	st.s.state = st.prev
+	return st.s.authPlain(strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,91 @@
+// Package clamd scans messages for viruses with a clamd compatible daemon
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamd's default StreamMaxLength is 25M but chunks should be well under that
+const chunkSize = 64 * 1024
+
+var ErrBadResponse = errors.New("unexpected response from clamd")
+
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// New creates a client for the clamd at address, which is either
+// "unix:/path/to/clamd.ctl" or "tcp:host:port"
+func New(address string, timeout time.Duration) (*Client, error) {
+	network, addr, ok := strings.Cut(address, ":")
+	if !ok {
+		return nil, fmt.Errorf("clamd.New: bad address %q", address)
+	}
+	switch network {
+	case "tcp", "inet":
+		network = "tcp"
+	case "unix", "local":
+		network = "unix"
+	default:
+		return nil, fmt.Errorf("clamd.New: unknown network %q", network)
+	}
+
+	return &Client{network, addr, timeout}, nil
+}
+
+// Scan streams data to clamd with INSTREAM. It returns the name of the virus
+// found, or an empty string if the data is clean.
+func (c *Client) Scan(data []byte) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("clamd.Scan: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.Write(w, binary.BigEndian, uint32(n))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	// zero length chunk ends the stream
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err = w.Flush(); err != nil {
+		return "", fmt.Errorf("clamd.Scan: %w", err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return "", fmt.Errorf("clamd.Scan: %w", err)
+	}
+	return parseResponse(string(bytes.TrimSuffix(resp, []byte{0})))
+}
+
+// responses look like "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR"
+func parseResponse(resp string) (string, error) {
+	resp = strings.TrimSpace(resp)
+	switch {
+	case strings.HasSuffix(resp, " FOUND"):
+		_, found, _ := strings.Cut(strings.TrimSuffix(resp, " FOUND"), ": ")
+		return found, nil
+	case strings.HasSuffix(resp, ": OK"):
+		return "", nil
+	case strings.HasSuffix(resp, " ERROR"):
+		return "", fmt.Errorf("clamd.Scan: %s", resp)
+	default:
+		return "", fmt.Errorf("%w: %q", ErrBadResponse, resp)
+	}
+}
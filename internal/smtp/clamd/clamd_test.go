@@ -0,0 +1,102 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM requests, flagging anything containing the EICAR
+// test string
+func fakeClamd(t *testing.T, network, address string) string {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					c.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				data := []byte{}
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+
+				if bytes.Contains(data, []byte(eicar)) {
+					c.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					c.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return network + ":" + l.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	addrs := []string{
+		fakeClamd(t, "tcp", "127.0.0.1:0"),
+		fakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock")),
+	}
+
+	for _, addr := range addrs {
+		c, err := New(addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		virus, err := c.Scan([]byte("Subject: hi\r\n\r\nnothing to see here\r\n"))
+		if err != nil || virus != "" {
+			t.Errorf("%s: clean message got %q, %v", addr, virus, err)
+		}
+
+		// big enough to need several chunks
+		msg := append(bytes.Repeat([]byte("a"), 3*chunkSize), eicar...)
+		virus, err = c.Scan(msg)
+		if err != nil || virus != "Eicar-Test-Signature" {
+			t.Errorf("%s: infected message got %q, %v", addr, virus, err)
+		}
+	}
+}
+
+func TestScanUnavailable(t *testing.T) {
+	c, err := New("unix:"+filepath.Join(t.TempDir(), "missing.sock"), time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = c.Scan([]byte("hi")); err == nil {
+		t.Error("expected an error scanning with no clamd running")
+	}
+}
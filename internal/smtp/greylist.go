@@ -0,0 +1,34 @@
+package smtp
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp/greylist"
+)
+
+var (
+	greylistOnce     sync.Once
+	greylistInstance *greylist.Greylist
+)
+
+// getGreylist returns the shared greylist, or nil if greylisting is disabled
+func getGreylist() *greylist.Greylist {
+	greylistOnce.Do(func() {
+		conf := config.GetConfig()
+		if !conf.Greylist.Enabled {
+			return
+		}
+
+		gl, err := greylist.New(conf.Greylist.WhitelistFile, conf.Greylist.Delay, conf.Greylist.Expiry, conf.Greylist.Lifetime)
+		if err != nil {
+			// better to let mail through than to refuse everything
+			slog.Error("Couldn't load greylist, greylisting disabled", "err", err.Error())
+			return
+		}
+		greylistInstance = gl
+	})
+
+	return greylistInstance
+}
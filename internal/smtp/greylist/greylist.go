@@ -0,0 +1,166 @@
+package greylist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Greylist temporarily rejects (client network, sender, recipient) triplets
+// the first time they're seen. Legitimate servers retry after a while, most
+// spam bots don't. Triplets that make it through get added to an
+// auto-whitelist which is persisted to disk so restarts don't make everyone
+// wait again.
+type Greylist struct {
+	mu        sync.Mutex
+	delay     time.Duration
+	expiry    time.Duration
+	lifetime  time.Duration
+	path      string
+	pending   map[string]time.Time
+	whitelist map[string]time.Time
+
+	// swappable for tests
+	now func() time.Time
+}
+
+// New creates a greylist, loading any previously saved whitelist from path.
+// delay is how long a sender has to wait before a retry is accepted, expiry is
+// how long we remember a triplet that never retried and lifetime is how long
+// a whitelisted triplet stays whitelisted without being seen again.
+func New(path string, delay, expiry, lifetime time.Duration) (*Greylist, error) {
+	g := &Greylist{
+		delay:     delay,
+		expiry:    expiry,
+		lifetime:  lifetime,
+		path:      path,
+		pending:   make(map[string]time.Time),
+		whitelist: make(map[string]time.Time),
+		now:       time.Now,
+	}
+
+	if path == "" {
+		return g, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("greylist.New: %w", err)
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&g.whitelist); err != nil {
+		return nil, fmt.Errorf("greylist.New: %w", err)
+	}
+
+	return g, nil
+}
+
+// Check reports whether mail from sender to rcpt coming from ip should be
+// accepted. A false return means the caller should tempfail.
+func (g *Greylist) Check(ip net.IP, sender, rcpt string) bool {
+	key := tripletKey(ip, sender, rcpt)
+	now := g.now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if seen, ok := g.whitelist[key]; ok && now.Sub(seen) < g.lifetime {
+		g.whitelist[key] = now
+		return true
+	}
+
+	first, ok := g.pending[key]
+	if !ok || now.Sub(first) > g.expiry {
+		g.pending[key] = now
+		g.prune(now)
+		return false
+	}
+
+	if now.Sub(first) < g.delay {
+		return false
+	}
+
+	delete(g.pending, key)
+	g.whitelist[key] = now
+	if err := g.save(); err != nil {
+		// not worth rejecting mail over, we'll just try again next time
+		return true
+	}
+	return true
+}
+
+// Save writes the whitelist to disk
+func (g *Greylist) Save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.save()
+}
+
+// must be called with g.mu held
+func (g *Greylist) save() error {
+	if g.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(g.path), 0700); err != nil {
+		return fmt.Errorf("greylist.save: %w", err)
+	}
+
+	// write to a temp file and rename so a crash can't leave a truncated whitelist
+	tmp := g.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("greylist.save: %w", err)
+	}
+
+	if err = json.NewEncoder(f).Encode(g.whitelist); err != nil {
+		f.Close()
+		return fmt.Errorf("greylist.save: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("greylist.save: %w", err)
+	}
+
+	if err = os.Rename(tmp, g.path); err != nil {
+		return fmt.Errorf("greylist.save: %w", err)
+	}
+	return nil
+}
+
+// drop stale entries so the maps don't grow forever. Must be called with
+// g.mu held
+func (g *Greylist) prune(now time.Time) {
+	for k, t := range g.pending {
+		if now.Sub(t) > g.expiry {
+			delete(g.pending, k)
+		}
+	}
+	for k, t := range g.whitelist {
+		if now.Sub(t) > g.lifetime {
+			delete(g.whitelist, k)
+		}
+	}
+}
+
+// Big providers send retries from different hosts in the same network, so
+// key on the /24 (or /64 for IPv6) rather than the exact address
+func tripletKey(ip net.IP, sender, rcpt string) string {
+	var network string
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(net.CIDRMask(24, 32)).String()
+	} else if ip != nil {
+		network = ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+
+	return strings.Join([]string{network, strings.ToLower(sender), strings.ToLower(rcpt)}, "/")
+}
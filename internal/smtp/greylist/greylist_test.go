@@ -0,0 +1,66 @@
+package greylist
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylistRetry(t *testing.T) {
+	g, err := New("", 5*time.Minute, 4*time.Hour, 36*24*time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+
+	ip := net.ParseIP("192.0.2.10")
+	if g.Check(ip, "a@example.com", "b@example.org") {
+		t.Error("first attempt was accepted, expected tempfail")
+	}
+
+	now = now.Add(time.Minute)
+	if g.Check(ip, "a@example.com", "b@example.org") {
+		t.Error("retry before delay was accepted, expected tempfail")
+	}
+
+	// retry from a different host in the same /24
+	now = now.Add(5 * time.Minute)
+	if !g.Check(net.ParseIP("192.0.2.99"), "a@example.com", "b@example.org") {
+		t.Error("retry after delay was rejected, expected accept")
+	}
+
+	if g.Check(net.ParseIP("198.51.100.1"), "a@example.com", "b@example.org") {
+		t.Error("first attempt from a new network was accepted, expected tempfail")
+	}
+}
+
+func TestGreylistPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	g, err := New(path, time.Minute, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	ip := net.ParseIP("2001:db8::1")
+	g.Check(ip, "a@example.com", "b@example.org")
+	now = now.Add(2 * time.Minute)
+	if !g.Check(ip, "a@example.com", "b@example.org") {
+		t.Fatal("retry after delay was rejected, expected accept")
+	}
+
+	reloaded, err := New(path, time.Minute, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloaded.now = g.now
+
+	if !reloaded.Check(ip, "A@example.com", "b@example.org") {
+		t.Error("whitelisted triplet was rejected after reload")
+	}
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+	"github.com/Queueue0/jums/internal/smtp/policy"
+)
+
+const heloLookupTimeout = 10 * time.Second
+
+// checkHelo applies the configured HELO policy to the name the client gave.
+// It returns a status to send instead of the greeting if the client should be
+// turned away, otherwise nil. Failures configured as "tag" are recorded on
+// the session and end up in a header on the message.
+func checkHelo(s *Session, name string) *packets.Status {
+	s.heloTags = nil
+
+	conf := config.GetConfig()
+	if !conf.HeloPolicy.Enabled {
+		return nil
+	}
+
+	// submission clients are people's own computers, which often don't
+	// have a name that checks out
+	ip := s.remoteIP()
+	if conf.IsTrusted(ip) || s.opts.Submission {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), heloLookupTimeout)
+	defer cancel()
+	violations := policy.CheckHelo(ctx, net.DefaultResolver, name, ip, conf.Mxdomain, conf.Domain)
+
+	worst := policy.None
+	for _, v := range violations {
+		var setting string
+		switch v {
+		case policy.BadSyntax:
+			setting = conf.HeloPolicy.BadSyntax
+		case policy.NoFCrDNS:
+			setting = conf.HeloPolicy.NoFCrDNS
+		case policy.ForgedIdentity:
+			setting = conf.HeloPolicy.ForgedIdentity
+		case policy.FCrDNSTempError:
+			setting = conf.HeloPolicy.NoFCrDNS
+		}
+
+		a, err := policy.ParseAction(setting)
+		if err != nil {
+			slog.Warn("Bad HELO policy config", "err", err.Error())
+			continue
+		}
+		// we don't know yet whether it'd pass, so it gets to try again
+		// rather than be tagged or turned away for good
+		if v == policy.FCrDNSTempError && a != policy.None {
+			a = policy.TempFail
+		}
+
+		slog.Debug("HELO check failed", "addr", ip.String(), "helo", name, "violation", v.String())
+		if a == policy.Tag {
+			s.heloTags = append(s.heloTags, v.String())
+		}
+		worst = max(worst, a)
+	}
+
+	switch worst {
+	case policy.Reject:
+		slog.Info("Rejecting client on HELO policy", "addr", ip.String(), "helo", name)
+		return packets.NewStatus(550, "Rejected: HELO/EHLO identity failed validation")
+	case policy.TempFail:
+		return packets.NewStatus(450, "HELO/EHLO identity could not be validated, try again later")
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,109 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/quota"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+)
+
+// HandleLMTP serves an LMTP client, RFC 2033. It's the same state machine as
+// SMTP, but the client is an MTA or content filter we trust to have done the
+// checking already: there's no HELO policy, greylisting, milters or relaying,
+// only final delivery to local users.
+func HandleLMTP(c net.Conn, o Options) {
+	defer c.Close()
+	slog.Debug("handling LMTP connection...", "addr", c.RemoteAddr().String())
+	s := NewSession(c)
+	s.lmtp = true
+	s.opts = o
+	if !track(s) {
+		Send(shutdownStatus(), c)
+		return
+	}
+	defer untrack(s)
+	Send(packets.NewStatus(220, "Josh's Unremarkable Mail Server LMTP ready"), c)
+	for s.Open() {
+		if err := s.HandleNextLine(); err != nil {
+			s.hangUp(err)
+			return
+		}
+	}
+}
+
+// lhlo is LMTP's EHLO
+func lhlo(s state, c *packets.Command) (state, *packets.Status) {
+	if !s.session().lmtp {
+		return s, packets.NewStatus(500, "command unrecoginized")
+	}
+	if len(c.Args()) < 1 {
+		return s, packets.NewStatus(501, "Syntax error, tell me who you are!")
+	}
+
+	name := c.Args()[0]
+	s.session().name = name
+	s.session().ext = true
+
+	lines := append([]string{fmt.Sprintf("Hello there, %s!", name)}, s.session().extensions()...)
+	return &greetedState{s.session()}, packets.NewStatus(250, lines...)
+}
+
+// lmtpRcpt accepts a recipient if they're local, there's nowhere else for
+// LMTP mail to go
+func (s *Session) lmtpRcpt(ra *mail.Address) *packets.Status {
+	conf := config.GetConfig()
+	if !conf.IsLocal(ra.Domain) {
+		return packets.NewStatus(550, fmt.Sprintf("%s is not a local recipient", ra.SmtpFormat()))
+	}
+	if sts := checkRecipient(ra); sts != nil {
+		return sts
+	}
+	s.mail.Rcpt = append(s.mail.Rcpt, *ra)
+	return packets.NewStatus(250, fmt.Sprintf("RCPT %s OK", ra.SmtpFormat()))
+}
+
+// deliverLocal delivers the message to each recipient in turn, recording a
+// status for each one
+func (s *Session) deliverLocal() {
+	s.rcptStatuses = []*packets.Status{}
+	for _, addr := range s.mail.Rcpt {
+		err := s.mail.Deliver(addr)
+		if errors.Is(err, quota.ErrOverQuota) {
+			slog.Info("LMTP recipient over quota", "id", s.mail.Id, "rcpt", addr.String())
+			s.rcptStatuses = append(s.rcptStatuses, packets.NewStatus(552, fmt.Sprintf("5.2.2 %s Mailbox full", addr.SmtpFormat())))
+			continue
+		}
+		if err != nil {
+			slog.Error("LMTP delivery failed", "id", s.mail.Id, "rcpt", addr.String(), "err", err.Error())
+			s.rcptStatuses = append(s.rcptStatuses, packets.NewStatus(451, fmt.Sprintf("%s delivery failed, try again later", addr.SmtpFormat())))
+			continue
+		}
+		s.rcptStatuses = append(s.rcptStatuses, packets.NewStatus(250, fmt.Sprintf("%s delivered", addr.SmtpFormat())))
+	}
+}
+
+// replyPerRecipient turns the reply to DATA into one reply per recipient as
+// LMTP wants. All but the last are sent here, the last is returned for the
+// caller to send. If nothing was delivered, e.g. because a filter rejected
+// the message, every recipient gets sts.
+func (s *Session) replyPerRecipient(sts *packets.Status) *packets.Status {
+	statuses := s.rcptStatuses
+	s.rcptStatuses = nil
+	if statuses == nil {
+		for range s.mail.Rcpt {
+			statuses = append(statuses, sts)
+		}
+	}
+
+	for _, rs := range statuses[:len(statuses)-1] {
+		if err := Send(rs, s.conn); err != nil {
+			slog.Debug("Couldn't send LMTP reply", "addr", s.conn.RemoteAddr().String(), "err", err.Error())
+		}
+	}
+	return statuses[len(statuses)-1]
+}
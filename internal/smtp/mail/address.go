@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/Queueue0/jums/internal/config"
 )
 
 type Address struct {
@@ -30,3 +32,30 @@ func (a *Address) String() string {
 func (a *Address) SmtpFormat() string {
 	return fmt.Sprintf("<%s@%s>", a.User, a.Domain)
 }
+
+// split cuts the user at the first recipient delimiter. A user that starts
+// with one isn't split, there'd be nothing left of it.
+func (a *Address) split() (string, string) {
+	delim := config.GetConfig().Subaddress.Delimiter
+	if delim == "" {
+		return a.User, ""
+	}
+	i := strings.IndexAny(a.User, delim)
+	if i <= 0 {
+		return a.User, ""
+	}
+	return a.User[:i], a.User[i+1:]
+}
+
+// BaseUser is the user without any detail, "alice" for alice+lists@example.com
+func (a *Address) BaseUser() string {
+	base, _ := a.split()
+	return base
+}
+
+// Detail is what comes after the recipient delimiter, "lists" for
+// alice+lists@example.com, or empty
+func (a *Address) Detail() string {
+	_, detail := a.split()
+	return detail
+}
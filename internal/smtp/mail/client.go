@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Queueue0/jums/internal/config"
@@ -21,6 +22,44 @@ const (
 	dataTerminationTimeout = 10 * time.Minute
 )
 
+// Connections to other servers are tracked so the queue can cut them off
+// when it's shutting down and can't wait any longer
+var (
+	outboundMu  sync.Mutex
+	outbound    = map[net.Conn]struct{}{}
+	outboundCut bool
+)
+
+var errOutboundCut = errors.New("cut off by shutdown")
+
+// trackOutbound is false if connections are being cut off and c shouldn't
+// be used
+func trackOutbound(c net.Conn) bool {
+	outboundMu.Lock()
+	defer outboundMu.Unlock()
+	if outboundCut {
+		return false
+	}
+	outbound[c] = struct{}{}
+	return true
+}
+
+func untrackOutbound(c net.Conn) {
+	outboundMu.Lock()
+	defer outboundMu.Unlock()
+	delete(outbound, c)
+}
+
+// cutOutbound makes everything waiting on another server fail now
+func cutOutbound() {
+	outboundMu.Lock()
+	defer outboundMu.Unlock()
+	outboundCut = true
+	for c := range outbound {
+		c.SetDeadline(time.Now())
+	}
+}
+
 func createSMTPConn(domain string) (net.Conn, error) {
 	mxrs, err := net.LookupMX(domain)
 	if err != nil {
@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"log/slog"
+	netmail "net/mail"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/dkim"
+)
+
+// dkimSignature signs the message for the domain in its From header, or the
+// envelope sender's if the header is missing. It's empty if that isn't one
+// of our domains with a DKIM key, or the message isn't one we vouch for.
+func (m *Mail) dkimSignature() string {
+	if !m.Sign {
+		return ""
+	}
+	domain := ""
+	if from, err := netmail.ParseAddress(m.HeaderValue("From")); err == nil {
+		if a, err := NewAddress(from.Address); err == nil {
+			domain = a.Domain
+		}
+	}
+	if domain == "" && m.From != nil {
+		domain = m.From.Domain
+	}
+
+	d, ok := config.GetConfig().LocalDomain(domain)
+	if !ok || d.DKIM.Selector == "" || d.DKIM.KeyFile == "" {
+		return ""
+	}
+	key, err := dkim.LoadKey(d.DKIM.KeyFile)
+	if err != nil {
+		slog.Error("Couldn't load DKIM key", "domain", d.Name, "err", err.Error())
+		return ""
+	}
+	sig, err := dkim.Sign(m.Data, d.Name, d.DKIM.Selector, key)
+	if err != nil {
+		slog.Error("Couldn't DKIM sign", "id", m.Id, "domain", d.Name, "err", err.Error())
+		return ""
+	}
+	return sig
+}
@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HeaderField is a single header from a message. Value is everything after
+// the colon, including any leading whitespace and folded continuation lines,
+// without the final CRLF.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Headers returns the header fields of the message in order
+func (m *Mail) Headers() []HeaderField {
+	h, _ := splitMessage(m.Data)
+	return h
+}
+
+// Body returns everything after the blank line separating the headers from
+// the body
+func (m *Mail) Body() []byte {
+	_, b := splitMessage(m.Data)
+	return b
+}
+
+// HeaderValue returns the trimmed, unfolded value of the first header called
+// name, or an empty string if there isn't one
+func (m *Mail) HeaderValue(name string) string {
+	for _, h := range m.Headers() {
+		if strings.EqualFold(h.Name, name) {
+			return unfold(h.Value)
+		}
+	}
+	return ""
+}
+
+// AddHeader appends a header field to the end of the header section
+func (m *Mail) AddHeader(name, value string) {
+	h, b := splitMessage(m.Data)
+	h = append(h, HeaderField{name, " " + value})
+	m.Data = joinMessage(h, b)
+}
+
+// InsertHeader inserts a header field before the header at index (0 based).
+// An index past the end appends.
+func (m *Mail) InsertHeader(index int, name, value string) {
+	h, b := splitMessage(m.Data)
+	index = min(max(index, 0), len(h))
+	h = append(h[:index], append([]HeaderField{{name, " " + value}}, h[index:]...)...)
+	m.Data = joinMessage(h, b)
+}
+
+// ChangeHeader replaces the value of the index'th (1 based) header called
+// name. An empty value deletes the header. If there aren't that many headers
+// called name a new one is appended.
+func (m *Mail) ChangeHeader(name string, index int, value string) {
+	h, b := splitMessage(m.Data)
+	seen := 0
+	for i := range h {
+		if !strings.EqualFold(h[i].Name, name) {
+			continue
+		}
+		seen++
+		if seen != index {
+			continue
+		}
+
+		if value == "" {
+			h = append(h[:i], h[i+1:]...)
+		} else {
+			h[i].Value = " " + value
+		}
+		m.Data = joinMessage(h, b)
+		return
+	}
+
+	if value != "" {
+		h = append(h, HeaderField{name, " " + value})
+		m.Data = joinMessage(h, b)
+	}
+}
+
+// RemoveHeader deletes every header called name
+func (m *Mail) RemoveHeader(name string) {
+	h, b := splitMessage(m.Data)
+	kept := h[:0]
+	for _, f := range h {
+		if !strings.EqualFold(f.Name, name) {
+			kept = append(kept, f)
+		}
+	}
+	m.Data = joinMessage(kept, b)
+}
+
+// splitMessage parses data into header fields and the body. Lines in the
+// header section that aren't valid fields are dropped.
+func splitMessage(data []byte) ([]HeaderField, []byte) {
+	var head, body []byte
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		head, body = nil, data[2:]
+	} else if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i+2], data[i+4:]
+	} else {
+		head, body = data, nil
+	}
+
+	fields := []HeaderField{}
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+
+		// folded continuation of the previous field
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += "\r\n" + line
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, HeaderField{name, value})
+	}
+
+	return fields, body
+}
+
+func joinMessage(fields []HeaderField, body []byte) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteString(f.Name)
+		buf.WriteByte(':')
+		buf.WriteString(f.Value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func unfold(v string) string {
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "").Replace(v))
+}
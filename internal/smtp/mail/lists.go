@@ -0,0 +1,545 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	netmail "net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/lists"
+)
+
+const (
+	// members are taken off a list after this many bounces
+	maxListBounces = 5
+	// how many lines of a -request message are read for commands
+	maxListCommands = 20
+)
+
+// findList works out whether addr is one of a list's addresses and which.
+// role is "post", "request", "owner" or "bounces", and for bounces member is
+// who the bounced copy went to.
+func findList(addr Address) (list string, role string, member string, ok bool) {
+	conf := config.GetConfig()
+	user := strings.ToLower(addr.User)
+	for _, l := range conf.Lists {
+		local, domain, _ := strings.Cut(l.Address, "@")
+		if domain != addr.Domain {
+			continue
+		}
+		switch user {
+		case local:
+			return l.Address, "post", "", true
+		case local + "-request":
+			return l.Address, "request", "", true
+		case local + "-owner":
+			return l.Address, "owner", "", true
+		case local + "-bounces":
+			return l.Address, "bounces", "", true
+		}
+		// VERP, each member's copy goes out from list-bounces+alice=example.org
+		if verp, found := strings.CutPrefix(user, local+"-bounces+"); found {
+			if i := strings.LastIndexByte(verp, '='); i > 0 {
+				return l.Address, "bounces", verp[:i] + "@" + verp[i+1:], true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// listAddress is one of a list's other addresses, e.g. "request" for
+// team-request@example.com
+func listAddress(list, role string) string {
+	local, domain, _ := strings.Cut(list, "@")
+	return local + "-" + role + "@" + domain
+}
+
+// bounceAddress is the envelope sender for a list's copy to member
+func bounceAddress(list, member string) *Address {
+	local, domain, _ := strings.Cut(list, "@")
+	return &Address{local + "-bounces+" + strings.Replace(member, "@", "=", 1), domain}
+}
+
+func openList(list string) (*lists.List, error) {
+	conf := config.GetConfig()
+	lc, ok := conf.List(list)
+	if !ok {
+		return nil, fmt.Errorf("no list %s", list)
+	}
+	return lists.Open(conf.ListsDir, lc.Address, lc.Members)
+}
+
+// deliverList handles mail to any of a list's addresses. Only trouble
+// storing things is returned, anything that's the sender's fault is told to
+// them or logged.
+func (m *Mail) deliverList(addr Address, list, role, member string, depth int) error {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	st, err := openList(list)
+	if err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	st.Expire()
+
+	switch role {
+	case "post":
+		return m.listPost(lc.Address, st)
+	case "request":
+		return m.listRequest(lc.Address, st)
+	case "owner":
+		return m.deliverAlias(addr, lc.Owners, depth)
+	case "bounces":
+		m.listBounce(lc.Address, st, member)
+	}
+	return nil
+}
+
+// poster is who a message is from, by its From header or else the envelope
+func (m *Mail) poster() string {
+	if a, err := netmail.ParseAddress(m.HeaderValue("From")); err == nil {
+		return strings.ToLower(a.Address)
+	}
+	if m.From != nil {
+		return strings.ToLower(m.From.String())
+	}
+	return ""
+}
+
+func (m *Mail) listPost(list string, st *lists.List) error {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	if strings.EqualFold(m.HeaderValue("X-Loop"), list) {
+		slog.Warn("Dropping list post that looped", "id", m.Id, "list", list)
+		return nil
+	}
+	if m.Spam {
+		slog.Info("Dropping list post the spam filter flagged", "id", m.Id, "list", list)
+		return nil
+	}
+	if len(m.ListMembers) > 0 {
+		// the rest of a post that was already let through
+		return m.distribute(list, st)
+	}
+
+	poster := m.poster()
+	member, err := st.IsMember(poster)
+	if err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+
+	allowed := false
+	switch {
+	case lc.IsOwner(poster):
+		allowed = true
+	case lc.Posting == "anyone":
+		allowed = true
+	case lc.Posting == "owners":
+		allowed = false
+	default:
+		allowed = member
+	}
+
+	action := "post"
+	if !allowed {
+		action = lc.NonMemberPosts
+		if action == "" {
+			action = "hold"
+		}
+	} else if lc.Moderated && !lc.IsOwner(poster) {
+		action = "hold"
+	}
+
+	switch action {
+	case "post":
+		return m.distribute(list, st)
+	case "reject":
+		slog.Info("List post rejected", "id", m.Id, "list", list, "from", poster)
+		m.listNoticeToSender(list, "Your message to "+list+" was rejected",
+			"Your message to "+list+" was rejected because you aren't allowed to post to the list.")
+		return nil
+	case "discard":
+		slog.Info("List post discarded", "id", m.Id, "list", list, "from", poster)
+		return nil
+	}
+
+	// held for an owner
+	sender := ""
+	if m.From != nil {
+		sender = m.From.String()
+	}
+	token, err := st.Hold(lists.Request{Kind: "post", Address: sender, Data: m.Data})
+	if err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	slog.Info("List post held", "id", m.Id, "list", list, "from", poster)
+	body := fmt.Sprintf("A message from %s to %s needs approval.\r\n\r\n"+
+		"To let it through, reply to this message or send \"confirm %s\" to %s.\r\n"+
+		"To reject it, send \"reject %s\" instead. It's forgotten after a week.\r\n",
+		poster, list, token, listAddress(list, "request"), token)
+	listNotice(list, lc.Owners, "confirm "+token, body, m.Data)
+	m.listNoticeToSender(list, "Your message to "+list+" is awaiting approval",
+		"Your message to "+list+" has been held until a list owner approves it.")
+	return nil
+}
+
+// distribute sends a post to every member, each with their own envelope
+// sender so bounces say who they're for, and their own unsubscribe link
+func (m *Mail) distribute(list string, st *lists.List) error {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	members, err := st.Members()
+	if err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	if len(m.ListMembers) > 0 {
+		// anyone who's left since doesn't get it
+		members = slices.DeleteFunc(members, func(member string) bool {
+			return !slices.Contains(m.ListMembers, member)
+		})
+	}
+
+	post := &Mail{Data: m.Data, Sign: m.Sign}
+	for _, h := range post.Headers() {
+		if name := strings.ToLower(h.Name); strings.HasPrefix(name, "list-") {
+			post.RemoveHeader(h.Name)
+		}
+	}
+	post.RemoveHeader("Precedence")
+	post.RemoveHeader("X-Loop")
+	post.RemoveHeader("Return-Path")
+
+	if subject := post.HeaderValue("Subject"); lc.SubjectPrefix != "" && !strings.Contains(subject, lc.SubjectPrefix) {
+		post.ChangeHeader("Subject", 1, strings.TrimSpace(lc.SubjectPrefix+" "+subject))
+	}
+	if lc.ReplyToList {
+		post.RemoveHeader("Reply-To")
+		post.AddHeader("Reply-To", "<"+list+">")
+	}
+
+	description := lc.Description
+	if description == "" {
+		description = list
+	}
+	request := listAddress(list, "request")
+	// RFC 2919 and RFC 2369
+	post.AddHeader("List-Id", fmt.Sprintf("%s <%s>", description, strings.Replace(list, "@", ".", 1)))
+	if lc.Posting == "owners" {
+		post.AddHeader("List-Post", "NO")
+	} else {
+		post.AddHeader("List-Post", "<mailto:"+list+">")
+	}
+	post.AddHeader("List-Help", "<mailto:"+request+"?subject=help>")
+	if lc.Subscribe != "closed" {
+		post.AddHeader("List-Subscribe", "<mailto:"+request+"?subject=subscribe>")
+	}
+	post.AddHeader("List-Owner", "<mailto:"+listAddress(list, "owner")+">")
+	post.AddHeader("Precedence", "list")
+	post.AddHeader("X-Loop", list)
+
+	var failed []string
+	for _, member := range members {
+		rcpt, err := NewAddress(member)
+		if err != nil {
+			slog.Warn("Bad list member", "list", list, "member", member)
+			continue
+		}
+
+		mc := &Mail{Data: post.Data}
+		unsubscribe := "<mailto:" + request + "?subject=unsubscribe>"
+		if conf.ListsURL != "" {
+			// RFC 8058 one-click, which needs an https link
+			u, err := lists.UnsubscribeURL(list, member)
+			if err == nil {
+				unsubscribe = "<" + u + ">, " + unsubscribe
+				mc.AddHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+			}
+		}
+		mc.AddHeader("List-Unsubscribe", unsubscribe)
+
+		lm := newLocal(bounceAddress(list, member), *rcpt, string(mc.Data))
+		// signed only if the poster could have had it signed themselves
+		lm.Sign = post.Sign
+		if err = enqueue(lm); err != nil {
+			// carry on, failing here would have it sent again to everyone
+			// already queued
+			slog.Warn("Couldn't queue list post", "id", m.Id, "list", list, "member", member, "err", err.Error())
+			failed = append(failed, member)
+		}
+	}
+	slog.Info("List post sent", "id", m.Id, "list", list, "members", len(members)-len(failed))
+	if len(failed) == 0 {
+		return nil
+	}
+
+	// the post goes round again, but only to the ones that missed out
+	addr, err := NewAddress(list)
+	if err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	rm := &Mail{
+		From:        m.From,
+		Rcpt:        []Address{*addr},
+		Data:        m.Data,
+		Id:          m.Id,
+		Received:    m.Received,
+		Sign:        m.Sign,
+		ListMembers: failed,
+	}
+	if err = enqueue(rm); err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	return nil
+}
+
+// listCommands reads commands from the subject and the start of the body,
+// stopping at the first line that isn't one
+func (m *Mail) listCommands() [][]string {
+	known := map[string]bool{"help": true, "subscribe": true, "unsubscribe": true, "confirm": true, "reject": true}
+	cmds := [][]string{}
+	add := func(line string) bool {
+		fields := strings.Fields(strings.ToLower(line))
+		// replies to a confirmation have Re: and the like in front
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || !known[fields[0]] {
+			return false
+		}
+		cmds = append(cmds, fields)
+		return true
+	}
+
+	add(m.HeaderValue("Subject"))
+	for _, line := range strings.Split(string(m.Body()), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "end" || line == "--" || len(cmds) >= maxListCommands || !add(line) {
+			break
+		}
+	}
+	return cmds
+}
+
+func (m *Mail) listRequest(list string, st *lists.List) error {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	if m.From == nil {
+		slog.Info("Ignoring bounce to list request address", "id", m.Id, "list", list)
+		return nil
+	}
+	if v := strings.ToLower(m.HeaderValue("Auto-Submitted")); v != "" && v != "no" {
+		return nil
+	}
+
+	sender := m.poster()
+	results := []string{}
+	subject := "Results of your commands to " + listAddress(list, "request")
+	cmds := m.listCommands()
+	if len(cmds) == 0 {
+		cmds = [][]string{{"help"}}
+	}
+
+	for _, cmd := range cmds {
+		arg := ""
+		if len(cmd) > 1 {
+			arg = cmd[1]
+		}
+		results = append(results, "> "+strings.Join(cmd, " "))
+
+		switch cmd[0] {
+		case "help":
+			results = append(results, fmt.Sprintf("Send any of these to %s, in the subject or one to a line:\r\n"+
+				"  subscribe          join %s\r\n"+
+				"  unsubscribe        leave it\r\n"+
+				"  confirm <token>    go ahead with a request that needed confirming\r\n"+
+				"  reject <token>     turn a held request down\r\n"+
+				"  help               this message\r\n"+
+				"Posts go to %s.", listAddress(list, "request"), list, list))
+		case "subscribe", "unsubscribe":
+			member, err := st.IsMember(sender)
+			if err != nil {
+				return fmt.Errorf("Deliver: %w", err)
+			}
+			switch {
+			case cmd[0] == "subscribe" && lc.Subscribe == "closed":
+				results = append(results, "This list is closed, ask "+listAddress(list, "owner")+" to be added.")
+				continue
+			case cmd[0] == "subscribe" && member:
+				results = append(results, sender+" is already subscribed.")
+				continue
+			case cmd[0] == "unsubscribe" && !member:
+				results = append(results, sender+" isn't subscribed.")
+				continue
+			}
+			// confirmation goes to the address itself, so nobody can
+			// subscribe someone else
+			token, err := st.Hold(lists.Request{Kind: cmd[0], Address: sender})
+			if err != nil {
+				return fmt.Errorf("Deliver: %w", err)
+			}
+			subject = "confirm " + token
+			results = append(results, fmt.Sprintf("To %s %s, reply to this message or send \"confirm %s\" to %s.",
+				cmd[0], sender, token, listAddress(list, "request")))
+		case "confirm", "reject":
+			req, err := st.Take(arg)
+			if errors.Is(err, lists.ErrNoSuchToken) {
+				results = append(results, err.Error())
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("Deliver: %w", err)
+			}
+			results = append(results, m.listDecide(list, st, req, cmd[0] == "confirm"))
+		}
+	}
+
+	rcpt, err := NewAddress(sender)
+	if err != nil {
+		rcpt = m.From
+	}
+	listNotice(list, []string{rcpt.String()}, subject, strings.Join(results, "\r\n\r\n")+"\r\n", nil)
+	return nil
+}
+
+// listDecide acts on a request someone has confirmed or rejected
+func (m *Mail) listDecide(list string, st *lists.List, req *lists.Request, confirmed bool) string {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	if !confirmed {
+		if req.Kind == "post" && req.Address != "" {
+			listNotice(list, []string{req.Address}, "Your message to "+list+" was rejected",
+				"A list owner rejected your message to "+list+".\r\n", nil)
+		}
+		slog.Info("List request rejected", "list", list, "kind", req.Kind, "address", req.Address)
+		return "Rejected."
+	}
+
+	switch req.Kind {
+	case "post":
+		pm := &Mail{Data: req.Data, Id: m.Id}
+		if req.Address != "" {
+			pm.From, _ = NewAddress(req.Address)
+		}
+		if err := pm.distribute(list, st); err != nil {
+			slog.Error("Couldn't send approved list post", "list", list, "err", err.Error())
+			return "Something went wrong sending the message."
+		}
+		return "The message has been sent to the list."
+	case "subscribe":
+		if lc.Subscribe == "approve" {
+			token, err := st.Hold(lists.Request{Kind: "approve-subscribe", Address: req.Address})
+			if err != nil {
+				slog.Error("Couldn't hold subscription", "list", list, "err", err.Error())
+				return "Something went wrong, please try again later."
+			}
+			listNotice(list, lc.Owners, "confirm "+token, fmt.Sprintf("%s would like to join %s.\r\n\r\n"+
+				"To let them, reply to this message or send \"confirm %s\" to %s.\r\n"+
+				"To turn them down, send \"reject %s\" instead.\r\n",
+				req.Address, list, token, listAddress(list, "request"), token), nil)
+			return "Your subscription is waiting for a list owner to approve it."
+		}
+		fallthrough
+	case "approve-subscribe":
+		if _, err := st.Subscribe(req.Address); err != nil {
+			slog.Error("Couldn't subscribe", "list", list, "err", err.Error())
+			return "Something went wrong, please try again later."
+		}
+		slog.Info("Subscribed to list", "list", list, "member", req.Address)
+		if req.Kind == "approve-subscribe" {
+			listNotice(list, []string{req.Address}, "Welcome to "+list,
+				"Your subscription to "+list+" has been approved.\r\n", nil)
+		}
+		return req.Address + " is now subscribed to " + list + "."
+	case "unsubscribe":
+		if _, err := st.Unsubscribe(req.Address); err != nil {
+			slog.Error("Couldn't unsubscribe", "list", list, "err", err.Error())
+			return "Something went wrong, please try again later."
+		}
+		slog.Info("Unsubscribed from list", "list", list, "member", req.Address, "how", "mail")
+		return req.Address + " has been unsubscribed from " + list + "."
+	}
+	return "Unknown request."
+}
+
+// listBounce counts a bounce against the member it was for, taking them off
+// the list once there have been too many
+func (m *Mail) listBounce(list string, st *lists.List, member string) {
+	conf := config.GetConfig()
+	lc, _ := conf.List(list)
+	if member == "" {
+		slog.Info("Bounce to list without a member", "id", m.Id, "list", list)
+		return
+	}
+	if ok, err := st.IsMember(member); err != nil || !ok {
+		return
+	}
+	n, err := st.Bounced(member)
+	if err != nil {
+		slog.Error("Couldn't count list bounce", "list", list, "err", err.Error())
+		return
+	}
+	slog.Info("List member bounced", "list", list, "member", member, "count", n)
+	if n < maxListBounces {
+		return
+	}
+	if _, err = st.Unsubscribe(member); err != nil {
+		slog.Error("Couldn't unsubscribe", "list", list, "err", err.Error())
+		return
+	}
+	slog.Info("Unsubscribed from list", "list", list, "member", member, "how", "bounces")
+	listNotice(list, lc.Owners, member+" was unsubscribed from "+list,
+		fmt.Sprintf("%s was unsubscribed from %s after %d bounces.\r\n", member, list, n), nil)
+}
+
+// listNoticeToSender tells whoever sent m about it, unless it's a bounce or
+// looks automatic
+func (m *Mail) listNoticeToSender(list, subject, body string) {
+	if !m.shouldAutoReply([]string{list}) {
+		return
+	}
+	listNotice(list, []string{m.From.String()}, subject, body+"\r\n", nil)
+}
+
+// listNotice sends a message from the list's request address. Its envelope
+// sender is the list's bounce address so problems don't go back and forth.
+// attach is included as a message/rfc822 part if it's set.
+func listNotice(list string, to []string, subject, body string, attach []byte) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", listAddress(list, "request"))
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if attach == nil {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		b.WriteString(body)
+	} else {
+		boundary := fmt.Sprintf("jums-%d", time.Now().UnixNano())
+		fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", boundary)
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, body)
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: message/rfc822\r\n\r\n%s\r\n", boundary, attach)
+		fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	}
+
+	local, domain, _ := strings.Cut(list, "@")
+	from := &Address{local + "-bounces", domain}
+	var errs []error
+	for _, t := range to {
+		rcpt, err := NewAddress(t)
+		if err != nil {
+			continue
+		}
+		if err = enqueue(newLocal(from, *rcpt, b.String())); err != nil {
+			slog.Error("Couldn't send list notice", "list", list, "to", t, "err", err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -3,9 +3,16 @@ package mail
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
 
 	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/quota"
+	"github.com/Queueue0/jums/internal/sieve"
 	"github.com/Queueue0/jums/internal/smtp/packets"
 )
 
@@ -15,10 +22,28 @@ type Mail struct {
 	Data     []byte
 	Id       string
 	Received PartialReceived
+	// set when the spam filter thinks this is junk, local delivery files it
+	// in the Junk folder instead of INBOX
+	Spam bool
+	// DKIM sign it on the way out. Only set for mail from our own users
+	// who logged in and mail made here, so nobody else's mail that claims
+	// to be from one of our domains gets vouched for when it's forwarded.
+	Sign bool
+	// set on a list post being retried, the members still owed a copy.
+	// Everyone else already has theirs queued.
+	ListMembers []string
 }
 
+// Send makes one attempt at delivering to every recipient. Use the queue
+// rather than calling this directly, it knows how to retry.
 func (m *Mail) Send() error {
-	fmt.Println("Sending mail...")
+	_, _, err := m.attempt()
+	return err
+}
+
+// attempt tries each recipient once. Recipients that failed temporarily are
+// returned in retry, ones that failed for good in failed, with why.
+func (m *Mail) attempt() (retry []Address, failed map[string]string, err error) {
 	var ce *CompiledErrors = nil
 	appendErr := func(err error) {
 		if ce == nil {
@@ -26,68 +51,269 @@ func (m *Mail) Send() error {
 		}
 		ce.Append(err)
 	}
+	failed = map[string]string{}
 
 	g := m.groupRcpts()
 	config := config.GetConfig()
+	// only worked out once there's a remote recipient
+	signature, signed := "", false
 	for domain, addrs := range g {
-		if domain == config.Domain {
+		if config.IsLocal(domain) {
 			for _, addr := range addrs {
-				m.Deliver(addr)
+				err := m.Deliver(addr)
+				switch {
+				case errors.Is(err, ErrNoSuchUser):
+					appendErr(err)
+					failed[addr.String()] = "550 5.1.1 No such user"
+				case err != nil:
+					appendErr(err)
+					retry = append(retry, addr)
+				}
 			}
 			continue
 		}
 
 		c, err := createSMTPConn(domain)
+		if err == nil && !trackOutbound(c) {
+			c.Close()
+			err = errOutboundCut
+		}
 		if err != nil {
 			appendErr(err)
+			retry = append(retry, addrs...)
 			continue
 		}
 
+		// anything other than want puts addr in retry or failed, depending
+		// on the reply
+		ok := func(addr Address, s *packets.Status, err error, want ...uint16) bool {
+			switch {
+			case err != nil:
+				appendErr(err)
+				retry = append(retry, addr)
+			case slices.Contains(want, s.Code()):
+				return true
+			case s.Code() >= 500:
+				appendErr(fmt.Errorf("%s: %s", addr.String(), s.String()))
+				failed[addr.String()] = s.String()
+			default:
+				appendErr(fmt.Errorf("%s: %s", addr.String(), s.String()))
+				retry = append(retry, addr)
+			}
+			_ = packets.NewCommand("RSET").Send(c)
+			readAndParseStatus(c)
+			return false
+		}
+
+		if !signed {
+			signature, signed = m.dkimSignature(), true
+		}
 		for _, addr := range addrs {
-			fmt.Println(m.Received.format(addr))
-			data := append([]byte(m.Received.format(addr)), m.Data...)
-			// TODO: handle these errors
-			_ = packets.NewCommand("MAIL", fmt.Sprintf("FROM:<%s>", m.From.String())).Send(c)
-			s, _ := readAndParseStatus(c)
-			if s.Code() != 250 {
-				_ = packets.NewCommand("RSET").Send(c)
-				readAndParseStatus(c)
+			data := append([]byte(m.Received.format(addr)+signature), dotStuff(m.Data)...)
+			data = append(data, ".\r\n"...)
+			_ = packets.NewCommand("MAIL", fmt.Sprintf("FROM:%s", m.reversePath())).Send(c)
+			if s, err := readAndParseStatus(c); !ok(addr, s, err, 250) {
 				continue
 			}
 
 			_ = packets.NewCommand("RCPT", fmt.Sprintf("TO:<%s>", addr.String())).Send(c)
-			s, _ = readAndParseStatus(c)
-			if s.Code() != 250 {
-				_ = packets.NewCommand("RSET").Send(c)
-				readAndParseStatus(c)
+			if s, err := readAndParseStatus(c); !ok(addr, s, err, 250, 251) {
 				continue
 			}
 
 			_ = packets.NewCommand("DATA").Send(c)
-			s, _ = readAndParseStatus(c)
 			// accept 250 even though it's not strictly in spec
-			if s.Code() != 354 && s.Code() != 250 {
-				_ = packets.NewCommand("RSET").Send(c)
-				readAndParseStatus(c)
+			if s, err := readAndParseStatus(c); !ok(addr, s, err, 354, 250) {
 				continue
 			}
 
 			c.Write(data)
-			readAndParseStatus(c)
+			s, err := readAndParseStatus(c)
+			ok(addr, s, err, 250)
 		}
 		_ = packets.NewCommand("QUIT").Send(c)
 		readAndParseStatus(c)
+		untrackOutbound(c)
 		c.Close()
 	}
 
-	return ce
+	// returning ce directly would give a non-nil error wrapping a nil pointer
+	if ce == nil {
+		return retry, failed, nil
+	}
+	return retry, failed, ce
 }
 
-// Deliver mail addressed to users at our domain
+// reversePath is the MAIL FROM argument, <> for bounces
+func (m *Mail) reversePath() string {
+	if m.From == nil {
+		return "<>"
+	}
+	return m.From.SmtpFormat()
+}
+
+// Deliver mail addressed to users at one of our domains
 func (m *Mail) Deliver(addr Address) error {
+	return m.deliver(addr, 0)
+}
+
+// aliases can point at other aliases, but not forever
+const maxAliasDepth = 8
+
+var errAliasLoop = errors.New("too many levels of aliases")
+
+func (m *Mail) deliver(addr Address, depth int) error {
+	conf := config.GetConfig()
+	domain, ok := conf.LocalDomain(addr.Domain)
+	if !ok {
+		return fmt.Errorf("Deliver: %s: %w", addr.String(), ErrNotLocal)
+	}
+	if list, role, member, ok := findList(addr); ok {
+		return m.deliverList(addr, list, role, member, depth)
+	}
+	account, targets, err := lookup(addr)
+	if err != nil {
+		return fmt.Errorf("Deliver: %s: %w", addr.String(), err)
+	}
+	if account == "" {
+		return m.deliverAlias(addr, targets, depth)
+	}
+
+	if m.Spam && domain.Policy.Spam == "discard" {
+		slog.Info("Discarding spam", "id", m.Id, "rcpt", addr.String())
+		return nil
+	}
+	junk := m.Spam && domain.Policy.Spam != "inbox"
+
+	dir, err := maildir.UserDir(conf.Mailbox(account))
+	if err != nil {
+		return fmt.Errorf("Deliver: %s: %w", addr.String(), err)
+	}
+
+	data := append([]byte(m.Received.format(addr)), m.Data...)
+	// stays in the queue in case they make room
+	if err := quota.Check(account, int64(len(data))); err != nil {
+		return fmt.Errorf("Deliver: %s: %w", addr.String(), err)
+	}
+	actions := m.filter(dir, addr)
+	if actions != nil {
+		if err := m.runActions(dir, addr, actions, data, junk); err != nil {
+			return fmt.Errorf("Deliver: %w", err)
+		}
+	} else {
+		folder := ""
+		if junk {
+			folder = "Junk"
+		} else if conf.Subaddress.FileIntoFolder {
+			folder = detailFolder(dir, addr)
+		}
+		folderDir, err := maildir.FolderPath(dir, folder)
+		if err != nil {
+			return fmt.Errorf("Deliver: %w", err)
+		}
+		if _, err = maildir.Deliver(folderDir, data); err != nil {
+			return fmt.Errorf("Deliver: %w", err)
+		}
+	}
+
+	// a sieve vacation action has already had its chance to reply, and
+	// mail the script discarded, rejected or sent elsewhere never reached
+	// the user to be out of office for
+	kept := actions == nil || slices.ContainsFunc(actions, func(a sieve.Action) bool {
+		return a.Kind == sieve.Keep || a.Kind == sieve.FileInto
+	})
+	replied := slices.ContainsFunc(actions, func(a sieve.Action) bool { return a.Kind == sieve.Vacation })
+	if kept && !replied {
+		m.outOfOffice(dir, addr)
+	}
 	return nil
 }
 
+// detailFolder is the folder named after an address's detail, if the user
+// has one by that name
+func detailFolder(userDir string, addr Address) string {
+	detail := addr.Detail()
+	if detail == "" {
+		return ""
+	}
+	dir, err := maildir.FolderPath(userDir, detail)
+	if err != nil || !maildir.Exists(dir) {
+		return ""
+	}
+	return detail
+}
+
+// deliverAlias delivers to each of an alias's targets, local ones straight
+// away and the rest through the queue. Targets without a domain are on the
+// alias's domain. A local target that can't be delivered to right now is
+// queued on its own, so retrying it doesn't deliver to the others twice.
+func (m *Mail) deliverAlias(addr Address, targets []string, depth int) error {
+	if depth >= maxAliasDepth {
+		return fmt.Errorf("Deliver: %s: %w", addr.String(), errAliasLoop)
+	}
+
+	conf := config.GetConfig()
+	remote, retry := []Address{}, []Address{}
+	for _, t := range targets {
+		if !strings.Contains(t, "@") {
+			t += "@" + addr.Domain
+		}
+		ta, err := NewAddress(t)
+		if err != nil {
+			slog.Warn("Bad alias target", "alias", addr.String(), "target", t)
+			continue
+		}
+		if !conf.IsLocal(ta.Domain) {
+			remote = append(remote, *ta)
+			continue
+		}
+		err = m.deliver(*ta, depth+1)
+		if errors.Is(err, errAliasLoop) {
+			return err
+		}
+		if err != nil {
+			slog.Info("Queueing alias target", "id", m.Id, "alias", addr.String(), "target", ta.String(), "err", err.Error())
+			retry = append(retry, *ta)
+		}
+	}
+
+	if len(retry) > 0 {
+		rm := &Mail{
+			From:     m.From,
+			Rcpt:     retry,
+			Data:     m.Data,
+			Id:       m.Id,
+			Received: m.Received,
+			Spam:     m.Spam,
+			Sign:     m.Sign,
+		}
+		if err := enqueue(rm); err != nil {
+			return fmt.Errorf("Deliver: %w", err)
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+
+	fm := &Mail{
+		From:     m.forwardSender(),
+		Rcpt:     remote,
+		Data:     m.Data,
+		Id:       m.Id,
+		Received: m.Received,
+		Sign:     m.Sign,
+	}
+	if err := enqueue(fm); err != nil {
+		return fmt.Errorf("Deliver: %w", err)
+	}
+	return nil
+}
+
+// PrependHeader adds a header field to the top of the message
+func (m *Mail) PrependHeader(name, value string) {
+	m.Data = append([]byte(fmt.Sprintf("%s: %s\r\n", name, value)), m.Data...)
+}
+
 func (m *Mail) GenerateId() error {
 	h := sha256.New()
 	_, err := h.Write(m.Data)
@@ -99,6 +325,21 @@ func (m *Mail) GenerateId() error {
 	return nil
 }
 
+// dotStuff escapes lines starting with a dot so they aren't mistaken for the
+// end of data, RFC 5321 section 4.5.2
+func dotStuff(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	atLineStart := true
+	for _, b := range data {
+		if atLineStart && b == '.' {
+			out = append(out, '.')
+		}
+		out = append(out, b)
+		atLineStart = b == '\n'
+	}
+	return out
+}
+
 func (m *Mail) groupRcpts() map[string][]Address {
 	g := make(map[string][]Address)
 	for _, r := range m.Rcpt {
@@ -0,0 +1,323 @@
+package mail
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/sieve"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+// the config is loaded once per process, so every test shares this one
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "jums-mail-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", dir)
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	os.MkdirAll(filepath.Join(dir, "config", "jums"), 0700)
+
+	conf := fmt.Sprintf(`Domain = "example.com"
+Mxdomain = "mx.example.com"
+BoxesDir = "%[1]s/boxes"
+UsersFile = "%[1]s/users"
+AliasesFile = "%[1]s/aliases"
+QueueDir = "%[1]s/queue"
+
+[Subaddress]
+Delimiter = "+"
+
+[[Lists]]
+Address = "team@example.com"
+Members = ["alice@example.com", "erin@remote.example"]
+
+[[Domains]]
+Name = "example.com"
+[Domains.DKIM]
+Selector = "test"
+KeyFile = "%[1]s/dkim.pem"
+`, dir)
+	os.WriteFile(filepath.Join(dir, "config", "jums", "config.toml"), []byte(conf), 0600)
+	os.WriteFile(filepath.Join(dir, "aliases"), []byte("sales@example.com: alice, bob\nsupport@example.com: alice, broken\nfwd@example.com: dave@remote.example\n"), 0600)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	os.WriteFile(filepath.Join(dir, "dkim.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	store, _ := users.Load(config.GetConfig().UsersFile)
+	for _, u := range []string{"alice", "bob", "broken", "away", "vac"} {
+		store.SetPassword(u, "secret")
+	}
+	if err := store.Save(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// userDir is an account's maildir, made if it doesn't exist yet
+func userDir(t *testing.T, account string) string {
+	t.Helper()
+	dir, err := maildir.UserDir(config.GetConfig().Mailbox(account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maildir.Exists(dir) {
+		if err = maildir.Create(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// delivered is how many new messages are in an account's INBOX
+func delivered(t *testing.T, account string) int {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(userDir(t, account), "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// deliver hands a message from from to rcpt straight to local delivery
+func deliver(t *testing.T, from, rcpt, data string) {
+	t.Helper()
+	fa, _ := NewAddress(from)
+	ra, _ := NewAddress(rcpt)
+	m := &Mail{From: fa, Rcpt: []Address{*ra}, Data: []byte(data)}
+	m.GenerateId()
+	if err := m.Deliver(*ra); err != nil {
+		t.Fatalf("delivering to %s: %v", rcpt, err)
+	}
+}
+
+// findQueued returns the queued message sent to rcpt, nil if there isn't one
+func findQueued(t *testing.T, rcpt string) *Mail {
+	t.Helper()
+	q, err := SharedQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := q.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		for _, r := range e.Mail.Rcpt {
+			if r.String() == rcpt {
+				return e.Mail
+			}
+		}
+	}
+	return nil
+}
+
+// countQueued is how many queued messages are sent to rcpt
+func countQueued(t *testing.T, rcpt string) int {
+	t.Helper()
+	q, err := SharedQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := q.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		for _, r := range e.Mail.Rcpt {
+			if r.String() == rcpt {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestOutOfOffice(t *testing.T) {
+	dir := userDir(t, "away")
+	ar := &AutoReply{Enabled: true, Days: 1, Subject: "Away", Body: "Back soon"}
+	if err := ar.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(t, "one@remote.example", "away@example.com", "To: Away <away@example.com>, bob@example.com\r\nSubject: hi\r\n\r\nhello\r\n")
+	if findQueued(t, "one@remote.example") == nil {
+		t.Error("no auto reply when named in To")
+	}
+	// only whole addresses count
+	deliver(t, "two@remote.example", "away@example.com", "To: castaway@example.com\r\nSubject: hi\r\n\r\nhello\r\n")
+	if findQueued(t, "two@remote.example") != nil {
+		t.Error("auto reply for castaway@example.com")
+	}
+	// nor is there one for mail the user's script threw away
+	os.WriteFile(filepath.Join(dir, sieve.ActiveFile), []byte("discard;\n"), 0600)
+	defer os.Remove(filepath.Join(dir, sieve.ActiveFile))
+	deliver(t, "three@remote.example", "away@example.com", "To: away@example.com\r\nSubject: hi\r\n\r\nhello\r\n")
+	if findQueued(t, "three@remote.example") != nil {
+		t.Error("auto reply for discarded mail")
+	}
+}
+
+func TestAliasRetriesOnlyFailedTargets(t *testing.T) {
+	// nothing can be delivered to broken while its maildir is a file
+	dir, _ := maildir.UserDir(config.GetConfig().Mailbox("broken"))
+	os.MkdirAll(filepath.Dir(dir), 0700)
+	os.WriteFile(dir, nil, 0600)
+	defer os.Remove(dir)
+	before := delivered(t, "alice")
+
+	deliver(t, "carol@remote.example", "support@example.com", "Subject: help\r\n\r\nit's broken\r\n")
+
+	if n := delivered(t, "alice") - before; n != 1 {
+		t.Errorf("alice got %d copies, expected 1", n)
+	}
+	rm := findQueued(t, "broken@example.com")
+	if rm == nil || len(rm.Rcpt) != 1 || rm.From == nil || rm.From.String() != "carol@remote.example" {
+		t.Errorf("queued %v, expected just broken@example.com from carol", rm)
+	}
+}
+
+func TestSubaddress(t *testing.T) {
+	for _, rcpt := range []string{"alice+lists@example.com", "sales+leads@example.com"} {
+		addr, _ := NewAddress(rcpt)
+		if err := CheckRecipient(*addr); err != nil {
+			t.Errorf("%s: %v", rcpt, err)
+		}
+	}
+	nobody, _ := NewAddress("nobody+lists@example.com")
+	if err := CheckRecipient(*nobody); !errors.Is(err, ErrNoSuchUser) {
+		t.Errorf("nobody+lists: %v", err)
+	}
+
+	// both land with the base user, and the alias's targets
+	alice, bob := delivered(t, "alice"), delivered(t, "bob")
+	deliver(t, "carol@remote.example", "alice+lists@example.com", "Subject: hi\r\n\r\nhello\r\n")
+	deliver(t, "carol@remote.example", "sales+leads@example.com", "Subject: hi\r\n\r\nhello\r\n")
+	if n := delivered(t, "alice") - alice; n != 2 {
+		t.Errorf("alice got %d messages, expected 2", n)
+	}
+	if n := delivered(t, "bob") - bob; n != 1 {
+		t.Errorf("bob got %d messages, expected 1", n)
+	}
+}
+
+func TestDKIMOnlySignsOurMail(t *testing.T) {
+	// anyone can send mail claiming to be from us, forwarding it mustn't
+	// get it signed
+	deliver(t, "ceo@example.com", "fwd@example.com", "From: ceo@example.com\r\nSubject: wire the money\r\n\r\nnow\r\n")
+	fm := findQueued(t, "dave@remote.example")
+	if fm == nil {
+		t.Fatal("nothing forwarded to dave@remote.example")
+	}
+	if sig := fm.dkimSignature(); sig != "" {
+		t.Errorf("forwarded mail signed: %q", sig)
+	}
+
+	// what our own users send is
+	from, _ := NewAddress("alice@example.com")
+	m := &Mail{From: from, Data: []byte("From: alice@example.com\r\nSubject: hi\r\n\r\nhello\r\n"), Sign: true}
+	if m.dkimSignature() == "" {
+		t.Error("mail from alice not signed")
+	}
+}
+
+func TestListPostPartlyQueued(t *testing.T) {
+	alice, erin := countQueued(t, "alice@example.com"), countQueued(t, "erin@remote.example")
+	orig := enqueue
+	defer func() { enqueue = orig }()
+	enqueue = func(m *Mail) error {
+		if m.Rcpt[0].String() == "erin@remote.example" {
+			return errors.New("disk full")
+		}
+		return orig(m)
+	}
+
+	deliver(t, "alice@example.com", "team@example.com", "From: alice@example.com\r\nSubject: hi\r\n\r\nhello\r\n")
+	if n := countQueued(t, "alice@example.com") - alice; n != 1 {
+		t.Fatalf("alice has %d copies queued, expected 1", n)
+	}
+	rm := findQueued(t, "team@example.com")
+	if rm == nil || len(rm.ListMembers) != 1 || rm.ListMembers[0] != "erin@remote.example" {
+		t.Fatalf("queued %v, expected a retry for just erin", rm)
+	}
+
+	// the retry doesn't send alice another
+	enqueue = orig
+	if err := rm.Deliver(rm.Rcpt[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := countQueued(t, "alice@example.com") - alice; n != 1 {
+		t.Errorf("alice has %d copies queued after the retry, expected 1", n)
+	}
+	if n := countQueued(t, "erin@remote.example") - erin; n != 1 {
+		t.Errorf("erin has %d copies queued after the retry, expected 1", n)
+	}
+}
+
+func TestQueueShutdown(t *testing.T) {
+	q, err := OpenQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go q.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-q.stopped:
+	default:
+		t.Error("Shutdown returned before Run did")
+	}
+}
+
+func TestVacationFrom(t *testing.T) {
+	dir := userDir(t, "vac")
+	script := func(from string) {
+		t.Helper()
+		src := fmt.Sprintf("require \"vacation\";\nvacation :from %q \"Away\";\n", from)
+		if err := os.WriteFile(filepath.Join(dir, sieve.ActiveFile), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		from, sender, want string
+	}{
+		// someone else's address is ignored
+		{"ceo@bank.example", "four@remote.example", "vac@example.com"},
+		{"alice@example.com", "five@remote.example", "vac@example.com"},
+		// their own is fine, +detail and all
+		{"Vac <vac+away@example.com>", "six@remote.example", "Vac <vac+away@example.com>"},
+	}
+	for _, tt := range tests {
+		script(tt.from)
+		deliver(t, tt.sender, "vac@example.com", "To: vac@example.com\r\nSubject: hi\r\n\r\nhello\r\n")
+		rm := findQueued(t, tt.sender)
+		if rm == nil {
+			t.Errorf(":from %s: no vacation reply", tt.from)
+			continue
+		}
+		if got := rm.HeaderValue("From"); got != tt.want {
+			t.Errorf(":from %s: reply is from %q, expected %q", tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Quarantine writes the message to dir instead of delivering it, so an admin
+// can look at it later. The reason and envelope are added as headers.
+func (m *Mail) Quarantine(dir, reason string) error {
+	if m.Id == "" {
+		if err := m.GenerateId(); err != nil {
+			return fmt.Errorf("Quarantine: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Quarantine: %w", err)
+	}
+
+	head := fmt.Sprintf("X-Jums-Quarantine-Reason: %s\r\n", reason)
+	if m.From != nil {
+		head += fmt.Sprintf("X-Jums-Envelope-From: %s\r\n", m.From.SmtpFormat())
+	}
+	for _, r := range m.Rcpt {
+		head += fmt.Sprintf("X-Jums-Envelope-To: %s\r\n", r.SmtpFormat())
+	}
+
+	data := append([]byte(head), m.Data...)
+	if err := os.WriteFile(filepath.Join(dir, m.Id+".eml"), data, 0600); err != nil {
+		return fmt.Errorf("Quarantine: %w", err)
+	}
+	return nil
+}
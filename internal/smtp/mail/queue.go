@@ -0,0 +1,320 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+)
+
+const (
+	// how often the queue is looked at when nothing wakes it up
+	queuePoll = time.Minute
+	// how long we keep trying before giving up and bouncing
+	maxQueueAge = 5 * 24 * time.Hour
+	// how long an attempt that's been cut off at shutdown has to save itself
+	queueCutGrace = 2 * time.Second
+)
+
+// waits between attempts, the last one repeats
+var retryDelays = []time.Duration{
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+}
+
+// Queue is the outbound spool. Mail is written to disk before anyone is told
+// it's been accepted, and retried until it's delivered or too old.
+// Each entry is its own file, only the runner rewrites or removes them.
+type Queue struct {
+	dir  string
+	wake chan struct{}
+	// closed by Shutdown, and by Run when it's returned
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+
+	mu sync.Mutex
+	// the entry being attempted, empty between attempts
+	current string
+}
+
+// QueueEntry is one message in the queue
+type QueueEntry struct {
+	ID          string
+	Mail        *Mail
+	Created     time.Time
+	NextAttempt time.Time
+	Attempts    int
+	LastError   string
+}
+
+// OpenQueue opens the spool in dir, creating it if needed
+func OpenQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("OpenQueue: %w", err)
+	}
+	return &Queue{
+		dir:     dir,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+var (
+	sharedQueueOnce sync.Once
+	sharedQueue     *Queue
+	sharedQueueErr  error
+)
+
+// SharedQueue is the queue in the configured QueueDir, everything that sends
+// mail should use it
+func SharedQueue() (*Queue, error) {
+	sharedQueueOnce.Do(func() {
+		sharedQueue, sharedQueueErr = OpenQueue(config.GetConfig().QueueDir)
+	})
+	return sharedQueue, sharedQueueErr
+}
+
+// Enqueue writes m to the spool and wakes the runner. Once it returns nil
+// the queue is responsible for the message.
+func (q *Queue) Enqueue(m *Mail) error {
+	if m.Id == "" {
+		if err := m.GenerateId(); err != nil {
+			return fmt.Errorf("Enqueue: %w", err)
+		}
+	}
+
+	e := newEntry(m)
+	if err := q.save(e); err != nil {
+		return fmt.Errorf("Enqueue: %w", err)
+	}
+	slog.Info("Message queued", "id", m.Id, "queue_id", e.ID, "rcpts", len(m.Rcpt))
+	q.signal()
+	return nil
+}
+
+func newEntry(m *Mail) *QueueEntry {
+	now := time.Now()
+	return &QueueEntry{
+		ID:          fmt.Sprintf("%d.%.16s", now.UnixNano(), m.Id),
+		Mail:        m,
+		Created:     now,
+		NextAttempt: now,
+	}
+}
+
+// signal wakes the runner without waiting for it
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *Queue) save(e *QueueEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(e.ID) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(e.ID))
+}
+
+// Entries lists everything in the queue, oldest first
+func (q *Queue) Entries() ([]*QueueEntry, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Queue.Entries: %w", err)
+	}
+	entries := []*QueueEntry{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, f.Name()))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("Queue.Entries: %w", err)
+		}
+		e := &QueueEntry{}
+		if err = json.Unmarshal(data, e); err != nil || e.Mail == nil {
+			slog.Error("Skipping unreadable queue file", "file", f.Name())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *QueueEntry) int { return a.Created.Compare(b.Created) })
+	return entries, nil
+}
+
+// Run delivers queued mail until Shutdown is called. It only returns
+// between attempts, so nothing is left half done on disk.
+func (q *Queue) Run() {
+	defer close(q.stopped)
+	for {
+		q.runDue(q.stop)
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-time.After(queuePoll):
+		}
+	}
+}
+
+// Shutdown stops Run and waits for the attempt it's on to finish. If it
+// hasn't when ctx is done, its connections to other servers are cut so it
+// fails and is saved for a retry, which it gets a moment more to do.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.stopOnce.Do(func() { close(q.stop) })
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	cutOutbound()
+	select {
+	case <-q.stopped:
+		return nil
+	case <-time.After(queueCutGrace):
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return fmt.Errorf("Queue.Shutdown: %s still being attempted: %w", q.current, ctx.Err())
+}
+
+// runDue makes an attempt at every entry that's due
+func (q *Queue) runDue(stop <-chan struct{}) {
+	entries, err := q.Entries()
+	if err != nil {
+		slog.Error("Couldn't read queue", "err", err.Error())
+		return
+	}
+	for _, e := range entries {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Now().Before(e.NextAttempt) {
+			continue
+		}
+		q.attempt(e)
+	}
+}
+
+func (q *Queue) attempt(e *QueueEntry) {
+	q.mu.Lock()
+	q.current = e.ID
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.current = ""
+		q.mu.Unlock()
+	}()
+
+	m := e.Mail
+	retry, failed, err := m.attempt()
+	e.Attempts++
+	if err != nil {
+		e.LastError = err.Error()
+		slog.Info("Delivery attempt failed", "id", m.Id, "queue_id", e.ID, "attempt", e.Attempts, "err", err.Error())
+	}
+
+	if len(retry) > 0 && time.Since(e.Created) > maxQueueAge {
+		for _, addr := range retry {
+			failed[addr.String()] = "Gave up after " + maxQueueAge.String() + ": " + e.LastError
+		}
+		retry = nil
+	}
+	if len(failed) > 0 {
+		q.bounce(m, failed)
+	}
+
+	if len(retry) == 0 {
+		if err := os.Remove(q.path(e.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Couldn't remove delivered message from queue", "queue_id", e.ID, "err", err.Error())
+		}
+		return
+	}
+
+	m.Rcpt = retry
+	delay := retryDelays[min(e.Attempts, len(retryDelays))-1]
+	e.NextAttempt = time.Now().Add(delay)
+	if err := q.save(e); err != nil {
+		slog.Error("Couldn't update queue entry", "queue_id", e.ID, "err", err.Error())
+	}
+}
+
+// bounce tells the sender which recipients we couldn't deliver to. Bounces
+// themselves are never bounced.
+func (q *Queue) bounce(m *Mail, failed map[string]string) {
+	if m.From == nil {
+		slog.Warn("Dropping undeliverable bounce", "id", m.Id)
+		return
+	}
+
+	conf := config.GetConfig()
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", conf.Mxdomain)
+	fmt.Fprintf(&b, "To: %s\r\n", m.From.SmtpFormat())
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("Your message couldn't be delivered to these recipients:\r\n\r\n")
+	for _, addr := range slices.Sorted(maps.Keys(failed)) {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", addr, failed[addr])
+	}
+	b.WriteString("\r\n----- Original message headers -----\r\n\r\n")
+	for _, h := range m.Headers() {
+		fmt.Fprintf(&b, "%s:%s\r\n", h.Name, h.Value)
+	}
+
+	bm := &Mail{
+		Rcpt: []Address{*m.From},
+		Data: []byte(b.String()),
+		Sign: true,
+	}
+	bm.GenerateId()
+	bm.Received = PartialReceived{
+		From:      "from localhost",
+		By:        "by " + conf.Mxdomain,
+		With:      "with local",
+		Id:        "id " + bm.Id,
+		Timestamp: time.Now().Local().Format("Mon, 02 Jan 2006 15:04:05 -0700 (MST)"),
+	}
+
+	if err := q.save(newEntry(bm)); err != nil {
+		slog.Error("Couldn't queue bounce", "id", m.Id, "err", err.Error())
+		return
+	}
+	q.signal()
+}
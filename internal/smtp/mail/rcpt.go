@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/aliases"
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/quota"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+var (
+	// ErrNoSuchUser is a local address nobody owns and no alias covers
+	ErrNoSuchUser = errors.New("no such user")
+	ErrNotLocal   = errors.New("not a local domain")
+)
+
+// lookup says where mail for a local address goes. That's either an
+// account's mailbox, or on to the targets of an alias or the domain's
+// catch-all, in which case account is empty. A user+detail address is
+// looked up as itself first and then as the base user.
+func lookup(addr Address) (account string, targets []string, err error) {
+	conf := config.GetConfig()
+	domain, ok := conf.LocalDomain(addr.Domain)
+	if !ok {
+		return "", nil, ErrNotLocal
+	}
+	names := []string{strings.ToLower(addr.User)}
+	if base := strings.ToLower(addr.BaseUser()); base != names[0] {
+		names = append(names, base)
+	}
+
+	table, err := aliases.Shared(conf.AliasesFile)
+	if err != nil {
+		return "", nil, err
+	}
+	store, err := users.Shared(conf.UsersFile)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, user := range names {
+		if t, ok := table.Lookup(user + "@" + domain.Name); ok {
+			return "", t, nil
+		}
+		if t, ok := domain.Aliases[user]; ok {
+			return "", t, nil
+		}
+		account = conf.Account(user, domain.Name)
+		if store.Exists(account) {
+			return account, nil, nil
+		}
+	}
+
+	if t, ok := table.Lookup("@" + domain.Name); ok {
+		return "", t, nil
+	}
+	return "", nil, ErrNoSuchUser
+}
+
+// CheckRecipient says whether a local address will take mail, for RCPT.
+// Unknown addresses are ErrNoSuchUser, anything else is temporary.
+func CheckRecipient(addr Address) error {
+	if _, _, _, ok := findList(addr); ok {
+		return nil
+	}
+	_, _, err := lookup(addr)
+	return err
+}
+
+// CheckQuota says whether a message of size fits in the mailbox a local
+// address delivers to. Aliases aren't checked, their targets are when
+// they're delivered to.
+func CheckQuota(addr Address, size int64) error {
+	account, _, err := lookup(addr)
+	if err != nil || account == "" {
+		return nil
+	}
+	return quota.Check(account, size)
+}
+
+// Verify returns the address a local address delivers to, for VRFY. That's
+// the account's own address, or addr itself for aliases and lists.
+func Verify(addr Address) (string, error) {
+	if _, _, _, ok := findList(addr); ok {
+		return addr.String(), nil
+	}
+	account, _, err := lookup(addr)
+	if err != nil {
+		return "", err
+	}
+	if account == "" {
+		return addr.String(), nil
+	}
+	return config.GetConfig().AccountAddress(account), nil
+}
+
+// Expand returns where mail to a local address goes one step on, for EXPN.
+// An alias gives its targets, a list its members and a list's -owner its
+// owners. Anything else is a single mailbox.
+func Expand(addr Address) ([]string, error) {
+	conf := config.GetConfig()
+	if list, role, _, ok := findList(addr); ok {
+		lc, _ := conf.List(list)
+		switch role {
+		case "post":
+			st, err := openList(list)
+			if err != nil {
+				return nil, err
+			}
+			return st.Members()
+		case "owner":
+			return lc.Owners, nil
+		}
+		return []string{addr.String()}, nil
+	}
+
+	account, targets, err := lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if account != "" {
+		return []string{conf.AccountAddress(account)}, nil
+	}
+	expanded := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if !strings.Contains(t, "@") {
+			t += "@" + addr.Domain
+		}
+		expanded = append(expanded, t)
+	}
+	return expanded, nil
+}
+
+// MayUseSender reports whether the account user may send as addr: it's their
+// own address, plus any +detail, or the sender login file lists them for it
+// or its whole domain
+func MayUseSender(user string, addr *Address) (bool, error) {
+	conf := config.GetConfig()
+	if conf.IsLocal(addr.Domain) && conf.Account(addr.BaseUser(), addr.Domain) == user {
+		return true, nil
+	}
+
+	table, err := aliases.Shared(conf.SenderLoginFile)
+	if err != nil {
+		return false, err
+	}
+	keys := []string{addr.String(), addr.BaseUser() + "@" + addr.Domain, "@" + addr.Domain}
+	for _, key := range keys {
+		logins, _ := table.Lookup(key)
+		for _, login := range logins {
+			local, domain, found := strings.Cut(login, "@")
+			if !found {
+				domain = conf.Domain
+			}
+			if conf.Account(local, domain) == user {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
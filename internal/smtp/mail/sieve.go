@@ -0,0 +1,220 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/sieve"
+)
+
+// filter runs the user's sieve script, if they have one. It returns nil
+// actions when the message should just be delivered normally.
+func (m *Mail) filter(userDir string, addr Address) []sieve.Action {
+	src, err := os.ReadFile(filepath.Join(userDir, sieve.ActiveFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Couldn't read sieve script", "user", addr.User, "err", err.Error())
+		}
+		return nil
+	}
+
+	script, err := sieve.Parse(string(src))
+	if err != nil {
+		slog.Warn("Bad sieve script, delivering to INBOX", "user", addr.User, "err", err.Error())
+		return nil
+	}
+
+	msg := &sieve.Message{To: addr.String(), Size: int64(len(m.Data))}
+	if m.From != nil {
+		msg.From = m.From.String()
+	}
+	for _, h := range m.Headers() {
+		msg.Headers = append(msg.Headers, sieve.Header{Name: h.Name, Value: h.Value})
+	}
+
+	actions, err := script.Run(msg)
+	if err != nil {
+		slog.Warn("Sieve script failed, delivering to INBOX", "user", addr.User, "err", err.Error())
+		return nil
+	}
+	return actions
+}
+
+// deliverTo stores the message in one folder of the user's maildir, falling
+// back to INBOX if the folder doesn't exist
+func (m *Mail) deliverTo(userDir, folder string, flags []string, data []byte) error {
+	dir, err := maildir.FolderPath(userDir, folder)
+	if err != nil || !maildir.Exists(dir) {
+		dir = userDir
+	}
+
+	if len(flags) > 0 {
+		_, err = maildir.Append(dir, data, flags, time.Time{})
+	} else {
+		_, err = maildir.Deliver(dir, data)
+	}
+	return err
+}
+
+// runActions carries out what a sieve script decided. Everything that
+// stores the message goes first, so a failure that has the message retried
+// can't come after a redirect, reject or vacation reply has already gone out.
+func (m *Mail) runActions(userDir string, addr Address, actions []sieve.Action, data []byte, junk bool) error {
+	for _, a := range actions {
+		var err error
+		switch a.Kind {
+		case sieve.Keep:
+			folder := ""
+			if junk {
+				folder = "Junk"
+			}
+			err = m.deliverTo(userDir, folder, a.Flags, data)
+		case sieve.FileInto:
+			err = m.deliverTo(userDir, a.Mailbox, a.Flags, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range actions {
+		var err error
+		switch a.Kind {
+		case sieve.Redirect:
+			err = m.redirect(addr, a.Address)
+		case sieve.Reject:
+			err = m.reject(addr, a.Reason)
+		case sieve.Vacation:
+			err = m.vacation(userDir, addr, a)
+		}
+		// retrying for these would deliver the message twice
+		if err != nil {
+			slog.Error("Sieve action failed", "id", m.Id, "user", addr.User, "err", err.Error())
+		}
+	}
+	return nil
+}
+
+// newLocal makes a message generated here ready for the queue
+func newLocal(from *Address, rcpt Address, data string) *Mail {
+	conf := config.GetConfig()
+	lm := &Mail{
+		From: from,
+		Rcpt: []Address{rcpt},
+		Data: []byte(data),
+		Sign: true,
+	}
+	lm.GenerateId()
+	lm.Received = PartialReceived{
+		From:      "from localhost",
+		By:        "by " + conf.Mxdomain,
+		With:      "with local",
+		Id:        "id " + lm.Id,
+		Timestamp: time.Now().Local().Format("Mon, 02 Jan 2006 15:04:05 -0700 (MST)"),
+	}
+	return lm
+}
+
+// enqueue puts m in the shared queue. A var so tests can make it fail.
+var enqueue = func(m *Mail) error {
+	q, err := SharedQueue()
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(m)
+}
+
+// redirect sends a copy on, with the sender rewritten if SRS is on
+func (m *Mail) redirect(addr Address, to string) error {
+	rcpt, err := NewAddress(to)
+	if err != nil {
+		return err
+	}
+	// a loop back to ourselves would go round until the hop count runs out
+	if strings.EqualFold(rcpt.String(), addr.String()) {
+		return nil
+	}
+
+	rm := newLocal(m.forwardSender(), *rcpt, string(m.Data))
+	rm.Received = m.Received
+	rm.Id = m.Id
+	// it's still the sender's message, not one of ours
+	rm.Sign = m.Sign
+	slog.Info("Sieve redirect", "id", m.Id, "user", addr.User, "to", rcpt.String())
+	return enqueue(rm)
+}
+
+// reject returns the message to its sender with the script's reason,
+// RFC 5429 section 2.1
+func (m *Mail) reject(addr Address, reason string) error {
+	if m.From == nil {
+		slog.Info("Not rejecting a bounce", "id", m.Id, "user", addr.User)
+		return nil
+	}
+
+	conf := config.GetConfig()
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", conf.Mxdomain)
+	fmt.Fprintf(&b, "To: %s\r\n", m.From.SmtpFormat())
+	b.WriteString("Subject: Message rejected\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "Your message to <%s> was rejected by the recipient:\r\n\r\n", addr.String())
+	b.WriteString(strings.TrimRight(reason, "\r\n"))
+	b.WriteString("\r\n\r\n----- Original message headers -----\r\n\r\n")
+	for _, h := range m.Headers() {
+		fmt.Fprintf(&b, "%s:%s\r\n", h.Name, h.Value)
+	}
+
+	slog.Info("Sieve reject", "id", m.Id, "user", addr.User)
+	return enqueue(newLocal(nil, *m.From, b.String()))
+}
+
+// vacation sends a sieve vacation reply, RFC 5230
+func (m *Mail) vacation(userDir string, addr Address, a sieve.Action) error {
+	from := a.From
+	if from != "" && !ownsFrom(addr, from) {
+		// the script can't make us send as someone else
+		slog.Warn("Ignoring sieve vacation :from the user can't send as", "id", m.Id, "user", addr.User, "from", from)
+		from = ""
+	}
+	r := reply{
+		handle:    "sieve\x00" + a.Handle,
+		days:      a.Days,
+		from:      from,
+		subject:   a.Subject,
+		body:      a.Reason,
+		mime:      a.Mime,
+		addresses: a.Addresses,
+	}
+	return m.autoReply(userDir, addr, r)
+}
+
+// ownsFrom is whether the account addr delivers to may send as from, by
+// the same rule as the submission port
+func ownsFrom(addr Address, from string) bool {
+	account, _, err := lookup(addr)
+	if err != nil || account == "" {
+		return false
+	}
+	a, err := netmail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	fa, err := NewAddress(a.Address)
+	if err != nil {
+		return false
+	}
+	ok, err := MayUseSender(account, fa)
+	return err == nil && ok
+}
@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/srs"
+)
+
+var (
+	srsLock     = &sync.Mutex{}
+	srsRewriter *srs.Rewriter
+)
+
+// rewriter returns nil when SRS is off or the key can't be had
+func rewriter() *srs.Rewriter {
+	conf := config.GetConfig()
+	if !conf.SRS.Enabled {
+		return nil
+	}
+
+	srsLock.Lock()
+	defer srsLock.Unlock()
+	if srsRewriter == nil {
+		secret, err := srs.LoadSecret(conf.SRS.SecretFile)
+		if err != nil {
+			slog.Error("Couldn't load SRS key", "error", err)
+			return nil
+		}
+		srsRewriter = srs.New(secret, conf.SRS.Domain, conf.SRS.MaxAge)
+	}
+	return srsRewriter
+}
+
+// forwardSender is the envelope sender for a copy we're sending on. Bounces
+// keep the null sender and without SRS it's the original one, which the
+// sender's SPF record probably won't allow us to use.
+func (m *Mail) forwardSender() *Address {
+	r := rewriter()
+	if m.From == nil || r == nil {
+		return m.From
+	}
+	s, err := r.Forward(m.From.String())
+	if err != nil {
+		slog.Warn("Couldn't rewrite sender", "id", m.Id, "from", m.From.String(), "error", err)
+		return m.From
+	}
+	a, err := NewAddress(s)
+	if err != nil {
+		return m.From
+	}
+	return a
+}
+
+// ReverseSRS decodes a bounce address we made when forwarding. ok is false
+// when addr isn't one of ours at all, err is set when it looks like one but
+// is forged or too old.
+func ReverseSRS(addr Address) (orig *Address, ok bool, err error) {
+	r := rewriter()
+	if r == nil || !r.IsSRS(addr.String()) {
+		return nil, false, nil
+	}
+	s, err := r.Reverse(addr.String())
+	if err != nil {
+		return nil, true, err
+	}
+	orig, err = NewAddress(s)
+	if err != nil {
+		return nil, true, errors.Join(srs.ErrNotSRS, err)
+	}
+	return orig, true, nil
+}
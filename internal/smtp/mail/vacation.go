@@ -0,0 +1,221 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Queueue0/jums/internal/maildir"
+)
+
+const (
+	// AutoReplyFile is a user's out of office settings, in their maildir
+	AutoReplyFile = "jums-autoreply.toml"
+	// vacationFile remembers who has had an automatic reply and when
+	vacationFile = "jums-vacation"
+)
+
+// AutoReply is a user's out of office reply, set with jumsctl
+type AutoReply struct {
+	Enabled bool
+	// replies are only sent between these, a zero time is no limit
+	Start time.Time
+	End   time.Time
+	// one reply per sender every Days days
+	Days    int
+	Subject string
+	Body    string
+}
+
+// LoadAutoReply reads a user's auto reply settings, nil if they have none
+func LoadAutoReply(userDir string) (*AutoReply, error) {
+	ar := &AutoReply{}
+	_, err := toml.DecodeFile(filepath.Join(userDir, AutoReplyFile), ar)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoadAutoReply: %w", err)
+	}
+	return ar, nil
+}
+
+// Save writes the settings to the user's maildir
+func (ar *AutoReply) Save(userDir string) error {
+	f, err := os.OpenFile(filepath.Join(userDir, AutoReplyFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("AutoReply.Save: %w", err)
+	}
+	defer f.Close()
+	if err = toml.NewEncoder(f).Encode(ar); err != nil {
+		return fmt.Errorf("AutoReply.Save: %w", err)
+	}
+	return nil
+}
+
+// Active says whether replies should be sent at t
+func (ar *AutoReply) Active(t time.Time) bool {
+	return ar.Enabled && (ar.Start.IsZero() || !t.Before(ar.Start)) && (ar.End.IsZero() || t.Before(ar.End))
+}
+
+// reply is an automatic reply, from the user's AutoReply or a sieve vacation
+// action
+type reply struct {
+	// replies with different handles are tracked separately
+	handle  string
+	days    int
+	from    string
+	subject string
+	body    string
+	// body is a MIME entity with its own headers
+	mime bool
+	// other addresses of the user's that count as being named in To or Cc
+	addresses []string
+}
+
+// outOfOffice sends the user's configured auto reply, if it's on
+func (m *Mail) outOfOffice(userDir string, addr Address) {
+	ar, err := LoadAutoReply(userDir)
+	if err != nil {
+		slog.Error("Couldn't read auto reply", "user", addr.User, "err", err.Error())
+		return
+	}
+	if ar == nil || !ar.Active(time.Now()) {
+		return
+	}
+
+	r := reply{
+		handle:  "autoreply",
+		days:    max(ar.Days, 1),
+		subject: ar.Subject,
+		body:    ar.Body,
+	}
+	if err = m.autoReply(userDir, addr, r); err != nil {
+		slog.Error("Couldn't send auto reply", "id", m.Id, "user", addr.User, "err", err.Error())
+	}
+}
+
+// shouldAutoReply says whether an automatic reply to m is allowed, following
+// RFC 3834 section 2 and RFC 5230 section 4.5
+func (m *Mail) shouldAutoReply(addrs []string) bool {
+	if m.From == nil || m.Spam {
+		return false
+	}
+	user := strings.ToLower(m.From.User)
+	if user == "mailer-daemon" || user == "postmaster" || user == "listserv" || user == "majordomo" ||
+		strings.HasPrefix(user, "owner-") || strings.HasSuffix(user, "-request") {
+		return false
+	}
+	if v := strings.ToLower(m.HeaderValue("Auto-Submitted")); v != "" && v != "no" {
+		return false
+	}
+	switch strings.ToLower(m.HeaderValue("Precedence")) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for _, h := range m.Headers() {
+		if strings.HasPrefix(strings.ToLower(h.Name), "list-") {
+			return false
+		}
+	}
+
+	// only reply if we were named, not just Bcc'd or sent a list copy
+	for _, name := range []string{"To", "Cc"} {
+		list, err := netmail.ParseAddressList(m.HeaderValue(name))
+		if err != nil {
+			continue
+		}
+		for _, named := range list {
+			for _, a := range addrs {
+				if a != "" && strings.EqualFold(named.Address, a) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// vacationSent is when each handle was last sent to each sender
+type vacationSent map[string]time.Time
+
+// repliedRecently records a reply to sender under handle, and says whether
+// one was already sent in the last days days
+func repliedRecently(userDir, handle, sender string, days int) (bool, error) {
+	defer maildir.Lock(userDir)()
+
+	path := filepath.Join(userDir, vacationFile)
+	sent := vacationSent{}
+	if b, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(b, &sent)
+	}
+
+	now := time.Now()
+	key := strings.ToLower(sender) + "\x00" + handle
+	if last, ok := sent[key]; ok && now.Sub(last) < time.Duration(days)*24*time.Hour {
+		return true, nil
+	}
+
+	// forget anyone we haven't heard from in a long while so the file
+	// doesn't grow forever
+	for k, t := range sent {
+		if now.Sub(t) > 365*24*time.Hour {
+			delete(sent, k)
+		}
+	}
+	sent[key] = now
+	b, err := json.Marshal(sent)
+	if err != nil {
+		return false, err
+	}
+	return false, os.WriteFile(path, b, 0600)
+}
+
+// autoReply queues r as a reply to m's sender, if that's allowed and they
+// haven't had one recently
+func (m *Mail) autoReply(userDir string, addr Address, r reply) error {
+	mine := []string{addr.String(), addr.BaseUser() + "@" + addr.Domain}
+	if !m.shouldAutoReply(append(mine, r.addresses...)) {
+		return nil
+	}
+	if recent, err := repliedRecently(userDir, r.handle, m.From.String(), r.days); err != nil || recent {
+		return err
+	}
+
+	from := r.from
+	if from == "" {
+		from = addr.String()
+	}
+	subject := r.subject
+	if subject == "" {
+		subject = "Auto: " + m.HeaderValue("Subject")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.From.SmtpFormat())
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if id := m.HeaderValue("Message-ID"); id != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&b, "References: %s\r\n", strings.TrimSpace(m.HeaderValue("References")+" "+id))
+	}
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	body := strings.ReplaceAll(strings.ReplaceAll(r.body, "\r\n", "\n"), "\n", "\r\n")
+	if !r.mime {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	}
+	b.WriteString(body)
+
+	slog.Info("Automatic reply", "id", m.Id, "user", addr.User, "to", m.From.String())
+	// RFC 3834 section 3.3 wants the null sender so replies can't loop
+	return enqueue(newLocal(nil, *m.From, b.String()))
+}
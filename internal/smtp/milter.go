@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/smtp/milter"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+)
+
+type milterConn struct {
+	address string
+	client  *milter.Client
+	onError string
+}
+
+// milterConnect dials every configured milter and tells them about the new
+// client. A non-nil status means the client should be turned away with it.
+func (s *Session) milterConnect() *packets.Status {
+	conf := config.GetConfig()
+	for _, mc := range conf.Milters {
+		c, err := milter.Dial(mc.Address, mc.Timeout)
+		if err != nil {
+			slog.Error("Couldn't connect to milter", "addr", mc.Address, "err", err.Error())
+			if strings.EqualFold(mc.OnError, "tempfail") {
+				return packets.NewStatus(421, "Service temporarily unavailable, try again later")
+			}
+			continue
+		}
+		s.milters = append(s.milters, &milterConn{mc.Address, c, mc.OnError})
+	}
+
+	if len(s.milters) == 0 {
+		return nil
+	}
+
+	ip := s.remoteIP()
+	hostname := fmt.Sprintf("[%s]", ip.String())
+	if names, err := net.LookupAddr(ip.String()); err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+	var port uint16
+	if _, p, err := net.SplitHostPort(s.conn.RemoteAddr().String()); err == nil {
+		n, _ := strconv.ParseUint(p, 10, 16)
+		port = uint16(n)
+	}
+	macros := map[string]string{
+		"j":             conf.Mxdomain,
+		"{daemon_name}": "jums",
+		"_":             fmt.Sprintf("%s [%s]", hostname, ip.String()),
+	}
+
+	sts := s.runMilters("connect", func(c *milter.Client) (*milter.Response, error) {
+		return c.Connect(hostname, ip, port, macros)
+	})
+	if sts == nil {
+		return nil
+	}
+
+	// anything other than a temporary failure at this stage means go away
+	if sts.Code() >= 500 {
+		return packets.NewStatus(554, "Connection rejected")
+	}
+	return packets.NewStatus(421, "Service temporarily unavailable, try again later")
+}
+
+func (s *Session) milterHelo(name string) *packets.Status {
+	return s.runMilters("helo", func(c *milter.Client) (*milter.Response, error) {
+		return c.Helo(name)
+	})
+}
+
+func (s *Session) milterMail(sender string) *packets.Status {
+	s.discard = false
+	s.quarantine = ""
+	return s.runMilters("mail", func(c *milter.Client) (*milter.Response, error) {
+		return c.Mail(sender, nil)
+	})
+}
+
+func (s *Session) milterRcpt(rcpt string) *packets.Status {
+	return s.runMilters("rcpt", func(c *milter.Client) (*milter.Response, error) {
+		return c.Rcpt(rcpt)
+	})
+}
+
+func (s *Session) milterData() *packets.Status {
+	return s.runMilters("data", func(c *milter.Client) (*milter.Response, error) {
+		return c.Data()
+	})
+}
+
+// milterMessage hands the finished message to each milter and applies the
+// changes they ask for
+func (s *Session) milterMessage() *packets.Status {
+	macros := map[string]string{"i": s.mail.Id}
+	return s.runMilters("eom", func(c *milter.Client) (*milter.Response, error) {
+		headers := []milter.Header{}
+		for _, h := range s.mail.Headers() {
+			headers = append(headers, milter.Header{Name: h.Name, Value: h.Value})
+		}
+
+		resp, mods, err := c.Message(headers, s.mail.Body(), macros)
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range mods {
+			s.applyModification(mod)
+		}
+		return resp, nil
+	})
+}
+
+func (s *Session) applyModification(mod milter.Modification) {
+	switch mod.Kind {
+	case milter.AddHeader:
+		s.mail.AddHeader(mod.Name, mod.Value)
+	case milter.InsertHeader:
+		s.mail.InsertHeader(mod.Index, mod.Name, mod.Value)
+	case milter.ChangeHeader:
+		s.mail.ChangeHeader(mod.Name, mod.Index, mod.Value)
+	case milter.AddRcpt:
+		addr, err := mail.NewAddress(mod.Name)
+		if err != nil {
+			slog.Warn("Milter tried to add an invalid recipient", "rcpt", mod.Name)
+			return
+		}
+		s.mail.Rcpt = append(s.mail.Rcpt, *addr)
+	case milter.DelRcpt:
+		s.mail.Rcpt = slices.DeleteFunc(s.mail.Rcpt, func(a mail.Address) bool {
+			return strings.EqualFold(a.String(), mod.Name)
+		})
+	case milter.Quarantine:
+		s.quarantine = mod.Value
+		if s.quarantine == "" {
+			s.quarantine = "quarantined by milter"
+		}
+	}
+}
+
+// milterAbort tells every milter the current message was abandoned
+func (s *Session) milterAbort() {
+	for _, m := range s.milters {
+		if err := m.client.Abort(); err != nil {
+			slog.Warn("Milter abort failed", "addr", m.address, "err", err.Error())
+		}
+	}
+}
+
+func (s *Session) closeMilters() {
+	for _, m := range s.milters {
+		m.client.Close()
+	}
+	s.milters = nil
+}
+
+// runMilters calls f for each milter in turn, stopping at the first one that
+// doesn't want us to continue. Milters that break are dropped for the rest of
+// the session unless they're configured to tempfail on error.
+func (s *Session) runMilters(stage string, f func(*milter.Client) (*milter.Response, error)) *packets.Status {
+	for i := 0; i < len(s.milters); {
+		m := s.milters[i]
+		resp, err := f(m.client)
+		if err != nil {
+			slog.Error("Milter error", "addr", m.address, "stage", stage, "err", err.Error())
+			if strings.EqualFold(m.onError, "tempfail") {
+				return packets.NewStatus(451, "Temporary local problem, try again later")
+			}
+			m.client.Close()
+			s.milters = append(s.milters[:i], s.milters[i+1:]...)
+			continue
+		}
+
+		switch resp.Action {
+		case milter.Reject:
+			slog.Info("Milter rejected", "addr", m.address, "stage", stage)
+			return packets.NewStatus(550, "Rejected by content filter")
+		case milter.TempFail:
+			return packets.NewStatus(451, "Temporarily rejected by content filter, try again later")
+		case milter.ReplyCode:
+			return packets.NewStatus(resp.Code, replyLines(resp.Code, resp.Text)...)
+		case milter.Discard:
+			s.discard = true
+		}
+		i++
+	}
+	return nil
+}
+
+// milters can hand back multi-line replies with the codes already on each
+// line, strip them off since Status adds its own
+func replyLines(code uint16, text string) []string {
+	lines := strings.Split(text, "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimPrefix(lines[i], fmt.Sprintf("%d-", code))
+		lines[i] = strings.TrimPrefix(lines[i], fmt.Sprintf("%d ", code))
+	}
+	return lines
+}
@@ -0,0 +1,540 @@
+// Package milter implements the MTA side of the Sendmail milter protocol
+// (version 6), so existing content filters like rspamd, OpenDKIM or
+// clamav-milter can inspect and modify mail as it comes in.
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const protocolVersion = 6
+
+// commands sent to the filter
+const (
+	cmdOptNeg  = 'O'
+	cmdMacro   = 'D'
+	cmdConnect = 'C'
+	cmdHelo    = 'H'
+	cmdMail    = 'M'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdHeader  = 'L'
+	cmdEOH     = 'N'
+	cmdBody    = 'B'
+	cmdEOB     = 'E'
+	cmdAbort   = 'A'
+	cmdQuit    = 'Q'
+)
+
+// replies from the filter
+const (
+	replyAccept     = 'a'
+	replyContinue   = 'c'
+	replyDiscard    = 'd'
+	replyReject     = 'r'
+	replyTempFail   = 't'
+	replyReplyCode  = 'y'
+	replyProgress   = 'p'
+	replySkip       = 's'
+	replyAddRcpt    = '+'
+	replyDelRcpt    = '-'
+	replyAddHeader  = 'h'
+	replyInsHeader  = 'i'
+	replyChgHeader  = 'm'
+	replyQuarantine = 'q'
+)
+
+// actions we allow the filter to take at end of message
+const (
+	actAddHeaders = 0x01
+	actAddRcpt    = 0x04
+	actDelRcpt    = 0x08
+	actChgHeaders = 0x10
+	actQuarantine = 0x20
+
+	supportedActions = actAddHeaders | actAddRcpt | actDelRcpt | actChgHeaders | actQuarantine
+)
+
+// protocol flags, the filter sets these to skip steps or say it won't reply
+const (
+	protoNoConnect = 1 << iota
+	protoNoHelo
+	protoNoMail
+	protoNoRcpt
+	protoNoBody
+	protoNoHeaders
+	protoNoEOH
+	protoNoReplyHeader
+	protoNoUnknown
+	protoNoData
+	protoSkip
+	protoRcptRej
+	protoNoReplyConnect
+	protoNoReplyHelo
+	protoNoReplyMail
+	protoNoReplyRcpt
+	protoNoReplyData
+	protoNoReplyUnknown
+	protoNoReplyEOH
+	protoNoReplyBody
+
+	supportedProtocol = protoNoConnect | protoNoHelo | protoNoMail | protoNoRcpt | protoNoBody |
+		protoNoHeaders | protoNoEOH | protoNoReplyHeader | protoNoUnknown | protoNoData |
+		protoNoReplyConnect | protoNoReplyHelo | protoNoReplyMail | protoNoReplyRcpt |
+		protoNoReplyData | protoNoReplyUnknown | protoNoReplyEOH | protoNoReplyBody
+)
+
+// filters won't accept body chunks bigger than this
+const maxBodyChunk = 65535
+
+// Action is the filter's verdict on a stage
+type Action int
+
+const (
+	Continue Action = iota
+	// Accept means the filter doesn't want to see the rest of this message
+	Accept
+	Reject
+	TempFail
+	// Discard means accept the message but silently drop it
+	Discard
+	// ReplyCode means reject or tempfail with the code and text in the Response
+	ReplyCode
+)
+
+type Response struct {
+	Action Action
+	// only set for ReplyCode, Text is the full reply including the codes
+	Code uint16
+	Text string
+}
+
+type ModKind int
+
+const (
+	AddHeader ModKind = iota
+	InsertHeader
+	ChangeHeader
+	AddRcpt
+	DelRcpt
+	Quarantine
+)
+
+// Modification is a change the filter asked for at end of message
+type Modification struct {
+	Kind ModKind
+	// header name, or recipient address for AddRcpt/DelRcpt
+	Name string
+	// header value, or the reason for Quarantine
+	Value string
+	// header position for InsertHeader (0 based) and ChangeHeader (1 based)
+	Index int
+}
+
+type Header struct {
+	Name  string
+	Value string
+}
+
+var ErrUnexpectedReply = errors.New("unexpected reply from milter")
+
+type Client struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	timeout  time.Duration
+	protocol uint32
+	actions  uint32
+	// set once the filter accepts a message, we stop bothering it until the next one
+	accepted bool
+}
+
+// Dial connects to the milter at address, which is either "unix:/path/to/sock"
+// or "inet:host:port", and negotiates options
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	network, addr, ok := strings.Cut(address, ":")
+	if !ok {
+		return nil, fmt.Errorf("milter.Dial: bad address %q", address)
+	}
+	switch network {
+	case "inet", "tcp":
+		network = "tcp"
+	case "inet6", "tcp6":
+		network = "tcp6"
+	case "unix", "local":
+		network = "unix"
+	default:
+		return nil, fmt.Errorf("milter.Dial: unknown network %q", network)
+	}
+
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("milter.Dial: %w", err)
+	}
+
+	c := &Client{
+		conn:    conn,
+		rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		timeout: timeout,
+	}
+	if err = c.negotiate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("milter.Dial: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Client) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], protocolVersion)
+	binary.BigEndian.PutUint32(data[4:], supportedActions)
+	binary.BigEndian.PutUint32(data[8:], supportedProtocol)
+	if err := c.send(cmdOptNeg, data); err != nil {
+		return err
+	}
+
+	cmd, data, err := c.read()
+	if err != nil {
+		return err
+	}
+	if cmd != cmdOptNeg || len(data) < 12 {
+		return ErrUnexpectedReply
+	}
+
+	version := binary.BigEndian.Uint32(data[0:])
+	if version < 2 {
+		return fmt.Errorf("milter protocol version %d is too old", version)
+	}
+	c.actions = binary.BigEndian.Uint32(data[4:]) & supportedActions
+	c.protocol = binary.BigEndian.Uint32(data[8:]) & supportedProtocol
+	return nil
+}
+
+// Connect tells the filter about a new client connection
+func (c *Client) Connect(hostname string, ip net.IP, port uint16, macros map[string]string) (*Response, error) {
+	if err := c.macros(cmdConnect, macros); err != nil {
+		return nil, err
+	}
+	if c.protocol&protoNoConnect != 0 {
+		return &Response{Action: Continue}, nil
+	}
+
+	var family byte = '4'
+	if ip.To4() == nil {
+		family = '6'
+	}
+	data := cstrings(hostname)
+	data = append(data, family)
+	data = binary.BigEndian.AppendUint16(data, port)
+	data = append(data, cstrings(ip.String())...)
+
+	return c.stage(cmdConnect, data, protoNoReplyConnect)
+}
+
+func (c *Client) Helo(name string) (*Response, error) {
+	if c.protocol&protoNoHelo != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return c.stage(cmdHelo, cstrings(name), protoNoReplyHelo)
+}
+
+// Mail starts a new message. sender is the bare envelope address.
+func (c *Client) Mail(sender string, macros map[string]string) (*Response, error) {
+	c.accepted = false
+	if err := c.macros(cmdMail, macros); err != nil {
+		return nil, err
+	}
+	if c.protocol&protoNoMail != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return c.stage(cmdMail, cstrings("<"+sender+">"), protoNoReplyMail)
+}
+
+func (c *Client) Rcpt(rcpt string) (*Response, error) {
+	if c.accepted || c.protocol&protoNoRcpt != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return c.stage(cmdRcpt, cstrings("<"+rcpt+">"), protoNoReplyRcpt)
+}
+
+func (c *Client) Data() (*Response, error) {
+	if c.accepted || c.protocol&protoNoData != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return c.stage(cmdData, nil, protoNoReplyData)
+}
+
+// Message sends the headers and body of a completed message followed by end
+// of message, and returns the filter's verdict along with any modifications
+// it asked for
+func (c *Client) Message(headers []Header, body []byte, macros map[string]string) (*Response, []Modification, error) {
+	if c.accepted {
+		return &Response{Action: Continue}, nil, nil
+	}
+
+	if c.protocol&protoNoHeaders == 0 {
+		for _, h := range headers {
+			// filters expect the single space after the colon to be stripped
+			value := strings.TrimPrefix(h.Value, " ")
+			resp, err := c.stage(cmdHeader, cstrings(h.Name, value), protoNoReplyHeader)
+			if err != nil || resp.Action != Continue {
+				return resp, nil, err
+			}
+		}
+	}
+
+	if c.protocol&protoNoEOH == 0 {
+		resp, err := c.stage(cmdEOH, nil, protoNoReplyEOH)
+		if err != nil || resp.Action != Continue {
+			return resp, nil, err
+		}
+	}
+
+	if c.protocol&protoNoBody == 0 {
+		for len(body) > 0 {
+			n := min(len(body), maxBodyChunk)
+			resp, err := c.stage(cmdBody, body[:n], protoNoReplyBody)
+			if err != nil || resp.Action != Continue {
+				return resp, nil, err
+			}
+			body = body[n:]
+		}
+	}
+
+	if err := c.macros(cmdEOB, macros); err != nil {
+		return nil, nil, err
+	}
+	if err := c.send(cmdEOB, nil); err != nil {
+		return nil, nil, err
+	}
+
+	// modifications come first, then the final verdict
+	mods := []Modification{}
+	for {
+		cmd, data, err := c.read()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mod, ok, err := c.parseModification(cmd, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			mods = append(mods, mod)
+			continue
+		}
+
+		resp, err := parseResponse(cmd, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp == nil {
+			// progress, the filter's still working on it
+			continue
+		}
+		return resp, mods, nil
+	}
+}
+
+// Abort tells the filter the current message was abandoned (RSET etc.)
+func (c *Client) Abort() error {
+	c.accepted = false
+	return c.send(cmdAbort, nil)
+}
+
+// Close says goodbye to the filter and closes the connection
+func (c *Client) Close() error {
+	c.send(cmdQuit, nil)
+	return c.conn.Close()
+}
+
+// send a stage command and read the reply, unless the filter told us it
+// won't send one
+func (c *Client) stage(cmd byte, data []byte, noReply uint32) (*Response, error) {
+	if err := c.send(cmd, data); err != nil {
+		return nil, err
+	}
+	if c.protocol&noReply != 0 {
+		return &Response{Action: Continue}, nil
+	}
+
+	for {
+		rcmd, rdata, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := parseResponse(rcmd, rdata)
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			// progress, keep waiting
+			continue
+		}
+		if resp.Action == Accept {
+			c.accepted = true
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) macros(stage byte, macros map[string]string) error {
+	if len(macros) == 0 {
+		return nil
+	}
+
+	data := []byte{stage}
+	for k, v := range macros {
+		data = append(data, cstrings(k, v)...)
+	}
+	return c.send(cmdMacro, data)
+}
+
+func (c *Client) send(cmd byte, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)+1))
+	hdr[4] = cmd
+	if _, err := c.rw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(data); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *Client) read() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size == 0 || size > 1<<20 {
+		return 0, nil, fmt.Errorf("milter packet size %d out of range", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.rw, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// parseResponse returns nil for progress messages
+func parseResponse(cmd byte, data []byte) (*Response, error) {
+	switch cmd {
+	case replyContinue, replySkip:
+		return &Response{Action: Continue}, nil
+	case replyAccept:
+		return &Response{Action: Accept}, nil
+	case replyReject:
+		return &Response{Action: Reject}, nil
+	case replyTempFail:
+		return &Response{Action: TempFail}, nil
+	case replyDiscard:
+		return &Response{Action: Discard}, nil
+	case replyProgress:
+		return nil, nil
+	case replyReplyCode:
+		text := string(bytes.TrimRight(data, "\x00"))
+		if len(text) < 3 {
+			return nil, ErrUnexpectedReply
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil || code < 400 || code > 599 {
+			return nil, ErrUnexpectedReply
+		}
+		return &Response{Action: ReplyCode, Code: uint16(code), Text: text}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnexpectedReply, cmd)
+	}
+}
+
+// parseModification reports ok=false if cmd isn't a modification
+func (c *Client) parseModification(cmd byte, data []byte) (Modification, bool, error) {
+	var needs uint32
+	var mod Modification
+	switch cmd {
+	case replyAddHeader:
+		needs = actAddHeaders
+		strs := splitCStrings(data)
+		if len(strs) < 2 {
+			return mod, false, ErrUnexpectedReply
+		}
+		mod = Modification{Kind: AddHeader, Name: strs[0], Value: strs[1]}
+	case replyInsHeader, replyChgHeader:
+		if len(data) < 4 {
+			return mod, false, ErrUnexpectedReply
+		}
+		idx := int(binary.BigEndian.Uint32(data))
+		strs := splitCStrings(data[4:])
+		if len(strs) < 2 {
+			return mod, false, ErrUnexpectedReply
+		}
+		if cmd == replyInsHeader {
+			needs = actAddHeaders
+			mod = Modification{Kind: InsertHeader, Name: strs[0], Value: strs[1], Index: idx}
+		} else {
+			needs = actChgHeaders
+			mod = Modification{Kind: ChangeHeader, Name: strs[0], Value: strs[1], Index: idx}
+		}
+	case replyAddRcpt, replyDelRcpt:
+		strs := splitCStrings(data)
+		if len(strs) < 1 {
+			return mod, false, ErrUnexpectedReply
+		}
+		rcpt := strings.Trim(strs[0], "<>")
+		if cmd == replyAddRcpt {
+			needs = actAddRcpt
+			mod = Modification{Kind: AddRcpt, Name: rcpt}
+		} else {
+			needs = actDelRcpt
+			mod = Modification{Kind: DelRcpt, Name: rcpt}
+		}
+	case replyQuarantine:
+		needs = actQuarantine
+		strs := splitCStrings(data)
+		reason := ""
+		if len(strs) > 0 {
+			reason = strs[0]
+		}
+		mod = Modification{Kind: Quarantine, Value: reason}
+	default:
+		return mod, false, nil
+	}
+
+	if c.actions&needs == 0 {
+		return mod, false, fmt.Errorf("milter attempted %q without negotiating it", cmd)
+	}
+	return mod, true, nil
+}
+
+func cstrings(strs ...string) []byte {
+	out := []byte{}
+	for _, s := range strs {
+		out = append(out, s...)
+		out = append(out, 0)
+	}
+	return out
+}
+
+func splitCStrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(string(data), "\x00")
+}
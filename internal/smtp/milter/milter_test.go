@@ -0,0 +1,139 @@
+package milter
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeFilter reads one packet and answers it with whatever reply returns
+func fakeFilter(t *testing.T, reply func(cmd byte, data []byte) [][]byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			var hdr [4]byte
+			if _, err := io.ReadFull(c, hdr[:]); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				return
+			}
+			for _, r := range reply(buf[0], buf[1:]) {
+				out := binary.BigEndian.AppendUint32(nil, uint32(len(r)))
+				c.Write(append(out, r...))
+			}
+		}
+	}()
+
+	return "inet:" + l.Addr().String()
+}
+
+func TestMilterSession(t *testing.T) {
+	addr := fakeFilter(t, func(cmd byte, data []byte) [][]byte {
+		switch cmd {
+		case cmdOptNeg:
+			r := []byte{cmdOptNeg}
+			r = binary.BigEndian.AppendUint32(r, 6)
+			r = binary.BigEndian.AppendUint32(r, actAddHeaders|actQuarantine)
+			// skip HELO and don't reply to headers
+			r = binary.BigEndian.AppendUint32(r, protoNoHelo|protoNoReplyHeader)
+			return [][]byte{r}
+		case cmdMacro, cmdHeader:
+			return nil
+		case cmdRcpt:
+			return [][]byte{append([]byte{replyReplyCode}, "550 5.1.1 no such user\x00"...)}
+		case cmdEOB:
+			return [][]byte{
+				append([]byte{replyAddHeader}, "X-Spam\x00yes\x00"...),
+				append([]byte{replyQuarantine}, "looks bad\x00"...),
+				{replyAccept},
+			}
+		default:
+			return [][]byte{{replyContinue}}
+		}
+	})
+
+	c, err := Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	resp, err := c.Connect("mail.example.com", net.ParseIP("192.0.2.1"), 25, map[string]string{"j": "mx.example.org"})
+	if err != nil || resp.Action != Continue {
+		t.Fatalf("Connect = %v, %v, expected Continue", resp, err)
+	}
+
+	if resp, err = c.Helo("mail.example.com"); err != nil || resp.Action != Continue {
+		t.Fatalf("Helo = %v, %v, expected Continue", resp, err)
+	}
+
+	if resp, err = c.Mail("a@example.com", nil); err != nil || resp.Action != Continue {
+		t.Fatalf("Mail = %v, %v, expected Continue", resp, err)
+	}
+
+	resp, err = c.Rcpt("nobody@example.org")
+	if err != nil || resp.Action != ReplyCode || resp.Code != 550 {
+		t.Fatalf("Rcpt = %v, %v, expected 550 ReplyCode", resp, err)
+	}
+
+	headers := []Header{{"Subject", " hello"}, {"From", " a@example.com"}}
+	resp, mods, err := c.Message(headers, []byte("hi\r\n"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.Action != Accept {
+		t.Errorf("Message action = %v, expected Accept", resp.Action)
+	}
+	if len(mods) != 2 || mods[0].Kind != AddHeader || mods[0].Name != "X-Spam" || mods[0].Value != "yes" ||
+		mods[1].Kind != Quarantine || mods[1].Value != "looks bad" {
+		t.Errorf("unexpected modifications %+v", mods)
+	}
+}
+
+func TestMilterProgress(t *testing.T) {
+	addr := fakeFilter(t, func(cmd byte, data []byte) [][]byte {
+		switch cmd {
+		case cmdOptNeg:
+			r := []byte{cmdOptNeg}
+			r = binary.BigEndian.AppendUint32(r, 6)
+			r = binary.BigEndian.AppendUint32(r, 0)
+			r = binary.BigEndian.AppendUint32(r, 0)
+			return [][]byte{r}
+		case cmdMacro:
+			return nil
+		case cmdEOB:
+			// a slow filter asks for more time before its verdict
+			return [][]byte{{replyProgress}, {replyProgress}, {replyReject}}
+		default:
+			return [][]byte{{replyContinue}}
+		}
+	})
+
+	c, err := Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	resp, _, err := c.Message([]Header{{"Subject", " hello"}}, []byte("hi\r\n"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp == nil || resp.Action != Reject {
+		t.Errorf("Message = %+v, expected Reject", resp)
+	}
+}
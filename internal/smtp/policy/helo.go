@@ -0,0 +1,191 @@
+package policy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Action is what we do with a client that fails a check
+type Action int
+
+const (
+	// Ignore the failure entirely
+	None Action = iota
+	// Accept the mail but add a header saying what failed
+	Tag
+	// Reply with a 4xx so legitimate servers try again later
+	TempFail
+	// Reply with a 5xx
+	Reject
+)
+
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return None, nil
+	case "tag":
+		return Tag, nil
+	case "tempfail":
+		return TempFail, nil
+	case "reject":
+		return Reject, nil
+	default:
+		return None, fmt.Errorf("ParseAction: unknown action %q", s)
+	}
+}
+
+// Violation is a reason a HELO/EHLO identity looks suspicious
+type Violation int
+
+const (
+	// The argument is neither a fully qualified domain name nor an address literal
+	BadSyntax Violation = iota + 1
+	// The client IP's PTR record doesn't resolve back to the client IP
+	NoFCrDNS
+	// The client claims to be us
+	ForgedIdentity
+	// The client IP's reverse DNS couldn't be checked right now, a timeout
+	// or SERVFAIL
+	FCrDNSTempError
+)
+
+func (v Violation) String() string {
+	switch v {
+	case BadSyntax:
+		return "invalid HELO syntax"
+	case NoFCrDNS:
+		return "no forward-confirmed reverse DNS"
+	case ForgedIdentity:
+		return "HELO claims to be this server"
+	case FCrDNSTempError:
+		return "temporary failure checking reverse DNS"
+	default:
+		return "unknown"
+	}
+}
+
+// Resolver is the subset of net.Resolver needed for FCrDNS, here so tests can
+// swap it out
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// CheckHelo validates the name a client gave in HELO/EHLO. ownNames are the
+// names this server goes by, a client claiming one of them is lying.
+func CheckHelo(ctx context.Context, r Resolver, name string, ip net.IP, ownNames ...string) []Violation {
+	violations := []Violation{}
+
+	if !ValidHeloSyntax(name) {
+		violations = append(violations, BadSyntax)
+	}
+
+	switch confirmed, err := forwardConfirmed(ctx, r, ip); {
+	case err != nil:
+		violations = append(violations, FCrDNSTempError)
+	case !confirmed:
+		violations = append(violations, NoFCrDNS)
+	}
+
+	trimmed := strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, own := range ownNames {
+		if own != "" && trimmed == strings.TrimSuffix(strings.ToLower(own), ".") {
+			violations = append(violations, ForgedIdentity)
+			break
+		}
+	}
+
+	return violations
+}
+
+// ValidHeloSyntax reports whether name is an FQDN or an RFC 5321 address
+// literal ([192.0.2.1] or [IPv6:2001:db8::1])
+func ValidHeloSyntax(name string) bool {
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		lit := name[1 : len(name)-1]
+		if v6, ok := strings.CutPrefix(lit, "IPv6:"); ok {
+			ip := net.ParseIP(v6)
+			return ip != nil && ip.To4() == nil
+		}
+		ip := net.ParseIP(lit)
+		return ip != nil && ip.To4() != nil
+	}
+
+	return validFQDN(name)
+}
+
+func validFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+		if l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	// top level domains are never all numeric, this catches bare IPs
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
+
+// forwardConfirmed checks the IP's PTR names resolve back to it. The error
+// is only for lookups that failed temporarily, when we can't say either way.
+func forwardConfirmed(ctx context.Context, r Resolver, ip net.IP) (bool, error) {
+	if ip == nil {
+		return false, nil
+	}
+
+	names, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false, temporary(err)
+	}
+
+	var tempErr error
+	for _, n := range names {
+		addrs, err := r.LookupHost(ctx, n)
+		if err != nil {
+			tempErr = cmp.Or(tempErr, temporary(err))
+			continue
+		}
+		for _, a := range addrs {
+			if ip.Equal(net.ParseIP(a)) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, tempErr
+}
+
+// temporary is err if it's a DNS failure that might go away, nil if the
+// answer really is no
+func temporary(err error) error {
+	var de *net.DNSError
+	if errors.As(err, &de) && (de.IsTemporary || de.IsTimeout) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
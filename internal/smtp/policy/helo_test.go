@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+type fakeResolver struct {
+	ptr   map[string][]string
+	hosts map[string][]string
+	// lookups of these fail with the error instead
+	errs map[string]error
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err, ok := r.errs[addr]; ok {
+		return nil, err
+	}
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if err, ok := r.errs[host]; ok {
+		return nil, err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestValidHeloSyntax(t *testing.T) {
+	cases := map[string]bool{
+		"mail.example.com":    true,
+		"mail.example.com.":   true,
+		"localhost":           false,
+		"-bad.example.com":    false,
+		"under_score.example": false,
+		"192.0.2.1":           false,
+		"[192.0.2.1]":         true,
+		"[IPv6:2001:db8::1]":  true,
+		"[2001:db8::1]":       false,
+		"[IPv6:192.0.2.1]":    false,
+		"[not an address]":    false,
+		"":                    false,
+	}
+
+	for name, want := range cases {
+		if got := ValidHeloSyntax(name); got != want {
+			t.Errorf("ValidHeloSyntax(%q) = %t, expected %t", name, got, want)
+		}
+	}
+}
+
+func TestCheckHelo(t *testing.T) {
+	r := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"mail.example.com."},
+			"192.0.2.2": {"spoofed.example.com."},
+		},
+		hosts: map[string][]string{
+			"mail.example.com.":    {"192.0.2.1"},
+			"spoofed.example.com.": {"198.51.100.7"},
+		},
+	}
+	ctx := context.Background()
+
+	if v := CheckHelo(ctx, r, "mail.example.com", net.ParseIP("192.0.2.1"), "mx.jums.test"); len(v) != 0 {
+		t.Errorf("good client got violations %v", v)
+	}
+
+	v := CheckHelo(ctx, r, "mx.jums.test", net.ParseIP("192.0.2.2"), "mx.jums.test")
+	if !slices.Contains(v, NoFCrDNS) || !slices.Contains(v, ForgedIdentity) || slices.Contains(v, BadSyntax) {
+		t.Errorf("forged client got violations %v, expected NoFCrDNS and ForgedIdentity", v)
+	}
+
+	v = CheckHelo(ctx, r, "localhost", net.ParseIP("192.0.2.1"))
+	if !slices.Equal(v, []Violation{BadSyntax}) {
+		t.Errorf("bare hostname got violations %v, expected only BadSyntax", v)
+	}
+}
+
+func TestCheckHeloDNSErrors(t *testing.T) {
+	r := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.3": {"slow.example.com."},
+		},
+		errs: map[string]error{
+			"192.0.2.1":         &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+			"192.0.2.2":         &net.DNSError{Err: "no such host", IsNotFound: true},
+			"slow.example.com.": &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+		},
+	}
+	ctx := context.Background()
+
+	tests := map[string]Violation{
+		"192.0.2.1": FCrDNSTempError,
+		"192.0.2.2": NoFCrDNS,
+		"192.0.2.3": FCrDNSTempError,
+	}
+	for ip, want := range tests {
+		v := CheckHelo(ctx, r, "mail.example.com", net.ParseIP(ip))
+		if !slices.Equal(v, []Violation{want}) {
+			t.Errorf("%s got violations %v, expected only %v", ip, v, want)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package smtp
 
 import (
+	"errors"
 	"log/slog"
 	"net"
+	"os"
 
 	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/smtp/packets"
 )
 
 type Session struct {
@@ -14,7 +17,29 @@ type Session struct {
 	name   string
 	ext    bool
 	authed bool
+	// the user that authenticated, if authed
+	user   string
 	mail   *mail.Mail
+
+	// failed HELO checks that we've been told to tag rather than reject
+	heloTags []string
+
+	milters []*milterConn
+	// set by filters, the current message is accepted but dropped
+	discard bool
+	// set by filters, the current message is held instead of delivered
+	quarantine string
+
+	// from the listener, see smtp.go
+	opts Options
+	// the current message is over MaxMessageSize, the rest of it is
+	// thrown away
+	tooBig bool
+
+	// this is an LMTP session, see lmtp.go
+	lmtp bool
+	// LMTP's reply to DATA, one per recipient
+	rcptStatuses []*packets.Status
 }
 
 func NewSession(c net.Conn) *Session {
@@ -53,15 +78,40 @@ func (s *Session) HandleNextLine() error {
 	return Send(resp, s.conn)
 }
 
+// SendMail hands the current message to the outbound queue, which takes
+// care of delivering it so the client isn't kept waiting on remote servers
 func (s *Session) SendMail() error {
-	return nil
+	q, err := mail.SharedQueue()
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(s.mail)
+}
+
+func (s *Session) remoteIP() net.IP {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		host = s.conn.RemoteAddr().String()
+	}
+	return net.ParseIP(host)
 }
 
 func (s *Session) readLine() ([]byte, error) {
+	if err := s.setReadDeadline(); err != nil {
+		return nil, err
+	}
 	read := []byte{}
 	for len(read) < 2 || string(read[len(read)-2:]) != "\r\n" {
 		next := make([]byte, 1)
 		_, err := s.conn.Read(next)
+		if errors.Is(err, os.ErrDeadlineExceeded) && shuttingDown() {
+			// Shutdown woke us, but the client's in the middle of
+			// something so it gets until drainBy
+			if err = s.setReadDeadline(); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Sessions are tracked so Shutdown can tell them to finish up. Setting a
+// read deadline of now wakes a session that's waiting on its client, and
+// it decides from there whether to hang up or carry on.
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[*Session]net.Conn{}
+	sessionsWg sync.WaitGroup
+	draining   bool
+	// when clients still in a transaction are cut off
+	drainBy time.Time
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// track adds a session for Shutdown to wait on. It's false if we're already
+// shutting down and the client should be turned away.
+func track(s *Session) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if draining {
+		return false
+	}
+	sessions[s] = s.conn
+	sessionsWg.Add(1)
+	return true
+}
+
+func untrack(s *Session) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, s)
+	sessionsWg.Done()
+}
+
+// Shutdown hangs up on every SMTP and LMTP client with a 421, waiting for
+// the ones partway through sending a message to finish it first. Clients
+// still connected when ctx is done are cut off.
+func Shutdown(ctx context.Context) error {
+	sessionsMu.Lock()
+	draining = true
+	drainBy, _ = ctx.Deadline()
+	for _, c := range sessions {
+		c.SetReadDeadline(time.Now())
+	}
+	sessionsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sessionsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		sessionsMu.Lock()
+		for _, c := range sessions {
+			c.Close()
+		}
+		sessionsMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// busy is whether the client is partway through a mail transaction, between
+// MAIL and the end of DATA
+func (s *Session) busy() bool {
+	switch s.state.(type) {
+	case *rcptState, *dataState:
+		return true
+	}
+	return false
+}
+
+// setReadDeadline gives the client Timeout to send its next line, or while
+// we're shutting down until drainBy, or no time at all if it isn't busy
+func (s *Session) setReadDeadline() error {
+	var deadline time.Time
+	if s.opts.Timeout > 0 {
+		deadline = time.Now().Add(s.opts.Timeout)
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if draining {
+		if !s.busy() || (!drainBy.IsZero() && time.Now().After(drainBy)) {
+			return errShuttingDown
+		}
+		if !drainBy.IsZero() && (deadline.IsZero() || drainBy.Before(deadline)) {
+			deadline = drainBy
+		}
+	}
+	return s.conn.SetReadDeadline(deadline)
+}
+
+// shuttingDown is whether Shutdown has been called
+func shuttingDown() bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return draining
+}
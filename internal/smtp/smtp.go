@@ -1,24 +1,104 @@
 package smtp
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Queueue0/jums/internal/smtp/packets"
 )
 
-func Handle(c net.Conn) {
+// Options are the settings a listener gives its sessions
+type Options struct {
+	// a submission port for people's own mail clients, RFC 6409
+	Submission bool
+	// clients have to authenticate before MAIL
+	RequireAuth bool
+	// clients that are quiet for this long are hung up on, 0 for never
+	Timeout time.Duration
+	// bigger messages are refused, 0 for no limit
+	MaxMessageSize int64
+}
+
+// Handle serves an SMTP client, either another server delivering mail to us
+// or, on a submission port, one of our users sending mail
+func Handle(c net.Conn, o Options) {
 	defer c.Close()
 	slog.Debug("handling connection...", "addr", c.RemoteAddr().String())
-	Send(packets.NewStatus(220, "Josh's Unremarkable Mail Server v0.0.0"), c)
 	s := NewSession(c)
+	s.opts = o
+	if !track(s) {
+		Send(shutdownStatus(), c)
+		return
+	}
+	defer untrack(s)
+	defer s.closeMilters()
+	if sts := s.milterConnect(); sts != nil {
+		Send(sts, c)
+		return
+	}
+	Send(packets.NewStatus(220, "Josh's Unremarkable Mail Server v0.0.0"), c)
 	for s.Open() {
-		s.HandleNextLine()
+		if err := s.HandleNextLine(); err != nil {
+			s.hangUp(err)
+			return
+		}
+	}
+}
+
+// hangUp tells a client why it's being disconnected, if it's because we're
+// shutting down or it went quiet
+func (s *Session) hangUp(err error) {
+	switch {
+	case errors.Is(err, errShuttingDown):
+		Send(shutdownStatus(), s.conn)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		slog.Info("SMTP client timed out", "addr", s.conn.RemoteAddr().String())
+		Send(packets.NewStatus(421, "4.4.2 Timeout, closing connection"), s.conn)
 	}
 }
 
+func shutdownStatus() *packets.Status {
+	return packets.NewStatus(421, "4.3.2 Shutting down, try again later")
+}
+
 func Send(p packets.Packet, c net.Conn) error {
 	slog.Debug("Sending packet", "to", c.RemoteAddr().String(), "msg", p.SafeString())
 	_, err := c.Write(p.Bytes())
 	return err
 }
+
+// extensions are what EHLO and LHLO advertise besides AUTH and STARTTLS
+func (s *Session) extensions() []string {
+	ext := slices.Clone(alwaysSupportedExtensions)
+	if s.opts.MaxMessageSize > 0 {
+		// RFC 1870
+		ext = append(ext, fmt.Sprintf("SIZE %d", s.opts.MaxMessageSize))
+	}
+	return ext
+}
+
+// checkSize turns away a message whose MAIL FROM SIZE parameter says it's
+// too big, rather than making the client send it all first
+func (s *Session) checkSize(params []string) *packets.Status {
+	for _, p := range params {
+		v, ok := strings.CutPrefix(strings.ToUpper(p), "SIZE=")
+		if !ok {
+			continue
+		}
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return packets.NewStatus(501, "5.5.4 Bad SIZE parameter")
+		}
+		if s.opts.MaxMessageSize > 0 && size > s.opts.MaxMessageSize {
+			return packets.NewStatus(552, "5.3.4 Message size exceeds fixed maximum message size")
+		}
+	}
+	return nil
+}
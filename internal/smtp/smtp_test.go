@@ -0,0 +1,479 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/lists"
+	"github.com/Queueue0/jums/internal/maildir"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/srs"
+	"github.com/Queueue0/jums/internal/users"
+)
+
+// the config is loaded once per process, so every test shares this one
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "jums-smtp-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", dir)
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	os.MkdirAll(filepath.Join(dir, "config", "jums"), 0700)
+	writeCert(dir)
+
+	conf := fmt.Sprintf(`Domain = "example.com"
+Mxdomain = "mx.example.com"
+BoxesDir = "%[1]s/boxes"
+CertFile = "%[1]s/cert.pem"
+KeyFile = "%[1]s/key.pem"
+UsersFile = "%[1]s/users"
+AliasesFile = "%[1]s/aliases"
+SenderLoginFile = "%[1]s/sender_logins"
+QueueDir = "%[1]s/queue"
+TrustedNetworks = ["127.0.0.2/32"]
+
+[SRS]
+Enabled = true
+Domain = "example.com"
+SecretFile = "%[1]s/srs.key"
+
+[Subaddress]
+Delimiter = "+"
+
+[[Lists]]
+Address = "team@example.com"
+Members = ["alice@example.com", "dave@remote.example"]
+Owners = ["alice@example.com"]
+`, dir)
+	os.WriteFile(filepath.Join(dir, "config", "jums", "config.toml"), []byte(conf), 0600)
+	os.WriteFile(filepath.Join(dir, "aliases"), []byte("sales@example.com: alice, bob\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "sender_logins"), []byte("sales@example.com: alice\n"), 0600)
+
+	store, _ := users.Load(config.GetConfig().UsersFile)
+	for _, u := range []string{"alice", "bob", "full"} {
+		store.SetPassword(u, "secret")
+	}
+	if err := store.Save(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// writeCert makes a self-signed certificate for STARTTLS
+func writeCert(dir string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+}
+
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+// dial starts a server with handle and connects to it from local, an
+// address on the loopback interface
+func dial(t *testing.T, local string, handle func(net.Conn)) *client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}, Timeout: 5 * time.Second}
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	cl := &client{t: t, c: c, r: bufio.NewReader(c)}
+	cl.expect("220")
+	return cl
+}
+
+func smtpServer(o Options) func(net.Conn) {
+	return func(c net.Conn) { Handle(c, o) }
+}
+
+// reply reads a whole reply, the lines joined with "\n"
+func (c *client) reply() string {
+	c.t.Helper()
+	c.c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading reply: %v (so far %q)", err, lines)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+func (c *client) send(line string) {
+	c.t.Helper()
+	if _, err := c.c.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// cmd sends line and returns the reply
+func (c *client) cmd(line string) string {
+	c.t.Helper()
+	c.send(line)
+	return c.reply()
+}
+
+// expect reads a reply and fails unless it starts with prefix
+func (c *client) expect(prefix string) string {
+	c.t.Helper()
+	r := c.reply()
+	if !strings.HasPrefix(r, prefix) {
+		c.t.Fatalf("got %q, expected %s", r, prefix)
+	}
+	return r
+}
+
+// must sends line and fails unless the reply starts with prefix
+func (c *client) must(line, prefix string) string {
+	c.t.Helper()
+	c.send(line)
+	return c.expect(prefix)
+}
+
+// startTLS upgrades the connection and greets the server again
+func (c *client) startTLS() {
+	c.t.Helper()
+	c.must("STARTTLS", "220")
+	tc := tls.Client(c.c, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.c = tc
+	c.r = bufio.NewReader(tc)
+	c.must("EHLO client.example.com", "250")
+}
+
+// login does STARTTLS and logs in as user
+func (c *client) login(user string) {
+	c.t.Helper()
+	c.startTLS()
+	c.must("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00"+user+"\x00secret")), "235")
+}
+
+// userDir is account's maildir, made if it doesn't exist yet
+func userDir(t *testing.T, account string) string {
+	t.Helper()
+	dir, err := maildir.UserDir(config.GetConfig().Mailbox(account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maildir.Exists(dir) {
+		if err = maildir.Create(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// delivered is how many new messages are in account's INBOX
+func delivered(t *testing.T, account string) int {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(userDir(t, account), "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// fillUp gives account a quota too small for any message
+func fillUp(t *testing.T, account string) {
+	t.Helper()
+	dir := userDir(t, account)
+	if err := maildir.SetUserQuota(dir, &maildir.Quota{Storage: 10}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { maildir.SetUserQuota(dir, nil) })
+}
+
+// queued returns the queued message sent to rcpt
+func queued(t *testing.T, rcpt string) *mail.Mail {
+	t.Helper()
+	m := findQueued(t, rcpt)
+	if m == nil {
+		t.Fatalf("nothing queued for %s", rcpt)
+	}
+	return m
+}
+
+// findQueued is queued, but nil if there's nothing for rcpt
+func findQueued(t *testing.T, rcpt string) *mail.Mail {
+	t.Helper()
+	q, err := mail.SharedQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := q.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		for _, r := range e.Mail.Rcpt {
+			if r.String() == rcpt {
+				return e.Mail
+			}
+		}
+	}
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	// strangers can't find out who's here
+	c := dial(t, "127.0.0.1", smtpServer(Options{}))
+	c.must("EHLO remote.example", "250")
+	c.must("VRFY alice", "252")
+	c.must("EXPN sales@example.com", "252")
+
+	// a trusted network can
+	c = dial(t, "127.0.0.2", smtpServer(Options{}))
+	c.must("EHLO client.example.com", "250")
+	if r := c.must("VRFY alice", "250"); r != "250 <alice@example.com>" {
+		t.Errorf("VRFY alice = %q", r)
+	}
+	c.must("VRFY <nobody@example.com>", "550")
+	r := c.must("EXPN sales@example.com", "250")
+	if !strings.Contains(r, "<alice@example.com>") || !strings.Contains(r, "<bob@example.com>") {
+		t.Errorf("EXPN sales = %q", r)
+	}
+
+	// and so can our users
+	c = dial(t, "127.0.0.1", smtpServer(Options{}))
+	c.must("EHLO client.example.com", "250")
+	c.login("bob")
+	c.must("VRFY alice@example.com", "250")
+}
+
+func TestSubmissionSender(t *testing.T) {
+	c := dial(t, "127.0.0.1", smtpServer(Options{Submission: true, RequireAuth: true}))
+	c.must("EHLO client.example.com", "250")
+	c.must("MAIL FROM:<alice@example.com>", "530")
+	c.must("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), "538")
+	c.login("alice")
+
+	c.must("MAIL FROM:<bob@example.com>", "553")
+	c.must("MAIL FROM:<alice+lists@example.com>", "250")
+	c.must("RSET", "250")
+
+	// the sender login file lets alice send as sales
+	c.must("MAIL FROM:<sales@example.com>", "250")
+	c.must("RCPT TO:<bob@example.com>", "250")
+	c.must("DATA", "354")
+	c.send("From: Sales <sales@example.com>")
+	c.send("Subject: hi")
+	c.send("")
+	c.send("hello")
+	c.must(".", "250")
+
+	// an envelope she's allowed doesn't let her forge the header
+	c.must("MAIL FROM:<alice@example.com>", "250")
+	c.must("RCPT TO:<carol@remote.example>", "250")
+	c.must("DATA", "354")
+	c.send("From: Bob <bob@example.com>")
+	c.send("Subject: hi")
+	c.send("")
+	c.send("hello")
+	c.must(".", "553")
+}
+
+func TestShutdownDrains(t *testing.T) {
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		draining, drainBy = false, time.Time{}
+		sessionsMu.Unlock()
+	})
+
+	busy := dial(t, "127.0.0.1", smtpServer(Options{}))
+	busy.must("EHLO remote.example", "250")
+	busy.must("MAIL FROM:<carol@remote.example>", "250")
+	busy.must("RCPT TO:<bob@example.com>", "250")
+	busy.must("DATA", "354")
+	busy.send("Subject: last one")
+	idle := dial(t, "127.0.0.1", smtpServer(Options{}))
+	idle.must("EHLO remote.example", "250")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Shutdown(ctx) }()
+
+	idle.expect("421")
+
+	// new clients are turned away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			Handle(c, Options{})
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	(&client{t: t, c: conn, r: bufio.NewReader(conn)}).expect("421")
+
+	// but the one partway through its message gets to finish
+	busy.send("")
+	busy.send("goodbye")
+	busy.must(".", "250")
+	busy.expect("421")
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-ctx.Done():
+		t.Error("Shutdown didn't return before its deadline")
+	}
+}
+
+func TestNullSenderBounceToSRS(t *testing.T) {
+	conf := config.GetConfig()
+	secret, err := srs.LoadSecret(conf.SRS.SecretFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := srs.New(secret, conf.SRS.Domain, conf.SRS.MaxAge).Forward("carol@remote.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, "127.0.0.1", smtpServer(Options{}))
+	c.must("EHLO remote.example", "250")
+	c.must("MAIL FROM:<>", "250")
+	c.must("RCPT TO:<"+rewritten+">", "250")
+	c.must("RCPT TO:<SRS0=bad=XX=remote.example=carol@example.com>", "550")
+	c.must("DATA", "354")
+	c.send("Subject: Undelivered Mail Returned to Sender")
+	c.send("")
+	c.send("it bounced")
+	c.must(".", "250")
+
+	m := queued(t, "carol@remote.example")
+	if m.From != nil {
+		t.Errorf("bounce forwarded from %s, expected the null sender", m.From.String())
+	}
+}
+
+func TestNullSenderListBounce(t *testing.T) {
+	conf := config.GetConfig()
+	lc, _ := conf.List("team@example.com")
+	st, err := lists.Open(conf.ListsDir, lc.Address, lc.Members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one more and dave's off the list
+	for range 4 {
+		st.Bounced("dave@remote.example")
+	}
+
+	c := dial(t, "127.0.0.1", smtpServer(Options{}))
+	c.must("EHLO remote.example", "250")
+	c.must("MAIL FROM:<>", "250")
+	c.must("RCPT TO:<team-bounces+dave=remote.example@example.com>", "250")
+	c.must("DATA", "354")
+	c.send("Subject: Undelivered Mail Returned to Sender")
+	c.send("")
+	c.send("no such user dave")
+	c.must(".", "250")
+
+	rcpt := "team-bounces+dave=remote.example@example.com"
+	m := queued(t, rcpt)
+	addr, _ := mail.NewAddress(rcpt)
+	if err = m.Deliver(*addr); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.IsMember("dave@remote.example"); ok {
+		t.Error("dave is still on the list after bouncing")
+	}
+	if ok, _ := st.IsMember("alice@example.com"); !ok {
+		t.Error("alice was taken off the list")
+	}
+}
+
+func TestLMTPReplyPerRecipient(t *testing.T) {
+	fillUp(t, "full")
+	before := delivered(t, "bob")
+
+	c := dial(t, "127.0.0.1", func(conn net.Conn) { HandleLMTP(conn, Options{}) })
+	c.must("LHLO filter.example.com", "250")
+	c.must("MAIL FROM:<carol@remote.example>", "250")
+	c.must("RCPT TO:<bob@example.com>", "250")
+	c.must("RCPT TO:<nobody@example.com>", "550")
+	c.must("RCPT TO:<full@example.com>", "250")
+	c.must("DATA", "354")
+	c.send("Subject: hi")
+	c.send("")
+	c.send("this is more than ten bytes")
+	c.send(".")
+	// one reply for each accepted recipient, in order
+	c.expect("250")
+	c.expect("552")
+	c.must("QUIT", "221")
+
+	if n := delivered(t, "bob") - before; n != 1 {
+		t.Errorf("bob got %d copies, expected 1", n)
+	}
+}
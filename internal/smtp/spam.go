@@ -0,0 +1,39 @@
+package smtp
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/spam"
+)
+
+// classifyMessage scores inbound mail and marks it as spam if it's over the
+// threshold. Mail from authenticated users isn't scored.
+func (s *Session) classifyMessage() {
+	conf := config.GetConfig()
+	if !conf.Spam.Enabled || s.authed {
+		return
+	}
+
+	c, err := spam.Shared(spam.DefaultPath(conf.BoxesDir))
+	if err != nil {
+		slog.Error("Couldn't load spam classifier", "err", err.Error())
+		return
+	}
+
+	score := c.Score(s.mail.Data)
+	s.mail.Spam = score >= conf.Spam.Threshold
+
+	status := "No"
+	if s.mail.Spam {
+		status = "Yes"
+	}
+
+	// don't trust whatever the sender put in these
+	s.mail.RemoveHeader("X-Spam-Score")
+	s.mail.RemoveHeader("X-Spam-Status")
+	s.mail.PrependHeader("X-Spam-Status", fmt.Sprintf("%s, score=%.3f threshold=%.3f", status, score, conf.Spam.Threshold))
+	s.mail.PrependHeader("X-Spam-Score", fmt.Sprintf("%.3f", score))
+	slog.Debug("Message classified", "id", s.mail.Id, "score", score)
+}
@@ -5,11 +5,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/quota"
 	"github.com/Queueue0/jums/internal/smtp/mail"
 	"github.com/Queueue0/jums/internal/smtp/packets"
 )
@@ -29,11 +31,21 @@ func newState(s *Session) state {
 // Generic functions for EHLO and HELO because all states basically treat them
 // the same
 func ehlo(s state, c *packets.Command) (state, *packets.Status) {
+	if s.session().lmtp {
+		return s, packets.NewStatus(500, "This is LMTP, use LHLO")
+	}
 	if len(c.Args()) < 1 {
 		return s, packets.NewStatus(501, "Syntax error, tell me who you are!")
 	}
 
 	name := c.Args()[0]
+	if sts := checkHelo(s.session(), name); sts != nil {
+		return s, sts
+	}
+	if sts := s.session().milterHelo(name); sts != nil {
+		return s, sts
+	}
+	s.session().name = name
 
 	var gs *greetedState
 	if _, ok := s.(*greetedState); ok {
@@ -43,7 +55,7 @@ func ehlo(s state, c *packets.Command) (state, *packets.Status) {
 	}
 
 	var sts *packets.Status
-	lines := append([]string{fmt.Sprintf("Hello there, %s!", name)}, alwaysSupportedExtensions...)
+	lines := append([]string{fmt.Sprintf("Hello there, %s!", name)}, s.session().extensions()...)
 	if _, ok := s.session().conn.(*tls.Conn); ok {
 		lines = append(lines, "AUTH PLAIN")
 		sts = packets.NewStatus(250, lines...)
@@ -58,10 +70,20 @@ func ehlo(s state, c *packets.Command) (state, *packets.Status) {
 }
 
 func helo(s state, c *packets.Command) (state, *packets.Status) {
+	if s.session().lmtp {
+		return s, packets.NewStatus(500, "This is LMTP, use LHLO")
+	}
 	if len(c.Args()) < 1 {
 		return s, packets.NewStatus(501, "Syntax error, tell me who you are!")
 	}
 	name := c.Args()[0]
+	if sts := checkHelo(s.session(), name); sts != nil {
+		return s, sts
+	}
+	if sts := s.session().milterHelo(name); sts != nil {
+		return s, sts
+	}
+	s.session().name = name
 
 	var gs *greetedState
 	if _, ok := s.(*greetedState); ok {
@@ -87,15 +109,17 @@ func (st *baseState) Handle(b []byte) *packets.Status {
 	c := packets.ParseCommand(b)
 	switch c.Cmd() {
 	case "EHLO":
-		// TODO: verify the given domain/address literal to prevent spam
 		ns, resp := ehlo(st, c)
 		st.s.state = ns
 		return resp
 	case "HELO":
-		//TODO: verify domain to prevent spam
 		ns, resp := helo(st, c)
 		st.s.state = ns
 		return resp
+	case "LHLO":
+		ns, resp := lhlo(st, c)
+		st.s.state = ns
+		return resp
 	case "MAIL":
 		// No mail until we've been greeted
 		return packets.NewStatus(503, "Bad sequence of commands")
@@ -110,7 +134,9 @@ func (st *baseState) Handle(b []byte) *packets.Status {
 	case "QUIT":
 		return packets.NewStatus(221, "Goodbye!")
 	case "VRFY":
-		return verify(c.Args()[0])
+		return verify(st.s, c)
+	case "EXPN":
+		return expand(st.s, c)
 	case "STARTTLS":
 		if _, ok := st.s.conn.(*tls.Conn); ok {
 			return packets.NewStatus(454, "TLS already in use")
@@ -130,17 +156,7 @@ func (st *baseState) Handle(b []byte) *packets.Status {
 
 func startTLS(c net.Conn) (*tls.Conn, error) {
 	_, err := c.Write(packets.NewStatus(220, "OK").Bytes())
-	tlsc := tls.Server(c, &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
-		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			conf := config.GetConfig()
-			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-			return &cert, nil
-		},
-	})
+	tlsc := tls.Server(c, config.ServerTLSConfig())
 	err = tlsc.Handshake()
 	if err != nil {
 		return nil, err
@@ -160,16 +176,21 @@ func (st *greetedState) Handle(b []byte) *packets.Status {
 	c := packets.ParseCommand(b)
 	switch c.Cmd() {
 	case "EHLO":
-		// TODO: verify the given domain/address literal to prevent spam
 		ns, resp := ehlo(st, c)
 		st.s.state = ns
 		return resp
 	case "HELO":
-		//TODO: verify domain to prevent spam
 		ns, resp := helo(st, c)
 		st.s.state = ns
 		return resp
+	case "LHLO":
+		ns, resp := lhlo(st, c)
+		st.s.state = ns
+		return resp
 	case "MAIL":
+		if st.s.opts.RequireAuth && !st.s.authed {
+			return packets.NewStatus(530, "5.7.0 Authentication required")
+		}
 		if !strings.Contains(c.Args()[0], ":") {
 			return packets.NewStatus(501, "Syntax error")
 		}
@@ -184,20 +205,41 @@ func (st *greetedState) Handle(b []byte) *packets.Status {
 		if !strings.HasPrefix(fparts[1], "<") || !strings.HasSuffix(fparts[1], ">") {
 			return packets.NewStatus(501, "Syntax error")
 		}
-		fstr := strings.Trim(fparts[1], "<>")
-		from, err := mail.NewAddress(fstr)
-		if err != nil {
-			return packets.NewStatus(553, "Invalid sender mailbox name (format should be user@domain)")
+		// <> is the null reverse-path that bounces come from, which is a
+		// nil From
+		var from *mail.Address
+		sender := "<>"
+		if fstr := strings.Trim(fparts[1], "<>"); fstr != "" {
+			var err error
+			from, err = mail.NewAddress(fstr)
+			if err != nil {
+				return packets.NewStatus(553, "Invalid sender mailbox name (format should be user@domain)")
+			}
+			sender = from.String()
+		}
+
+		if sts := st.s.checkSender(from); sts != nil {
+			return sts
+		}
+		if sts := st.s.checkSize(c.Args()[1:]); sts != nil {
+			return sts
+		}
+		if sts := st.s.milterMail(sender); sts != nil {
+			return sts
 		}
 
 		st.s.mail = &mail.Mail{
 			From: from,
 			Rcpt: []mail.Address{},
 			Data: []byte{},
+			Sign: st.s.authed,
 		}
+		st.s.tooBig = false
 
 		st.s.state = &rcptState{st.s}
 		return packets.NewStatus(250, "OK proceed")
+	case "AUTH":
+		return auth(st, c)
 	case "RCPT":
 		return packets.NewStatus(503, "Bad sequence of commands")
 	case "DATA":
@@ -209,7 +251,9 @@ func (st *greetedState) Handle(b []byte) *packets.Status {
 	case "QUIT":
 		return packets.NewStatus(221, "Goodbye!")
 	case "VRFY":
-		return verify(c.Args()[0])
+		return verify(st.s, c)
+	case "EXPN":
+		return expand(st.s, c)
 	case "STARTTLS":
 		if _, ok := st.s.conn.(*tls.Conn); ok {
 			return packets.NewStatus(454, "TLS already in use")
@@ -240,15 +284,17 @@ func (st *rcptState) Handle(b []byte) *packets.Status {
 	c := packets.ParseCommand(b)
 	switch c.Cmd() {
 	case "EHLO":
-		// TODO: verify the given domain/address literal to prevent spam
 		ns, resp := ehlo(st, c)
 		st.s.state = ns
 		return resp
 	case "HELO":
-		//TODO: verify domain to prevent spam
 		ns, resp := helo(st, c)
 		st.s.state = ns
 		return resp
+	case "LHLO":
+		ns, resp := lhlo(st, c)
+		st.s.state = ns
+		return resp
 	case "MAIL":
 		return packets.NewStatus(503, "Bad sequence of commands")
 	case "RCPT":
@@ -261,18 +307,61 @@ func (st *rcptState) Handle(b []byte) *packets.Status {
 		if err != nil {
 			return packets.NewStatus(550, fmt.Sprintf("Invalid address %s", rs))
 		}
+		if st.s.lmtp {
+			return st.s.lmtpRcpt(ra)
+		}
+
+		// bounces to a sender we rewrote when forwarding go back to the
+		// original sender, wherever that is
+		orig, isSRS, err := mail.ReverseSRS(*ra)
+		if err != nil {
+			slog.Info("Bad SRS address", "rcpt", ra.String(), "err", err.Error())
+			return packets.NewStatus(550, fmt.Sprintf("5.1.1 %s Invalid or expired bounce address", ra.SmtpFormat()))
+		}
+		if isSRS {
+			ra = orig
+		}
 
 		config := config.GetConfig()
-		if !st.s.authed && ra.Domain != config.Domain {
+		domain, local := config.LocalDomain(ra.Domain)
+		if !st.s.authed && !local && !isSRS {
 			return packets.NewStatus(530, "Authentication required for relay")
 		}
+		if local {
+			if sts := checkRecipient(ra); sts != nil {
+				return sts
+			}
+		}
+
+		ip := st.s.remoteIP()
+		skipGreylist := local && domain.Policy.SkipGreylist
+		if gl := getGreylist(); gl != nil && !st.s.authed && !config.IsTrusted(ip) && !skipGreylist {
+			sender := ""
+			if st.s.mail.From != nil {
+				sender = st.s.mail.From.String()
+			}
+			if !gl.Check(ip, sender, ra.String()) {
+				return packets.NewStatus(451, "Greylisted, please try again later")
+			}
+		}
+
+		if sts := st.s.milterRcpt(ra.String()); sts != nil {
+			return sts
+		}
 
 		st.s.mail.Rcpt = append(st.s.mail.Rcpt, *ra)
 		return packets.NewStatus(250, fmt.Sprintf("RCPT <%s> OK", rs))
 	case "DATA":
+		if len(st.s.mail.Rcpt) == 0 {
+			return packets.NewStatus(554, "No valid recipients")
+		}
+		if sts := st.s.milterData(); sts != nil {
+			return sts
+		}
 		st.s.state = &dataState{st.s}
 		return packets.NewStatus(354, "Start mail input; end with <CRLF>.<CRLF>")
 	case "RSET":
+		st.s.milterAbort()
 		st.s.state = &greetedState{st.s}
 		return packets.NewStatus(250, "Reset OK")
 	case "NOOP":
@@ -280,7 +369,9 @@ func (st *rcptState) Handle(b []byte) *packets.Status {
 	case "QUIT":
 		return packets.NewStatus(221, "Goodbye!")
 	case "VRFY":
-		return verify(c.Args()[0])
+		return verify(st.s, c)
+	case "EXPN":
+		return expand(st.s, c)
 	case "STARTTLS":
 		if _, ok := st.s.conn.(*tls.Conn); ok {
 			return packets.NewStatus(454, "TLS already in use")
@@ -308,16 +399,97 @@ func (st *dataState) session() *Session {
 }
 
 func (st *dataState) Handle(b []byte) *packets.Status {
-	st.s.mail.Data = append(st.s.mail.Data, b...)
 	if bytes.Equal(b, []byte(".\r\n")) {
-		st.generateReceived()
-		st.s.SendMail()
 		st.s.state = &greetedState{st.s}
-		return packets.NewStatus(250, "OK")
+		var sts *packets.Status
+		if st.s.tooBig {
+			st.s.milterAbort()
+			sts = packets.NewStatus(552, "5.3.4 Message size exceeds fixed maximum message size")
+		} else {
+			sts = st.finish()
+		}
+		if st.s.lmtp {
+			return st.s.replyPerRecipient(sts)
+		}
+		return sts
+	}
+
+	// undo dot-stuffing, RFC 5321 section 4.5.2
+	if len(b) > 1 && b[0] == '.' {
+		b = b[1:]
+	}
+	if max := st.s.opts.MaxMessageSize; max > 0 && int64(len(st.s.mail.Data)+len(b)) > max {
+		st.s.tooBig = true
+		st.s.mail.Data = nil
+	}
+	if !st.s.tooBig {
+		st.s.mail.Data = append(st.s.mail.Data, b...)
 	}
 	return nil
 }
 
+// finish runs the filters over a complete message and sends it on its way
+func (st *dataState) finish() *packets.Status {
+	st.generateReceived()
+	if len(st.s.heloTags) > 0 {
+		st.s.mail.PrependHeader("X-Jums-Helo-Check", strings.Join(st.s.heloTags, ", "))
+	}
+
+	return st.s.accept()
+}
+
+// accept runs a finished message past the filters, then queues it, delivers
+// it over LMTP, quarantines it or drops it as they decide
+func (s *Session) accept() *packets.Status {
+	if sts := s.checkFromHeader(); sts != nil {
+		return sts
+	}
+	if sts := s.milterMessage(); sts != nil {
+		return sts
+	}
+	if sts := s.scanMessage(); sts != nil {
+		return sts
+	}
+	s.classifyMessage()
+
+	switch {
+	case s.quarantine != "":
+		conf := config.GetConfig()
+		if err := s.mail.Quarantine(conf.QuarantineDir, s.quarantine); err != nil {
+			slog.Error("Couldn't quarantine message", "id", s.mail.Id, "err", err.Error())
+			return packets.NewStatus(451, "Local error in processing")
+		}
+		slog.Info("Message quarantined", "id", s.mail.Id, "reason", s.quarantine)
+	case s.discard:
+		slog.Info("Message discarded by filter", "id", s.mail.Id)
+	case s.lmtp:
+		s.deliverLocal()
+	default:
+		if sts := s.checkQuota(); sts != nil {
+			return sts
+		}
+		if err := s.SendMail(); err != nil {
+			slog.Error("Couldn't queue message", "id", s.mail.Id, "err", err.Error())
+			return packets.NewStatus(451, "Local error in processing")
+		}
+	}
+	return packets.NewStatus(250, "OK")
+}
+
+// checkQuota refuses a message that won't fit in any of its local
+// recipients' mailboxes. If it fits in some it's taken, and the rest wait in
+// the queue for room to be made.
+func (s *Session) checkQuota() *packets.Status {
+	conf := config.GetConfig()
+	size := int64(len(s.mail.Data))
+	for _, ra := range s.mail.Rcpt {
+		if !conf.IsLocal(ra.Domain) || !errors.Is(mail.CheckQuota(ra, size), quota.ErrOverQuota) {
+			return nil
+		}
+	}
+	return packets.NewStatus(552, "5.2.2 Mailbox full, message too big for the space left")
+}
+
 func (st *dataState) generateReceived() {
 	var rname string
 	remote, _, err := net.SplitHostPort(st.s.conn.RemoteAddr().String())
@@ -335,7 +507,9 @@ func (st *dataState) generateReceived() {
 	enc := isTls(st.s.conn)
 
 	var smtpType string
-	if st.s.ext {
+	if st.s.lmtp {
+		smtpType = "LMTP"
+	} else if st.s.ext {
 		smtpType = "ESMTP"
 		if enc {
 			smtpType += "S"
@@ -375,9 +549,24 @@ func isTls(c net.Conn) bool {
 	return ok
 }
 
-func verify(address string) *packets.Status {
-	//TODO actually implement this (could be useful for receiving mail and for authenticated users)
-	return packets.NewStatus(252, "VRFY command currently disabled")
+// checkRecipient turns away local addresses nobody owns, and for now the
+// ones that have no room left
+func checkRecipient(ra *mail.Address) *packets.Status {
+	err := mail.CheckRecipient(*ra)
+	if err == nil {
+		err = mail.CheckQuota(*ra, 1)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, quota.ErrOverQuota):
+		return packets.NewStatus(452, fmt.Sprintf("4.2.2 %s Mailbox full", ra.SmtpFormat()))
+	case errors.Is(err, mail.ErrNoSuchUser):
+		return packets.NewStatus(550, fmt.Sprintf("5.1.1 %s No such user here", ra.SmtpFormat()))
+	default:
+		slog.Error("Recipient lookup failed", "rcpt", ra.String(), "err", err.Error())
+		return packets.NewStatus(451, "4.3.0 Temporary lookup failure, try again later")
+	}
 }
 
 func parseTO(to string) (string, error) {
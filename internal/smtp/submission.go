@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	netmail "net/mail"
+
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+)
+
+// checkSender makes sure an authenticated user only sends as themselves, or
+// as an address the sender login file gives them. The null sender isn't
+// anyone's, so it's allowed.
+func (s *Session) checkSender(from *mail.Address) *packets.Status {
+	if !s.authed || from == nil {
+		return nil
+	}
+	ok, err := mail.MayUseSender(s.user, from)
+	if err != nil {
+		slog.Error("Sender login lookup failed", "user", s.user, "from", from.String(), "err", err.Error())
+		return packets.NewStatus(451, "4.3.0 Temporary lookup failure, try again later")
+	}
+	if !ok {
+		slog.Info("Sender not owned by user", "user", s.user, "from", from.String())
+		return packets.NewStatus(553, fmt.Sprintf("5.7.1 %s Sender address not owned by user %s", from.SmtpFormat(), s.user))
+	}
+	return nil
+}
+
+// checkFromHeader holds the message's From header to the same rule as the
+// envelope sender, so the envelope can't be used to get past it
+func (s *Session) checkFromHeader() *packets.Status {
+	if !s.authed {
+		return nil
+	}
+	from := s.mail.HeaderValue("From")
+	if from == "" {
+		return nil
+	}
+	list, err := netmail.ParseAddressList(from)
+	if err != nil {
+		return packets.NewStatus(550, "5.6.0 Malformed From header")
+	}
+	for _, a := range list {
+		addr, err := mail.NewAddress(a.Address)
+		if err != nil {
+			return packets.NewStatus(550, "5.6.0 Malformed From header")
+		}
+		if sts := s.checkSender(addr); sts != nil {
+			return sts
+		}
+	}
+	return nil
+}
+
+// Submit puts mail one of our users sent some other way than SMTP, e.g. over
+// JMAP, through everything the submission port would before queueing it: the
+// From header check, milters, clamd and quarantine. remote is the client's
+// host:port. A non-nil status is what an SMTP client would have been told
+// instead of 250.
+func Submit(m *mail.Mail, user, remote string) *packets.Status {
+	s := NewSession(injectedConn{remote: remoteAddr(remote)})
+	s.name = "[" + s.remoteIP().String() + "]"
+	s.authed = true
+	s.user = user
+	s.mail = m
+	m.Sign = true
+	s.opts = Options{Submission: true, RequireAuth: true}
+	defer s.closeMilters()
+
+	if sts := s.milterConnect(); sts != nil {
+		return sts
+	}
+	if sts := s.milterHelo(s.name); sts != nil {
+		return sts
+	}
+	sender := "<>"
+	if m.From != nil {
+		sender = m.From.String()
+	}
+	if sts := s.milterMail(sender); sts != nil {
+		return sts
+	}
+	for _, ra := range m.Rcpt {
+		if sts := s.milterRcpt(ra.String()); sts != nil {
+			return sts
+		}
+	}
+	if sts := s.milterData(); sts != nil {
+		return sts
+	}
+	if sts := s.accept(); sts.Code() != 250 {
+		return sts
+	}
+	return nil
+}
+
+// injectedConn stands in for a client connection for Submit, which only
+// ever asks it who the client is
+type injectedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c injectedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/smtp/mail"
+	"github.com/Queueue0/jums/internal/smtp/packets"
+)
+
+// VRFY and EXPN only get a real answer for clients that have authenticated
+// or are on a trusted network. Anyone else could use them to find out who
+// has an address here, so they're told what RCPT would do instead.
+func (s *Session) canVerify() bool {
+	return s.authed || config.GetConfig().IsTrusted(s.remoteIP())
+}
+
+// verifyAddress reads VRFY and EXPN's argument, which may be a bare user
+// name on our Domain
+func verifyAddress(c *packets.Command) (*mail.Address, *packets.Status) {
+	arg := strings.Trim(strings.Join(c.Args(), " "), "<>")
+	if arg == "" {
+		return nil, packets.NewStatus(501, "Syntax error, tell me who to look up")
+	}
+	if !strings.Contains(arg, "@") {
+		arg += "@" + config.GetConfig().Domain
+	}
+	addr, err := mail.NewAddress(arg)
+	if err != nil {
+		return nil, packets.NewStatus(501, fmt.Sprintf("Invalid address %s", arg))
+	}
+	if !config.GetConfig().IsLocal(addr.Domain) {
+		return nil, packets.NewStatus(252, fmt.Sprintf("%s is not local, but will accept message and attempt delivery", addr.SmtpFormat()))
+	}
+	return addr, nil
+}
+
+// lookupFailed is VRFY and EXPN's answer when addr couldn't be looked up
+func lookupFailed(addr *mail.Address, err error) *packets.Status {
+	if errors.Is(err, mail.ErrNoSuchUser) {
+		return packets.NewStatus(550, fmt.Sprintf("5.1.1 %s No such user here", addr.SmtpFormat()))
+	}
+	slog.Error("Recipient lookup failed", "rcpt", addr.String(), "err", err.Error())
+	return packets.NewStatus(451, "4.3.0 Temporary lookup failure, try again later")
+}
+
+func verify(s *Session, c *packets.Command) *packets.Status {
+	if !s.canVerify() {
+		return packets.NewStatus(252, "Cannot VRFY user, but will accept message and attempt delivery")
+	}
+	addr, sts := verifyAddress(c)
+	if sts != nil {
+		return sts
+	}
+	to, err := mail.Verify(*addr)
+	if err != nil {
+		return lookupFailed(addr, err)
+	}
+	return packets.NewStatus(250, "<"+to+">")
+}
+
+func expand(s *Session, c *packets.Command) *packets.Status {
+	if !s.canVerify() {
+		return packets.NewStatus(252, "Cannot EXPN address, but will accept message and attempt delivery")
+	}
+	addr, sts := verifyAddress(c)
+	if sts != nil {
+		return sts
+	}
+	targets, err := mail.Expand(*addr)
+	if err != nil {
+		return lookupFailed(addr, err)
+	}
+	if len(targets) == 0 {
+		return packets.NewStatus(250, fmt.Sprintf("%s has no members", addr.SmtpFormat()))
+	}
+	lines := make([]string, len(targets))
+	for i, t := range targets {
+		lines[i] = "<" + t + ">"
+	}
+	return packets.NewStatus(250, lines...)
+}
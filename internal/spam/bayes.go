@@ -0,0 +1,227 @@
+// Package spam is a small statistical spam filter using Robinson/Fisher
+// chi-squared combining, the same approach SpamBayes uses
+package spam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/filecache"
+)
+
+const (
+	// strength of the prior for tokens we've seen rarely
+	priorStrength = 0.45
+	priorProb     = 0.5
+	// only the most significant tokens count towards a score
+	maxDiscriminators = 150
+	minDeviation      = 0.1
+)
+
+// Classifier holds token statistics for spam and ham. It's safe for
+// concurrent use.
+type Classifier struct {
+	mu     sync.RWMutex
+	NSpam  int
+	NHam   int
+	Tokens map[string]*Counts
+}
+
+type Counts struct {
+	Spam int `json:"s,omitempty"`
+	Ham  int `json:"h,omitempty"`
+}
+
+func New() *Classifier {
+	return &Classifier{Tokens: map[string]*Counts{}}
+}
+
+// DefaultPath is where token statistics live under BoxesDir
+func DefaultPath(boxesDir string) string {
+	return filepath.Join(boxesDir, ".spam", "bayes.json")
+}
+
+// Load reads a classifier saved with Save. A missing file gives an empty
+// classifier.
+func Load(path string) (*Classifier, error) {
+	c := New()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spam.Load: %w", err)
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("spam.Load: %w", err)
+	}
+	if c.Tokens == nil {
+		c.Tokens = map[string]*Counts{}
+	}
+	return c, nil
+}
+
+func (c *Classifier) Save(path string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("spam.Save: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("spam.Save: %w", err)
+	}
+	if err = json.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return fmt.Errorf("spam.Save: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("spam.Save: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("spam.Save: %w", err)
+	}
+	return nil
+}
+
+// Train adds a raw message to the statistics as spam or ham
+func (c *Classifier) Train(msg []byte, isSpam bool) {
+	c.adjust(Tokenize(msg), isSpam, 1)
+}
+
+// Untrain removes a message previously trained with Train, for when a user
+// reclassifies something
+func (c *Classifier) Untrain(msg []byte, isSpam bool) {
+	c.adjust(Tokenize(msg), isSpam, -1)
+}
+
+func (c *Classifier) adjust(tokens []string, isSpam bool, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if isSpam {
+		c.NSpam = max(c.NSpam+delta, 0)
+	} else {
+		c.NHam = max(c.NHam+delta, 0)
+	}
+
+	for _, t := range tokens {
+		counts, ok := c.Tokens[t]
+		if !ok {
+			if delta < 0 {
+				continue
+			}
+			counts = &Counts{}
+			c.Tokens[t] = counts
+		}
+
+		if isSpam {
+			counts.Spam = max(counts.Spam+delta, 0)
+		} else {
+			counts.Ham = max(counts.Ham+delta, 0)
+		}
+
+		if counts.Spam == 0 && counts.Ham == 0 {
+			delete(c.Tokens, t)
+		}
+	}
+}
+
+// Score rates a raw message from 0 (definitely ham) to 1 (definitely spam).
+// Messages we can't say anything about score 0.5.
+func (c *Classifier) Score(msg []byte) float64 {
+	return c.score(Tokenize(msg))
+}
+
+func (c *Classifier) score(tokens []string) float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.NSpam == 0 || c.NHam == 0 {
+		return priorProb
+	}
+
+	probs := []float64{}
+	for _, t := range tokens {
+		counts, ok := c.Tokens[t]
+		if !ok {
+			continue
+		}
+		p := c.tokenProb(counts)
+		if math.Abs(p-0.5) >= minDeviation {
+			probs = append(probs, p)
+		}
+	}
+	if len(probs) == 0 {
+		return priorProb
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > maxDiscriminators {
+		probs = probs[:maxDiscriminators]
+	}
+
+	var sumSpam, sumHam float64
+	for _, p := range probs {
+		sumSpam += math.Log(1 - p)
+		sumHam += math.Log(p)
+	}
+	n := 2 * len(probs)
+	s := 1 - chi2Q(-2*sumSpam, n)
+	h := 1 - chi2Q(-2*sumHam, n)
+
+	return (1 + s - h) / 2
+}
+
+// Robinson's adjusted probability that a message containing the token is spam
+func (c *Classifier) tokenProb(counts *Counts) float64 {
+	spamRatio := float64(counts.Spam) / float64(c.NSpam)
+	hamRatio := float64(counts.Ham) / float64(c.NHam)
+	p := spamRatio / (spamRatio + hamRatio)
+
+	n := float64(counts.Spam + counts.Ham)
+	p = (priorStrength*priorProb + n*p) / (priorStrength + n)
+	// keep away from 0 and 1 so the logs stay finite
+	return min(max(p, 0.0001), 0.9999)
+}
+
+// inverse chi-squared, probability that a value >= x2 would be seen with v
+// degrees of freedom. v must be even.
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return min(sum, 1)
+}
+
+var shared = filecache.New(Load)
+
+// Shared returns a classifier for path that's kept in memory and reloaded
+// when the file changes, e.g. after training with jumsctl. Callers that train
+// it should call SaveShared afterwards.
+func Shared(path string) (*Classifier, error) {
+	return shared.Get(path)
+}
+
+// SaveShared saves the shared classifier for path and remembers the new
+// modification time so we don't pointlessly reload our own changes
+func SaveShared(path string) error {
+	return shared.Save(path, func(c *Classifier) error { return c.Save(path) })
+}
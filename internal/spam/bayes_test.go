@@ -0,0 +1,58 @@
+package spam
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func message(subject, body string) []byte {
+	return []byte(fmt.Sprintf("From: someone@example.com\r\nSubject: %s\r\n\r\n%s\r\n", subject, body))
+}
+
+func trained() *Classifier {
+	c := New()
+	for i := 0; i < 10; i++ {
+		c.Train(message("cheap pills", "buy cheap viagra pills now, limited offer, click here"), true)
+		c.Train(message("you won", "claim your lottery prize money now, click here"), true)
+		c.Train(message("meeting notes", "here are the notes from the planning meeting on tuesday"), false)
+		c.Train(message("lunch?", "want to grab lunch after the standup tomorrow"), false)
+	}
+	return c
+}
+
+func TestScore(t *testing.T) {
+	c := trained()
+
+	if s := c.Score(message("cheap offer", "click here to buy pills and claim your prize")); s < 0.9 {
+		t.Errorf("spammy message scored %.3f, expected >= 0.9", s)
+	}
+	if s := c.Score(message("notes", "the planning meeting moved to tomorrow after lunch")); s > 0.1 {
+		t.Errorf("hammy message scored %.3f, expected <= 0.1", s)
+	}
+	if s := New().Score(message("anything", "at all")); s != 0.5 {
+		t.Errorf("untrained classifier scored %.3f, expected 0.5", s)
+	}
+}
+
+func TestUntrainAndPersist(t *testing.T) {
+	c := trained()
+	msg := message("unique subject", "zyzzyva quokka")
+	c.Train(msg, true)
+	c.Untrain(msg, true)
+	if _, ok := c.Tokens["zyzzyva"]; ok {
+		t.Error("token still present after untraining")
+	}
+
+	path := filepath.Join(t.TempDir(), "bayes.json")
+	if err := c.Save(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if loaded.NSpam != c.NSpam || loaded.NHam != c.NHam || len(loaded.Tokens) != len(c.Tokens) {
+		t.Errorf("loaded classifier doesn't match saved one")
+	}
+}
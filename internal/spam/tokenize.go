@@ -0,0 +1,136 @@
+package spam
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	minTokenLen = 3
+	maxTokenLen = 40
+	// don't bother with more than this much text from one message
+	maxTextLen = 256 * 1024
+)
+
+var (
+	htmlTag = regexp.MustCompile(`<[^>]*>`)
+	urlHost = regexp.MustCompile(`(?i)https?://([a-z0-9.-]+)`)
+)
+
+// Tokenize breaks a raw message up into the unique tokens the classifier
+// looks at: words from the subject and text parts of the body, plus a few
+// prefixed tokens for things like the sender's domain and linked hosts.
+func Tokenize(msg []byte) []string {
+	seen := map[string]bool{}
+	add := func(t string) {
+		seen[t] = true
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		// not a parseable message, just treat the whole thing as text
+		for _, w := range words(string(msg)) {
+			add(w)
+		}
+		return keys(seen)
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		subject = m.Header.Get("Subject")
+	}
+	for _, w := range words(subject) {
+		add("subject:" + w)
+	}
+
+	if from, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		if _, domain, ok := strings.Cut(from.Address, "@"); ok {
+			add("from:" + strings.ToLower(domain))
+		}
+	}
+
+	ct := m.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		add("content-type:" + mt)
+	}
+
+	text := bodyText(ct, m.Header.Get("Content-Transfer-Encoding"), m.Body, 0)
+	if len(text) > maxTextLen {
+		text = text[:maxTextLen]
+	}
+
+	for _, u := range urlHost.FindAllStringSubmatch(text, -1) {
+		add("url:" + strings.ToLower(u[1]))
+	}
+	for _, w := range words(htmlTag.ReplaceAllString(text, " ")) {
+		add(w)
+	}
+
+	return keys(seen)
+}
+
+// bodyText pulls the decoded text/* parts out of a (possibly multipart) body
+func bodyText(contentType, encoding string, body io.Reader, depth int) string {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = "text/plain"
+	}
+
+	if strings.HasPrefix(mt, "multipart/") && depth < 10 {
+		out := strings.Builder{}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				break
+			}
+			out.WriteString(bodyText(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, depth+1))
+			out.WriteByte('\n')
+		}
+		return out.String()
+	}
+
+	if !strings.HasPrefix(mt, "text/") {
+		return ""
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(body, maxTextLen))
+	return string(b)
+}
+
+func words(s string) []string {
+	out := []string{}
+	for _, w := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '$' && r != '!'
+	}) {
+		w = strings.ToLower(strings.Trim(w, "'!"))
+		if len(w) >= minTokenLen && len(w) <= maxTokenLen {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+func keys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
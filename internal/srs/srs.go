@@ -0,0 +1,192 @@
+// Package srs rewrites the envelope sender of forwarded mail with the Sender
+// Rewriting Scheme, so the forward passes SPF and bounces still find their
+// way back to the original sender
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// days are counted mod 1024 and written as two base32 characters
+	timeBase   = 32
+	timeSize   = timeBase * timeBase
+	timeDigits = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	hashLen    = 4
+)
+
+var (
+	ErrNotSRS  = errors.New("not an SRS address")
+	ErrBadHash = errors.New("SRS hash doesn't match")
+	ErrExpired = errors.New("SRS address has expired")
+)
+
+type Rewriter struct {
+	secret []byte
+	// the domain rewritten addresses are at, it has to be one of ours
+	domain string
+	// how long bounces are accepted for
+	maxAge int
+}
+
+func New(secret []byte, domain string, maxAgeDays int) *Rewriter {
+	return &Rewriter{secret: secret, domain: strings.ToLower(domain), maxAge: maxAgeDays}
+}
+
+// LoadSecret reads the key from path, making a random one the first time
+func LoadSecret(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return []byte(strings.TrimSpace(string(b))), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("srs.LoadSecret: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("srs.LoadSecret: %w", err)
+	}
+	secret := base64.StdEncoding.EncodeToString(raw)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("srs.LoadSecret: %w", err)
+	}
+	if err = os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("srs.LoadSecret: %w", err)
+	}
+	return []byte(secret), nil
+}
+
+func (r *Rewriter) hash(parts ...string) string {
+	h := hmac.New(sha1.New, r.secret)
+	for _, p := range parts {
+		h.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))[:hashLen]
+}
+
+func (r *Rewriter) checkHash(hash string, parts ...string) bool {
+	// base64 is case sensitive but some MTAs fold case, so compare the way
+	// libsrs2 does
+	return strings.EqualFold(hash, r.hash(parts...))
+}
+
+func timestamp(t time.Time) string {
+	day := (t.Unix() / 86400) % timeSize
+	return string([]byte{timeDigits[day/timeBase], timeDigits[day%timeBase]})
+}
+
+// age is how many days ago a timestamp was made
+func age(ts string, now time.Time) (int, bool) {
+	if len(ts) != 2 {
+		return 0, false
+	}
+	hi := strings.IndexByte(timeDigits, strings.ToUpper(ts)[0])
+	lo := strings.IndexByte(timeDigits, strings.ToUpper(ts)[1])
+	if hi < 0 || lo < 0 {
+		return 0, false
+	}
+	then := int64(hi*timeBase + lo)
+	today := (now.Unix() / 86400) % timeSize
+	return int((today - then + timeSize) % timeSize), true
+}
+
+func split(addr string) (string, string, bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// Forward rewrites a sender so it's at our domain. Senders that are already
+// SRS addresses from another forwarder become SRS1, pointing back at that
+// forwarder rather than adding another layer.
+func (r *Rewriter) Forward(sender string) (string, error) {
+	local, domain, ok := split(sender)
+	if !ok {
+		return "", fmt.Errorf("srs.Forward: bad address %q", sender)
+	}
+	if strings.EqualFold(domain, r.domain) {
+		// already ours, nothing would be gained
+		return sender, nil
+	}
+
+	upper := strings.ToUpper(local)
+	switch {
+	case strings.HasPrefix(upper, "SRS0") && len(local) > 5 && strings.ContainsRune("=+-", rune(local[4])):
+		rest := local[5:]
+		hash := r.hash(domain, rest)
+		return fmt.Sprintf("SRS1=%s=%s==%s@%s", hash, domain, rest, r.domain), nil
+	case strings.HasPrefix(upper, "SRS1") && len(local) > 5 && strings.ContainsRune("=+-", rune(local[4])):
+		// SRS1=hash=host==rest, keep the original host and rest
+		_, after, ok := strings.Cut(local[5:], "=")
+		host, rest, ok2 := strings.Cut(after, "==")
+		if ok && ok2 {
+			hash := r.hash(host, rest)
+			return fmt.Sprintf("SRS1=%s=%s==%s@%s", hash, host, rest, r.domain), nil
+		}
+	}
+
+	ts := timestamp(time.Now())
+	hash := r.hash(ts, domain, local)
+	return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", hash, ts, domain, local, r.domain), nil
+}
+
+// IsSRS reports whether addr looks like an SRS address at our domain
+func (r *Rewriter) IsSRS(addr string) bool {
+	local, domain, ok := split(addr)
+	if !ok || !strings.EqualFold(domain, r.domain) || len(local) < 5 {
+		return false
+	}
+	prefix := strings.ToUpper(local[:4])
+	return (prefix == "SRS0" || prefix == "SRS1") && strings.ContainsRune("=+-", rune(local[4]))
+}
+
+// Reverse turns an SRS address at our domain back into where the bounce
+// should go: the original sender for SRS0, the previous forwarder for SRS1
+func (r *Rewriter) Reverse(addr string) (string, error) {
+	if !r.IsSRS(addr) {
+		return "", ErrNotSRS
+	}
+	local, _, _ := split(addr)
+
+	if strings.ToUpper(local[:4]) == "SRS1" {
+		hash, after, ok := strings.Cut(local[5:], "=")
+		host, rest, ok2 := strings.Cut(after, "==")
+		if !ok || !ok2 || host == "" {
+			return "", ErrNotSRS
+		}
+		if !r.checkHash(hash, host, rest) {
+			return "", ErrBadHash
+		}
+		return "SRS0=" + rest + "@" + host, nil
+	}
+
+	// SRS0=hash=tt=domain=local, the local part can have = in it
+	parts := strings.SplitN(local[5:], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", ErrNotSRS
+	}
+	hash, ts, domain, user := parts[0], parts[1], parts[2], parts[3]
+	if !r.checkHash(hash, ts, domain, user) {
+		return "", ErrBadHash
+	}
+	days, ok := age(ts, time.Now())
+	if !ok {
+		return "", ErrNotSRS
+	}
+	if days > r.maxAge {
+		return "", ErrExpired
+	}
+	return user + "@" + domain, nil
+}
@@ -0,0 +1,51 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	r := New([]byte("secret"), "fwd.example", 21)
+
+	s, err := r.Forward("Alice=x@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s, "SRS0=") || !strings.HasSuffix(s, "=example.com=Alice=x@fwd.example") {
+		t.Fatalf("Forward = %q", s)
+	}
+	if got, err := r.Reverse(strings.ToLower(s)); err != nil || !strings.EqualFold(got, "Alice=x@example.com") {
+		t.Errorf("Reverse = %q, %v", got, err)
+	}
+
+	// a second hop points back at the first forwarder
+	r2 := New([]byte("other"), "second.example", 21)
+	s1, _ := r2.Forward(s)
+	if !strings.HasPrefix(s1, "SRS1=") || !strings.Contains(s1, "=fwd.example==") {
+		t.Fatalf("Forward = %q", s1)
+	}
+	back, err := r2.Reverse(s1)
+	if err != nil || back != s {
+		t.Errorf("Reverse = %q, %v, want %q", back, err, s)
+	}
+
+	forged := "SRS0=AAAA" + s[9:]
+	if _, err := r.Reverse(forged); !errors.Is(err, ErrBadHash) {
+		t.Errorf("forged: %v", err)
+	}
+	if _, err := r.Reverse("bob@fwd.example"); !errors.Is(err, ErrNotSRS) {
+		t.Errorf("plain: %v", err)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	r := New([]byte("secret"), "fwd.example", 21)
+	ts := timestamp(time.Now().Add(-30 * 24 * time.Hour))
+	addr := "SRS0=" + r.hash(ts, "example.com", "alice") + "=" + ts + "=example.com=alice@fwd.example"
+	if _, err := r.Reverse(addr); !errors.Is(err, ErrExpired) {
+		t.Errorf("Reverse: %v", err)
+	}
+}
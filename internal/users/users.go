@@ -0,0 +1,252 @@
+// Package users is the account database shared by everything that needs to
+// authenticate someone: SMTP AUTH, IMAP and friends. Accounts are kept in a
+// passwd style file, one "username:hash" per line.
+package users
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Queueue0/jums/internal/config"
+	"github.com/Queueue0/jums/internal/filecache"
+)
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 210000
+	saltLen        = 16
+	keyLen         = 32
+)
+
+var (
+	ErrNoSuchUser  = errors.New("no such user")
+	ErrInvalidName = errors.New("invalid username")
+)
+
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	hashes map[string]string
+}
+
+// Load reads the user file at path. A missing file is an empty store.
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, hashes: map[string]string{}}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("users.Load: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		s.hashes[name] = hash
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("users.Load: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Store) Save() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.hashes))
+	for n := range s.hashes {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&b, "%s:%s\n", n, s.hashes[n])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("users.Save: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("users.Save: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("users.Save: %w", err)
+	}
+	return nil
+}
+
+// Authenticate checks a username and password, returning the canonical
+// username on success
+func (s *Store) Authenticate(name, password string) (string, bool) {
+	name = Normalize(name)
+	s.mu.RLock()
+	hash, ok := s.hashes[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		// still do the work so timing doesn't give away which users exist
+		checkPassword(dummyHash, password)
+		return "", false
+	}
+	return name, checkPassword(hash, password)
+}
+
+// Exists reports whether there's an account called name
+func (s *Store) Exists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.hashes[Normalize(name)]
+	return ok
+}
+
+func (s *Store) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.hashes))
+	for n := range s.hashes {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetPassword creates the user if needed and sets their password
+func (s *Store) SetPassword(name, password string) error {
+	name = Normalize(name)
+	if !ValidName(name) {
+		return fmt.Errorf("users.SetPassword: %w", ErrInvalidName)
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("users.SetPassword: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[name] = hash
+	return nil
+}
+
+func (s *Store) Delete(name string) error {
+	name = Normalize(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hashes[name]; !ok {
+		return fmt.Errorf("users.Delete: %w", ErrNoSuchUser)
+	}
+	delete(s.hashes, name)
+	return nil
+}
+
+// Normalize case folds a username
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// ValidName reports whether name can be used as an account name. Names end up
+// as directory names under BoxesDir so they're kept conservative.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 64 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("._-+@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// HashPassword returns a salted hash in the form
+// $pbkdf2-sha256$<iterations>$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, keyLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$%s$%d$%s$%s", hashScheme, hashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+var dummyHash, _ = HashPassword("dummy")
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != hashScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[2])
+	if err != nil || iter < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+var shared = filecache.New(Load)
+
+// Shared returns a store for path that's kept in memory and reloaded when
+// the file changes, so edits made with jumsctl are picked up without a
+// restart
+func Shared(path string) (*Store, error) {
+	return shared.Get(path)
+}
+
+// Authenticate checks credentials against the configured user file. Users on
+// our domain can log in with or without the @domain.
+func Authenticate(name, password string) (string, bool) {
+	conf := config.GetConfig()
+	s, err := Shared(conf.UsersFile)
+	if err != nil {
+		slog.Error("Couldn't load users", "err", err.Error())
+		return "", false
+	}
+
+	name = Normalize(name)
+	if local, domain, ok := strings.Cut(name, "@"); ok && domain == strings.ToLower(conf.Domain) {
+		name = local
+	}
+	return s.Authenticate(name, password)
+}